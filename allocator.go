@@ -0,0 +1,170 @@
+package vfs
+
+import (
+	"github.com/spf13/afero"
+)
+
+// Allocator selects how a memory VFS stores file contents
+type Allocator int
+
+const (
+	// AllocatorHeap gives every file a buffer of its own. It is the
+	// default, and suits trees of few or large files.
+	AllocatorHeap Allocator = iota
+
+	// AllocatorPool stores small files in slabs of fixed-size slots, one
+	// slab size per power of two. Removed and rewritten files give their
+	// slots back for reuse, which suits trees with heavy churn.
+	AllocatorPool
+
+	// AllocatorArena appends small files to large arenas and never reuses
+	// space within one: an arena is freed once every file in it has been
+	// removed or rewritten, and Compact reclaims the rest. It wastes the
+	// least memory on trees that are mostly written once.
+	AllocatorArena
+)
+
+const (
+	// maxAllocSize is the largest file the pool and arena allocators
+	// store; larger files have a buffer of their own
+	maxAllocSize = 4096
+
+	// minAllocClass is the smallest pool slot
+	minAllocClass = 64
+
+	// poolSlabSize and arenaSize are the sizes of the buffers carved up
+	// by the pool and arena allocators
+	poolSlabSize = 64 << 10
+	arenaSize    = 1 << 20
+)
+
+// WithAllocator selects how a memory or hybrid VFS stores file contents.
+// With AllocatorPool or AllocatorArena, the contents of files of up to 4 KiB
+// share large buffers instead of each holding one. Only content buffers are
+// pooled: every file keeps its own entry, name and metadata, so this saves
+// one of the handful of heap objects each small file costs (see
+// BenchmarkAllocatorObjects). A file's content moves to the shared buffers
+// once it is closed, and is copied out again while open for writing. Clones
+// and Compact keep the allocator.
+func WithAllocator(a Allocator) Option {
+	return func(v *VFS) {
+		v.allocator = a
+	}
+}
+
+// newMemoryBackend returns an empty memory backend using allocator a
+func newMemoryBackend(a Allocator) afero.Fs {
+	if a == AllocatorHeap {
+		return afero.NewMemMapFs()
+	}
+	return newMemFs(newFileStore(a))
+}
+
+// slab is a buffer that blocks of file content are carved from
+type slab struct {
+	buf  []byte
+	used int // Bytes handed out from the start of buf
+	live int // Bytes held by files
+}
+
+// block is the part of a slab holding one file's content
+type block struct {
+	slab *slab
+	off  int
+	size int // Bytes reserved, the slot size of pooled blocks
+}
+
+// fileStore hands out blocks for small file contents. It is not safe for
+// concurrent use; memFs calls it under its lock.
+type fileStore struct {
+	allocator Allocator
+	current   *slab     // Arena being filled
+	slabs     [][]*slab // Pool slabs by size class
+	free      [][]block // Free pool slots by size class
+}
+
+func newFileStore(a Allocator) *fileStore {
+	s := &fileStore{allocator: a}
+	if a == AllocatorPool {
+		n := 0
+		for size := minAllocClass; size <= maxAllocSize; size *= 2 {
+			n++
+		}
+		s.slabs = make([][]*slab, n)
+		s.free = make([][]block, n)
+	}
+	return s
+}
+
+// store copies data into a block and returns the block and the copy, or
+// false if data is too large for the allocator
+func (s *fileStore) store(data []byte) (block, []byte, bool) {
+	if len(data) == 0 || len(data) > maxAllocSize {
+		return block{}, nil, false
+	}
+
+	var b block
+	if s.allocator == AllocatorPool {
+		b = s.poolBlock(len(data))
+	} else {
+		b = s.arenaBlock(len(data))
+	}
+	b.slab.live += b.size
+
+	// Capped, so that appending to the copy cannot overwrite a neighbour
+	stored := b.slab.buf[b.off : b.off+len(data) : b.off+len(data)]
+	copy(stored, data)
+	return b, stored, true
+}
+
+// release returns a block. Pooled slots are reused; arena space is not, and
+// an arena is left to the garbage collector once no file uses it.
+func (s *fileStore) release(b block) {
+	if b.slab == nil {
+		return
+	}
+	b.slab.live -= b.size
+	if s.allocator == AllocatorPool {
+		class := sizeClass(b.size)
+		s.free[class] = append(s.free[class], b)
+	}
+}
+
+func (s *fileStore) poolBlock(n int) block {
+	class := sizeClass(n)
+	if free := s.free[class]; len(free) > 0 {
+		b := free[len(free)-1]
+		s.free[class] = free[:len(free)-1]
+		return b
+	}
+
+	size := minAllocClass << class
+	slabs := s.slabs[class]
+	if len(slabs) == 0 || slabs[len(slabs)-1].used+size > poolSlabSize {
+		slabs = append(slabs, &slab{buf: make([]byte, poolSlabSize)})
+		s.slabs[class] = slabs
+	}
+	sl := slabs[len(slabs)-1]
+	b := block{slab: sl, off: sl.used, size: size}
+	sl.used += size
+	return b
+}
+
+func (s *fileStore) arenaBlock(n int) block {
+	if s.current == nil || s.current.used+n > len(s.current.buf) {
+		s.current = &slab{buf: make([]byte, arenaSize)}
+	}
+	b := block{slab: s.current, off: s.current.used, size: n}
+	s.current.used += n
+	return b
+}
+
+// sizeClass returns the pool size class of n bytes: the index of the
+// smallest power of two from minAllocClass that holds them
+func sizeClass(n int) int {
+	class := 0
+	for size := minAllocClass; size < n; size *= 2 {
+		class++
+	}
+	return class
+}
@@ -0,0 +1,335 @@
+package vfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// archiveHeaderSize is the number of leading bytes passed to
+// ArchiveFormat.Match
+const archiveHeaderSize = 64 << 10
+
+// ArchiveFormat describes an archive format that NewArchiveVFS can open
+type ArchiveFormat struct {
+	Name string
+
+	// Match reports whether an archive starting with header (its first
+	// 64 KiB, or less for smaller files) has this format
+	Match func(header []byte) bool
+
+	// Open returns a filesystem over the archive. It should index the
+	// archive without reading file contents, which it reads from r
+	// lazily. r stays valid until the VFS is closed.
+	Open func(r io.ReaderAt, size int64) (fs.FS, error)
+}
+
+var (
+	archiveFormats   []ArchiveFormat
+	archiveFormatsMu sync.RWMutex
+)
+
+func init() {
+	RegisterArchiveFormat(ArchiveFormat{Name: "zip", Match: matchZip, Open: openZip})
+	RegisterArchiveFormat(ArchiveFormat{Name: "tar.gz", Match: matchGzip, Open: openTarGz})
+	RegisterArchiveFormat(ArchiveFormat{Name: "tar", Match: matchTar, Open: openTar})
+	RegisterArchiveFormat(ArchiveFormat{Name: "iso9660", Match: matchISO9660, Open: openISO9660})
+	RegisterArchiveFormat(ArchiveFormat{Name: "fat", Match: matchFAT, Open: openFAT})
+	RegisterArchiveFormat(ArchiveFormat{Name: "squashfs", Match: matchSquashFS, Open: openSquashFS})
+}
+
+// RegisterArchiveFormat adds a format to those recognized by
+// NewArchiveVFS. Formats are tried in registration order, built-in formats
+// (zip, tar.gz, tar, ISO9660, FAT and SquashFS images) first.
+func RegisterArchiveFormat(format ArchiveFormat) {
+	archiveFormatsMu.Lock()
+	defer archiveFormatsMu.Unlock()
+	archiveFormats = append(archiveFormats, format)
+}
+
+// NewArchiveVFS opens the archive at path as a read-only VFS rooted at the
+// archive's root. Only the archive's index is read up front; file contents
+// are read when accessed, so large archives open quickly and tools can
+// work on packaged projects without extracting them. Writes fail with
+// fs.ErrPermission. Close the VFS to release the archive.
+func NewArchiveVFS(path string, opts ...Option) (*VFS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, format, err := openArchive(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+
+	opts = append(opts, WithType(VFSTypeArchive), WithRoot(path), withArchive(fsys, f))
+	v := New(opts...)
+	v.logger.Debug("Opened %s archive: %s", format, path)
+	return v, nil
+}
+
+// MountImage opens the archive or disk image at path read-only and makes
+// its contents available under prefix, like a bundled filesystem:
+//
+//	v.MountImage("boot", "./firmware/boot.img")
+//	data, err := v.ReadFile("boot://EFI/BOOT/BOOTX64.EFI")
+//
+// Any format NewArchiveVFS recognizes can be mounted. Mounting another
+// image under the same prefix replaces the first; Close releases all
+// mounted images.
+func (v *VFS) MountImage(prefix, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	fsys, format, err := openArchive(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to mount %s: %w", path, err)
+	}
+
+	if err := v.bundledManager.RegisterFS(prefix, fsys, ""); err != nil {
+		f.Close()
+		return err
+	}
+	v.mounts.add(prefix, f)
+	v.logger.Debug("Mounted %s image %s at %s://", format, path, strings.TrimSuffix(prefix, "://"))
+	return nil
+}
+
+// mountSet holds the images a VFS has mounted, by prefix. Clones share
+// the mounts through the bundled manager but don't own them.
+type mountSet struct {
+	mu      sync.Mutex
+	closers map[string]io.Closer
+}
+
+// add records closer for prefix, closing an image mounted there before
+func (m *mountSet) add(prefix string, closer io.Closer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix = strings.TrimSuffix(prefix, "://")
+	if old, ok := m.closers[prefix]; ok {
+		old.Close()
+	}
+	if m.closers == nil {
+		m.closers = make(map[string]io.Closer)
+	}
+	m.closers[prefix] = closer
+}
+
+// close releases all mounted images
+func (m *mountSet) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var firstErr error
+	for prefix, closer := range m.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(m.closers, prefix)
+	}
+	return firstErr
+}
+
+// withArchive sets the filesystem of an archive VFS
+func withArchive(fsys fs.FS, closer io.Closer) Option {
+	return func(v *VFS) {
+		v.archiveFS = fsys
+		v.archive = closer
+	}
+}
+
+// openArchive detects the format of f and opens it
+func openArchive(f *os.File) (fs.FS, string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+
+	header := make([]byte, min(info.Size(), archiveHeaderSize))
+	if _, err := f.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, "", err
+	}
+
+	archiveFormatsMu.RLock()
+	formats := append([]ArchiveFormat(nil), archiveFormats...)
+	archiveFormatsMu.RUnlock()
+
+	for _, format := range formats {
+		if format.Match(header) {
+			fsys, err := format.Open(f, info.Size())
+			return fsys, format.Name, err
+		}
+	}
+	return nil, "", errors.New("unknown archive format")
+}
+
+// rootedFS adapts an fs.FS to the rooted, slash-prefixed paths used by
+// the VFS
+type rootedFS struct {
+	fs.FS
+}
+
+func (r rootedFS) Open(name string) (fs.File, error) {
+	return r.FS.Open(ioFSPath(name))
+}
+
+// ioFSPath converts a VFS path into an fs.FS path
+func ioFSPath(name string) string {
+	name = archiveName(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// newArchiveAfero returns the afero.Fs over an archive filesystem
+func newArchiveAfero(fsys fs.FS) afero.Fs {
+	return afero.FromIOFS{FS: rootedFS{fsys}}
+}
+
+func matchZip(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06"))
+}
+
+func matchGzip(header []byte) bool {
+	return bytes.HasPrefix(header, []byte{0x1f, 0x8b})
+}
+
+func matchTar(header []byte) bool {
+	return len(header) >= 262 && bytes.HasPrefix(header[257:], []byte("ustar"))
+}
+
+// openZip indexes a zip archive. Stored entries are read in place;
+// compressed entries are decompressed when opened.
+func openZip(r io.ReaderAt, size int64) (fs.FS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := newArchiveFS()
+	for _, zf := range zr.File {
+		zf := zf
+		if strings.HasSuffix(zf.Name, "/") {
+			archive.add(zf.Name, fs.ModeDir|zf.Mode().Perm(), zf.Modified, 0, nil)
+			continue
+		}
+
+		open := func() (io.ReaderAt, error) {
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			data, err := io.ReadAll(rc)
+			return bytes.NewReader(data), err
+		}
+		if zf.Method == zip.Store && zf.Flags&0x1 == 0 {
+			offset, err := zf.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			open = func() (io.ReaderAt, error) {
+				return io.NewSectionReader(r, offset, int64(zf.UncompressedSize64)), nil
+			}
+		}
+		archive.add(zf.Name, zf.Mode().Perm(), zf.Modified, int64(zf.UncompressedSize64), open)
+	}
+	return archive.finish(), nil
+}
+
+// openTarGz decompresses a gzipped tar archive into memory, since gzip
+// streams cannot be read at random offsets
+func openTarGz(r io.ReaderAt, size int64) (fs.FS, error) {
+	zr, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	return openTar(bytes.NewReader(data), int64(len(data)))
+}
+
+// openTar indexes a tar archive by reading its headers only. Each regular
+// file is later read in place at its recorded offset. Symbolic links are
+// skipped; hard links share their target's content.
+func openTar(r io.ReaderAt, size int64) (fs.FS, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+
+	archive := newArchiveFS()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		info := hdr.FileInfo()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			archive.add(hdr.Name, fs.ModeDir|info.Mode().Perm(), hdr.ModTime, 0, nil)
+
+		case tar.TypeReg, tar.TypeGNUSparse:
+			open, err := tarContent(r, sr, tr, hdr)
+			if err != nil {
+				return nil, err
+			}
+			archive.add(hdr.Name, info.Mode().Perm(), hdr.ModTime, hdr.Size, open)
+
+		case tar.TypeLink:
+			target, ok := archive.entries[archiveName(hdr.Linkname)]
+			if ok && !target.IsDir() {
+				archive.add(hdr.Name, info.Mode().Perm(), hdr.ModTime, target.size, target.open)
+			}
+		}
+	}
+	return archive.finish(), nil
+}
+
+// tarContent returns the function that opens the content of the entry tr
+// is positioned at. The tar reader consumes whole header blocks and leaves
+// the section reader at the start of the content, so it can be read in
+// place later. Sparse files are expanded into memory instead.
+func tarContent(r io.ReaderAt, sr *io.SectionReader, tr *tar.Reader, hdr *tar.Header) (func() (io.ReaderAt, error), error) {
+	_, sparse := hdr.PAXRecords["GNU.sparse.major"]
+	if hdr.Typeflag == tar.TypeGNUSparse || sparse {
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		return func() (io.ReaderAt, error) { return bytes.NewReader(data), nil }, nil
+	}
+
+	offset, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	size := hdr.Size
+	return func() (io.ReaderAt, error) {
+		return io.NewSectionReader(r, offset, size), nil
+	}, nil
+}
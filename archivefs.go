@@ -0,0 +1,186 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveFS is a read-only fs.FS over an index of archive entries. The
+// index is built once when the archive is opened; file contents are only
+// read when a file is opened. Archive formats build one with add.
+type archiveFS struct {
+	entries map[string]*archiveEntry
+}
+
+// archiveEntry is a file or directory in an archive. It doubles as the
+// entry's fs.FileInfo and fs.DirEntry.
+type archiveEntry struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	size     int64
+	children []*archiveEntry
+	open     func() (io.ReaderAt, error) // Returns the file content
+}
+
+func newArchiveFS() *archiveFS {
+	root := &archiveEntry{name: ".", mode: fs.ModeDir | 0755}
+	return &archiveFS{entries: map[string]*archiveEntry{".": root}}
+}
+
+// add records an entry, creating missing parent directories. Names are
+// cleaned and confined to the archive root; a later entry replaces an
+// earlier one with the same name.
+func (a *archiveFS) add(name string, mode fs.FileMode, modTime time.Time, size int64, open func() (io.ReaderAt, error)) {
+	name = archiveName(name)
+	if name == "" {
+		if mode.IsDir() {
+			a.entries["."].modTime = modTime
+		}
+		return
+	}
+
+	parent := a.mkdirAll(path.Dir(name))
+	if existing, ok := a.entries[name]; ok {
+		if existing.mode.IsDir() && mode.IsDir() {
+			existing.mode, existing.modTime = mode, modTime
+			return
+		}
+		a.remove(parent, existing)
+	}
+
+	entry := &archiveEntry{name: path.Base(name), mode: mode, modTime: modTime, size: size, open: open}
+	a.entries[name] = entry
+	parent.children = append(parent.children, entry)
+}
+
+// archiveName cleans a name inside an archive and confines it to the
+// archive root. The root itself is "".
+func archiveName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// mkdirAll returns the directory at name, creating it and its parents
+func (a *archiveFS) mkdirAll(name string) *archiveEntry {
+	if entry, ok := a.entries[name]; ok && entry.mode.IsDir() {
+		return entry
+	}
+
+	parent := a.mkdirAll(path.Dir(name))
+	if existing, ok := a.entries[name]; ok {
+		a.remove(parent, existing) // A file where a directory is needed
+	}
+	entry := &archiveEntry{name: path.Base(name), mode: fs.ModeDir | 0755}
+	a.entries[name] = entry
+	parent.children = append(parent.children, entry)
+	return entry
+}
+
+// remove detaches entry from parent. Entries below it stay reachable by
+// name until replaced, which only matters for malformed archives.
+func (a *archiveFS) remove(parent, entry *archiveEntry) {
+	for i, child := range parent.children {
+		if child == entry {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			return
+		}
+	}
+}
+
+// finish sorts directory listings; it must be called once all entries
+// have been added
+func (a *archiveFS) finish() *archiveFS {
+	for _, entry := range a.entries {
+		sort.Slice(entry.children, func(i, j int) bool {
+			return entry.children[i].name < entry.children[j].name
+		})
+	}
+	return a
+}
+
+// Open implements fs.FS
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, ok := a.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if entry.IsDir() {
+		return &archiveDir{entry: entry}, nil
+	}
+
+	r, err := entry.open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &archiveFile{entry: entry, SectionReader: io.NewSectionReader(r, 0, entry.size)}, nil
+}
+
+// Stat implements fs.StatFS
+func (a *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, ok := a.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
+}
+
+func (e *archiveEntry) Name() string               { return e.name }
+func (e *archiveEntry) Size() int64                { return e.size }
+func (e *archiveEntry) Mode() fs.FileMode          { return e.mode }
+func (e *archiveEntry) ModTime() time.Time         { return e.modTime }
+func (e *archiveEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e *archiveEntry) Sys() interface{}           { return nil }
+func (e *archiveEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e *archiveEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+// archiveFile is an open archive file
+type archiveFile struct {
+	*io.SectionReader
+	entry *archiveEntry
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.entry, nil }
+func (f *archiveFile) Close() error               { return nil }
+
+// archiveDir is an open archive directory
+type archiveDir struct {
+	entry  *archiveEntry
+	offset int
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entry.children[d.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+
+	entries := make([]fs.DirEntry, len(rest))
+	for i, child := range rest {
+		entries[i] = child
+	}
+	return entries, nil
+}
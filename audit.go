@@ -0,0 +1,288 @@
+package vfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a single entry in the audit log. Records are written as
+// JSON lines and chained: Hash covers the record and the previous record's
+// hash, so editing, dropping or reordering entries breaks the chain.
+type AuditRecord struct {
+	Time      time.Time `json:"ts"`
+	Op        string    `json:"op"`
+	Path      string    `json:"path"`
+	To        string    `json:"to,omitempty"` // Destination of renames
+	Bytes     int64     `json:"bytes"`
+	Result    string    `json:"result"`
+	Principal string    `json:"principal,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+// AuditOptions configures the audit log
+type AuditOptions struct {
+	// Principal is recorded for operations whose context carries no
+	// identity (see WithPrincipal)
+	Principal string
+
+	// Prev is the hash of the last record already in the log, which the
+	// first new record chains to. It is read from the log itself when w is
+	// an *os.File or a RotatingFile; other writers appending to an existing
+	// log should set it.
+	Prev string
+
+	// Clock overrides time.Now, mainly for tests
+	Clock func() time.Time
+}
+
+// AuditLog writes a tamper-evident record of every mutating operation
+type AuditLog struct {
+	w      io.Writer
+	opts   AuditOptions
+	logger Logger
+	last   string
+	mu     sync.Mutex
+}
+
+// WithAuditLog records every mutating operation (WriteFile, MkdirAll,
+// Create, Remove and RemoveAll, including those performed on behalf of
+// Copy, Move, Merge and the import functions) to w. Use NewRotatingFile to
+// write the log to disk with size-based rotation. Records appended to an
+// existing log continue its chain.
+func WithAuditLog(w io.Writer, opts AuditOptions) Option {
+	return func(v *VFS) {
+		if opts.Clock == nil {
+			opts.Clock = time.Now
+		}
+		last := opts.Prev
+		if last == "" {
+			last = lastAuditHash(w)
+		}
+		v.auditLog = &AuditLog{w: w, opts: opts, last: last}
+	}
+}
+
+// lastAuditHash returns the hash of the last record of the log w appends
+// to, if w is a file it can read back. A RotatingFile that was just rotated
+// continues from its most recent backup.
+func lastAuditHash(w io.Writer) string {
+	var paths []string
+	switch w := w.(type) {
+	case *RotatingFile:
+		paths = []string{w.path, w.path + ".1"}
+	case *os.File:
+		paths = []string{w.Name()}
+	}
+	for _, p := range paths {
+		if hash := lastRecordHash(p); hash != "" {
+			return hash
+		}
+	}
+	return ""
+}
+
+// lastRecordHash returns the hash of the last record in the audit log file
+// at path, or "" if it has none
+func lastRecordHash(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	last := ""
+	for scanner.Scan() {
+		var rec AuditRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil && rec.Hash != "" {
+			last = rec.Hash
+		}
+	}
+	return last
+}
+
+// record appends a chained record to the log
+func (a *AuditLog) record(op, path string, size int64, principal string, opErr error) {
+	a.append(AuditRecord{Op: op, Path: path, Bytes: size, Principal: principal}, opErr)
+}
+
+// recordRename appends a record of a move from path to to
+func (a *AuditLog) recordRename(op, path, to string, principal string, opErr error) {
+	a.append(AuditRecord{Op: op, Path: path, To: to, Principal: principal}, opErr)
+}
+
+// append completes rec and chains it to the log
+func (a *AuditLog) append(rec AuditRecord, opErr error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec.Time = a.opts.Clock().UTC()
+	rec.Result = "ok"
+	rec.Prev = a.last
+	if rec.Principal == "" {
+		rec.Principal = a.opts.Principal
+	}
+	if opErr != nil {
+		rec.Result = opErr.Error()
+	}
+	rec.Hash = rec.chainHash()
+
+	line, err := json.Marshal(rec)
+	if err == nil {
+		_, err = a.w.Write(append(line, '\n'))
+	}
+	if err != nil {
+		if a.logger != nil {
+			a.logger.Error("Failed to write audit record for %s %s: %v", rec.Op, rec.Path, err)
+		}
+		return
+	}
+
+	a.last = rec.Hash
+}
+
+// chainHash computes the record hash over every field except Hash itself
+func (r AuditRecord) chainHash() string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyAuditLog checks the hash chain of an audit log read from r. The
+// first record may continue a chain from an earlier (rotated) file. It
+// returns the number of records verified.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	count := 0
+	prev := ""
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return count, fmt.Errorf("audit record %d: %w", count+1, err)
+		}
+		if count > 0 && rec.Prev != prev {
+			return count, fmt.Errorf("audit record %d: chain broken, previous hash does not match", count+1)
+		}
+		if rec.chainHash() != rec.Hash {
+			return count, fmt.Errorf("audit record %d: hash mismatch, record was modified", count+1)
+		}
+		prev = rec.Hash
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// RotatingFile is an io.WriteCloser that writes to a file on disk and
+// rotates it once it would grow beyond a maximum size. Rotated files are
+// renamed path.1, path.2, ... with path.1 being the most recent.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	mu         sync.Mutex
+}
+
+// NewRotatingFile opens (or creates) path for appending. maxBackups limits
+// the number of rotated files kept; older files are deleted.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("rotating file %s: max size must be positive", path)
+	}
+
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Write writes p, rotating first if p would push the file past its limit.
+// A single write is never split across files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// open opens the active file and records its current size
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups and starts a new active file
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+
+	if rf.maxBackups <= 0 {
+		if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return rf.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+
+	return rf.open()
+}
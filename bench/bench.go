@@ -0,0 +1,231 @@
+// Package bench provides standardized workloads for comparing VFS backends.
+//
+// Every workload runs against every backend as a sub-benchmark named
+// "<workload>/<backend>", so results from different backends, machines or
+// revisions can be compared directly with benchstat:
+//
+//	go test ./bench -bench . -count 10 > new.txt
+//	benchstat old.txt new.txt
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yasufadhili/vfs"
+)
+
+// Backend creates a fresh filesystem for a benchmark
+type Backend struct {
+	Name string
+	New  func(tb testing.TB) vfs.FileSystem
+}
+
+// Workload is a standardized benchmark body. Setup runs untimed before the
+// benchmark loop; Run performs b.N iterations of the workload.
+type Workload struct {
+	Name  string
+	Setup func(tb testing.TB, fsys vfs.FileSystem)
+	Run   func(b *testing.B, fsys vfs.FileSystem)
+}
+
+// Backends returns the built-in backends. Additional backends are compared
+// by appending to the returned slice.
+func Backends() []Backend {
+	return []Backend{
+		{
+			Name: "memory",
+			New: func(tb testing.TB) vfs.FileSystem {
+				return vfs.NewMemoryVFS()
+			},
+		},
+		{
+			Name: "memory-pool",
+			New: func(tb testing.TB) vfs.FileSystem {
+				return vfs.NewMemoryVFS(vfs.WithAllocator(vfs.AllocatorPool))
+			},
+		},
+		{
+			Name: "memory-arena",
+			New: func(tb testing.TB) vfs.FileSystem {
+				return vfs.NewMemoryVFS(vfs.WithAllocator(vfs.AllocatorArena))
+			},
+		},
+		{
+			Name: "disk",
+			New: func(tb testing.TB) vfs.FileSystem {
+				v := vfs.NewDiskVFS(tb.TempDir())
+				tb.Cleanup(func() { v.Close() })
+				return v
+			},
+		},
+		{
+			Name: "hybrid",
+			New: func(tb testing.TB) vfs.FileSystem {
+				return vfs.NewHybridVFS()
+			},
+		},
+	}
+}
+
+// Workloads returns the standard workloads
+func Workloads() []Workload {
+	return []Workload{
+		SmallFiles(1000, 256),
+		HugeFiles(2, 8<<20),
+		DeepTree(32, 4),
+		ConcurrentReaders(100, 4<<10),
+	}
+}
+
+// Run benchmarks every workload against every backend
+func Run(b *testing.B, backends []Backend, workloads []Workload) {
+	for _, w := range workloads {
+		b.Run(w.Name, func(b *testing.B) {
+			for _, backend := range backends {
+				b.Run(backend.Name, func(b *testing.B) {
+					fsys := backend.New(b)
+					if w.Setup != nil {
+						w.Setup(b, fsys)
+					}
+					b.ReportAllocs()
+					b.ResetTimer()
+					w.Run(b, fsys)
+				})
+			}
+		})
+	}
+}
+
+// SmallFiles writes and reads back count files of size bytes per iteration
+func SmallFiles(count, size int) Workload {
+	data := payload(size)
+	return Workload{
+		Name: fmt.Sprintf("SmallFiles-%dx%dB", count, size),
+		Run: func(b *testing.B, fsys vfs.FileSystem) {
+			b.SetBytes(int64(count * size * 2))
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < count; j++ {
+					name := fmt.Sprintf("/small/%03d/file%d.txt", j%100, j)
+					if err := fsys.WriteFile(name, data, 0644); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for j := 0; j < count; j++ {
+					name := fmt.Sprintf("/small/%03d/file%d.txt", j%100, j)
+					if _, err := fsys.ReadFile(name); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		},
+	}
+}
+
+// HugeFiles writes and reads back count files of size bytes per iteration
+func HugeFiles(count, size int) Workload {
+	data := payload(size)
+	return Workload{
+		Name: fmt.Sprintf("HugeFiles-%dx%dMB", count, size>>20),
+		Run: func(b *testing.B, fsys vfs.FileSystem) {
+			b.SetBytes(int64(count * size * 2))
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < count; j++ {
+					name := fmt.Sprintf("/huge/file%d.bin", j)
+					if err := fsys.WriteFile(name, data, 0644); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := fsys.ReadFile(name); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		},
+	}
+}
+
+// DeepTree builds a tree depth levels deep with filesPerLevel files in every
+// directory, then walks it and searches it once per iteration
+func DeepTree(depth, filesPerLevel int) Workload {
+	return Workload{
+		Name: fmt.Sprintf("DeepTree-%dx%d", depth, filesPerLevel),
+		Setup: func(tb testing.TB, fsys vfs.FileSystem) {
+			dir := "/deep"
+			for d := 0; d < depth; d++ {
+				dir = path.Join(dir, fmt.Sprintf("level%d", d))
+				for f := 0; f < filesPerLevel; f++ {
+					name := path.Join(dir, fmt.Sprintf("file%d.go", f))
+					if err := fsys.WriteFile(name, []byte("package deep\n"), 0644); err != nil {
+						tb.Fatal(err)
+					}
+				}
+			}
+		},
+		Run: func(b *testing.B, fsys vfs.FileSystem) {
+			for i := 0; i < b.N; i++ {
+				entries := 0
+				err := fsys.Walk("/deep", func(path string, info fs.FileInfo, err error) error {
+					entries++
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				matches, err := fsys.FindFiles("/deep", "*.go")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(matches) != depth*filesPerLevel {
+					b.Fatalf("found %d files, want %d", len(matches), depth*filesPerLevel)
+				}
+			}
+		},
+	}
+}
+
+// ConcurrentReaders prepares count files of size bytes and reads random
+// files from GOMAXPROCS goroutines
+func ConcurrentReaders(count, size int) Workload {
+	data := payload(size)
+	return Workload{
+		Name: fmt.Sprintf("ConcurrentReaders-%dx%dKB", count, size>>10),
+		Setup: func(tb testing.TB, fsys vfs.FileSystem) {
+			for j := 0; j < count; j++ {
+				if err := fsys.WriteFile(fmt.Sprintf("/shared/file%d", j), data, 0644); err != nil {
+					tb.Fatal(err)
+				}
+			}
+		},
+		Run: func(b *testing.B, fsys vfs.FileSystem) {
+			b.SetBytes(int64(size))
+			var seed atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(seed.Add(1)))
+				for pb.Next() {
+					// FailNow may only run on the benchmark goroutine
+					got, err := fsys.ReadFile(fmt.Sprintf("/shared/file%d", r.Intn(count)))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if len(got) != size {
+						b.Errorf("read %d bytes, want %d", len(got), size)
+						return
+					}
+				}
+			})
+		},
+	}
+}
+
+// payload returns deterministic, mildly compressible content
+func payload(size int) []byte {
+	pattern := []byte("0123456789abcdefghijklmnopqrstuvwxyz\n")
+	return bytes.Repeat(pattern, size/len(pattern)+1)[:size]
+}
@@ -0,0 +1,8 @@
+package bench
+
+import "testing"
+
+// BenchmarkBackends runs the standard workloads against the built-in backends
+func BenchmarkBackends(b *testing.B) {
+	Run(b, Backends(), Workloads())
+}
@@ -0,0 +1,358 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BroadcastChunkSize is the size of the content-addressed chunks that
+// broadcast files are split into
+const BroadcastChunkSize = 4 << 20
+
+// ErrNotSealed is returned when publishing a VFS that is not sealed
+var ErrNotSealed = errors.New("vfs is not sealed")
+
+// BroadcastEntry describes one path of a published VFS
+type BroadcastEntry struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	IsDir  bool        `json:"dir,omitempty"`
+	Size   int64       `json:"size,omitempty"`
+	Chunks []string    `json:"chunks,omitempty"` // SHA-256 of each chunk, in order
+}
+
+// BroadcastManifest lists every path of a published VFS. Version is a hash
+// of the entries, so workers that are up to date can tell from it alone.
+type BroadcastManifest struct {
+	Version string           `json:"version"`
+	Entries []BroadcastEntry `json:"entries"`
+}
+
+// chunkRef locates a chunk within a file
+type chunkRef struct {
+	path string
+	off  int64
+	size int64
+}
+
+// published is a sealed VFS together with its manifest
+type published struct {
+	vfs      *VFS
+	manifest []byte // JSON
+	version  string
+	chunks   map[string]chunkRef
+}
+
+// BroadcastHandler publishes a sealed VFS to worker processes over HTTP. It
+// serves the manifest at /manifest and each chunk at /chunks/<sha256>.
+// Workers sync with a BroadcastReceiver, which fetches only chunks they do
+// not have yet. The zero BroadcastHandler answers 503 Service Unavailable
+// until a VFS is published.
+type BroadcastHandler struct {
+	current *published
+	mu      sync.RWMutex
+}
+
+// NewBroadcastHandler returns a handler publishing v, which must be sealed
+func NewBroadcastHandler(v *VFS) (*BroadcastHandler, error) {
+	h := &BroadcastHandler{}
+	if err := h.Publish(v); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Publish replaces the published VFS with v, which must be sealed. Workers
+// pick it up on their next sync, fetching only the chunks that changed.
+func (h *BroadcastHandler) Publish(v *VFS) error {
+	if !v.IsSealed() {
+		return fmt.Errorf("broadcast: %w", ErrNotSealed)
+	}
+
+	p := &published{vfs: v, chunks: make(map[string]chunkRef)}
+	var entries []BroadcastEntry
+	err := v.walk("/", func(entry WalkEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info := entry.Info
+		e := BroadcastEntry{Path: entry.Path, Mode: info.Mode(), IsDir: info.IsDir()}
+		if !e.IsDir {
+			data, err := v.ReadFile(entry.Path)
+			if err != nil {
+				return err
+			}
+			e.Size = int64(len(data))
+			for off := 0; off < len(data); off += BroadcastChunkSize {
+				chunk := data[off:min(off+BroadcastChunkSize, len(data))]
+				sum := sha256.Sum256(chunk)
+				hash := hex.EncodeToString(sum[:])
+				e.Chunks = append(e.Chunks, hash)
+				p.chunks[hash] = chunkRef{path: entry.Path, off: int64(off), size: int64(len(chunk))}
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("broadcast: %w", err)
+	}
+
+	p.version = manifestVersion(entries)
+	p.manifest, err = json.Marshal(BroadcastManifest{Version: p.version, Entries: entries})
+	if err != nil {
+		return fmt.Errorf("broadcast: %w", err)
+	}
+
+	h.mu.Lock()
+	h.current = p
+	h.mu.Unlock()
+	v.logger.Info("Publishing VFS version %s: %d entries, %d chunks", p.version, len(entries), len(p.chunks))
+	return nil
+}
+
+// manifestVersion hashes the entries of a manifest
+func manifestVersion(entries []BroadcastEntry) string {
+	data, _ := json.Marshal(entries)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// ServeHTTP implements http.Handler
+func (h *BroadcastHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.RLock()
+	p := h.current
+	h.mu.RUnlock()
+	if p == nil {
+		http.Error(w, "nothing published", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	switch {
+	case name == "/manifest":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"`+p.version+`"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(p.manifest))
+	case strings.HasPrefix(name, "/chunks/"):
+		ref, ok := p.chunks[strings.TrimPrefix(name, "/chunks/")]
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		data, err := p.vfs.ReadRange(ref.path, ref.off, ref.size)
+		if err != nil {
+			p.vfs.logger.Error("Failed to serve chunk of %s: %v", ref.path, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// Chunks are content-addressed, so they never change
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// BroadcastStats summarizes a BroadcastReceiver sync
+type BroadcastStats struct {
+	Version       string // Manifest version now held
+	Files         int    // Files written
+	Removed       int    // Paths removed
+	ChunksFetched int
+	ChunksReused  int // Chunks copied from files already held
+	BytesFetched  int64
+}
+
+// BroadcastReceiver keeps a worker's VFS in sync with a BroadcastHandler
+type BroadcastReceiver struct {
+	dest    *VFS
+	url     string
+	client  *http.Client
+	version string
+	entries map[string]BroadcastEntry // Of the manifest last synced
+	mu      sync.Mutex
+}
+
+// NewBroadcastReceiver returns a receiver that syncs dest with the
+// BroadcastHandler at url. dest must not be sealed, as syncs write to it.
+// A nil client uses http.DefaultClient.
+func NewBroadcastReceiver(dest *VFS, url string, client *http.Client) *BroadcastReceiver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &BroadcastReceiver{dest: dest, url: strings.TrimSuffix(url, "/"), client: client}
+}
+
+// Sync brings the destination VFS up to the published version. The first
+// sync fetches every chunk; later ones write only the files that changed,
+// taking chunks from files already held where possible, and remove the
+// paths that are no longer published. Every chunk is fetched and verified
+// against its hash before the destination is changed, so that a failed or
+// canceled fetch leaves it at the version it had.
+func (r *BroadcastReceiver) Sync(ctx context.Context) (BroadcastStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var stats BroadcastStats
+	var manifest BroadcastManifest
+	body, err := r.fetch(ctx, "/manifest")
+	if err != nil {
+		return stats, err
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return stats, fmt.Errorf("broadcast manifest: %w", err)
+	}
+	stats.Version = manifest.Version
+	if manifest.Version == r.version {
+		return stats, nil
+	}
+
+	// Chunks of the files held since the last sync
+	local := make(map[string]chunkRef)
+	for _, e := range r.entries {
+		var off int64
+		for _, hash := range e.Chunks {
+			size := min(BroadcastChunkSize, e.Size-off)
+			local[hash] = chunkRef{path: e.Path, off: off, size: size}
+			off += size
+		}
+	}
+
+	entries := make(map[string]BroadcastEntry, len(manifest.Entries))
+	for _, e := range manifest.Entries {
+		entries[e.Path] = e
+	}
+
+	// Remove first, so that a path that changed type can be recreated.
+	// Children sort after their parents, so go backwards.
+	var removed []string
+	for p, old := range r.entries {
+		if e, ok := entries[p]; !ok || e.IsDir != old.IsDir {
+			removed = append(removed, p)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+
+	// Read reusable chunks before their files are removed or rewritten
+	fetched := make(map[string][]byte)
+	for _, e := range manifest.Entries {
+		if old, ok := r.entries[e.Path]; e.IsDir || (ok && sameEntry(old, e)) {
+			continue
+		}
+		for _, hash := range e.Chunks {
+			ref, ok := local[hash]
+			if _, have := fetched[hash]; have || !ok {
+				continue
+			}
+			if data, err := r.dest.ReadRange(ref.path, ref.off, ref.size); err == nil && chunkHash(data) == hash {
+				fetched[hash] = data
+				stats.ChunksReused++
+			}
+		}
+	}
+
+	// Stage the entries to write and their chunks
+	var changed []BroadcastEntry
+	for _, e := range manifest.Entries {
+		if old, ok := r.entries[e.Path]; ok && sameEntry(old, e) && r.dest.Exists(e.Path) {
+			continue
+		}
+		changed = append(changed, e)
+		for _, hash := range e.Chunks {
+			if _, ok := fetched[hash]; ok {
+				continue
+			}
+			data, err := r.fetch(ctx, "/chunks/"+hash)
+			if err != nil {
+				return stats, err
+			}
+			if chunkHash(data) != hash {
+				return stats, fmt.Errorf("broadcast chunk %s of %s: content does not match hash", hash, e.Path)
+			}
+			fetched[hash] = data
+			stats.ChunksFetched++
+			stats.BytesFetched += int64(len(data))
+		}
+	}
+
+	// Apply them. From here on nothing is fetched, and ctx is no longer
+	// checked, so that a sync is not stopped halfway.
+	for _, p := range removed {
+		if err := r.dest.RemoveAll(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return stats, err
+		}
+		stats.Removed++
+	}
+	for _, e := range changed {
+		if e.IsDir {
+			if err := r.dest.MkdirAll(e.Path, e.Mode.Perm()); err != nil {
+				return stats, err
+			}
+			continue
+		}
+
+		var content bytes.Buffer
+		for _, hash := range e.Chunks {
+			content.Write(fetched[hash])
+		}
+		if err := r.dest.WriteFile(e.Path, content.Bytes(), e.Mode.Perm()); err != nil {
+			return stats, err
+		}
+		stats.Files++
+	}
+
+	r.version = manifest.Version
+	r.entries = entries
+	r.dest.logger.Info("Synced VFS version %s: %d files written, %d chunks fetched", stats.Version, stats.Files, stats.ChunksFetched)
+	return stats, nil
+}
+
+// fetch gets a resource from the handler
+func (r *BroadcastReceiver) fetch(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("broadcast %s: %s", name, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// sameEntry reports whether two manifest entries have the same content
+// and mode
+func sameEntry(a, b BroadcastEntry) bool {
+	return a.IsDir == b.IsDir && a.Mode == b.Mode && a.Size == b.Size && slices.Equal(a.Chunks, b.Chunks)
+}
+
+func chunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -4,6 +4,7 @@ import (
 	"embed"
 	"fmt"
 	"io/fs"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -25,6 +26,12 @@ func NewBundledManager() *BundledManager {
 
 // Register registers an embedded filesystem with a given prefix
 func (bm *BundledManager) Register(prefix string, embedFS embed.FS, subdir string) error {
+	return bm.RegisterFS(prefix, embedFS, subdir)
+}
+
+// RegisterFS registers any read-only filesystem, such as a mounted disk
+// image, with a given prefix
+func (bm *BundledManager) RegisterFS(prefix string, fsys fs.FS, subdir string) error {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
 
@@ -33,26 +40,37 @@ func (bm *BundledManager) Register(prefix string, embedFS embed.FS, subdir strin
 	}
 
 	bundled := &BundledFS{
-		embedFS: embedFS,
-		prefix:  strings.TrimSuffix(prefix, "://"),
-		subdir:  subdir,
+		fsys:   fsys,
+		prefix: strings.TrimSuffix(prefix, "://"),
+		subdir: cleanSubdir(subdir),
 	}
 
 	bm.bundled[prefix] = bundled
 	return nil
 }
 
-// GetBundledFS returns the appropriate bundled filesystem for a path
+// cleanSubdir normalizes a bundle subdirectory to the form fs.FS expects,
+// with "" for the whole filesystem
+func cleanSubdir(subdir string) string {
+	subdir = strings.Trim(path.Clean(filepath.ToSlash(subdir)), "/")
+	if subdir == "." {
+		return ""
+	}
+	return subdir
+}
+
+// GetBundledFS returns the appropriate bundled filesystem for a path. When
+// several registered prefixes match, the longest one wins so that nested
+// prefixes such as "std://" and "std://lib://" resolve deterministically.
 func (bm *BundledManager) GetBundledFS(path string) (*BundledFS, string, bool) {
 	bm.mu.RLock()
 	defer bm.mu.RUnlock()
 
-	for prefix, bundled := range bm.bundled {
-		if strings.HasPrefix(path, prefix) {
-			return bundled, strings.TrimPrefix(path, prefix), true
-		}
+	prefix, ok := bm.matchPrefix(path)
+	if !ok {
+		return nil, "", false
 	}
-	return nil, "", false
+	return bm.bundled[prefix], strings.TrimPrefix(path, prefix), true
 }
 
 // IsBundledPath checks if a path is a bundled path
@@ -60,12 +78,20 @@ func (bm *BundledManager) IsBundledPath(path string) bool {
 	bm.mu.RLock()
 	defer bm.mu.RUnlock()
 
+	_, ok := bm.matchPrefix(path)
+	return ok
+}
+
+// matchPrefix returns the longest registered prefix that path starts with.
+// Callers must hold the lock.
+func (bm *BundledManager) matchPrefix(path string) (string, bool) {
+	longest := ""
 	for prefix := range bm.bundled {
-		if strings.HasPrefix(path, prefix) {
-			return true
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(longest) {
+			longest = prefix
 		}
 	}
-	return false
+	return longest, longest != ""
 }
 
 // ListRegistered returns all registered prefixes
@@ -80,43 +106,55 @@ func (bm *BundledManager) ListRegistered() []string {
 	return prefixes
 }
 
+// PathForm selects how FindFilesAs reports paths inside bundles
+type PathForm int
+
+const (
+	// PathURL reports prefix:// URLs, which every VFS method accepts
+	PathURL PathForm = iota
+
+	// PathBundleRelative reports paths relative to the bundle's root, as
+	// seen below its subdirectory
+	PathBundleRelative
+)
+
 // BundledFS handles embedded filesystem access
 type BundledFS struct {
-	embedFS embed.FS
-	prefix  string
-	subdir  string
+	fsys   fs.FS
+	prefix string
+	subdir string
 }
 
 // ReadFile reads from the embedded filesystem
 func (b *BundledFS) ReadFile(path string) ([]byte, error) {
 	fullPath := b.getFullPath(path)
-	return fs.ReadFile(b.embedFS, fullPath)
+	return fs.ReadFile(b.fsys, fullPath)
 }
 
 // Exists checks if a file exists in the embedded filesystem
 func (b *BundledFS) Exists(path string) bool {
 	fullPath := b.getFullPath(path)
-	_, err := fs.Stat(b.embedFS, fullPath)
+	_, err := fs.Stat(b.fsys, fullPath)
 	return err == nil
 }
 
 // IsDir checks if a path is a directory in the embedded filesystem
 func (b *BundledFS) IsDir(path string) bool {
 	fullPath := b.getFullPath(path)
-	stat, err := fs.Stat(b.embedFS, fullPath)
+	stat, err := fs.Stat(b.fsys, fullPath)
 	return err == nil && stat.IsDir()
 }
 
 // Stat returns file info for embedded files
 func (b *BundledFS) Stat(path string) (fs.FileInfo, error) {
 	fullPath := b.getFullPath(path)
-	return fs.Stat(b.embedFS, fullPath)
+	return fs.Stat(b.fsys, fullPath)
 }
 
 // ListFiles lists files in an embedded directory
 func (b *BundledFS) ListFiles(path string) ([]string, error) {
 	fullPath := b.getFullPath(path)
-	entries, err := fs.ReadDir(b.embedFS, fullPath)
+	entries, err := fs.ReadDir(b.fsys, fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -134,7 +172,7 @@ func (b *BundledFS) ListFiles(path string) ([]string, error) {
 // ListDirs lists directories in an embedded directory
 func (b *BundledFS) ListDirs(path string) ([]string, error) {
 	fullPath := b.getFullPath(path)
-	entries, err := fs.ReadDir(b.embedFS, fullPath)
+	entries, err := fs.ReadDir(b.fsys, fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -149,38 +187,55 @@ func (b *BundledFS) ListDirs(path string) ([]string, error) {
 	return dirs, nil
 }
 
-// Walk traverses the embedded filesystem
+// Walk traverses the embedded filesystem, passing each path to walkFn as
+// a prefix:// URL. It honors fs.SkipDir and fs.SkipAll like VFS.Walk.
 func (b *BundledFS) Walk(root string, walkFn filepath.WalkFunc) error {
+	return b.WalkEntries(root, func(entry WalkEntry, err error) error {
+		return walkFn(entry.Path, entry.Info, err)
+	})
+}
+
+// WalkEntries traverses the embedded filesystem, passing each path both as
+// a prefix:// URL and relative to the bundle
+func (b *BundledFS) WalkEntries(root string, fn WalkEntryFunc) error {
 	fullRoot := b.getFullPath(root)
 
-	return fs.WalkDir(b.embedFS, fullRoot, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return walkFn(path, nil, err)
-		}
+	return fs.WalkDir(b.fsys, fullRoot, func(path string, d fs.DirEntry, err error) error {
+		// Convert back to the original path format
+		entry := WalkEntry{FSPath: b.getOriginalPath(path)}
+		entry.Path = fmt.Sprintf("%s://%s", b.prefix, entry.FSPath)
 
-		info, err := d.Info()
+		if err == nil {
+			entry.Info, err = d.Info()
+		}
 		if err != nil {
-			return walkFn(path, nil, err)
+			err = walkError(path == fullRoot, entry.Path, err)
 		}
-
-		// Convert back to the original path format
-		originalPath := b.getOriginalPath(path)
-		bundledURL := fmt.Sprintf("%s://%s", b.prefix, originalPath)
-
-		return walkFn(bundledURL, info, nil)
+		return fn(entry, err)
 	})
 }
 
-// getFullPath constructs the full path within the embedded filesystem
-func (b *BundledFS) getFullPath(path string) string {
-	if b.subdir == "" {
-		return path
+// getFullPath constructs the full path within the embedded filesystem.
+// Paths are cleaned and cannot climb out of the subdirectory.
+func (b *BundledFS) getFullPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	switch {
+	case name == "" && b.subdir == "":
+		return "." // The root of the bundle
+	case name == "":
+		return b.subdir
+	case b.subdir == "":
+		return name
 	}
-	return filepath.Join(b.subdir, path)
+	return b.subdir + "/" + name
 }
 
-// getOriginalPath converts a full embedded path back to the original format
+// getOriginalPath converts a full embedded path back to the original
+// format, so that prefix:// plus the result reads the same file
 func (b *BundledFS) getOriginalPath(fullPath string) string {
+	if fullPath == "." || fullPath == b.subdir {
+		return ""
+	}
 	if b.subdir == "" {
 		return fullPath
 	}
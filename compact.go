@@ -0,0 +1,288 @@
+package vfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unique"
+
+	"github.com/spf13/afero"
+)
+
+// CompactStats describes a compaction of the memory backend
+type CompactStats struct {
+	Files    int
+	Dirs     int
+	Bytes    int64 // Total size of the compacted files
+	Churn    int   // Writes and removals since the previous compaction
+	Duration time.Duration
+}
+
+// CompactPolicy configures automatic background compaction
+type CompactPolicy struct {
+	// MinChurn is the number of writes and removals after which a
+	// compaction is started
+	MinChurn int
+
+	// MinInterval is the shortest time between two compactions
+	MinInterval time.Duration
+}
+
+// compactState tracks churn and compaction results. It is shared by all
+// views of a VFS.
+type compactState struct {
+	policy  *CompactPolicy
+	churn   int
+	running bool
+	last    time.Time
+	stats   CompactStats
+	mu      sync.Mutex
+}
+
+// WithAutoCompact compacts a memory or hybrid VFS in the background once
+// policy.MinChurn writes and removals have happened since the previous
+// compaction, at most once per policy.MinInterval
+func WithAutoCompact(policy CompactPolicy) Option {
+	return func(v *VFS) {
+		if policy.MinChurn < 1 {
+			policy.MinChurn = 1
+		}
+		v.compaction.policy = &policy
+	}
+}
+
+// Compact rebuilds the memory backend from scratch. Go maps never shrink and
+// file buffers keep the capacity of their largest past contents, so a
+// long-running VFS with heavy churn (files rewritten smaller, trees created
+// and removed) holds on to memory it no longer uses, as do the arenas of
+// AllocatorArena. Compact copies every file into an exactly sized buffer, or
+// fresh slabs, in fresh directory tables, preserving
+// modes and modification times, and swaps the result in. Internal caches
+// are rebuilt the same way.
+//
+// Writes wait while Compact runs; reads continue. Compact fails if files
+// opened with Create are still open, since their later writes would go to
+// the old backend. Disk and sealed filesystems have nothing to compact.
+func (v *VFS) Compact() (CompactStats, error) {
+	swap, ok := v.fs.(*swapFs)
+	if !ok || v.IsSealed() {
+		return CompactStats{}, nil
+	}
+
+	v.seal.gate.Lock()
+	defer v.seal.gate.Unlock()
+
+	if n := swap.writers.Load(); n > 0 {
+		return CompactStats{}, fmt.Errorf("cannot compact: %d files open for writing", n)
+	}
+
+	start := time.Now()
+	fresh := newMemoryBackend(v.allocator)
+	stats, err := copyTree(swap.current(), fresh)
+	if err != nil {
+		return CompactStats{}, fmt.Errorf("failed to compact: %w", err)
+	}
+	swap.swap(fresh)
+
+	v.generations.compact()
+	v.shared.compact()
+
+	v.compaction.mu.Lock()
+	stats.Churn = v.compaction.churn
+	stats.Duration = time.Since(start)
+	v.compaction.churn = 0
+	v.compaction.last = time.Now()
+	v.compaction.stats = stats
+	v.compaction.mu.Unlock()
+
+	v.logger.Debug("Compacted %d files and %d directories (%d bytes) in %v", stats.Files, stats.Dirs, stats.Bytes, stats.Duration)
+	return stats, nil
+}
+
+// LastCompaction returns the result of the most recent compaction
+func (v *VFS) LastCompaction() CompactStats {
+	v.compaction.mu.Lock()
+	defer v.compaction.mu.Unlock()
+	return v.compaction.stats
+}
+
+// noteChurn counts a successful write or removal and starts a background
+// compaction if the policy calls for one
+func (v *VFS) noteChurn() {
+	c := v.compaction
+	c.mu.Lock()
+	c.churn++
+	due := c.policy != nil && !c.running && c.churn >= c.policy.MinChurn &&
+		time.Since(c.last) >= c.policy.MinInterval
+	if due {
+		c.running = true
+	}
+	c.mu.Unlock()
+
+	if !due {
+		return
+	}
+
+	go func() {
+		if _, err := v.Compact(); err != nil {
+			v.logger.Debug("Background compaction skipped: %v", err)
+		}
+		c.mu.Lock()
+		c.running = false
+		c.mu.Unlock()
+	}()
+}
+
+// copyTree copies every directory and file of src into dst, preserving
+// modes and modification times
+func copyTree(src, dst afero.Fs) (CompactStats, error) {
+	var stats CompactStats
+	var infos []fs.FileInfo
+	var paths []string
+
+	err := afero.Walk(src, "/", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if err := dst.MkdirAll(path, info.Mode().Perm()); err != nil {
+				return err
+			}
+			stats.Dirs++
+		} else {
+			data, err := afero.ReadFile(src, path)
+			if err != nil {
+				return err
+			}
+			if err := afero.WriteFile(dst, path, data, info.Mode().Perm()); err != nil {
+				return err
+			}
+			stats.Files++
+			stats.Bytes += int64(len(data))
+		}
+
+		paths = append(paths, path)
+		infos = append(infos, info)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return stats, err
+	}
+
+	// Restore metadata once every entry exists, since creating an entry
+	// touches its parent directory
+	for i := range paths {
+		if err := dst.Chmod(paths[i], infos[i].Mode()); err != nil {
+			return stats, err
+		}
+		if err := dst.Chtimes(paths[i], infos[i].ModTime(), infos[i].ModTime()); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// compact rebuilds the generation tree's maps
+func (g *generationTable) compact() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var rebuild func(node *genNode)
+	rebuild = func(node *genNode) {
+		if node.children == nil {
+			return
+		}
+		children := make(map[unique.Handle[string]]*genNode, len(node.children))
+		for name, child := range node.children {
+			rebuild(child)
+			children[name] = child
+		}
+		node.children = children
+	}
+	rebuild(g.root)
+}
+
+// compact rebuilds the shared cache map
+func (c *sharedCache) compact() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make(map[internedPath]*sharedEntry, len(c.entries))
+	for path, entry := range c.entries {
+		entries[path] = entry
+	}
+	c.entries = entries
+}
+
+// swapFs is an afero.Fs whose backend can be replaced atomically. It is
+// shared by all views of a memory VFS and counts files open for writing.
+type swapFs struct {
+	fs      atomic.Pointer[afero.Fs]
+	writers atomic.Int64
+}
+
+func newSwapFs(backend afero.Fs) *swapFs {
+	s := &swapFs{}
+	s.swap(backend)
+	return s
+}
+
+func (s *swapFs) current() afero.Fs     { return *s.fs.Load() }
+func (s *swapFs) swap(backend afero.Fs) { s.fs.Store(&backend) }
+
+func (s *swapFs) Create(name string) (afero.File, error) {
+	return s.track(s.current().Create(name))
+}
+
+func (s *swapFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := s.current().OpenFile(name, flag, perm)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return s.track(f, err)
+}
+
+func (s *swapFs) Open(name string) (afero.File, error) { return s.current().Open(name) }
+func (s *swapFs) Mkdir(name string, perm os.FileMode) error {
+	return s.current().Mkdir(name, perm)
+}
+func (s *swapFs) MkdirAll(path string, perm os.FileMode) error {
+	return s.current().MkdirAll(path, perm)
+}
+func (s *swapFs) Remove(name string) error                  { return s.current().Remove(name) }
+func (s *swapFs) RemoveAll(path string) error               { return s.current().RemoveAll(path) }
+func (s *swapFs) Rename(oldname, newname string) error      { return s.current().Rename(oldname, newname) }
+func (s *swapFs) Stat(name string) (os.FileInfo, error)     { return s.current().Stat(name) }
+func (s *swapFs) Name() string                              { return s.current().Name() }
+func (s *swapFs) Chmod(name string, mode os.FileMode) error { return s.current().Chmod(name, mode) }
+func (s *swapFs) Chown(name string, uid, gid int) error     { return s.current().Chown(name, uid, gid) }
+func (s *swapFs) Chtimes(name string, atime, mtime time.Time) error {
+	return s.current().Chtimes(name, atime, mtime)
+}
+
+// track counts a writable file until it is closed
+func (s *swapFs) track(f afero.File, err error) (afero.File, error) {
+	if err != nil {
+		return f, err
+	}
+	s.writers.Add(1)
+	return &writerFile{File: f, fs: s}, nil
+}
+
+// writerFile is a file open for writing on a swapFs
+type writerFile struct {
+	afero.File
+	fs     *swapFs
+	closed atomic.Bool
+}
+
+func (f *writerFile) Close() error {
+	if f.closed.CompareAndSwap(false, true) {
+		f.fs.writers.Add(-1)
+	}
+	return f.File.Close()
+}
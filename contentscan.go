@@ -0,0 +1,257 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// ScanVerdict is a content scanner's decision about a file
+type ScanVerdict int
+
+const (
+	// ScanClean lets the content through
+	ScanClean ScanVerdict = iota
+
+	// ScanReject drops the content; the write fails with ErrContentRejected
+	ScanReject
+
+	// ScanQuarantine moves the content to the quarantine directory for
+	// review; the write fails with ErrQuarantined
+	ScanQuarantine
+)
+
+// String returns the name of the verdict
+func (s ScanVerdict) String() string {
+	switch s {
+	case ScanClean:
+		return "clean"
+	case ScanReject:
+		return "reject"
+	case ScanQuarantine:
+		return "quarantine"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrContentRejected is returned for writes a content scanner rejected.
+	// It matches fs.ErrPermission with errors.Is.
+	ErrContentRejected = fmt.Errorf("content rejected by scanner: %w", fs.ErrPermission)
+
+	// ErrQuarantined is returned for writes a content scanner quarantined.
+	// It matches fs.ErrPermission with errors.Is.
+	ErrQuarantined = fmt.Errorf("content quarantined by scanner: %w", fs.ErrPermission)
+)
+
+// ContentScanner inspects content written to path, for example by
+// streaming it to a ClamAV daemon. An error fails synchronous writes and
+// quarantines files already written, so content is never let through
+// unscanned.
+type ContentScanner func(ctx context.Context, path string, content io.Reader) (ScanVerdict, error)
+
+// ScanOptions selects which writes are scanned and how
+type ScanOptions struct {
+	MinSize    int64    // Skip files smaller than this many bytes
+	Extensions []string // Only scan files with these extensions, all if empty
+	Async      bool     // Scan after the write returns, then remove or quarantine the file if needed
+	Quarantine afero.Fs // Where quarantined content goes, by path; in memory by default
+}
+
+// contentScanner holds the scanner of a VFS. It is shared by all views.
+type contentScanner struct {
+	scan       ContentScanner
+	opts       ScanOptions
+	extensions map[string]bool
+	pending    sync.WaitGroup // Asynchronous scans in flight
+}
+
+// WithContentScanner passes content written with WriteFile, CreateNew and
+// Create to scanner. Synchronous scans see WriteFile and CreateNew content
+// before it is stored; files from Create, and everything when opts.Async
+// is set, are scanned once written, and removed or quarantined afterwards
+// unless they were rewritten in the meantime. Close waits for pending
+// asynchronous scans.
+//
+// Quarantined content is kept apart from the tree, so that it can never
+// be read or served through the VFS; see Quarantine.
+func WithContentScanner(scanner ContentScanner, opts ScanOptions) Option {
+	return func(v *VFS) {
+		if opts.Quarantine == nil {
+			opts.Quarantine = afero.NewMemMapFs()
+		}
+
+		s := &contentScanner{scan: scanner, opts: opts}
+		if len(opts.Extensions) > 0 {
+			s.extensions = make(map[string]bool, len(opts.Extensions))
+			for _, ext := range opts.Extensions {
+				if !strings.HasPrefix(ext, ".") {
+					ext = "." + ext
+				}
+				s.extensions[strings.ToLower(ext)] = true
+			}
+		}
+		v.scanner = s
+	}
+}
+
+// Quarantine returns where the content scanner puts quarantined content,
+// by the path it was written to, or nil without a scanner
+func (v *VFS) Quarantine() afero.Fs {
+	if v.scanner == nil {
+		return nil
+	}
+	return v.scanner.opts.Quarantine
+}
+
+// applies reports whether a file of size bytes at key is to be scanned
+func (s *contentScanner) applies(key string, size int64) bool {
+	if size < s.opts.MinSize {
+		return false
+	}
+	return s.extensions == nil || s.extensions[strings.ToLower(path.Ext(key))]
+}
+
+// quarantine stores content written to key in the quarantine
+func (s *contentScanner) quarantine(key string, content io.Reader) error {
+	q := s.opts.Quarantine
+	if err := q.MkdirAll(path.Dir(key), 0700); err != nil {
+		return err
+	}
+	f, err := q.OpenFile(key, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// quarantineFile moves the file at key to the quarantine. The file is
+// removed even if storing it fails.
+func (v *VFS) quarantineFile(key string) error {
+	f, err := v.fs.Open(key)
+	if err != nil {
+		return err
+	}
+	err = v.scanner.quarantine(key, f)
+	f.Close()
+	return errors.Join(err, v.Remove(key))
+}
+
+// scanWrite scans data before it is written to p, for synchronous
+// scanners. Quarantined data is stored in the quarantine directory.
+func (v *VFS) scanWrite(op, p string, data []byte) error {
+	s := v.scanner
+	if s == nil || s.opts.Async {
+		return nil
+	}
+	key := v.pathKey(p)
+	if !s.applies(key, int64(len(data))) {
+		return nil
+	}
+
+	verdict, err := s.scan(v.Context(), key, bytes.NewReader(data))
+	if err != nil {
+		return &fs.PathError{Op: op, Path: p, Err: fmt.Errorf("content scan: %w", err)}
+	}
+	switch verdict {
+	case ScanReject:
+		v.logger.Info("Scanner rejected %s", p)
+		return &fs.PathError{Op: op, Path: p, Err: ErrContentRejected}
+	case ScanQuarantine:
+		v.logger.Info("Scanner quarantined %s", p)
+		if err := s.quarantine(key, bytes.NewReader(data)); err != nil {
+			return &fs.PathError{Op: op, Path: p, Err: fmt.Errorf("%w, but storing it failed: %v", ErrQuarantined, err)}
+		}
+		return &fs.PathError{Op: op, Path: p, Err: ErrQuarantined}
+	}
+	return nil
+}
+
+// scanWritten scans the file at key once it has been written, in the
+// background for asynchronous scanners
+func (v *VFS) scanWritten(op, key string, size int64) error {
+	s := v.scanner
+	if !s.applies(key, size) {
+		return nil
+	}
+
+	gen := v.generations.get(key)
+	if !s.opts.Async {
+		return v.rescan(v.Context(), op, key, gen)
+	}
+
+	// The scan outlives the call, so it must not end with the caller's context
+	ctx := context.WithoutCancel(v.Context())
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		if err := v.rescan(ctx, op, key, gen); err != nil {
+			v.logger.Error("Scan of %s: %v", key, err)
+		}
+	}()
+	return nil
+}
+
+// rescan scans the file at key and removes or quarantines it, provided it
+// is still at generation gen: a later write is scanned on its own. Files
+// that could not be scanned are quarantined.
+func (v *VFS) rescan(ctx context.Context, op, key string, gen uint64) error {
+	f, err := v.fs.Open(key)
+	if err != nil {
+		return err
+	}
+	verdict, scanErr := v.scanner.scan(ctx, key, f)
+	f.Close()
+	if (scanErr == nil && verdict == ScanClean) || v.generations.get(key) != gen {
+		return nil
+	}
+
+	if scanErr != nil || verdict == ScanQuarantine {
+		v.logger.Info("Scanner quarantined %s", key)
+		reason := ErrQuarantined
+		if scanErr != nil {
+			reason = fmt.Errorf("%w after a failed content scan: %w", ErrQuarantined, scanErr)
+		}
+		if err := v.quarantineFile(key); err != nil {
+			return &fs.PathError{Op: op, Path: key, Err: fmt.Errorf("%w, but storing it failed: %v", reason, err)}
+		}
+		return &fs.PathError{Op: op, Path: key, Err: reason}
+	}
+	v.logger.Info("Scanner rejected %s", key)
+	if err := v.Remove(key); err != nil {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: key, Err: ErrContentRejected}
+}
+
+// scanOnClose is a file from Create that is scanned once closed
+type scanOnClose struct {
+	afero.File
+	v   *VFS
+	key string
+}
+
+func (f *scanOnClose) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	info, err := f.v.fs.Stat(f.key)
+	if err != nil {
+		return err
+	}
+	return f.v.scanWritten("Create", f.key, info.Size())
+}
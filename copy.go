@@ -0,0 +1,96 @@
+package vfs
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// CopyOption configures the bulk copies made by CloneWith, MergeWith and
+// LoadFromDiskWith
+type CopyOption func(*copyOptions)
+
+type copyOptions struct {
+	emptyDirs bool
+	modes     bool
+}
+
+// CopyEmptyDirs sets whether directories are recreated even if they hold no
+// files. It is on by default, since build layouts often rely on empty
+// directories existing.
+func CopyEmptyDirs(enabled bool) CopyOption {
+	return func(o *copyOptions) {
+		o.emptyDirs = enabled
+	}
+}
+
+// CopyModes sets whether the exact permission bits of files and
+// directories are carried over. It is on by default; when off, directories
+// are created 0755 and files get their mode only as far as the umask
+// allows.
+func CopyModes(enabled bool) CopyOption {
+	return func(o *copyOptions) {
+		o.modes = enabled
+	}
+}
+
+func newCopyOptions(opts []CopyOption) copyOptions {
+	o := copyOptions{emptyDirs: true, modes: true}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// modeList records the modes of copied entries, to apply once the copy is
+// complete: creating an entry touches its parent directory, which may not
+// be writable once its own mode is restored
+type modeList struct {
+	paths []string
+	modes []fs.FileMode
+}
+
+func (l *modeList) add(path string, mode fs.FileMode) {
+	l.paths = append(l.paths, path)
+	l.modes = append(l.modes, mode)
+}
+
+// applyModes sets the recorded modes, deepest entries first so that
+// restricting a directory does not lock out its contents
+func (v *VFS) applyModes(l *modeList) error {
+	for i := len(l.paths) - 1; i >= 0; i-- {
+		if err := v.chmod(l.paths[i], l.modes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chmod sets the mode of path as a write of its own: it is refused by a
+// sealed or frozen VFS, audited and journaled, so that RebuildAt restores
+// the mode
+func (v *VFS) chmod(path string, mode fs.FileMode) (err error) {
+	defer v.mutation("Chmod", path, 0)(&err)
+
+	if err := v.authorize("Chmod", path, true); err != nil {
+		return err
+	}
+
+	if err := v.beginWrite("Chmod", path, false); err != nil {
+		return err
+	}
+	defer v.endWrite()
+	defer v.journalWrite(&err, Change{Op: "Chmod", Path: path})
+
+	return v.fs.Chmod(v.normalizePath(path), mode)
+}
+
+// walkSource walks every entry of a merge source from the root. A *VFS is
+// walked with its hidden files, so that Merge copies what Clone does.
+func walkSource(src FileSystem, fn filepath.WalkFunc) error {
+	if sv, ok := src.(*VFS); ok {
+		return sv.walkAll("/", func(entry WalkEntry, err error) error {
+			return fn(entry.Path, entry.Info, err)
+		})
+	}
+	return src.Walk("/", fn)
+}
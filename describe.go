@@ -0,0 +1,71 @@
+package vfs
+
+import (
+	"sort"
+	"time"
+)
+
+// VFSInfo describes how a VFS is configured. It is meant for tests and
+// admin tools that need to check configuration without parsing Dump output.
+type VFSInfo struct {
+	Type    VFSType
+	Root    string            // Disk directory of a disk VFS, "" if it only has mounts
+	Mounts  map[string]string // Virtual paths of further disk roots, to their directories
+	Bundles []string          // Registered bundle prefixes, including mounted images, sorted
+
+	SharedCacheLimit int64 // Bytes of file copies kept for OpenShared
+	DirCache         bool
+	DirCacheTTL      time.Duration // 0 if cached listings never expire
+	PathIndex        bool
+	PathIndexMaxAge  time.Duration
+	Durability       Durability
+
+	Watching     bool // Watch is available
+	Metadata     bool // Metadata database enabled with WithMetadataDB
+	AuditLog     bool
+	AccessPolicy bool
+	Profiling    bool // Profile labels or slow operation log enabled
+	Promotion    bool // Hybrid VFS promotes bundled files to memory
+	ReadOnly     bool // Archive VFS, which cannot be written
+	Sealed       bool
+	Frozen       []string // Roots of frozen subtrees, sorted
+}
+
+// Describe returns the configuration of the VFS
+func (v *VFS) Describe() VFSInfo {
+	info := VFSInfo{
+		Type:             v.vfsType,
+		Bundles:          v.bundledManager.ListRegistered(),
+		SharedCacheLimit: v.shared.limit,
+		Durability:       v.durability,
+		Watching:         v.watchManager != nil,
+		Metadata:         v.metadata != nil,
+		AuditLog:         v.auditLog != nil,
+		AccessPolicy:     v.accessPolicy != nil,
+		Profiling:        v.profiler != nil,
+		Promotion:        v.promoter != nil && v.vfsType == VFSTypeHybrid,
+		ReadOnly:         v.vfsType == VFSTypeArchive,
+		Sealed:           v.IsSealed(),
+		Frozen:           v.FrozenPaths(),
+	}
+	sort.Strings(info.Bundles)
+
+	if v.vfsType == VFSTypeDisk {
+		info.Root = v.diskPath
+	}
+	if len(v.diskMounts) > 0 {
+		info.Mounts = make(map[string]string, len(v.diskMounts))
+		for _, mount := range v.diskMounts {
+			info.Mounts[mount.point] = mount.disk
+		}
+	}
+	if v.dirCache != nil {
+		info.DirCache = true
+		info.DirCacheTTL = v.dirCache.ttl
+	}
+	if v.pathIndex != nil {
+		info.PathIndex = true
+		info.PathIndexMaxAge = v.pathIndex.maxAge
+	}
+	return info
+}
@@ -0,0 +1,157 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DiffKind describes how a path differs between two filesystems
+type DiffKind int
+
+const (
+	DiffAdded       DiffKind = iota // Present only in the second filesystem
+	DiffRemoved                     // Present only in the first filesystem
+	DiffModified                    // Both are files with different content
+	DiffModeChanged                 // Same content, different permissions
+	DiffTypeChanged                 // File in one filesystem, directory in the other
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "ADDED"
+	case DiffRemoved:
+		return "REMOVED"
+	case DiffModified:
+		return "MODIFIED"
+	case DiffModeChanged:
+		return "MODE"
+	case DiffTypeChanged:
+		return "TYPE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Difference describes a single path that differs between two filesystems.
+// Path is relative to the compared root and always starts with "/".
+type Difference struct {
+	Path  string
+	Kind  DiffKind
+	IsDir bool
+	ModeA fs.FileMode
+	ModeB fs.FileMode
+}
+
+// diffEntry is a snapshot of one path collected while walking a tree
+type diffEntry struct {
+	path  string
+	isDir bool
+	mode  fs.FileMode
+}
+
+// Diff compares the trees rooted at root in a and b and returns the
+// differences sorted by path. A missing root is treated as an empty tree.
+func Diff(a, b FileSystem, root string) ([]Difference, error) {
+	entriesA, err := collectDiffEntries(a, root)
+	if err != nil {
+		return nil, err
+	}
+	entriesB, err := collectDiffEntries(b, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []Difference
+	for rel, ea := range entriesA {
+		eb, ok := entriesB[rel]
+		if !ok {
+			diffs = append(diffs, Difference{Path: rel, Kind: DiffRemoved, IsDir: ea.isDir, ModeA: ea.mode})
+			continue
+		}
+
+		if ea.isDir != eb.isDir {
+			diffs = append(diffs, Difference{Path: rel, Kind: DiffTypeChanged, IsDir: eb.isDir, ModeA: ea.mode, ModeB: eb.mode})
+			continue
+		}
+
+		if !ea.isDir && !sameHash(a, b, ea.path, eb.path) {
+			dataA, err := a.ReadFile(ea.path)
+			if err != nil {
+				return nil, err
+			}
+			dataB, err := b.ReadFile(eb.path)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(dataA, dataB) {
+				diffs = append(diffs, Difference{Path: rel, Kind: DiffModified, ModeA: ea.mode, ModeB: eb.mode})
+				continue
+			}
+		}
+
+		if ea.mode.Perm() != eb.mode.Perm() {
+			diffs = append(diffs, Difference{Path: rel, Kind: DiffModeChanged, IsDir: ea.isDir, ModeA: ea.mode, ModeB: eb.mode})
+		}
+	}
+
+	for rel, eb := range entriesB {
+		if _, ok := entriesA[rel]; !ok {
+			diffs = append(diffs, Difference{Path: rel, Kind: DiffAdded, IsDir: eb.isDir, ModeB: eb.mode})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs, nil
+}
+
+// sameHash reports whether both filesystems keep metadata databases whose
+// recorded hashes show the files are equal, sparing Diff from reading them
+func sameHash(a, b FileSystem, pathA, pathB string) bool {
+	va, okA := a.(*VFS)
+	vb, okB := b.(*VFS)
+	// Hashing one side is wasted if the other has nothing to compare with
+	if !okA || !okB || va.metadata == nil || vb.metadata == nil {
+		return false
+	}
+	hashA, okA := va.cachedHash(pathA)
+	if !okA {
+		return false
+	}
+	hashB, okB := vb.cachedHash(pathB)
+	return okB && hashA == hashB
+}
+
+// collectDiffEntries walks root and indexes every entry by its root-relative path
+func collectDiffEntries(fsys FileSystem, root string) (map[string]diffEntry, error) {
+	entries := make(map[string]diffEntry)
+	if !fsys.Exists(root) {
+		return entries, nil
+	}
+
+	err := fsys.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := strings.TrimPrefix(filepath.ToSlash(path), filepath.ToSlash(root))
+		rel = "/" + strings.TrimPrefix(rel, "/")
+		if rel == "/" {
+			return nil // Skip the root itself
+		}
+
+		entries[rel] = diffEntry{path: path, isDir: info.IsDir(), mode: info.Mode()}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,124 @@
+package vfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// dirCache caches directory listings of a disk VFS. It is shared by all
+// views of a VFS.
+type dirCache struct {
+	ttl     time.Duration
+	entries map[internedPath]dirCacheEntry
+	epoch   uint64 // Incremented by every invalidation
+	mu      sync.Mutex
+}
+
+type dirCacheEntry struct {
+	infos   []fs.FileInfo
+	expires time.Time // Zero if the entry never expires
+}
+
+// WithDirCache caches directory listings (ListFiles, ListDirs) of a disk
+// VFS. Cached listings are dropped when the directory is changed through
+// the VFS or, when file watching is available, when the watcher reports a
+// change on disk; as a fallback they expire after ttl (never if ttl is 0).
+// Memory and hybrid filesystems ignore the option.
+func WithDirCache(ttl time.Duration) Option {
+	return func(v *VFS) {
+		v.dirCache = &dirCache{ttl: ttl, entries: make(map[internedPath]dirCacheEntry)}
+	}
+}
+
+// readDir returns the sorted entries of dir, from the cache if possible
+func (v *VFS) readDir(dir string) ([]fs.FileInfo, error) {
+	vfsDir := v.normalizePath(dir)
+	if v.dirCache == nil || v.vfsType != VFSTypeDisk {
+		return afero.ReadDir(v.fs, vfsDir)
+	}
+
+	key := internPath(v.pathKey(dir))
+	infos, epoch, ok := v.dirCache.get(key)
+	if ok {
+		return infos, nil
+	}
+
+	// Watch before listing, so a change made right after the listing is
+	// reported rather than missed
+	if err := v.watchManager.watchInternal(vfsDir); err != nil && v.dirCache.ttl <= 0 {
+		// Without events or expiry the listing could be stale forever
+		return afero.ReadDir(v.fs, vfsDir)
+	}
+
+	infos, err := afero.ReadDir(v.fs, vfsDir)
+	if err != nil {
+		return nil, err
+	}
+	v.dirCache.put(key, infos, epoch)
+	return infos, nil
+}
+
+// get returns a cached listing. On a miss it returns the current epoch, to
+// be passed to put.
+func (c *dirCache) get(key internedPath) ([]fs.FileInfo, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if ok && !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	return entry.infos, c.epoch, ok
+}
+
+// put caches a listing read after get returned epoch. It is discarded if an
+// invalidation happened in between, since the listing may predate it.
+func (c *dirCache) put(key internedPath, infos []fs.FileInfo, epoch uint64) {
+	entry := dirCacheEntry{infos: infos}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+
+	c.mu.Lock()
+	if c.epoch == epoch {
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+}
+
+// invalidate drops the listings affected by a change to path: those of its
+// ancestors, which may have gained directories created along with it, and
+// for directories its own and those below it
+func (c *dirCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	for dir := path; dir != "/"; {
+		dir = filepath.ToSlash(filepath.Dir(dir))
+		delete(c.entries, internPath(dir))
+	}
+	for key := range c.entries {
+		if within(key.String(), path) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// invalidateEvent is the watch listener that keeps the cache current. A
+// watcher error means events may have been lost, so everything is dropped.
+func (c *dirCache) invalidateEvent(event WatchEvent) {
+	if event.Error != nil {
+		c.mu.Lock()
+		c.epoch++
+		clear(c.entries)
+		c.mu.Unlock()
+		return
+	}
+	c.invalidate(event.Path)
+}
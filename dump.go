@@ -0,0 +1,211 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+)
+
+// DumpSection selects parts of DumpSections' output
+type DumpSection int
+
+const (
+	// DumpFiles is the tree of the VFS itself
+	DumpFiles DumpSection = 1 << iota
+
+	// DumpBundles lists each bundled filesystem
+	DumpBundles
+
+	// DumpAll is every section, the default
+	DumpAll = DumpFiles | DumpBundles
+)
+
+// errNilWriter is returned when Dump is given no writer
+var errNilWriter = errors.New("dump: nil writer")
+
+// Dump writes the tree of the VFS and of each bundled filesystem to writer.
+// It stops at the first failed write and returns its error.
+func (v *VFS) Dump(writer io.Writer) error {
+	return v.DumpSections(writer)
+}
+
+// DumpSections is Dump limited to sections, or every section if none are
+// passed
+func (v *VFS) DumpSections(writer io.Writer, sections ...DumpSection) error {
+	if writer == nil {
+		return errNilWriter
+	}
+
+	show := DumpAll
+	if len(sections) > 0 {
+		show = 0
+		for _, s := range sections {
+			show |= s
+		}
+	}
+
+	w := &dumpWriter{w: writer}
+	if show&DumpFiles != 0 {
+		if !w.printf("--- VFS Root ---\n") {
+			return w.err
+		}
+		if err := v.dumpFiles(w, "/"); err != nil {
+			return err
+		}
+	}
+
+	// --- Dump each bundled filesystem ---
+	registeredPrefixes := v.bundledManager.ListRegistered()
+	sort.Strings(registeredPrefixes)
+	if show&DumpBundles != 0 && len(registeredPrefixes) > 0 {
+		if !w.printf("\n--- Bundled Filesystems ---\n") {
+			return w.err
+		}
+
+		for _, prefix := range registeredPrefixes {
+			if !w.printf("Bundle [%s://]:\n", prefix) {
+				return w.err
+			}
+			if err := v.dumpBundle(w, prefix+"://", "  "); err != nil {
+				return err
+			}
+		}
+	}
+	return w.err
+}
+
+// DumpTree writes the tree below root, a VFS path or bundled URL, to writer
+func (v *VFS) DumpTree(writer io.Writer, root string) error {
+	if writer == nil {
+		return errNilWriter
+	}
+
+	w := &dumpWriter{w: writer}
+	dump := v.dumpFiles
+	if v.bundledManager.IsBundledPath(root) {
+		dump = func(w *dumpWriter, root string) error { return v.dumpBundle(w, root, "") }
+	} else {
+		root = v.normalizePath(root)
+	}
+
+	if !w.printf("--- %s ---\n", root) {
+		return w.err
+	}
+	if err := dump(w, root); err != nil {
+		return err
+	}
+	return w.err
+}
+
+// dumpFiles prints the VFS tree below root
+func (v *VFS) dumpFiles(w *dumpWriter, root string) error {
+	vfsRoot := v.normalizePath(root)
+
+	// Use a map to build a tree to sort it nicely
+	tree := make(map[string][]string)
+	err := v.Walk(vfsRoot, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == vfsRoot { // Skip the root itself
+			return nil
+		}
+
+		parent := filepath.Dir(path)
+		if parent == "." {
+			parent = "/"
+		}
+		tree[parent] = append(tree[parent], path)
+		return nil
+	})
+
+	// A root that does not exist yet, as in an empty VFS, is an empty tree
+	var walkErr *WalkError
+	if err != nil && !(errors.As(err, &walkErr) && errors.Is(err, fs.ErrNotExist)) {
+		return err
+	}
+
+	printTree(w, tree, vfsRoot, "")
+	return nil
+}
+
+// dumpBundle prints the tree of a bundled filesystem below root
+func (v *VFS) dumpBundle(w *dumpWriter, root, indent string) error {
+	bundledFS, bundledPath, ok := v.bundledManager.GetBundledFS(root)
+	if !ok {
+		return nil
+	}
+
+	bundleTree := make(map[string][]string)
+	base, visited := "", false
+	err := bundledFS.WalkEntries(bundledPath, func(entry WalkEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !visited { // Skip the root itself
+			base, visited = entry.FSPath, true
+			return nil
+		}
+
+		parent := filepath.Dir(entry.FSPath)
+		if parent == "." {
+			parent = ""
+		}
+		bundleTree[parent] = append(bundleTree[parent], entry.FSPath)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	printTree(w, bundleTree, base, indent)
+	return nil
+}
+
+// printTree is a helper function to print the file tree structure
+// recursively. It stops once a write fails.
+func printTree(w *dumpWriter, tree map[string][]string, root, indent string) {
+	// Sort entries for a consistent order
+	entries := tree[root]
+	sort.Strings(entries)
+
+	for i, path := range entries {
+		isLast := i == len(entries)-1
+		connector := "├── "
+		if isLast {
+			connector = "└── "
+		}
+
+		baseName := filepath.Base(path)
+		if !w.printf("%s%s%s\n", indent, connector, baseName) {
+			return
+		}
+
+		// If this path is a directory (i.e., it's a key in the tree), recurse
+		if _, ok := tree[path]; ok {
+			newIndent := indent + "│   "
+			if isLast {
+				newIndent = indent + "    "
+			}
+			printTree(w, tree, path, newIndent)
+		}
+	}
+}
+
+// dumpWriter remembers the first failed write, after which it writes
+// nothing more
+type dumpWriter struct {
+	w   io.Writer
+	err error
+}
+
+// printf writes formatted output and reports whether writing succeeded
+func (d *dumpWriter) printf(format string, args ...any) bool {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+	return d.err == nil
+}
@@ -0,0 +1,232 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// Durability controls how hard a disk VFS works to get writes onto stable
+// storage before reporting success
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing to the OS. Call Sync or SyncAll to
+	// persist changes at points of your choosing.
+	DurabilityNone Durability = iota
+
+	// DurabilityFlush fsyncs file contents before WriteFile returns and
+	// when files from Create are closed
+	DurabilityFlush
+
+	// DurabilityFsync also fsyncs the parent directory after files are
+	// created or removed, so the directory entries survive a crash too
+	DurabilityFsync
+)
+
+// String returns the name of the durability level
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityFlush:
+		return "flush"
+	case DurabilityFsync:
+		return "fsync"
+	default:
+		return "unknown"
+	}
+}
+
+// WithDurability sets the durability of disk writes. The default,
+// DurabilityNone, inherits the OS's write-back behavior. Memory and hybrid
+// VFSs have nothing to persist and ignore it.
+func WithDurability(d Durability) Option {
+	return func(v *VFS) {
+		v.durability = d
+	}
+}
+
+// dirtySet records disk paths changed since they were last synced
+type dirtySet struct {
+	mu    sync.Mutex
+	paths map[string]bool // Path key to whether it was removed
+}
+
+func (d *dirtySet) add(key string, removed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.paths == nil {
+		d.paths = make(map[string]bool)
+	}
+	d.paths[key] = removed
+}
+
+// take returns and clears the dirty paths
+func (d *dirtySet) take() map[string]bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	paths := d.paths
+	d.paths = nil
+	return paths
+}
+
+func (d *dirtySet) forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.paths, key)
+}
+
+// Sync flushes path to stable storage: the file's contents, or the entries
+// of a directory. It is a no-op for memory, hybrid and bundled paths.
+func (v *VFS) Sync(path string) error {
+	if err := v.authorize("Sync", path, false); err != nil {
+		return err
+	}
+	if v.vfsType != VFSTypeDisk || v.bundledManager.IsBundledPath(path) {
+		return nil
+	}
+
+	key := v.pathKey(path)
+	if err := v.syncPath(key); err != nil {
+		return err
+	}
+	v.dirty.forget(key)
+	return nil
+}
+
+// SyncAll flushes every disk change made through the VFS since it was last
+// synced: written files and the directories whose entries changed. Paths
+// that fail to sync stay pending for the next call.
+func (v *VFS) SyncAll() error {
+	if v.vfsType != VFSTypeDisk {
+		return nil
+	}
+
+	pending := v.dirty.take()
+	files := make([]string, 0, len(pending))
+	dirs := make(map[string]bool)
+	for key, removed := range pending {
+		if !removed {
+			files = append(files, key)
+		}
+		dirs[path.Dir(key)] = true
+	}
+	sort.Strings(files)
+
+	var firstErr error
+	fail := func(key string, removed bool, err error) {
+		v.dirty.add(key, removed)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, key := range files {
+		if err := v.syncPath(key); err != nil && !os.IsNotExist(err) {
+			fail(key, false, err)
+		}
+	}
+	for dir := range dirs {
+		if err := v.syncDir(dir); err != nil && !os.IsNotExist(err) {
+			fail(dir, false, err)
+		}
+	}
+	return firstErr
+}
+
+// persist applies the durability policy after a successful mutation of
+// key, or records it for SyncAll
+func (v *VFS) persist(op, key string) error {
+	if v.vfsType != VFSTypeDisk {
+		return nil
+	}
+	if v.durability < DurabilityFsync {
+		v.dirty.add(key, isRemoval(op))
+		return nil
+	}
+
+	if op == "MkdirAll" {
+		// Directories may have been created at any level of the path
+		for dir := key; ; dir = path.Dir(dir) {
+			if err := v.syncDir(dir); err != nil {
+				return err
+			}
+			if dir == "/" {
+				return nil
+			}
+		}
+	}
+	return v.syncDir(path.Dir(key))
+}
+
+// syncPath fsyncs a file or directory
+func (v *VFS) syncPath(key string) error {
+	info, err := v.fs.Stat(key)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return v.syncDir(key)
+	}
+
+	// Windows only flushes files opened for writing
+	f, err := v.fs.OpenFile(key, os.O_RDWR, 0)
+	if err != nil {
+		if f, err = v.fs.Open(key); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// syncDir fsyncs a directory so changes to its entries are durable. On
+// Windows directory entries are journaled by the filesystem and directories
+// cannot be synced.
+func (v *VFS) syncDir(key string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := v.fs.Open(key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// writeDurably writes a file like afero.WriteFile, fsyncing its contents
+// before closing it
+func (v *VFS) writeDurably(name string, data []byte, perm os.FileMode) error {
+	f, err := v.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncOnClose is a file from Create that fsyncs its contents when closed
+type syncOnClose struct {
+	afero.File
+}
+
+func (f *syncOnClose) Close() error {
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
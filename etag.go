@@ -0,0 +1,165 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"unique"
+)
+
+// generationTable assigns every path a generation number that changes on
+// each successful write through the VFS. It is shared by all views of a VFS.
+// Paths are kept in a tree of their components, so removing or moving a
+// directory only touches the entries below it.
+type generationTable struct {
+	next uint64
+	root *genNode
+	mu   sync.Mutex
+}
+
+// genNode is one path component. Its generation is 0 if the path itself
+// was never written, only paths below it.
+type genNode struct {
+	gen      uint64
+	children map[unique.Handle[string]]*genNode
+}
+
+func newGenerationTable() *generationTable {
+	return &generationTable{root: &genNode{}}
+}
+
+// genComponents splits a path key into its components
+func genComponents(path string) []string {
+	if path == "/" {
+		return []string{""}
+	}
+	return strings.Split(path, "/")
+}
+
+// lookup returns the node of path, creating it and its parents if create
+// is set. Otherwise it returns nil for paths not in the table.
+func (g *generationTable) lookup(path string, create bool) *genNode {
+	node := g.root
+	for _, name := range genComponents(path) {
+		child := node.children[unique.Make(name)]
+		if child == nil {
+			if !create {
+				return nil
+			}
+			child = &genNode{}
+			if node.children == nil {
+				node.children = make(map[unique.Handle[string]]*genNode)
+			}
+			node.children[unique.Make(name)] = child
+		}
+		node = child
+	}
+	return node
+}
+
+// detach removes the node of path, with everything below it, and returns
+// it. Parents left without entries are removed too.
+func (g *generationTable) detach(path string) *genNode {
+	names := genComponents(path)
+	parents := make([]*genNode, 0, len(names))
+	node := g.root
+	for _, name := range names {
+		parents = append(parents, node)
+		if node = node.children[unique.Make(name)]; node == nil {
+			return nil
+		}
+	}
+
+	detached := node
+	for i := len(names) - 1; i >= 0; i-- {
+		parent := parents[i]
+		delete(parent.children, unique.Make(names[i]))
+		if parent == g.root || parent.gen != 0 || len(parent.children) > 0 {
+			break
+		}
+	}
+	return detached
+}
+
+// bump records a write to path. Removing a path forgets it and everything
+// below it; if the path is recreated it gets a fresh generation.
+func (g *generationTable) bump(path string, removed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if removed {
+		g.detach(path)
+		return
+	}
+
+	g.next++
+	g.lookup(path, true).gen = g.next
+}
+
+func (g *generationTable) get(path string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if node := g.lookup(path, false); node != nil {
+		return node.gen
+	}
+	return 0
+}
+
+// each calls fn for every path with a generation
+func (g *generationTable) each(fn func(names []unique.Handle[string], gen uint64)) {
+	var walk func(node *genNode, names []unique.Handle[string])
+	walk = func(node *genNode, names []unique.Handle[string]) {
+		if node.gen != 0 {
+			fn(names, node.gen)
+		}
+		for name, child := range node.children {
+			walk(child, append(names, name))
+		}
+	}
+	walk(g.root, nil)
+}
+
+// Generation returns the generation of path: a number that increases with
+// every WriteFile, Create or MkdirAll of path through this VFS or its views.
+// It is 0 for paths that have not been written since the VFS was created,
+// such as files loaded by a disk VFS or bundled resources.
+func (v *VFS) Generation(path string) uint64 {
+	return v.generations.get(v.pathKey(path))
+}
+
+// ETag returns a strong HTTP entity tag for the file at path, quoted as
+// required in ETag headers. It changes whenever the file is written through
+// the VFS, and also when its size or modification time changes behind the
+// VFS's back (files on disk). Bundled files are tagged by a hash of their
+// content, since embedded files carry no modification time.
+//
+// Generations are counted per process, so tags of other files are only
+// meaningful until the process exits. They include the file's size and
+// modification time, which makes a stale tag matching new content after a
+// restart unlikely but not impossible; caches in front of long-lived
+// deployments should not outlive a restart.
+func (v *VFS) ETag(path string) (string, error) {
+	if v.bundledManager.IsBundledPath(path) {
+		data, err := v.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		return `"` + hex.EncodeToString(sum[:12]) + `"`, nil
+	}
+
+	info, err := v.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`"%x-%x-%x"`, v.Generation(path), info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// isRemoval reports whether a mutating operation deletes its path
+func isRemoval(op string) bool {
+	return op == "Remove" || op == "RemoveAll"
+}
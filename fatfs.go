@@ -0,0 +1,385 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FAT support
+//
+// A FAT volume starts with a boot sector whose BIOS parameter block gives
+// the layout: reserved sectors, the file allocation tables, a fixed root
+// directory on FAT12 and FAT16, then the data area in clusters. Files and
+// directories are cluster chains linked through the first allocation
+// table. Long names are stored in VFAT entries preceding each 8.3 entry.
+// Whole disk images with an MBR partition table are opened at their first
+// FAT partition.
+
+// fatPartitionTypes are the MBR partition types of FAT volumes
+var fatPartitionTypes = map[byte]bool{0x01: true, 0x04: true, 0x06: true, 0x0b: true, 0x0c: true, 0x0e: true, 0xef: true}
+
+func matchFAT(header []byte) bool {
+	if len(header) < 512 || header[510] != 0x55 || header[511] != 0xaa {
+		return false
+	}
+	if isFATBootSector(header) {
+		return true
+	}
+	_, ok := fatPartition(header)
+	return ok
+}
+
+// isFATBootSector checks the BIOS parameter block for sane values
+func isFATBootSector(b []byte) bool {
+	bps := binary.LittleEndian.Uint16(b[11:13])
+	spc := b[13]
+	return (b[0] == 0xeb || b[0] == 0xe9) &&
+		bps >= 512 && bps <= 4096 && bps&(bps-1) == 0 &&
+		spc != 0 && spc&(spc-1) == 0 &&
+		binary.LittleEndian.Uint16(b[14:16]) != 0 && b[16] != 0
+}
+
+// fatPartition returns the byte offset of the first FAT partition in an
+// MBR partition table
+func fatPartition(mbr []byte) (int64, bool) {
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+16*i : 446+16*(i+1)]
+		if fatPartitionTypes[entry[4]] {
+			return int64(binary.LittleEndian.Uint32(entry[8:12])) * 512, true
+		}
+	}
+	return 0, false
+}
+
+// openFAT indexes a FAT12, FAT16 or FAT32 volume. File contents are read
+// in place, following their cluster chains.
+func openFAT(r io.ReaderAt, size int64) (fs.FS, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	if !isFATBootSector(boot) {
+		off, ok := fatPartition(boot)
+		if !ok || off >= size {
+			return nil, errors.New("no FAT partition found")
+		}
+		r, size = io.NewSectionReader(r, off, size-off), size-off
+		if _, err := r.ReadAt(boot, 0); err != nil {
+			return nil, err
+		}
+		if !isFATBootSector(boot) {
+			return nil, errors.New("invalid FAT boot sector in partition")
+		}
+	}
+
+	vol := &fatVolume{r: r, afs: newArchiveFS()}
+	if err := vol.parseBootSector(boot, size); err != nil {
+		return nil, err
+	}
+
+	table := make([]byte, vol.fatSize)
+	if _, err := r.ReadAt(table, vol.fatOffset); err != nil {
+		return nil, fmt.Errorf("failed to read allocation table: %w", err)
+	}
+	vol.table = table
+
+	root := vol.rootDir
+	if vol.bits == 32 {
+		chain, err := vol.chain(vol.rootCluster)
+		if err != nil {
+			return nil, err
+		}
+		root = vol.chainReader(chain, int64(len(chain))*vol.clusterSize)
+	}
+	if err := vol.readDir(root, "", 0); err != nil {
+		return nil, err
+	}
+	return vol.afs.finish(), nil
+}
+
+// fatVolume is the layout of a FAT volume being indexed
+type fatVolume struct {
+	r           io.ReaderAt
+	afs         *archiveFS
+	bits        int // 12, 16 or 32
+	table       []byte
+	fatOffset   int64
+	fatSize     int64
+	dataOffset  int64
+	clusterSize int64
+	clusters    uint32
+	rootCluster uint32            // FAT32 only
+	rootDir     *io.SectionReader // FAT12 and FAT16 only
+}
+
+func (vol *fatVolume) parseBootSector(b []byte, size int64) error {
+	bps := int64(binary.LittleEndian.Uint16(b[11:13]))
+	spc := int64(b[13])
+	reserved := int64(binary.LittleEndian.Uint16(b[14:16]))
+	rootEntries := int64(binary.LittleEndian.Uint16(b[17:19]))
+
+	total := int64(binary.LittleEndian.Uint16(b[19:21]))
+	if total == 0 {
+		total = int64(binary.LittleEndian.Uint32(b[32:36]))
+	}
+	fatSectors := int64(binary.LittleEndian.Uint16(b[22:24]))
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(b[36:40]))
+	}
+
+	rootSectors := (rootEntries*32 + bps - 1) / bps
+	firstData := reserved + int64(b[16])*fatSectors + rootSectors
+	if fatSectors == 0 || total <= firstData || total*bps > size {
+		return errors.New("invalid FAT volume layout")
+	}
+
+	vol.fatOffset = reserved * bps
+	vol.fatSize = fatSectors * bps
+	vol.dataOffset = firstData * bps
+	vol.clusterSize = spc * bps
+	vol.clusters = uint32((total - firstData) / spc)
+
+	switch {
+	case vol.clusters < 4085:
+		vol.bits = 12
+	case vol.clusters < 65525:
+		vol.bits = 16
+	default:
+		vol.bits = 32
+		vol.rootCluster = binary.LittleEndian.Uint32(b[44:48])
+	}
+	if vol.bits != 32 {
+		vol.rootDir = io.NewSectionReader(vol.r, vol.dataOffset-rootSectors*bps, rootEntries*32)
+	}
+	return nil
+}
+
+// next returns the cluster following c in its chain, or 0 at the end
+func (vol *fatVolume) next(c uint32) uint32 {
+	var n uint32
+	switch vol.bits {
+	case 12:
+		off := int(c + c/2)
+		if off+2 > len(vol.table) {
+			return 0
+		}
+		n = uint32(binary.LittleEndian.Uint16(vol.table[off:]))
+		if c%2 == 1 {
+			n >>= 4
+		}
+		n &= 0xfff
+	case 16:
+		if int(2*c)+2 > len(vol.table) {
+			return 0
+		}
+		n = uint32(binary.LittleEndian.Uint16(vol.table[2*c:]))
+	default:
+		if int(4*c)+4 > len(vol.table) {
+			return 0
+		}
+		n = binary.LittleEndian.Uint32(vol.table[4*c:]) & 0x0fffffff
+	}
+	if n < 2 || n >= vol.clusters+2 {
+		return 0 // End of chain, bad or free cluster
+	}
+	return n
+}
+
+// chain returns the clusters of the chain starting at start
+func (vol *fatVolume) chain(start uint32) ([]uint32, error) {
+	var clusters []uint32
+	for c := start; c != 0; c = vol.next(c) {
+		if c < 2 || c >= vol.clusters+2 {
+			return nil, fmt.Errorf("invalid cluster %d", c)
+		}
+		if len(clusters) >= int(vol.clusters) {
+			return nil, errors.New("cluster chain loops")
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// chainReader returns a reader over the first size bytes of a chain
+func (vol *fatVolume) chainReader(chain []uint32, size int64) *io.SectionReader {
+	return io.NewSectionReader(&fatChain{vol: vol, clusters: chain}, 0, size)
+}
+
+// fatChain reads a cluster chain as one contiguous byte range
+type fatChain struct {
+	vol      *fatVolume
+	clusters []uint32
+}
+
+func (c *fatChain) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		i := off / c.vol.clusterSize
+		if i >= int64(len(c.clusters)) {
+			return n, io.EOF
+		}
+		within := off % c.vol.clusterSize
+		chunk := min(int64(len(p)), c.vol.clusterSize-within)
+		pos := c.vol.dataOffset + int64(c.clusters[i]-2)*c.vol.clusterSize + within
+
+		m, err := c.vol.r.ReadAt(p[:chunk], pos)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p, off = p[chunk:], off+chunk
+	}
+	return n, nil
+}
+
+// readDir adds the entries of the directory in dir below name
+func (vol *fatVolume) readDir(dir *io.SectionReader, name string, depth int) error {
+	if depth > 64 {
+		return errors.New("directories nested too deeply")
+	}
+
+	data := make([]byte, dir.Size())
+	if _, err := dir.ReadAt(data, 0); err != nil && err != io.EOF {
+		return err
+	}
+
+	var long []uint16 // Long name parts collected so far
+	var longSum byte
+	for off := 0; off+32 <= len(data); off += 32 {
+		e := data[off : off+32]
+		if e[0] == 0 {
+			break // End of directory
+		}
+		if e[0] == 0xe5 {
+			long = nil
+			continue // Deleted
+		}
+
+		attr := e[11]
+		if attr&0x3f == 0x0f {
+			long, longSum = fatLongName(e, long, longSum)
+			continue
+		}
+		if attr&0x08 != 0 {
+			long = nil
+			continue // Volume label
+		}
+
+		short := e[:11]
+		entryName := fatShortName(short, e[12])
+		if long != nil && longSum == fatChecksum(short) {
+			entryName = string(utf16.Decode(long))
+		}
+		long = nil
+		if entryName == "." || entryName == ".." || strings.Contains(entryName, "/") {
+			continue
+		}
+
+		p := path.Join(name, entryName)
+		modTime := fatTime(binary.LittleEndian.Uint16(e[24:26]), binary.LittleEndian.Uint16(e[22:24]))
+		cluster := uint32(binary.LittleEndian.Uint16(e[26:28]))
+		if vol.bits == 32 {
+			cluster |= uint32(binary.LittleEndian.Uint16(e[20:22])) << 16
+		}
+
+		var chain []uint32
+		if cluster != 0 {
+			var err error
+			if chain, err = vol.chain(cluster); err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+		}
+
+		mode := fs.FileMode(0644)
+		if attr&0x01 != 0 {
+			mode = 0444 // Read-only
+		}
+
+		if attr&0x10 != 0 {
+			vol.afs.add(p, fs.ModeDir|0755, modTime, 0, nil)
+			sub := vol.chainReader(chain, int64(len(chain))*vol.clusterSize)
+			if err := vol.readDir(sub, p, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		size := int64(binary.LittleEndian.Uint32(e[28:32]))
+		if size > int64(len(chain))*vol.clusterSize {
+			return fmt.Errorf("%s: size exceeds its clusters", p)
+		}
+		content := vol.chainReader(chain, size)
+		vol.afs.add(p, mode, modTime, size, func() (io.ReaderAt, error) {
+			return content, nil
+		})
+	}
+	return nil
+}
+
+// fatLongName adds the characters of a VFAT long name entry to long.
+// Entries are stored last part first, so each is prepended.
+func fatLongName(e []byte, long []uint16, sum byte) ([]uint16, byte) {
+	if e[0]&0x40 != 0 {
+		long, sum = nil, e[13] // The last part starts a new name
+	} else if e[13] != sum {
+		return nil, 0
+	}
+
+	var part []uint16
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for i := r[0]; i < r[1]; i += 2 {
+			u := binary.LittleEndian.Uint16(e[i:])
+			if u == 0 || u == 0xffff {
+				return append(part, long...), sum
+			}
+			part = append(part, u)
+		}
+	}
+	return append(part, long...), sum
+}
+
+// fatChecksum is the checksum of a short name that long name entries carry
+func fatChecksum(short []byte) byte {
+	var sum byte
+	for _, b := range short {
+		sum = (sum>>1 | sum<<7) + b
+	}
+	return sum
+}
+
+// fatShortName formats an 8.3 name, applying the lower case flags set by
+// Windows NT
+func fatShortName(short []byte, flags byte) string {
+	base := strings.TrimRight(string(short[:8]), " ")
+	ext := strings.TrimRight(string(short[8:11]), " ")
+	if base != "" && base[0] == 0x05 {
+		base = "σ" + base[1:] // 0xe5 in code page 437
+	}
+	if flags&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if flags&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// fatTime decodes a FAT date and time. FAT stores local time without a
+// zone, so it is reported as UTC.
+func fatTime(date, t uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0x0f), int(date&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f)*2, 0, time.UTC)
+}
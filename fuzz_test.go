@@ -0,0 +1,151 @@
+package vfs_test
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/yasufadhili/vfs"
+	"github.com/yasufadhili/vfs/vfstest"
+)
+
+//go:embed testdata/*
+var fuzzdataFS embed.FS
+
+// FuzzNormalizePath checks that any path accepted by WriteFile can be read
+// back and never escapes the VFS root
+func FuzzNormalizePath(f *testing.F) {
+	vfstest.FuzzPaths(f)
+
+	f.Fuzz(func(t *testing.T, p string) {
+		v := vfs.NewMemoryVFS()
+		if err := v.WriteFile(p, []byte("data"), 0644); err != nil {
+			return
+		}
+
+		if v.IsDir(p) {
+			return // Writing "/" or "." resolves to the root directory
+		}
+
+		if !v.Exists(p) {
+			t.Fatalf("WriteFile(%q) succeeded but Exists is false", p)
+		}
+
+		data, err := v.ReadFile(p)
+		if err != nil || string(data) != "data" {
+			t.Fatalf("ReadFile(%q) = %q, %v after successful write", p, data, err)
+		}
+
+		v.Walk("/", func(path string, info fs.FileInfo, err error) error {
+			if err == nil && !strings.HasPrefix(filepath.ToSlash(path), "/") {
+				t.Fatalf("Walk yielded a path outside the root: %q", path)
+			}
+			return nil
+		})
+	})
+}
+
+// FuzzBundledPrefix checks that bundled prefix matching always picks the
+// longest registered prefix the path starts with
+func FuzzBundledPrefix(f *testing.F) {
+	vfstest.FuzzPaths(f)
+
+	f.Fuzz(func(t *testing.T, p string) {
+		bm := vfs.NewBundledManager()
+		prefixes := []string{"std", "std://lib", "stdlib", "s"}
+		for _, prefix := range prefixes {
+			bm.Register(prefix, fuzzdataFS, "testdata")
+		}
+
+		_, rest, ok := bm.GetBundledFS(p)
+		if ok != bm.IsBundledPath(p) {
+			t.Fatalf("GetBundledFS and IsBundledPath disagree for %q", p)
+		}
+
+		longest := ""
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(p, prefix+"://") && len(prefix) > len(longest) {
+				longest = prefix
+			}
+		}
+
+		if (longest != "") != ok {
+			t.Fatalf("GetBundledFS(%q) matched = %v, want %v", p, ok, longest != "")
+		}
+		if ok && rest != strings.TrimPrefix(p, longest+"://") {
+			t.Fatalf("GetBundledFS(%q) rest = %q, want prefix %q stripped", p, rest, longest)
+		}
+	})
+}
+
+// FuzzFindFiles checks FindFiles against a direct match of every file
+func FuzzFindFiles(f *testing.F) {
+	for _, seed := range []string{"*", "*.go", "file?.txt", "[a-z]*", "[", "\\", "*/*"} {
+		f.Add(seed)
+	}
+
+	files := []string{"/a.go", "/file1.txt", "/dir/b.go", "/dir/nested/Zed.md", "/x[1].txt"}
+	v := vfs.NewMemoryVFS()
+	for _, file := range files {
+		v.WriteFile(file, []byte("content"), 0644)
+	}
+
+	f.Fuzz(func(t *testing.T, pattern string) {
+		matches, err := v.FindFiles("/", pattern)
+		if _, matchErr := filepath.Match(pattern, "probe"); matchErr != nil && err == nil {
+			t.Fatalf("FindFiles(%q) accepted a malformed pattern", pattern)
+		}
+		if err != nil {
+			if err != filepath.ErrBadPattern {
+				t.Fatalf("FindFiles(%q) failed: %v", pattern, err)
+			}
+			return
+		}
+
+		var expected []string
+		for _, file := range files {
+			if ok, _ := filepath.Match(pattern, filepath.Base(file)); ok {
+				expected = append(expected, file)
+			}
+		}
+		sort.Strings(matches)
+		sort.Strings(expected)
+		if strings.Join(matches, ",") != strings.Join(expected, ",") {
+			t.Fatalf("FindFiles(%q) = %v, want %v", pattern, matches, expected)
+		}
+	})
+}
+
+// FuzzImportTxtar checks that arbitrary archives never escape the import
+// destination
+func FuzzImportTxtar(f *testing.F) {
+	f.Add([]byte("-- a.txt --\nhello\n"))
+	f.Add([]byte("comment\n-- ../../escape --\nx\n-- dir/ --\n"))
+	f.Add([]byte("-- / --\n-- . --\n-- -- --\n"))
+	for _, p := range vfstest.PathSeeds() {
+		f.Add([]byte("-- " + p + " --\ncontent\n"))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v := vfs.NewMemoryVFS()
+		v.MkdirAll("/dest", 0755)
+		if err := v.ImportTxtar(bytes.NewReader(data), "/dest"); err != nil {
+			return
+		}
+
+		v.Walk("/", func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			path = filepath.ToSlash(path)
+			if path != "/" && path != "/dest" && !strings.HasPrefix(path, "/dest/") {
+				t.Fatalf("ImportTxtar wrote outside the destination: %q", path)
+			}
+			return nil
+		})
+	})
+}
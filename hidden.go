@@ -0,0 +1,88 @@
+package vfs
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultJunkFiles are the patterns of OS metadata files that walks,
+// LoadFromDisk, SaveToDisk and the exports skip by default. Patterns are
+// matched against base names with filepath.Match.
+var DefaultJunkFiles = []string{
+	".DS_Store", "._*", ".Spotlight-V100", ".Trashes", ".fseventsd", // macOS
+	"Thumbs.db", "ehthumbs.db", "desktop.ini", "$RECYCLE.BIN", // Windows
+}
+
+// hiddenPolicy decides which hidden and system files walks see. It is
+// fixed once the VFS is created.
+type hiddenPolicy struct {
+	hideDotfiles bool
+	junk         []string
+}
+
+func defaultHiddenPolicy() *hiddenPolicy {
+	return &hiddenPolicy{junk: DefaultJunkFiles}
+}
+
+// WithDotfiles sets whether names starting with "." are included in walks,
+// loads, saves and exports. They are by default.
+func WithDotfiles(include bool) Option {
+	return func(v *VFS) {
+		v.hidden.hideDotfiles = !include
+	}
+}
+
+// WithJunkFiles replaces DefaultJunkFiles as the patterns of files to
+// leave out of walks, loads, saves and exports. With no patterns nothing is
+// left out.
+func WithJunkFiles(patterns ...string) Option {
+	return func(v *VFS) {
+		v.hidden.junk = patterns
+	}
+}
+
+// isHidden reports whether the policy leaves out entries named name
+func (p *hiddenPolicy) isHidden(name string) bool {
+	if p.hideDotfiles && strings.HasPrefix(name, ".") && name != "." && name != ".." {
+		return true
+	}
+	for _, pattern := range p.junk {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hidesBelow reports whether the policy leaves out p, or any directory
+// leading to it from root
+func (p *hiddenPolicy) hidesBelow(root, name string) bool {
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+	for _, part := range strings.Split(rel, "/") {
+		if part != "" && p.isHidden(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipHidden wraps fn so that hidden entries below the walk's root, and
+// everything inside hidden directories, are never passed to it
+func (p *hiddenPolicy) skipHidden(fn WalkEntryFunc) WalkEntryFunc {
+	visited := false
+	return func(entry WalkEntry, err error) error {
+		if !visited { // The root is walked even if hidden
+			visited = true
+			return fn(entry, err)
+		}
+		if p.isHidden(path.Base(filepath.ToSlash(entry.FSPath))) {
+			if entry.Info != nil && entry.Info.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		return fn(entry, err)
+	}
+}
@@ -0,0 +1,98 @@
+package vfs
+
+import (
+	"strings"
+	"unique"
+)
+
+// internedPath is a path stored as an interned directory and an interned
+// base name, for use as a key in internal tables. All entries of a
+// directory share one copy of the directory string and repeated names
+// (index.js, go.mod) share one copy of the name, so deep trees no longer
+// store their common prefixes once per path.
+type internedPath struct {
+	dir  unique.Handle[string] // Everything up to and including the last "/"
+	name unique.Handle[string]
+}
+
+// internPath interns p. String returns p unchanged.
+func internPath(p string) internedPath {
+	i := strings.LastIndexByte(p, '/') + 1
+	return internedPath{dir: unique.Make(p[:i]), name: unique.Make(p[i:])}
+}
+
+func (p internedPath) String() string {
+	return p.dir.Value() + p.name.Value()
+}
+
+// MemStats reports the memory used by paths in the VFS's interned tables:
+// the path index, generation numbers, the OpenShared cache and watches
+type MemStats struct {
+	Paths         int   // Paths held across the tables
+	PathBytes     int64 // Bytes the paths would take as separate strings
+	InternedBytes int64 // Bytes of the distinct directories and names actually stored
+}
+
+// Saved returns the bytes saved by interning
+func (s MemStats) Saved() int64 {
+	return s.PathBytes - s.InternedBytes
+}
+
+// MemStats returns path storage statistics. It walks every table, so it is
+// meant for diagnostics rather than frequent polling.
+func (v *VFS) MemStats() MemStats {
+	c := memStatsCounter{seen: make(map[unique.Handle[string]]bool)}
+
+	if idx := v.pathIndex; idx != nil {
+		idx.mu.RLock()
+		for p := range idx.paths {
+			c.add(p)
+		}
+		idx.mu.RUnlock()
+	}
+
+	v.generations.mu.Lock()
+	v.generations.each(func(names []unique.Handle[string], _ uint64) {
+		c.addNames(names)
+		c.stats.PathBytes += int64(len(names) - 1) // Separators
+	})
+	v.generations.mu.Unlock()
+
+	v.shared.mu.Lock()
+	for p := range v.shared.entries {
+		c.add(p)
+	}
+	v.shared.mu.Unlock()
+
+	if wm := v.watchManager; wm != nil {
+		wm.mu.RLock()
+		for p := range wm.watches {
+			c.add(p)
+		}
+		wm.mu.RUnlock()
+	}
+
+	return c.stats
+}
+
+// memStatsCounter accumulates MemStats, counting each interned string once
+type memStatsCounter struct {
+	stats MemStats
+	seen  map[unique.Handle[string]]bool
+}
+
+func (c *memStatsCounter) add(p internedPath) {
+	c.addNames([]unique.Handle[string]{p.dir, p.name})
+}
+
+// addNames counts a path stored as the interned strings names
+func (c *memStatsCounter) addNames(names []unique.Handle[string]) {
+	c.stats.Paths++
+	for _, h := range names {
+		c.stats.PathBytes += int64(len(h.Value()))
+		if !c.seen[h] {
+			c.seen[h] = true
+			c.stats.InternedBytes += int64(len(h.Value()))
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ISO9660 support
+//
+// An ISO9660 image is a sequence of 2048 byte sectors. Volume descriptors
+// start at sector 16; the primary descriptor holds the root directory
+// record, and an optional Joliet supplementary descriptor holds a second
+// directory tree with long UCS-2 names. Rock Ridge extensions, when
+// present, carry POSIX names and modes in each record's system use area.
+// Names are taken from Rock Ridge first, then Joliet, then the plain
+// 8.3 names with their ";1" version suffix removed.
+
+const isoSectorSize = 2048
+
+func matchISO9660(header []byte) bool {
+	const offset = 16*isoSectorSize + 1
+	return len(header) >= offset+5 && bytes.Equal(header[offset:offset+5], []byte("CD001"))
+}
+
+// openISO9660 indexes the directory tree of an ISO9660 image. File
+// contents are read in place.
+func openISO9660(r io.ReaderAt, size int64) (fs.FS, error) {
+	var primary, joliet []byte
+	for sector := int64(16); ; sector++ {
+		desc := make([]byte, isoSectorSize)
+		if _, err := r.ReadAt(desc, sector*isoSectorSize); err != nil {
+			return nil, errors.New("truncated volume descriptors")
+		}
+		if !bytes.Equal(desc[1:6], []byte("CD001")) {
+			return nil, errors.New("invalid volume descriptor")
+		}
+
+		switch desc[0] {
+		case 1:
+			primary = desc
+		case 2:
+			if esc := desc[88:91]; esc[0] == '%' && esc[1] == '/' && bytes.IndexByte([]byte("@CE"), esc[2]) >= 0 {
+				joliet = desc
+			}
+		}
+		if desc[0] == 255 {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, errors.New("no primary volume descriptor")
+	}
+
+	img := &isoImage{r: r, size: size, afs: newArchiveFS(), visited: make(map[uint32]bool)}
+
+	// Rock Ridge names are only in the primary tree, so prefer it when the
+	// root's "." record announces SUSP
+	desc := primary
+	if joliet != nil && !img.hasRockRidge(primary[156:190]) {
+		desc, img.joliet = joliet, true
+	}
+	if err := img.readDir(desc[156:190], ""); err != nil {
+		return nil, err
+	}
+	return img.afs.finish(), nil
+}
+
+// isoImage is the state of an ISO9660 image being indexed
+type isoImage struct {
+	r       io.ReaderAt
+	size    int64
+	afs     *archiveFS
+	joliet  bool
+	visited map[uint32]bool // Directory extents, to stop cycles
+}
+
+// isoRecord is a parsed directory record
+type isoRecord struct {
+	extent  uint32
+	size    uint32
+	flags   byte
+	name    []byte
+	modTime time.Time
+	system  []byte // System use area, holding Rock Ridge entries
+}
+
+func parseISORecord(rec []byte) (isoRecord, bool) {
+	if len(rec) < 34 || int(rec[0]) > len(rec) || int(33+rec[32]) > int(rec[0]) {
+		return isoRecord{}, false
+	}
+	nameLen := int(rec[32])
+	r := isoRecord{
+		extent:  binary.LittleEndian.Uint32(rec[2:6]),
+		size:    binary.LittleEndian.Uint32(rec[10:14]),
+		flags:   rec[25],
+		name:    rec[33 : 33+nameLen],
+		modTime: isoTime(rec[18:25]),
+	}
+	sys := 33 + nameLen
+	if nameLen%2 == 0 {
+		sys++ // Padding byte after even-length names
+	}
+	if sys < int(rec[0]) {
+		r.system = rec[sys:rec[0]]
+	}
+	return r, true
+}
+
+// isoTime decodes a 7 byte directory record timestamp
+func isoTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// hasRockRidge reports whether the root directory's "." record carries
+// SUSP entries
+func (img *isoImage) hasRockRidge(rootRec []byte) bool {
+	root, ok := parseISORecord(rootRec)
+	if !ok {
+		return false
+	}
+	data, err := img.extent(root)
+	if err != nil {
+		return false
+	}
+	dot, ok := parseISORecord(data)
+	return ok && bytes.HasPrefix(dot.system, []byte("SP"))
+}
+
+// extent reads the data of a directory record
+func (img *isoImage) extent(rec isoRecord) ([]byte, error) {
+	off := int64(rec.extent) * isoSectorSize
+	if off+int64(rec.size) > img.size {
+		return nil, errors.New("directory extends past end of image")
+	}
+	data := make([]byte, rec.size)
+	if _, err := img.r.ReadAt(data, off); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readDir adds the entries of the directory described by dirRec below dir
+func (img *isoImage) readDir(dirRec []byte, dir string) error {
+	rec, ok := parseISORecord(dirRec)
+	if !ok {
+		return errors.New("invalid root directory record")
+	}
+	return img.walk(rec, dir)
+}
+
+func (img *isoImage) walk(dirRec isoRecord, dir string) error {
+	if img.visited[dirRec.extent] {
+		return nil
+	}
+	img.visited[dirRec.extent] = true
+
+	data, err := img.extent(dirRec)
+	if err != nil {
+		return err
+	}
+
+	var pending *isoRecord // A multi-extent file awaiting its last part
+	for off := 0; off < len(data); {
+		if data[off] == 0 {
+			// Records don't cross sectors; the rest of this one is padding
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		rec, ok := parseISORecord(data[off:])
+		if !ok {
+			return errors.New("invalid directory record")
+		}
+		off += int(data[off])
+
+		if len(rec.name) == 1 && rec.name[0] <= 1 {
+			continue // "." and ".."
+		}
+
+		name, mode, skip := img.recordName(rec)
+		if skip {
+			continue
+		}
+		p := path.Join(dir, name)
+
+		if rec.flags&2 != 0 {
+			img.afs.add(p, fs.ModeDir|mode, rec.modTime, 0, nil)
+			if err := img.walk(rec, p); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Parts of a multi-extent file are assumed to be contiguous, which
+		// is how mastering tools lay them out
+		if pending != nil {
+			rec.size += pending.size
+			rec.extent = pending.extent
+			pending = nil
+		}
+		if rec.flags&0x80 != 0 {
+			pending = &rec
+			continue
+		}
+
+		start, size := int64(rec.extent)*isoSectorSize, int64(rec.size)
+		if start+size > img.size {
+			return errors.New("file extends past end of image")
+		}
+		img.afs.add(p, mode, rec.modTime, size, func() (io.ReaderAt, error) {
+			return io.NewSectionReader(img.r, start, size), nil
+		})
+	}
+	return nil
+}
+
+// recordName returns the name and permissions of a record, and whether
+// it is a kind of file the VFS cannot represent
+func (img *isoImage) recordName(rec isoRecord) (name string, mode fs.FileMode, skip bool) {
+	mode = 0644
+	if rec.flags&2 != 0 {
+		mode = 0755
+	}
+
+	var rrName []byte
+	for sys := rec.system; len(sys) >= 4 && int(sys[2]) >= 4 && int(sys[2]) <= len(sys); sys = sys[sys[2]:] {
+		entry := sys[:sys[2]]
+		switch string(entry[:2]) {
+		case "NM":
+			if len(entry) > 5 && entry[4]&0x06 == 0 { // Not "." or ".."
+				rrName = append(rrName, entry[5:]...)
+			}
+		case "PX":
+			if len(entry) >= 12 {
+				posix := binary.LittleEndian.Uint32(entry[4:8])
+				if typ := posix & 0170000; typ != 0040000 && typ != 0100000 {
+					return "", 0, true // Symbolic links, devices and fifos
+				}
+				mode = fs.FileMode(posix & 0777)
+			}
+		}
+	}
+
+	switch {
+	case len(rrName) > 0:
+		name = string(rrName)
+	case img.joliet:
+		units := make([]uint16, len(rec.name)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(rec.name[2*i:])
+		}
+		name = string(utf16.Decode(units))
+	default:
+		name = string(rec.name)
+	}
+
+	if len(rrName) == 0 && rec.flags&2 == 0 {
+		if i := strings.LastIndexByte(name, ';'); i >= 0 {
+			name = name[:i]
+		}
+		name = strings.TrimSuffix(name, ".")
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return "", 0, true
+	}
+	return name, mode, false
+}
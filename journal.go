@@ -0,0 +1,343 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cursor is a position in the change journal: the number of changes
+// recorded up to it. The zero Cursor is the start of the journal.
+type Cursor uint64
+
+// Change is one mutation recorded in the change journal
+type Change struct {
+	Cursor  Cursor    `json:"cursor"` // Position just after this change
+	Time    time.Time `json:"ts"`
+	Op      string    `json:"op"` // WriteFile, MkdirAll, Create, CreateNew, Remove, RemoveAll, RenameDir, Chmod, or Close, see JournalOptions.Content
+	Path    string    `json:"path"`
+	OldPath string    `json:"oldPath,omitempty"` // Source of a RenameDir
+	Size    int64     `json:"size,omitempty"`
+
+	// With JournalOptions.Content, the mode of created and chmodded paths
+	// and the content of written files
+	Mode fs.FileMode `json:"mode,omitempty"`
+	Data []byte      `json:"data,omitempty"`
+
+	// Where the change is in the journal file, if its Data was left there
+	// rather than kept in memory
+	fileOff, fileLen int64
+}
+
+// ErrJournalTruncated is returned by Changes when changes after the cursor
+// were dropped to respect JournalOptions.MaxChanges. Consumers should
+// rescan and continue from the current cursor.
+var ErrJournalTruncated = errors.New("changes since cursor were dropped from the journal")
+
+// JournalOptions configures the change journal
+type JournalOptions struct {
+	// Path is a file the journal is appended to as JSON lines and reloaded
+	// from by New, so that cursors survive restarts. The journal is kept
+	// in memory only if empty.
+	Path string
+
+	// MaxChanges limits the changes kept in memory, 0 for no limit. The
+	// file keeps every change.
+	MaxChanges int
+
+	// Content records the mode and content of what is written, so that
+	// RebuildAt can reconstruct earlier states. Files from Create are
+	// recorded once closed, as a Close change. With a Path, content is
+	// kept in the file only and read back when needed; otherwise it stays
+	// in memory.
+	Content bool
+
+	// Clock overrides time.Now, mainly for tests
+	Clock func() time.Time
+}
+
+// changeJournal is the ordered log of mutations. It is shared by all views.
+type changeJournal struct {
+	opts       JournalOptions
+	changes    []Change // Oldest first
+	head       Cursor
+	file       *os.File
+	size       int64 // Of the file
+	durability Durability
+	logger     Logger
+	mu         sync.Mutex
+
+	// order is held from a write to its record, so that changes are
+	// journaled in the order the backend applied them
+	order sync.Mutex
+}
+
+// WithChangeJournal records every successful mutation, in order, in a
+// journal read with Changes and WaitChanges. Unlike watches it sees every
+// write made through the VFS, on any backend, and nothing else. Writes
+// through the VFS are serialized to keep that order, and fail if their
+// change cannot be written to JournalOptions.Path, which is fsynced after
+// every change with DurabilityFlush or above on any backend.
+func WithChangeJournal(opts JournalOptions) Option {
+	return func(v *VFS) {
+		if opts.Clock == nil {
+			opts.Clock = time.Now
+		}
+		v.journal = &changeJournal{opts: opts}
+	}
+}
+
+// open loads the journal file, if any, and opens it for appending
+func (j *changeJournal) open() {
+	if j.opts.Path == "" {
+		return
+	}
+
+	var end int64 // Of the last valid change
+	if f, err := os.Open(j.opts.Path); err == nil {
+		// A decoder rather than a line scanner, since changes carrying
+		// content have no size limit
+		dec := json.NewDecoder(bufio.NewReader(f))
+		for dec.More() {
+			var c Change
+			start := dec.InputOffset()
+			if err := dec.Decode(&c); err != nil || c.Cursor != j.head+1 {
+				j.logger.Error("Ignoring the rest of change journal %s from change %d", j.opts.Path, j.head+1)
+				break
+			}
+			end = dec.InputOffset()
+			if len(c.Data) > 0 {
+				c.Data, c.fileOff, c.fileLen = nil, start, end-start
+			}
+			j.keep(c)
+		}
+		f.Close()
+
+		// Appending after a damaged tail would hide later changes. Valid
+		// changes end with a newline.
+		if end > 0 {
+			end++
+		}
+		if info, err := os.Stat(j.opts.Path); err == nil && info.Size() > end {
+			if err := os.Truncate(j.opts.Path, end); err != nil {
+				j.logger.Error("Failed to truncate change journal %s: %v", j.opts.Path, err)
+				return
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		j.logger.Error("Failed to read change journal %s: %v", j.opts.Path, err)
+	}
+
+	f, err := os.OpenFile(j.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		j.logger.Error("Failed to open change journal %s: %v", j.opts.Path, err)
+		return
+	}
+	j.file = f
+	if info, err := f.Stat(); err == nil {
+		j.size = info.Size()
+	}
+	j.logger.Debug("Loaded %d changes from %s", j.head, j.opts.Path)
+}
+
+// record appends a change to the journal. The change is kept in memory
+// even if writing it to the file fails, since it was made.
+func (j *changeJournal) record(c Change) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	c.Cursor = j.head + 1
+	c.Time = j.opts.Clock().UTC()
+	if j.file == nil {
+		// The caller may reuse its buffer; history must not change with it
+		c.Data = bytes.Clone(c.Data)
+		j.keep(c)
+		return nil
+	}
+
+	line, err := json.Marshal(c)
+	if err == nil {
+		_, err = j.file.Write(append(line, '\n'))
+	}
+	if err == nil && j.durability >= DurabilityFlush {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		c.Data = bytes.Clone(c.Data)
+		j.keep(c)
+		return fmt.Errorf("failed to write change journal %s: %w", j.opts.Path, err)
+	}
+
+	if len(c.Data) > 0 {
+		c.Data, c.fileOff, c.fileLen = nil, j.size, int64(len(line))
+	}
+	j.size += int64(len(line)) + 1
+	j.keep(c)
+	return nil
+}
+
+// loadData reads back the Data of changes that left it in the file
+func (j *changeJournal) loadData(changes []Change) error {
+	var f *os.File
+	for i := range changes {
+		c := &changes[i]
+		if c.fileLen == 0 {
+			continue
+		}
+		if f == nil {
+			var err error
+			if f, err = os.Open(j.opts.Path); err != nil {
+				return err
+			}
+			defer f.Close()
+		}
+
+		buf := make([]byte, c.fileLen)
+		var stored Change
+		if _, err := f.ReadAt(buf, c.fileOff); err != nil {
+			return fmt.Errorf("failed to read change %d from %s: %w", c.Cursor, j.opts.Path, err)
+		}
+		if err := json.Unmarshal(buf, &stored); err != nil || stored.Cursor != c.Cursor {
+			return fmt.Errorf("change %d in %s is damaged", c.Cursor, j.opts.Path)
+		}
+		c.Data = stored.Data
+	}
+	return nil
+}
+
+// each calls fn with every change up to cursor upTo, oldest first. The
+// changes are read from the journal file, which keeps them all, if there
+// is one, and from memory otherwise, which must still hold them all.
+func (j *changeJournal) each(upTo Cursor, fn func(Change) error) error {
+	j.mu.Lock()
+	fromFile := j.file != nil
+	j.mu.Unlock()
+
+	if !fromFile {
+		changes, _, err := j.since(0)
+		if err != nil {
+			return err
+		}
+		if len(changes) > 0 && changes[0].Cursor != 1 {
+			return ErrJournalTruncated
+		}
+		for _, c := range changes {
+			if c.Cursor > upTo {
+				break
+			}
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Changes up to the head are complete in the file, since they were
+	// written under the lock. Later ones are not read.
+	f, err := os.Open(j.opts.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for next := Cursor(1); next <= upTo; next++ {
+		var c Change
+		if err := dec.Decode(&c); err != nil || c.Cursor != next {
+			return fmt.Errorf("change journal %s lacks change %d", j.opts.Path, next)
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keep adds c to the changes in memory and moves the head to it
+func (j *changeJournal) keep(c Change) {
+	j.changes = append(j.changes, c)
+	j.head = c.Cursor
+	if max := j.opts.MaxChanges; max > 0 && len(j.changes) > max {
+		j.changes = append(j.changes[:0:0], j.changes[len(j.changes)-max:]...)
+	}
+}
+
+// since returns the changes after cursor and the cursor after them
+func (j *changeJournal) since(cursor Cursor) ([]Change, Cursor, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if cursor > j.head {
+		return nil, j.head, fmt.Errorf("cursor %d is ahead of the journal at %d", cursor, j.head)
+	}
+	if len(j.changes) > 0 && cursor+1 < j.changes[0].Cursor {
+		return nil, j.head, ErrJournalTruncated
+	}
+	i := sort.Search(len(j.changes), func(i int) bool { return j.changes[i].Cursor > cursor })
+	changes := append([]Change(nil), j.changes[i:]...)
+	for i := range changes {
+		changes[i].Data = bytes.Clone(changes[i].Data)
+	}
+	if err := j.loadData(changes); err != nil {
+		return nil, j.head, err
+	}
+	return changes, j.head, nil
+}
+
+// cursor returns the cursor after the last change
+func (j *changeJournal) cursor() Cursor {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.head
+}
+
+func (j *changeJournal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// Changes returns the changes recorded after cursor since, oldest first,
+// and the cursor to pass to the next call. Pass the zero Cursor to read the
+// whole journal. The Data of each change is the caller's own copy.
+func (v *VFS) Changes(since Cursor) ([]Change, Cursor, error) {
+	if v.journal == nil {
+		return nil, 0, errors.New("change journal is not enabled")
+	}
+	return v.journal.since(since)
+}
+
+// WaitChanges is like Changes, but waits until there are changes after
+// since or ctx is done, so that consumers can follow the journal as a
+// stream
+func (v *VFS) WaitChanges(ctx context.Context, since Cursor) ([]Change, Cursor, error) {
+	if v.journal == nil {
+		return nil, 0, errors.New("change journal is not enabled")
+	}
+
+	changed, unsubscribe := v.changed.subscribe()
+	defer unsubscribe()
+	for {
+		changes, cursor, err := v.journal.since(since)
+		if err != nil || len(changes) > 0 {
+			return changes, cursor, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, cursor, ctx.Err()
+		case <-changed:
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package vfs
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/spf13/afero"
 	"io"
 	"io/fs"
+	"os"
 	"path/filepath"
-	"sort"
+	"runtime"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 // VFS represents a virtual file system with support for bundled resources and watching
@@ -19,7 +25,34 @@ type VFS struct {
 	logger         Logger
 	bundledManager *BundledManager
 	watchManager   *WatchManager
-	diskPath       string // For disk-based VFS
+	profiler       *Profiler
+	auditLog       *AuditLog
+	accessPolicy   AccessPolicy
+	seal           *sealState
+	generations    *generationTable
+	shared         *sharedCache
+	promoter       *promoter
+	compaction     *compactState
+	allocator      Allocator // How the memory backend stores files
+	pathIndex      *pathIndex
+	dirCache       *dirCache
+	metadata       *metadataDB
+	archiveFS      fs.FS           // For archive-based VFS
+	archive        io.Closer       // Releases the archive file
+	mounts         *mountSet       // Images mounted with MountImage
+	ctx            context.Context // Set on views created by WithContext
+	diskPath       string          // For disk-based VFS
+	diskMounts     []diskMount     // Further disk roots, see WithDiskMount
+	durability     Durability
+	dirty          *dirtySet   // Disk changes not yet synced
+	createMu       *sync.Mutex // Makes CreateNew atomic in memory
+	hidden         *hiddenPolicy
+	nameRules      *NameRules // nil accepts every name
+	writeRules     []WriteRule
+	scanner        *contentScanner
+	changed        *changeSignal // Wakes up Replicate and WaitChanges after mutations
+	journal        *changeJournal
+	snapshots      *snapshotSet
 }
 
 // New creates a new VFS instance
@@ -29,6 +62,16 @@ func New(opts ...Option) *VFS {
 		vfsType:        VFSTypeMemory,
 		logger:         NullLogger{},
 		bundledManager: NewBundledManager(),
+		seal:           &sealState{},
+		generations:    newGenerationTable(),
+		shared:         newSharedCache(),
+		compaction:     &compactState{},
+		mounts:         &mountSet{},
+		dirty:          &dirtySet{},
+		createMu:       &sync.Mutex{},
+		hidden:         defaultHiddenPolicy(),
+		changed:        &changeSignal{},
+		snapshots:      &snapshotSet{},
 	}
 
 	// Apply options first to determine type
@@ -36,22 +79,70 @@ func New(opts ...Option) *VFS {
 		opt(vfs)
 	}
 
+	if vfs.profiler != nil {
+		vfs.profiler.logger = vfs.logger
+	}
+	if vfs.auditLog != nil {
+		vfs.auditLog.logger = vfs.logger
+	}
+
 	// Initialize filesystem based on type
 	switch vfs.vfsType {
 	case VFSTypeMemory, VFSTypeHybrid:
-		memFs := afero.NewMemMapFs()
+		memFs := newSwapFs(newMemoryBackend(vfs.allocator))
 		vfs.fs = memFs
 		vfs.afero = &afero.Afero{Fs: memFs}
+		if vfs.promoter != nil {
+			vfs.promoter.files = newMemoryBackend(vfs.allocator)
+		}
 	case VFSTypeDisk:
 		if vfs.root == "/" {
 			vfs.root = "."
 		}
 		vfs.diskPath = vfs.root
 		// Create a base directory filesystem rooted at diskPath
-		baseFs := afero.NewBasePathFs(afero.NewOsFs(), vfs.diskPath)
+		var baseFs afero.Fs
+		if vfs.diskPath != "" {
+			baseFs = afero.NewBasePathFs(afero.NewOsFs(), vfs.diskPath)
+		} else {
+			baseFs = afero.NewReadOnlyFs(afero.NewMemMapFs()) // Only mounts
+		}
+		if len(vfs.diskMounts) > 0 {
+			baseFs = newMountFs(baseFs, vfs.diskMounts)
+		}
 		vfs.fs = baseFs
 		vfs.afero = &afero.Afero{Fs: baseFs}
 		vfs.watchManager = NewWatchManager(vfs.diskPath, vfs.logger)
+		if vfs.watchManager != nil {
+			vfs.watchManager.mounts = vfs.diskMounts
+		}
+		if vfs.dirCache != nil && vfs.watchManager != nil {
+			vfs.watchManager.addListener(vfs.dirCache.invalidateEvent)
+		}
+		if vfs.pathIndex != nil && vfs.watchManager != nil {
+			vfs.startPathIndexWatch()
+		}
+	case VFSTypeArchive:
+		if vfs.archiveFS == nil {
+			vfs.archiveFS = newArchiveFS()
+		}
+		archiveFs := newArchiveAfero(vfs.archiveFS)
+		vfs.fs = archiveFs
+		vfs.afero = &afero.Afero{Fs: archiveFs}
+	}
+
+	if vfs.nameRules == nil && vfs.vfsType == VFSTypeDisk {
+		rules := DiskNameRules()
+		vfs.nameRules = &rules
+	}
+
+	if vfs.metadata != nil {
+		vfs.loadMetadata()
+	}
+	if vfs.journal != nil {
+		vfs.journal.logger = vfs.logger
+		vfs.journal.durability = vfs.durability
+		vfs.journal.open()
 	}
 
 	vfs.logger.Debug("Created VFS with type: %v, root: %s", vfs.vfsType, vfs.root)
@@ -60,28 +151,66 @@ func New(opts ...Option) *VFS {
 
 // Clone creates a deep copy of the VFS
 func (v *VFS) Clone() FileSystem {
+	return v.CloneWith()
+}
+
+// CloneWith is Clone with copy options. Empty directories and exact modes
+// are copied unless opts turn them off.
+func (v *VFS) CloneWith(opts ...CopyOption) FileSystem {
+	clone, err := v.cloneWith(newCopyOptions(opts))
+	if err != nil {
+		clone.logger.Error("Failed to clone VFS: %v", err)
+	}
+	return clone
+}
+
+// cloneWith copies v into a new memory VFS. It stops at the first entry
+// that cannot be read and returns the partial copy with the error.
+func (v *VFS) cloneWith(o copyOptions) (*VFS, error) {
 	clone := &VFS{
 		root:           v.root,
 		vfsType:        VFSTypeMemory, // Clones are always memory-based
 		logger:         v.logger,
 		bundledManager: v.bundledManager, // Share bundled resources
+		seal:           &sealState{},
+		generations:    newGenerationTable(),
+		shared:         newSharedCache(),
+		compaction:     &compactState{},
+		allocator:      v.allocator,
+		mounts:         &mountSet{},
+		createMu:       &sync.Mutex{},
+		hidden:         v.hidden,
+		changed:        &changeSignal{},
+		snapshots:      &snapshotSet{},
 	}
 
-	memFs := afero.NewMemMapFs()
+	memFs := newSwapFs(newMemoryBackend(clone.allocator))
 	clone.fs = memFs
 	clone.afero = &afero.Afero{Fs: memFs}
 
-	// Copy all files from original to clone
-	v.Walk("/", func(path string, info fs.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+	// Copy all files from original to clone, hidden ones included
+	var modes modeList
+	walkErr := v.walkAll("/", func(entry WalkEntry, err error) error {
+		if err != nil {
 			return err
 		}
+		path, info := entry.Path, entry.Info
 
 		// Skip bundled files as they're shared
 		if v.bundledManager.IsBundledPath(path) {
 			return nil
 		}
 
+		if o.modes {
+			modes.add(path, info.Mode())
+		}
+		if info.IsDir() {
+			if !o.emptyDirs {
+				return nil
+			}
+			return clone.MkdirAll(path, 0755)
+		}
+
 		data, readErr := v.ReadFile(path)
 		if readErr != nil {
 			return readErr
@@ -89,34 +218,70 @@ func (v *VFS) Clone() FileSystem {
 
 		return clone.WriteFile(path, data, info.Mode())
 	})
+	if err := errors.Join(walkErr, clone.applyModes(&modes)); err != nil {
+		return clone, err
+	}
 
 	clone.logger.Debug("Created clone of VFS")
-	return clone
+	return clone, nil
 }
 
-// Merge merges another filesystem into this one at the specified destination path
+// Merge merges another filesystem into this one at the specified
+// destination path
 func (v *VFS) Merge(other FileSystem, destPath string) error {
-	return other.Walk("/", func(path string, info fs.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+	return v.MergeWith(other, destPath)
+}
+
+// MergeWith is Merge with copy options. Empty directories and exact modes
+// are copied unless opts turn them off; destPath itself keeps its mode.
+// Hidden files of a *VFS are copied too, as by Clone.
+func (v *VFS) MergeWith(other FileSystem, destPath string, opts ...CopyOption) error {
+	return v.track("Merge", destPath, func(v *VFS) error {
+		return v.mergeWith(other, destPath, opts...)
+	})
+}
+
+func (v *VFS) mergeWith(other FileSystem, destPath string, opts ...CopyOption) (err error) {
+	o := newCopyOptions(opts)
+	var modes modeList
+	err = walkSource(other, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
 			return err
 		}
 
+		// Calculate destination path
+		relPath := strings.TrimPrefix(path, "/")
+		mergePath := filepath.Join(destPath, relPath)
+
+		if info.IsDir() {
+			if !o.emptyDirs {
+				return nil
+			}
+			if o.modes && relPath != "" {
+				modes.add(mergePath, info.Mode())
+			}
+			return v.MkdirAll(mergePath, 0755)
+		}
+
 		data, readErr := other.ReadFile(path)
 		if readErr != nil {
 			return readErr
 		}
 
-		// Calculate destination path
-		relPath := strings.TrimPrefix(path, "/")
-		mergePath := filepath.Join(destPath, relPath)
-
 		// Ensure directory exists
 		if err := v.MkdirAll(filepath.Dir(mergePath), 0755); err != nil {
 			return err
 		}
 
+		if o.modes {
+			modes.add(mergePath, info.Mode())
+		}
 		return v.WriteFile(mergePath, data, info.Mode())
 	})
+	if err != nil {
+		return err
+	}
+	return v.applyModes(&modes)
 }
 
 // normalizePath ensures path is absolute within the VFS
@@ -131,10 +296,40 @@ func (v *VFS) normalizePath(path string) string {
 	return path
 }
 
+// pathKey returns the canonical form of path used to key internal tables
+func (v *VFS) pathKey(path string) string {
+	return filepath.ToSlash(filepath.Clean(v.normalizePath(path)))
+}
+
 // ReadFile reads a file from either bundled, disk, or memory storage
 func (v *VFS) ReadFile(filename string) ([]byte, error) {
+	return tracked(v, "ReadFile", filename, func(v *VFS) ([]byte, error) {
+		return v.readFile(filename)
+	})
+}
+
+func (v *VFS) readFile(filename string) (_ []byte, err error) {
+	if err := v.authorize("ReadFile", filename, false); err != nil {
+		return nil, err
+	}
+
 	if bundled, bundledPath, ok := v.bundledManager.GetBundledFS(filename); ok {
-		return bundled.ReadFile(bundledPath)
+		if v.vfsType != VFSTypeHybrid || v.promoter == nil {
+			return bundled.ReadFile(bundledPath)
+		}
+		key := promotedPath(filename, bundledPath)
+		if data, ok := v.promoter.lookup(key); ok {
+			return data, nil
+		}
+		data, err := bundled.ReadFile(bundledPath)
+		if err == nil {
+			v.promoter.recordRead(key, data)
+		}
+		return data, err
+	}
+
+	if entry, _ := v.sealedLookup(filename); entry != nil && !entry.info.IsDir() {
+		return bytes.Clone(entry.data), nil
 	}
 
 	vfsPath := v.normalizePath(filename)
@@ -156,6 +351,30 @@ func (v *VFS) ReadFileString(filename string) (string, error) {
 
 // WriteFile writes data to a file
 func (v *VFS) WriteFile(filename string, data []byte, perm fs.FileMode) error {
+	return v.track("WriteFile", filename, func(v *VFS) error {
+		return v.writeFile(filename, data, perm)
+	})
+}
+
+func (v *VFS) writeFile(filename string, data []byte, perm fs.FileMode) (err error) {
+	defer v.mutation("WriteFile", filename, int64(len(data)))(&err)
+
+	if err := v.authorize("WriteFile", filename, true); err != nil {
+		return err
+	}
+	if err := v.admitCreate("WriteFile", filename, false); err != nil {
+		return err
+	}
+	if err := v.scanWrite("WriteFile", filename, data); err != nil {
+		return err
+	}
+
+	if err := v.beginWrite("WriteFile", filename, false); err != nil {
+		return err
+	}
+	defer v.endWrite()
+	defer v.journalWrite(&err, Change{Op: "WriteFile", Path: filename, Size: int64(len(data)), Data: data})
+
 	if v.bundledManager.IsBundledPath(filename) {
 		return fmt.Errorf("cannot write to bundled URL: %s", filename)
 	}
@@ -167,7 +386,11 @@ func (v *VFS) WriteFile(filename string, data []byte, perm fs.FileMode) error {
 		return err
 	}
 
-	err := v.afero.WriteFile(vfsPath, data, perm)
+	if v.vfsType == VFSTypeDisk && v.durability >= DurabilityFlush {
+		err = v.writeDurably(vfsPath, data, perm)
+	} else {
+		err = v.afero.WriteFile(vfsPath, data, perm)
+	}
 	if err != nil {
 		v.logger.Error("Failed to write file %s: %v", filename, err)
 	} else {
@@ -176,12 +399,109 @@ func (v *VFS) WriteFile(filename string, data []byte, perm fs.FileMode) error {
 	return err
 }
 
+// CreateNew writes data to a new file, failing with an error matching
+// fs.ErrExist if path already exists. The check and the create are atomic
+// on disk (O_EXCL) and in memory, so it can implement lockfiles and PID
+// files: of several callers racing for the same path, exactly one wins.
+func (v *VFS) CreateNew(path string, data []byte, perm fs.FileMode) error {
+	return v.track("CreateNew", path, func(v *VFS) error {
+		return v.createNew(path, data, perm)
+	})
+}
+
+func (v *VFS) createNew(path string, data []byte, perm fs.FileMode) (err error) {
+	defer v.mutation("CreateNew", path, int64(len(data)))(&err)
+
+	if err := v.authorize("CreateNew", path, true); err != nil {
+		return err
+	}
+	if err := v.admitCreate("CreateNew", path, false); err != nil {
+		return err
+	}
+	if err := v.scanWrite("CreateNew", path, data); err != nil {
+		return err
+	}
+
+	if err := v.beginWrite("CreateNew", path, false); err != nil {
+		return err
+	}
+	defer v.endWrite()
+	defer v.journalWrite(&err, Change{Op: "CreateNew", Path: path, Size: int64(len(data)), Data: data})
+
+	if v.bundledManager.IsBundledPath(path) {
+		return fmt.Errorf("cannot write to bundled URL: %s", path)
+	}
+
+	vfsPath := v.normalizePath(path)
+	if err := v.afero.MkdirAll(filepath.Dir(vfsPath), 0755); err != nil {
+		return err
+	}
+
+	// The memory backend checks and creates in two steps
+	v.createMu.Lock()
+	f, err := v.fs.OpenFile(vfsPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	v.createMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil && v.vfsType == VFSTypeDisk && v.durability >= DurabilityFlush {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		v.fs.Remove(vfsPath) // Don't leave a partial file claiming the path
+	}
+	return err
+}
+
+// maxUniqueAttempts bounds the names UniquePath tries
+const maxUniqueAttempts = 10000
+
+// UniquePath reserves a new file in dir named base plus ext, or base-1,
+// base-2, ... plus ext if that is taken, and returns its path. The file is
+// created empty with CreateNew, so concurrent callers never get the same
+// path; write the content to it afterwards.
+func (v *VFS) UniquePath(dir, base, ext string) (string, error) {
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	for i := 0; i < maxUniqueAttempts; i++ {
+		name := base + ext
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		p := filepath.ToSlash(filepath.Join(v.normalizePath(dir), name))
+
+		err := v.CreateNew(p, nil, 0644)
+		if err == nil {
+			return p, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+	return "", &fs.PathError{Op: "UniquePath", Path: dir, Err: fmt.Errorf("%w: no free name for %s%s", fs.ErrExist, base, ext)}
+}
+
 // Exists checks if a path exists
 func (v *VFS) Exists(path string) bool {
 	if bundled, bundledPath, ok := v.bundledManager.GetBundledFS(path); ok {
 		return bundled.Exists(bundledPath)
 	}
 
+	if entry, indexed := v.sealedLookup(path); indexed {
+		return entry != nil
+	}
+
+	if _, exists, known := v.indexLookup(path); known && !exists {
+		return false
+	}
+
 	vfsPath := v.normalizePath(path)
 	exists, _ := v.afero.Exists(vfsPath)
 	return exists
@@ -193,6 +513,14 @@ func (v *VFS) IsDir(path string) bool {
 		return bundled.IsDir(bundledPath)
 	}
 
+	if entry, indexed := v.sealedLookup(path); indexed {
+		return entry != nil && entry.info.IsDir()
+	}
+
+	if _, exists, known := v.indexLookup(path); known && !exists {
+		return false
+	}
+
 	vfsPath := v.normalizePath(path)
 	info, err := v.afero.Stat(vfsPath)
 	if err != nil {
@@ -203,12 +531,33 @@ func (v *VFS) IsDir(path string) bool {
 
 // MkdirAll creates directories recursively
 func (v *VFS) MkdirAll(path string, perm fs.FileMode) error {
+	return v.track("MkdirAll", path, func(v *VFS) error {
+		return v.mkdirAll(path, perm)
+	})
+}
+
+func (v *VFS) mkdirAll(path string, perm fs.FileMode) (err error) {
+	defer v.mutation("MkdirAll", path, 0)(&err)
+
+	if err := v.authorize("MkdirAll", path, true); err != nil {
+		return err
+	}
+	if err := v.admitCreate("MkdirAll", path, true); err != nil {
+		return err
+	}
+
+	if err := v.beginWrite("MkdirAll", path, false); err != nil {
+		return err
+	}
+	defer v.endWrite()
+	defer v.journalWrite(&err, Change{Op: "MkdirAll", Path: path})
+
 	if v.bundledManager.IsBundledPath(path) {
 		return fmt.Errorf("cannot create directories in bundled URL: %s", path)
 	}
 
 	vfsPath := v.normalizePath(path)
-	err := v.afero.MkdirAll(vfsPath, perm)
+	err = v.afero.MkdirAll(vfsPath, perm)
 	if err != nil {
 		v.logger.Error("Failed to create directory %s: %v", path, err)
 	}
@@ -217,6 +566,24 @@ func (v *VFS) MkdirAll(path string, perm fs.FileMode) error {
 
 // Remove removes a file or directory
 func (v *VFS) Remove(path string) error {
+	return v.track("Remove", path, func(v *VFS) error {
+		return v.remove(path)
+	})
+}
+
+func (v *VFS) remove(path string) (err error) {
+	defer v.mutation("Remove", path, 0)(&err)
+
+	if err := v.authorize("Remove", path, true); err != nil {
+		return err
+	}
+
+	if err := v.beginWrite("Remove", path, true); err != nil {
+		return err
+	}
+	defer v.endWrite()
+	defer v.journalWrite(&err, Change{Op: "Remove", Path: path})
+
 	if v.bundledManager.IsBundledPath(path) {
 		return fmt.Errorf("cannot remove bundled URL: %s", path)
 	}
@@ -227,6 +594,24 @@ func (v *VFS) Remove(path string) error {
 
 // RemoveAll removes a path recursively
 func (v *VFS) RemoveAll(path string) error {
+	return v.track("RemoveAll", path, func(v *VFS) error {
+		return v.removeAll(path)
+	})
+}
+
+func (v *VFS) removeAll(path string) (err error) {
+	defer v.mutation("RemoveAll", path, 0)(&err)
+
+	if err := v.authorize("RemoveAll", path, true); err != nil {
+		return err
+	}
+
+	if err := v.beginWrite("RemoveAll", path, true); err != nil {
+		return err
+	}
+	defer v.endWrite()
+	defer v.journalWrite(&err, Change{Op: "RemoveAll", Path: path})
+
 	if v.bundledManager.IsBundledPath(path) {
 		return fmt.Errorf("cannot remove bundled URL: %s", path)
 	}
@@ -241,12 +626,27 @@ func (v *VFS) Stat(path string) (fs.FileInfo, error) {
 		return bundled.Stat(bundledPath)
 	}
 
+	if entry, indexed := v.sealedLookup(path); indexed {
+		if entry == nil {
+			return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+		}
+		return entry.info, nil
+	}
+
+	if _, exists, known := v.indexLookup(path); known && !exists {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+
 	vfsPath := v.normalizePath(path)
 	return v.afero.Stat(vfsPath)
 }
 
 // Open opens a file for reading
 func (v *VFS) Open(path string) (afero.File, error) {
+	if err := v.authorize("Open", path, false); err != nil {
+		return nil, err
+	}
+
 	if v.bundledManager.IsBundledPath(path) {
 		return nil, fmt.Errorf("open not implemented for bundled URLs")
 	}
@@ -256,35 +656,158 @@ func (v *VFS) Open(path string) (afero.File, error) {
 }
 
 // Create creates a file for writing
-func (v *VFS) Create(path string) (afero.File, error) {
+func (v *VFS) Create(path string) (_ afero.File, err error) {
+	defer v.mutation("Create", path, 0)(&err)
+
+	if err := v.authorize("Create", path, true); err != nil {
+		return nil, err
+	}
+	if err := v.admitCreate("Create", path, false); err != nil {
+		return nil, err
+	}
+
+	if err := v.beginWrite("Create", path, false); err != nil {
+		return nil, err
+	}
+	defer v.endWrite()
+	defer v.journalWrite(&err, Change{Op: "Create", Path: path})
+
 	if v.bundledManager.IsBundledPath(path) {
 		return nil, fmt.Errorf("cannot create files with bundled URL: %s", path)
 	}
 
 	vfsPath := v.normalizePath(path)
-	return v.fs.Create(vfsPath)
+	f, err := v.fs.Create(vfsPath)
+	if err == nil && v.vfsType == VFSTypeDisk && v.durability >= DurabilityFlush {
+		f = &syncOnClose{File: f}
+	}
+	if err == nil && v.journal != nil && v.journal.opts.Content {
+		f = &journalOnClose{File: f, v: v, key: v.pathKey(path)}
+	}
+	if err == nil && v.scanner != nil {
+		f = &scanOnClose{File: f, v: v, key: v.pathKey(path)}
+	}
+	return f, err
 }
 
-// Walk traverses the filesystem
-func (v *VFS) Walk(root string, walkFn filepath.WalkFunc) error {
-	if bundled, bundledPath, ok := v.bundledManager.GetBundledFS(root); ok {
-		return bundled.Walk(bundledPath, walkFn)
+// ErrTooLarge is returned by writers from CreateLimited once their limit is
+// exceeded
+var ErrTooLarge = errors.New("file exceeds size limit")
+
+// CreateLimited creates a file, and its parent directories, like Create
+// but with a writer that accepts at most max bytes. The write that would
+// exceed the limit fails with ErrTooLarge and the partial file is removed,
+// so an upload handler cannot be made to store more than max bytes:
+//
+//	w, err := v.CreateLimited("/uploads/"+name, 10<<20)
+//	if err != nil {
+//		return err
+//	}
+//	if _, err := io.Copy(w, r.Body); err != nil {
+//		w.Close()
+//		return err
+//	}
+//	return w.Close()
+func (v *VFS) CreateLimited(path string, max int64) (io.WriteCloser, error) {
+	if !v.bundledManager.IsBundledPath(path) {
+		if err := v.MkdirAll(filepath.Dir(v.normalizePath(path)), 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := v.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedFile{f: f, v: v, path: path, remaining: max}, nil
+}
+
+// limitedFile is a writer from CreateLimited
+type limitedFile struct {
+	f         afero.File
+	v         *VFS
+	path      string
+	remaining int64
+	err       error // Returned by every call once the limit was exceeded or the file closed
+}
+
+func (l *limitedFile) Write(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if int64(len(p)) > l.remaining {
+		l.abort()
+		return 0, l.err
 	}
+	n, err := l.f.Write(p)
+	l.remaining -= int64(n)
+	return n, err
+}
 
-	vfsRoot := v.normalizePath(root)
-	return afero.Walk(v.fs, vfsRoot, walkFn)
+// abort discards the partial file
+func (l *limitedFile) abort() {
+	l.err = &fs.PathError{Op: "write", Path: l.path, Err: ErrTooLarge}
+
+	// The partial content is neither scanned nor journaled, since it is
+	// not kept
+	unwrapClose(l.f).Close()
+	if err := l.v.Remove(l.path); err != nil {
+		l.v.logger.Error("Failed to remove oversized file %s: %v", l.path, err)
+	}
+}
+
+// unwrapClose returns f without the wrappers that scan or journal a file
+// once it is closed
+func unwrapClose(f afero.File) afero.File {
+	for {
+		switch w := f.(type) {
+		case *scanOnClose:
+			f = w.File
+		case *journalOnClose:
+			f = w.File
+		default:
+			return f
+		}
+	}
+}
+
+func (l *limitedFile) Close() error {
+	if l.err != nil {
+		return l.err
+	}
+	l.err = &fs.PathError{Op: "close", Path: l.path, Err: fs.ErrClosed}
+	return l.f.Close()
+}
+
+// Walk traverses the filesystem in lexical order. Returning fs.SkipDir from
+// walkFn skips the rest of a directory: the directory itself, or the
+// remaining entries of a file's directory. fs.SkipAll ends the walk; neither
+// is returned by Walk. Errors passed to walkFn are a *WalkError when the root
+// cannot be walked and a *WalkEntryError for an unreadable entry below it.
+func (v *VFS) Walk(root string, walkFn filepath.WalkFunc) error {
+	return v.track("Walk", root, func(v *VFS) error {
+		return v.walk(root, func(entry WalkEntry, err error) error {
+			return walkFn(entry.Path, entry.Info, err)
+		})
+	})
 }
 
 // ListFiles lists files in a directory
 func (v *VFS) ListFiles(dir string) ([]string, error) {
+	if err := v.authorize("ListFiles", dir, false); err != nil {
+		return nil, err
+	}
+
 	if bundled, bundledPath, ok := v.bundledManager.GetBundledFS(dir); ok {
 		return bundled.ListFiles(bundledPath)
 	}
 
+	if entry, _ := v.sealedLookup(dir); entry != nil && entry.info.IsDir() {
+		return append([]string(nil), entry.files...), nil
+	}
+
 	var files []string
-	vfsDir := v.normalizePath(dir)
 
-	entries, err := afero.ReadDir(v.fs, vfsDir)
+	entries, err := v.readDir(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -300,14 +823,21 @@ func (v *VFS) ListFiles(dir string) ([]string, error) {
 
 // ListDirs lists directories in a directory
 func (v *VFS) ListDirs(dir string) ([]string, error) {
+	if err := v.authorize("ListDirs", dir, false); err != nil {
+		return nil, err
+	}
+
 	if bundled, bundledPath, ok := v.bundledManager.GetBundledFS(dir); ok {
 		return bundled.ListDirs(bundledPath)
 	}
 
+	if entry, _ := v.sealedLookup(dir); entry != nil && entry.info.IsDir() {
+		return append([]string(nil), entry.dirs...), nil
+	}
+
 	var dirs []string
-	vfsDir := v.normalizePath(dir)
 
-	entries, err := afero.ReadDir(v.fs, vfsDir)
+	entries, err := v.readDir(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -321,22 +851,45 @@ func (v *VFS) ListDirs(dir string) ([]string, error) {
 	return dirs, nil
 }
 
-// FindFiles recursively finds files matching a pattern
+// FindFiles recursively finds files matching a pattern. Files in bundles
+// are returned as prefix:// URLs.
 func (v *VFS) FindFiles(root, pattern string) ([]string, error) {
+	return v.FindFilesAs(root, pattern, PathURL)
+}
+
+// FindFilesAs is FindFiles with a choice of how paths in bundles are
+// returned. Other paths are VFS paths in either form.
+func (v *VFS) FindFilesAs(root, pattern string, form PathForm) ([]string, error) {
+	return tracked(v, "FindFiles", root, func(v *VFS) ([]string, error) {
+		return v.findFiles(root, pattern, form)
+	})
+}
+
+func (v *VFS) findFiles(root, pattern string, form PathForm) ([]string, error) {
+	if err := validatePattern(pattern); err != nil {
+		return nil, err
+	}
+
+	if matches, ok, err := v.indexFind(root, pattern); ok {
+		return matches, err
+	}
+
 	var matches []string
 
-	err := v.Walk(root, func(path string, info fs.FileInfo, err error) error {
+	err := v.walk(root, func(entry WalkEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if !info.IsDir() {
-			matched, err := filepath.Match(pattern, filepath.Base(path))
+		if !entry.Info.IsDir() {
+			matched, err := filepath.Match(pattern, filepath.Base(entry.FSPath))
 			if err != nil {
 				return err
 			}
-			if matched {
-				matches = append(matches, path)
+			if matched && form == PathBundleRelative {
+				matches = append(matches, entry.FSPath)
+			} else if matched {
+				matches = append(matches, entry.Path)
 			}
 		}
 
@@ -346,8 +899,77 @@ func (v *VFS) FindFiles(root, pattern string) ([]string, error) {
 	return matches, err
 }
 
+// validatePattern rejects malformed patterns up front. filepath.Match only
+// reports syntax errors it reaches while matching, so without this check
+// FindFiles would fail or succeed depending on which names it happened to see.
+// The rules mirror filepath.Match.
+func validatePattern(pattern string) error {
+	escapes := runtime.GOOS != "windows"
+
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if escapes {
+				i++
+				if i >= len(pattern) {
+					return filepath.ErrBadPattern
+				}
+			}
+		case '[':
+			i++
+			if i < len(pattern) && pattern[i] == '^' {
+				i++
+			}
+			for ranges := 0; ; ranges++ {
+				if i < len(pattern) && pattern[i] == ']' && ranges > 0 {
+					break
+				}
+				// Low end of the range, optionally followed by -high
+				next, ok := classChar(pattern, i, escapes)
+				if !ok {
+					return filepath.ErrBadPattern
+				}
+				i = next
+				if i < len(pattern) && pattern[i] == '-' {
+					if i, ok = classChar(pattern, i+1, escapes); !ok {
+						return filepath.ErrBadPattern
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// classChar validates a single character class member starting at i and
+// returns the index just past it
+func classChar(pattern string, i int, escapes bool) (int, bool) {
+	if i >= len(pattern) || pattern[i] == '-' || pattern[i] == ']' {
+		return i, false
+	}
+	if pattern[i] == '\\' && escapes {
+		i++
+		if i >= len(pattern) {
+			return i, false
+		}
+	}
+	r, size := utf8.DecodeRuneInString(pattern[i:])
+	if r == utf8.RuneError && size == 1 {
+		return i, false
+	}
+	i += size
+	// A class must be closed before the pattern ends
+	return i, i < len(pattern)
+}
+
 // Copy copies a file from src to dst
 func (v *VFS) Copy(src, dst string) error {
+	return v.track("Copy", src, func(v *VFS) error {
+		return v.copyFile(src, dst)
+	})
+}
+
+func (v *VFS) copyFile(src, dst string) (err error) {
 	data, err := v.ReadFile(src)
 	if err != nil {
 		return fmt.Errorf("failed to read source file %s: %w", src, err)
@@ -363,6 +985,12 @@ func (v *VFS) Copy(src, dst string) error {
 
 // Move moves a file from src to dst
 func (v *VFS) Move(src, dst string) error {
+	return v.track("Move", src, func(v *VFS) error {
+		return v.moveFile(src, dst)
+	})
+}
+
+func (v *VFS) moveFile(src, dst string) (err error) {
 	if err := v.Copy(src, dst); err != nil {
 		return err
 	}
@@ -371,9 +999,23 @@ func (v *VFS) Move(src, dst string) error {
 
 // LoadFromDisk loads files from the OS filesystem
 func (v *VFS) LoadFromDisk(srcPath, destPath string) error {
+	return v.LoadFromDiskWith(srcPath, destPath)
+}
+
+// LoadFromDiskWith is LoadFromDisk with copy options. Empty directories
+// and exact modes are copied unless opts turn them off.
+func (v *VFS) LoadFromDiskWith(srcPath, destPath string, opts ...CopyOption) error {
+	return v.track("LoadFromDisk", srcPath, func(v *VFS) error {
+		return v.loadFromDiskWith(srcPath, destPath, opts...)
+	})
+}
+
+func (v *VFS) loadFromDiskWith(srcPath, destPath string, opts ...CopyOption) (err error) {
 	realFs := afero.NewOsFs()
+	o := newCopyOptions(opts)
+	var modes modeList
 
-	return afero.Walk(realFs, srcPath, func(path string, info fs.FileInfo, err error) error {
+	err = afero.Walk(realFs, srcPath, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -385,8 +1027,21 @@ func (v *VFS) LoadFromDisk(srcPath, destPath string) error {
 
 		vfsPath := filepath.Join(destPath, relPath)
 
+		if relPath != "." && v.hidden.isHidden(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		if info.IsDir() {
-			return v.MkdirAll(vfsPath, info.Mode())
+			if !o.emptyDirs && relPath != "." {
+				return nil
+			}
+			if o.modes {
+				modes.add(vfsPath, info.Mode())
+			}
+			return v.MkdirAll(vfsPath, 0755)
 		}
 
 		content, err := afero.ReadFile(realFs, path)
@@ -394,17 +1049,34 @@ func (v *VFS) LoadFromDisk(srcPath, destPath string) error {
 			return err
 		}
 
+		if err := v.MkdirAll(filepath.Dir(vfsPath), 0755); err != nil {
+			return err
+		}
+		if o.modes {
+			modes.add(vfsPath, info.Mode())
+		}
 		return v.WriteFile(vfsPath, content, info.Mode())
 	})
+	if err != nil {
+		return err
+	}
+	return v.applyModes(&modes)
 }
 
 // SaveToDisk saves VFS contents to disk
 func (v *VFS) SaveToDisk(srcPath, destPath string) error {
+	return v.track("SaveToDisk", srcPath, func(v *VFS) error {
+		return v.saveToDisk(srcPath, destPath)
+	})
+}
+
+func (v *VFS) saveToDisk(srcPath, destPath string) (err error) {
 	if v.bundledManager.IsBundledPath(srcPath) {
 		return fmt.Errorf("cannot save bundled URLs to disk directly")
 	}
 
 	realFs := afero.NewOsFs()
+	rules := DiskNameRules()
 	vfsSrcPath := v.normalizePath(srcPath)
 
 	return v.Walk(vfsSrcPath, func(path string, info fs.FileInfo, err error) error {
@@ -417,6 +1089,10 @@ func (v *VFS) SaveToDisk(srcPath, destPath string) error {
 			return err
 		}
 
+		// Names valid in memory may not be on this OS, like "a:b" on Windows
+		if err := rules.Validate(relPath); err != nil {
+			return err
+		}
 		diskPath := filepath.Join(destPath, relPath)
 
 		if info.IsDir() {
@@ -431,102 +1107,3 @@ func (v *VFS) SaveToDisk(srcPath, destPath string) error {
 		return afero.WriteFile(realFs, diskPath, content, info.Mode())
 	})
 }
-
-func (v *VFS) Dump(writer io.Writer) error {
-	// --- Dump the primary filesystem (memory or disk) ---
-	io.WriteString(writer, "--- VFS Root ---\n")
-
-	// Use a map to build a tree to sort it nicely
-	tree := make(map[string][]string)
-	err := v.Walk("/", func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if path == "/" { // Skip the root itself
-			return nil
-		}
-
-		parent := filepath.Dir(path)
-		if parent == "." {
-			parent = "/"
-		}
-		tree[parent] = append(tree[parent], path)
-		return nil
-	})
-
-	if err != nil {
-		// Handle cases where the root might not exist yet in an empty VFS
-		if _, ok := err.(*fs.PathError); !ok {
-			return err
-		}
-	}
-
-	printTree(writer, tree, "/", "")
-
-	// --- Dump each bundled filesystem ---
-	registeredPrefixes := v.bundledManager.ListRegistered()
-	if len(registeredPrefixes) > 0 {
-		io.WriteString(writer, "\n--- Bundled Filesystems ---\n")
-
-		for _, prefix := range registeredPrefixes {
-			io.WriteString(writer, fmt.Sprintf("Bundle [%s://]:\n", prefix))
-
-			bundleTree := make(map[string][]string)
-			bundledFS, _, ok := v.bundledManager.GetBundledFS(prefix + "://")
-			if !ok {
-				continue
-			}
-
-			// Walk the bundled filesystem starting from root
-			bundledFS.Walk("", func(path string, info fs.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-
-				// Skip the prefix part and get the clean path
-				cleanPath := strings.TrimPrefix(path, prefix+"://")
-				if cleanPath == "" || cleanPath == "." {
-					return nil
-				}
-
-				parent := filepath.Dir(cleanPath)
-				if parent == "." {
-					parent = ""
-				}
-				bundleTree[parent] = append(bundleTree[parent], cleanPath)
-				return nil
-			})
-
-			printTree(writer, bundleTree, "", "  ")
-		}
-	}
-
-	return nil
-}
-
-// printTree is a helper function to print the file tree structure recursively.
-func printTree(w io.Writer, tree map[string][]string, root, indent string) {
-	// Sort entries for a consistent order
-	entries := tree[root]
-	sort.Strings(entries)
-
-	for i, path := range entries {
-		isLast := i == len(entries)-1
-		connector := "├── "
-		if isLast {
-			connector = "└── "
-		}
-
-		baseName := filepath.Base(path)
-		io.WriteString(w, fmt.Sprintf("%s%s%s\n", indent, connector, baseName))
-
-		// If this path is a directory (i.e., it's a key in the tree), recurse
-		if _, ok := tree[path]; ok {
-			newIndent := indent + "│   "
-			if isLast {
-				newIndent = indent + "    "
-			}
-			printTree(w, tree, path, newIndent)
-		}
-	}
-}
@@ -0,0 +1,621 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// memFs is a memory afero.Fs whose small files are kept by a fileStore
+// instead of in a buffer each. WithAllocator selects it in place of afero's
+// MemMapFs, whose behaviour it follows: missing parents of created files
+// are created, and permissions are recorded but not enforced.
+type memFs struct {
+	root  *memNode
+	store *fileStore
+	mu    sync.RWMutex
+}
+
+// memNode is a file or directory of a memFs. Its fields are guarded by the
+// memFs lock.
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte              // Content of files
+	block    block               // Where data is stored, if in the file store
+	children map[string]*memNode // Entries of directories
+	writers  int                 // Handles open for writing
+	removed  bool                // Unlinked while open, so not to be stored
+}
+
+func newMemFs(store *fileStore) *memFs {
+	return &memFs{root: newMemDir("/", 0755), store: store}
+}
+
+func newMemDir(name string, perm fs.FileMode) *memNode {
+	return &memNode{name: name, mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now(), children: make(map[string]*memNode)}
+}
+
+// memPath splits a name into its cleaned path elements
+func memPath(name string) []string {
+	clean := path.Clean("/" + filepath.ToSlash(name))
+	if clean == "/" {
+		return nil
+	}
+	return strings.Split(clean[1:], "/")
+}
+
+// find returns the node at name
+func (m *memFs) find(op, name string) (*memNode, error) {
+	node := m.root
+	for _, elem := range memPath(name) {
+		if !node.mode.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		child, ok := node.children[elem]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// parent returns the directory that holds name and the base name, creating
+// missing directories if create is set
+func (m *memFs) parent(op, name string, create bool) (*memNode, string, error) {
+	elems := memPath(name)
+	if len(elems) == 0 {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	dir := m.root
+	for _, elem := range elems[:len(elems)-1] {
+		child, ok := dir.children[elem]
+		switch {
+		case !ok && create:
+			child = newMemDir(elem, 0755)
+			dir.add(child)
+		case !ok:
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		case !child.mode.IsDir():
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		dir = child
+	}
+	return dir, elems[len(elems)-1], nil
+}
+
+// add links child into the directory n
+func (n *memNode) add(child *memNode) {
+	n.children[child.name] = child
+	n.modTime = time.Now()
+}
+
+// release gives the file store back the blocks of n and everything below it
+func (m *memFs) release(n *memNode) {
+	m.store.release(n.block)
+	n.block, n.data, n.removed = block{}, nil, true
+	for _, child := range n.children {
+		m.release(child)
+	}
+}
+
+// settle moves the content of a file no longer open for writing into the
+// file store
+func (m *memFs) settle(n *memNode) {
+	if n.writers > 0 || n.removed || n.block.slab != nil {
+		return
+	}
+	if b, stored, ok := m.store.store(n.data); ok {
+		n.block, n.data = b, stored
+	}
+}
+
+// unsettle copies the content of a file out of the file store, so that it
+// can be written
+func (m *memFs) unsettle(n *memNode) {
+	if n.block.slab == nil {
+		return
+	}
+	n.data = bytes.Clone(n.data)
+	m.store.release(n.block)
+	n.block = block{}
+}
+
+func (m *memFs) Name() string { return "MemFs" }
+
+func (m *memFs) Create(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *memFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if !writable && flag&os.O_CREATE == 0 {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		node, err := m.find("open", name)
+		if err != nil {
+			return nil, err
+		}
+		return &memFile{fs: m, node: node, name: name, flag: flag}, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.find("open", name)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0:
+		dir, base, err := m.parent("open", name, true)
+		if err != nil {
+			return nil, err
+		}
+		node = &memNode{name: base, mode: perm & chmodBits, modTime: time.Now()}
+		dir.add(node)
+	case err != nil:
+		return nil, err
+	}
+
+	if writable {
+		if node.mode.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if flag&os.O_TRUNC != 0 {
+			m.store.release(node.block)
+			node.block, node.data = block{}, nil
+			node.modTime = time.Now()
+		} else {
+			m.unsettle(node)
+		}
+		node.writers++
+	}
+
+	f := &memFile{fs: m, node: node, name: name, flag: flag}
+	if flag&os.O_APPEND != 0 {
+		f.off = int64(len(node.data))
+	}
+	return f, nil
+}
+
+// chmodBits are the mode bits Chmod changes, as in afero's MemMapFs
+const chmodBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+func (m *memFs) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, err := m.parent("mkdir", name, false)
+	if err != nil {
+		if len(memPath(name)) == 0 {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+		return err
+	}
+	if _, ok := dir.children[base]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	dir.add(newMemDir(base, perm))
+	return nil
+}
+
+func (m *memFs) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir := m.root
+	for _, elem := range memPath(name) {
+		child, ok := dir.children[elem]
+		if !ok {
+			child = newMemDir(elem, perm)
+			dir.add(child)
+		} else if !child.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		dir = child
+	}
+	return nil
+}
+
+func (m *memFs) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, err := m.parent("remove", name, false)
+	if err != nil {
+		return err
+	}
+	node, ok := dir.children[base]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(node.children) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	m.release(node)
+	delete(dir.children, base)
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (m *memFs) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(memPath(name)) == 0 {
+		m.release(m.root)
+		m.root.children = make(map[string]*memNode)
+		return nil
+	}
+	dir, base, err := m.parent("removeall", name, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if node, ok := dir.children[base]; ok {
+		m.release(node)
+		delete(dir.children, base)
+		dir.modTime = time.Now()
+	}
+	return nil
+}
+
+func (m *memFs) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldDir, oldBase, err := m.parent("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+	node, ok := oldDir.children[oldBase]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	oldElems, newElems := memPath(oldname), memPath(newname)
+	if node.mode.IsDir() && len(newElems) > len(oldElems) && slicesHavePrefix(newElems, oldElems) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+	newDir, newBase, err := m.parent("rename", newname, false)
+	if err != nil {
+		return err
+	}
+
+	if existing, ok := newDir.children[newBase]; ok {
+		if existing == node {
+			return nil
+		}
+		switch {
+		case existing.mode.IsDir() != node.mode.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrExist}
+		case len(existing.children) > 0:
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTEMPTY}
+		}
+		m.release(existing)
+	}
+
+	delete(oldDir.children, oldBase)
+	oldDir.modTime = time.Now()
+	node.name = newBase
+	newDir.add(node)
+	return nil
+}
+
+// slicesHavePrefix reports whether s starts with the elements of prefix
+func slicesHavePrefix(s, prefix []string) bool {
+	for i, elem := range prefix {
+		if s[i] != elem {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *memFs) Stat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	node, err := m.find("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+func (m *memFs) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.find("chmod", name)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode&^chmodBits | mode&chmodBits
+	return nil
+}
+
+func (m *memFs) Chown(name string, uid, gid int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, err := m.find("chown", name)
+	return err
+}
+
+func (m *memFs) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.find("chtimes", name)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// memInfo is the fs.FileInfo of a memNode at the time of the call
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (n *memNode) info() *memInfo {
+	return &memInfo{name: n.name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() interface{}   { return nil }
+
+// memFile is an open file or directory of a memFs
+type memFile struct {
+	fs      *memFs
+	node    *memNode
+	name    string
+	flag    int
+	off     int64
+	entries []*memInfo // Directory listing, read by Readdir from the start
+	closed  bool
+	mu      sync.Mutex // Guards off, entries and closed
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+
+	if f.writable() {
+		f.fs.mu.Lock()
+		f.node.writers--
+		f.fs.settle(f.node)
+		f.fs.mu.Unlock()
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	return f.node.info(), nil
+}
+
+func (f *memFile) Sync() error { return nil }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+	}
+
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	if f.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		f.fs.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.fs.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.fs.mu.RLock()
+		f.off = int64(len(f.node.data))
+		f.fs.mu.RUnlock()
+	}
+	n, err := f.writeAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.writable() {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	node := f.node
+	if end := off + int64(len(p)); end > int64(len(node.data)) {
+		if end > int64(cap(node.data)) {
+			grown := make([]byte, end, max(end, 2*int64(cap(node.data))))
+			copy(grown, node.data)
+			node.data = grown
+		} else {
+			node.data = node.data[:end]
+		}
+	}
+	copy(node.data[off:], p)
+	node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.writable() {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrPermission}
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	node := f.node
+	if size <= int64(len(node.data)) {
+		node.data = node.data[:size]
+	} else {
+		grown := make([]byte, size)
+		copy(grown, node.data)
+		node.data = grown
+	}
+	node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	if f.entries == nil {
+		f.fs.mu.RLock()
+		if !f.node.mode.IsDir() {
+			f.fs.mu.RUnlock()
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+		}
+		f.entries = make([]*memInfo, 0, len(f.node.children))
+		for _, child := range f.node.children {
+			f.entries = append(f.entries, child.info())
+		}
+		f.fs.mu.RUnlock()
+		sort.Slice(f.entries, func(i, j int) bool { return f.entries[i].name < f.entries[j].name })
+	}
+
+	n := len(f.entries)
+	if count > 0 {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		n = min(n, count)
+	}
+	infos := make([]os.FileInfo, n)
+	for i, info := range f.entries[:n] {
+		infos[i] = info
+	}
+	f.entries = f.entries[n:]
+	return infos, nil
+}
+
+func (f *memFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
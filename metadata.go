@@ -0,0 +1,307 @@
+package vfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// metadataVersion is the format version of the metadata sidecar file
+const metadataVersion = 1
+
+// FileMetadata is the persisted metadata of a file
+type FileMetadata struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    fs.FileMode `json:"mode"`
+	Hash    string      `json:"sha256,omitempty"` // Empty until computed
+	Tags    []string    `json:"tags,omitempty"`
+}
+
+// metadataDB holds file metadata and persists it to a sidecar file. It is
+// shared by all views of a VFS.
+type metadataDB struct {
+	path    string
+	records map[string]*FileMetadata
+	dirty   bool
+	mu      sync.Mutex
+}
+
+// metadataFile is the on-disk form of the metadata database
+type metadataFile struct {
+	Version int             `json:"version"`
+	Files   []*FileMetadata `json:"files"`
+}
+
+// WithMetadataDB keeps file metadata (size, modification time, mode,
+// SHA-256 hash and tags) in a JSON sidecar file at path on the OS
+// filesystem, so a large disk root doesn't need to be rehashed on every
+// run. The sidecar should live outside the VFS root. Records are loaded
+// when the VFS is created and kept current by writes through the VFS;
+// RescanMetadata catches up with changes made behind its back, rehashing
+// only files whose size or modification time changed. Changes are saved by
+// SaveMetadata and Close.
+func WithMetadataDB(path string) Option {
+	return func(v *VFS) {
+		v.metadata = &metadataDB{path: path, records: make(map[string]*FileMetadata)}
+	}
+}
+
+// loadMetadata reads the sidecar file, if it exists
+func (v *VFS) loadMetadata() {
+	db := v.metadata
+	data, err := os.ReadFile(db.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		v.logger.Error("Failed to read metadata database %s: %v", db.path, err)
+		return
+	}
+
+	var file metadataFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Version != metadataVersion {
+		v.logger.Error("Ignoring unreadable metadata database %s", db.path)
+		return
+	}
+	for _, rec := range file.Files {
+		db.records[rec.Path] = rec
+	}
+	v.logger.Debug("Loaded metadata for %d files from %s", len(db.records), db.path)
+}
+
+// Metadata returns the metadata of the file at path, computing its hash if
+// the file changed since it was last recorded
+func (v *VFS) Metadata(path string) (FileMetadata, error) {
+	if v.metadata == nil {
+		return FileMetadata{}, errors.New("metadata database is not enabled")
+	}
+	if v.bundledManager.IsBundledPath(path) {
+		return FileMetadata{}, fmt.Errorf("bundled URLs have no metadata: %s", path)
+	}
+
+	info, err := v.Stat(path)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	if info.IsDir() {
+		return FileMetadata{}, &fs.PathError{Op: "metadata", Path: path, Err: errors.New("is a directory")}
+	}
+
+	return v.metadata.refresh(v, v.pathKey(path), info)
+}
+
+// SetTags replaces the tags of the file at path
+func (v *VFS) SetTags(path string, tags ...string) error {
+	if _, err := v.Metadata(path); err != nil {
+		return err
+	}
+
+	tags = append([]string(nil), tags...)
+	sort.Strings(tags)
+
+	db := v.metadata
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if rec, ok := db.records[v.pathKey(path)]; ok {
+		rec.Tags = tags
+		db.dirty = true
+	}
+	return nil
+}
+
+// FindByTag returns the paths of all recorded files carrying tag, sorted
+func (v *VFS) FindByTag(tag string) []string {
+	if v.metadata == nil {
+		return nil
+	}
+
+	db := v.metadata
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var paths []string
+	for path, rec := range db.records {
+		for _, t := range rec.Tags {
+			if t == tag {
+				paths = append(paths, path)
+				break
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// RescanMetadata brings the metadata database up to date with the backend
+// and saves it. Unchanged files are not read.
+func (v *VFS) RescanMetadata() error {
+	return v.rescanMetadata(context.Background(), nil)
+}
+
+// rescanMetadata rescans the metadata database, calling visit for every
+// file. If ctx is cancelled the records refreshed so far are saved, but
+// records of removed files are kept.
+func (v *VFS) rescanMetadata(ctx context.Context, visit func(string, fs.FileInfo)) error {
+	if v.metadata == nil {
+		return errors.New("metadata database is not enabled")
+	}
+
+	seen := make(map[string]bool)
+	err := afero.Walk(v.fs, "/", func(path string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path = filepath.ToSlash(path)
+		if visit != nil {
+			visit(path, info)
+		}
+		seen[path] = true
+		_, err = v.metadata.refresh(v, path, info)
+		return err
+	})
+	if ctx.Err() != nil {
+		if saveErr := v.SaveMetadata(); saveErr != nil {
+			v.logger.Error("%v", saveErr)
+		}
+		return ctx.Err()
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to rescan metadata: %w", err)
+	}
+
+	v.metadata.mu.Lock()
+	for path := range v.metadata.records {
+		if !seen[path] {
+			delete(v.metadata.records, path)
+			v.metadata.dirty = true
+		}
+	}
+	v.metadata.mu.Unlock()
+
+	return v.SaveMetadata()
+}
+
+// SaveMetadata writes the metadata database to its sidecar file if it
+// changed. The file is replaced atomically.
+func (v *VFS) SaveMetadata() error {
+	db := v.metadata
+	if db == nil {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.dirty {
+		return nil
+	}
+
+	file := metadataFile{Version: metadataVersion}
+	for _, rec := range db.records {
+		file.Files = append(file.Files, rec)
+	}
+	sort.Slice(file.Files, func(i, j int) bool {
+		return file.Files[i].Path < file.Files[j].Path
+	})
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	tmp := db.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save metadata database: %w", err)
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		return fmt.Errorf("failed to save metadata database: %w", err)
+	}
+
+	db.dirty = false
+	return nil
+}
+
+// cachedHash returns the recorded hash of path if the record is still
+// valid, without reading the file
+func (v *VFS) cachedHash(path string) (string, bool) {
+	if v.metadata == nil || v.bundledManager.IsBundledPath(path) {
+		return "", false
+	}
+	info, err := v.Stat(path)
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+	rec, err := v.metadata.refresh(v, v.pathKey(path), info)
+	return rec.Hash, err == nil
+}
+
+// refresh returns the record of the file at key, updating it if info shows
+// the file changed
+func (db *metadataDB) refresh(v *VFS, key string, info fs.FileInfo) (FileMetadata, error) {
+	db.mu.Lock()
+	rec, ok := db.records[key]
+	if ok && rec.Hash != "" && rec.Size == info.Size() && rec.ModTime.Equal(info.ModTime()) {
+		if rec.Mode != info.Mode() {
+			rec.Mode = info.Mode()
+			db.dirty = true
+		}
+		current := *rec
+		db.mu.Unlock()
+		return current, nil
+	}
+	db.mu.Unlock()
+
+	data, err := v.afero.ReadFile(key)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	sum := sha256.Sum256(data)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if rec, ok = db.records[key]; !ok {
+		rec = &FileMetadata{Path: key}
+		db.records[key] = rec
+	}
+	rec.Size = info.Size()
+	rec.ModTime = info.ModTime()
+	rec.Mode = info.Mode()
+	rec.Hash = hex.EncodeToString(sum[:])
+	db.dirty = true
+	return *rec, nil
+}
+
+// forget invalidates the hash of a written path, or drops the records of
+// a removed one and everything below it. Tags survive writes.
+func (db *metadataDB) forget(path string, removed bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !removed {
+		if rec, ok := db.records[path]; ok {
+			rec.Hash = ""
+			db.dirty = true
+		}
+		return
+	}
+	for p := range db.records {
+		if within(p, path) {
+			delete(db.records, p)
+			db.dirty = true
+		}
+	}
+}
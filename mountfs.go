@@ -0,0 +1,305 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
+)
+
+// errCrossMount is returned when renaming between two disk roots, which
+// the OS cannot do in place
+var errCrossMount = errors.New("rename across disk roots")
+
+// diskMount maps a virtual directory of a disk VFS to a directory on disk
+type diskMount struct {
+	point string // Virtual path, such as "/d"
+	disk  string // Disk path, such as "D:/cache" or `\\server\share`
+	fs    afero.Fs
+}
+
+// WithDiskMount mounts the disk directory diskPath at the virtual path
+// mountPoint of a disk VFS, so one VFS can span several roots, for example
+// two Windows drives or a UNC share:
+//
+//	v := vfs.NewMultiRootVFS(map[string]string{"/c": `C:\work`, "/d": `D:\cache`})
+//
+// Each mount is watched through its own disk path. Renames between roots
+// fail, as on the OS; Move copies instead.
+func WithDiskMount(mountPoint, diskPath string) Option {
+	return func(v *VFS) {
+		point := path.Clean("/" + filepath.ToSlash(mountPoint))
+		if point == "/" {
+			v.logger.Error("Ignoring disk mount of %s at the root", diskPath)
+			return
+		}
+		v.diskMounts = append(v.diskMounts, diskMount{point: point, disk: filepath.Clean(diskPath)})
+	}
+}
+
+// NewMultiRootVFS creates a disk VFS made only of mounted disk roots, keyed
+// by their virtual paths. Paths outside the mounts are read-only and empty
+// except for the directories leading to mount points.
+func NewMultiRootVFS(mounts map[string]string, opts ...Option) *VFS {
+	for point, disk := range mounts {
+		opts = append(opts, WithDiskMount(point, disk))
+	}
+	opts = append(opts, WithType(VFSTypeDisk), withoutDiskRoot())
+	return New(opts...)
+}
+
+// withoutDiskRoot leaves a disk VFS without a primary root
+func withoutDiskRoot() Option {
+	return func(v *VFS) {
+		v.root = ""
+	}
+}
+
+// mountFs routes paths to the disk mount containing them, and everything
+// else to the base filesystem. Directories leading to mount points list
+// the mounts as subdirectories.
+type mountFs struct {
+	base   afero.Fs
+	mounts []diskMount // Longest mount point first
+}
+
+func newMountFs(base afero.Fs, mounts []diskMount) *mountFs {
+	m := &mountFs{base: base}
+	for _, mount := range mounts {
+		mount.fs = afero.NewBasePathFs(afero.NewOsFs(), mount.disk)
+		m.mounts = append(m.mounts, mount)
+	}
+	sort.SliceStable(m.mounts, func(i, j int) bool {
+		return len(m.mounts[i].point) > len(m.mounts[j].point)
+	})
+	return m
+}
+
+// route returns the filesystem holding name and the path within it
+func (m *mountFs) route(name string) (afero.Fs, string) {
+	p := path.Clean("/" + filepath.ToSlash(name))
+	for _, mount := range m.mounts {
+		if within(p, mount.point) {
+			return mount.fs, "/" + strings.TrimPrefix(strings.TrimPrefix(p, mount.point), "/")
+		}
+	}
+	return m.base, name
+}
+
+// children returns the names of mount points and directories leading to
+// them directly below dir
+func (m *mountFs) children(dir string) []string {
+	dir = path.Clean("/" + filepath.ToSlash(dir))
+	seen := make(map[string]bool)
+	var names []string
+	for _, mount := range m.mounts {
+		if mount.point == dir || !within(mount.point, dir) {
+			continue
+		}
+		rest := strings.TrimPrefix(strings.TrimPrefix(mount.point, dir), "/")
+		name, _, _ := strings.Cut(rest, "/")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isVirtual reports whether dir leads to a mount point, so it exists even
+// if the base filesystem has no such directory
+func (m *mountFs) isVirtual(dir string) bool {
+	return len(m.children(dir)) > 0
+}
+
+// guard fails removals and renames of paths that contain mount points
+func (m *mountFs) guard(op, name string) error {
+	p := path.Clean("/" + filepath.ToSlash(name))
+	for _, mount := range m.mounts {
+		if within(mount.point, p) {
+			return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("%w: contains disk mount %s", fs.ErrPermission, mount.point)}
+		}
+	}
+	return nil
+}
+
+func (m *mountFs) Create(name string) (afero.File, error) {
+	fsys, p := m.route(name)
+	return fsys.Create(p)
+}
+
+func (m *mountFs) Mkdir(name string, perm os.FileMode) error {
+	fsys, p := m.route(name)
+	return fsys.Mkdir(p, perm)
+}
+
+func (m *mountFs) MkdirAll(name string, perm os.FileMode) error {
+	fsys, p := m.route(name)
+	return fsys.MkdirAll(p, perm)
+}
+
+func (m *mountFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *mountFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fsys, p := m.route(name)
+	f, err := fsys.OpenFile(p, flag, perm)
+
+	children := m.children(name)
+	if len(children) == 0 {
+		return f, err
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, err
+		}
+		f = mem.NewFileHandle(mem.CreateDir(name)) // Only leads to mounts
+	}
+	return &mountDir{File: f, fs: m, dir: name, children: children}, nil
+}
+
+func (m *mountFs) Remove(name string) error {
+	if err := m.guard("remove", name); err != nil {
+		return err
+	}
+	fsys, p := m.route(name)
+	return fsys.Remove(p)
+}
+
+func (m *mountFs) RemoveAll(name string) error {
+	if err := m.guard("removeall", name); err != nil {
+		return err
+	}
+	fsys, p := m.route(name)
+	return fsys.RemoveAll(p)
+}
+
+func (m *mountFs) Rename(oldname, newname string) error {
+	if err := m.guard("rename", oldname); err != nil {
+		return err
+	}
+	oldFs, oldPath := m.route(oldname)
+	newFs, newPath := m.route(newname)
+	if oldFs != newFs {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errCrossMount}
+	}
+	return oldFs.Rename(oldPath, newPath)
+}
+
+func (m *mountFs) Stat(name string) (os.FileInfo, error) {
+	fsys, p := m.route(name)
+	info, err := fsys.Stat(p)
+	if err != nil && errors.Is(err, fs.ErrNotExist) && m.isVirtual(name) {
+		return mem.GetFileInfo(mem.CreateDir(name)), nil
+	}
+	if err == nil && p == "/" && fsys != m.base {
+		// A mount's root is named after its mount point
+		info = renamedInfo{FileInfo: info, name: path.Base(filepath.ToSlash(name))}
+	}
+	return info, err
+}
+
+func (m *mountFs) Name() string { return "MountFs" }
+
+func (m *mountFs) Chmod(name string, mode os.FileMode) error {
+	fsys, p := m.route(name)
+	return fsys.Chmod(p, mode)
+}
+
+func (m *mountFs) Chown(name string, uid, gid int) error {
+	fsys, p := m.route(name)
+	return fsys.Chown(p, uid, gid)
+}
+
+func (m *mountFs) Chtimes(name string, atime, mtime time.Time) error {
+	fsys, p := m.route(name)
+	return fsys.Chtimes(p, atime, mtime)
+}
+
+// renamedInfo reports a different name for a file
+type renamedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (r renamedInfo) Name() string { return r.name }
+
+// mountDir is an open directory whose listing includes the mount points
+// and directories leading to them below it
+type mountDir struct {
+	afero.File
+	fs       *mountFs
+	dir      string
+	children []string
+
+	entries []os.FileInfo // Listing, loaded by the first Readdir
+	loaded  bool
+	offset  int
+}
+
+func (d *mountDir) Readdir(n int) ([]os.FileInfo, error) {
+	if !d.loaded {
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	rest := d.entries[d.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	return rest, nil
+}
+
+func (d *mountDir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+// load lists the directory, with mounts shadowing base entries of the
+// same name
+func (d *mountDir) load() error {
+	base, err := d.File.Readdir(-1)
+	if err != nil {
+		return err
+	}
+
+	shadowed := make(map[string]bool, len(d.children))
+	for _, name := range d.children {
+		shadowed[name] = true
+		info, err := d.fs.Stat(path.Join(filepath.ToSlash(d.dir), name))
+		if err != nil {
+			return err
+		}
+		d.entries = append(d.entries, info)
+	}
+	for _, info := range base {
+		if !shadowed[info.Name()] {
+			d.entries = append(d.entries, info)
+		}
+	}
+
+	sort.Slice(d.entries, func(i, j int) bool {
+		return d.entries[i].Name() < d.entries[j].Name()
+	})
+	d.loaded = true
+	return nil
+}
@@ -0,0 +1,158 @@
+package vfs
+
+// mutationEvent describes a successful mutating operation
+type mutationEvent struct {
+	op     string
+	key    string // Path key of the mutated path, the destination of renames
+	oldKey string // Source path key of renames, empty otherwise
+	size   int64
+}
+
+// renamed reports whether the event moved a subtree
+func (e mutationEvent) renamed() bool {
+	return e.oldKey != ""
+}
+
+// mutationHook brings one facility up to date with a successful mutation.
+// An error fails the operation, but the remaining hooks still run.
+type mutationHook func(v *VFS, e mutationEvent) error
+
+// mutationHooks run in order after every successful mutation. Caches are
+// invalidated first, so that scans and subscribers woken last see the new
+// state. The change journal is written earlier, by journalWrite.
+var mutationHooks []mutationHook
+
+// Registered in init, since hooks such as scanHook lead back to mutation
+func init() {
+	mutationHooks = []mutationHook{
+		(*VFS).generationsHook,
+		(*VFS).sharedHook,
+		(*VFS).indexHook,
+		(*VFS).dirCacheHook,
+		(*VFS).metadataHook,
+		(*VFS).churnHook,
+		(*VFS).persistHook,
+		(*VFS).scanHook,
+		(*VFS).notifyHook,
+	}
+}
+
+// mutation returns the function that finishes a mutating operation. It is
+// used as
+//
+//	defer v.mutation("WriteFile", filename, int64(len(data)))(&err)
+func (v *VFS) mutation(op, path string, size int64) func(*error) {
+	return func(errp *error) {
+		err := *errp
+		if err == nil {
+			err = v.runMutationHooks(mutationEvent{op: op, key: v.pathKey(path), size: size})
+			*errp = err
+		}
+		if v.auditLog != nil {
+			v.auditLog.record(op, v.normalizePath(path), size, v.principal(), err)
+		}
+	}
+}
+
+// renameMutation is mutation for an operation that moves the subtree at
+// oldPath to newPath
+func (v *VFS) renameMutation(op, oldPath, newPath string) func(*error) {
+	return func(errp *error) {
+		err := *errp
+		if err == nil {
+			err = v.runMutationHooks(mutationEvent{op: op, key: v.pathKey(newPath), oldKey: v.pathKey(oldPath)})
+			*errp = err
+		}
+		if v.auditLog != nil {
+			v.auditLog.recordRename(op, v.normalizePath(oldPath), v.normalizePath(newPath), v.principal(), err)
+		}
+	}
+}
+
+// runMutationHooks runs every hook and returns the first error
+func (v *VFS) runMutationHooks(e mutationEvent) error {
+	var first error
+	for _, hook := range mutationHooks {
+		if err := hook(v, e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (v *VFS) generationsHook(e mutationEvent) error {
+	if e.renamed() {
+		v.generations.rename(e.oldKey, e.key)
+	} else {
+		v.generations.bump(e.key, isRemoval(e.op))
+	}
+	return nil
+}
+
+func (v *VFS) sharedHook(e mutationEvent) error {
+	if e.renamed() {
+		v.shared.forget(e.oldKey, true)
+		v.shared.forget(e.key, true)
+	} else {
+		v.shared.forget(e.key, isRemoval(e.op))
+	}
+	return nil
+}
+
+func (v *VFS) indexHook(e mutationEvent) error {
+	if e.renamed() {
+		if v.pathIndex != nil {
+			v.pathIndex.apply(indexUpdate{path: e.key, from: e.oldKey, isDir: true})
+		}
+	} else {
+		v.indexMutation(e.op, e.key)
+	}
+	return nil
+}
+
+func (v *VFS) dirCacheHook(e mutationEvent) error {
+	if v.dirCache != nil {
+		if e.renamed() {
+			v.dirCache.invalidate(e.oldKey)
+		}
+		v.dirCache.invalidate(e.key)
+	}
+	return nil
+}
+
+func (v *VFS) metadataHook(e mutationEvent) error {
+	if v.metadata != nil {
+		if e.renamed() {
+			v.metadata.rename(e.oldKey, e.key)
+		} else {
+			v.metadata.forget(e.key, isRemoval(e.op))
+		}
+	}
+	return nil
+}
+
+func (v *VFS) churnHook(mutationEvent) error {
+	v.noteChurn()
+	return nil
+}
+
+func (v *VFS) persistHook(e mutationEvent) error {
+	if e.renamed() {
+		if err := v.persist(e.op, e.oldKey); err != nil {
+			return err
+		}
+	}
+	return v.persist(e.op, e.key)
+}
+
+func (v *VFS) scanHook(e mutationEvent) error {
+	if v.scanner != nil && v.scanner.opts.Async && (e.op == "WriteFile" || e.op == "CreateNew") {
+		v.scanWritten(e.op, e.key, e.size)
+	}
+	return nil
+}
+
+func (v *VFS) notifyHook(mutationEvent) error {
+	v.changed.notify()
+	return nil
+}
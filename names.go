@@ -0,0 +1,201 @@
+package vfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// NameRules are the constraints a backend puts on file names. The zero
+// value accepts every name.
+type NameRules struct {
+	MaxNameLength int    // Longest path component, 0 for no limit
+	MaxPathLength int    // Longest VFS path, 0 for no limit
+	UTF16         bool   // Lengths count UTF-16 code units, as on Windows, rather than bytes
+	InvalidChars  string // Characters no name may contain, besides control characters if ReservedNames is set
+	ReservedNames bool   // Reject Windows device names (CON, nul.txt, COM1, ...), control characters and names ending in a dot or space
+}
+
+var (
+	// UnixNameRules are the limits of common Unix filesystems such as ext4
+	// and APFS
+	UnixNameRules = NameRules{MaxNameLength: 255, MaxPathLength: 4095, InvalidChars: "\x00"}
+
+	// WindowsNameRules are the limits of NTFS as seen through the Win32 API.
+	// Long paths are handled by the os package, so only names are limited.
+	WindowsNameRules = NameRules{MaxNameLength: 255, UTF16: true, InvalidChars: `<>:"\|?*`, ReservedNames: true}
+
+	// PortableNameRules accept only names that are valid on both
+	PortableNameRules = NameRules{MaxNameLength: 255, MaxPathLength: 4095, InvalidChars: `<>:"\|?*`, ReservedNames: true}
+)
+
+// DiskNameRules returns the name rules of the OS the program runs on
+func DiskNameRules() NameRules {
+	if runtime.GOOS == "windows" {
+		return WindowsNameRules
+	}
+	return UnixNameRules
+}
+
+// WithNameRules sets the rules that WriteFile, MkdirAll, Create, CreateNew
+// and RenameDir check new paths against. Disk VFSs default to
+// DiskNameRules, other types accept every name.
+func WithNameRules(rules NameRules) Option {
+	return func(v *VFS) {
+		v.nameRules = &rules
+	}
+}
+
+// NameError is returned when a path breaks the VFS's name rules. It matches
+// fs.ErrInvalid with errors.Is.
+type NameError struct {
+	Path   string
+	Name   string // The offending path component, or the path if it is too long
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("invalid name %q in %s: %s", e.Name, e.Path, e.Reason)
+}
+
+// Is reports NameError as an invalid argument
+func (e *NameError) Is(target error) bool {
+	return target == fs.ErrInvalid
+}
+
+// windowsDevices are the reserved device names of Windows
+var windowsDevices = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Validate checks every component of the slash-separated path p
+func (r NameRules) Validate(p string) error {
+	p = filepath.ToSlash(p)
+	if r.MaxPathLength > 0 && r.length(p) > r.MaxPathLength {
+		return &NameError{Path: p, Name: p, Reason: fmt.Sprintf("path longer than %d", r.MaxPathLength)}
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+		if reason := r.check(name); reason != "" {
+			return &NameError{Path: p, Name: name, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// check returns why name breaks the rules, or "" if it does not
+func (r NameRules) check(name string) string {
+	if r.MaxNameLength > 0 && r.length(name) > r.MaxNameLength {
+		return fmt.Sprintf("name longer than %d", r.MaxNameLength)
+	}
+	if i := strings.IndexAny(name, r.InvalidChars); i >= 0 {
+		return fmt.Sprintf("contains %q", name[i])
+	}
+	if !r.ReservedNames {
+		return ""
+	}
+	for _, c := range name {
+		if c < 0x20 {
+			return "contains a control character"
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return "ends in a dot or space"
+	}
+	if windowsDevices[strings.ToUpper(deviceStem(name))] {
+		return "reserved device name"
+	}
+	return ""
+}
+
+// deviceStem returns the part of name Windows matches against device
+// names: "nul.tar.gz" and "NUL " are both the NUL device
+func deviceStem(name string) string {
+	stem, _, _ := strings.Cut(name, ".")
+	return strings.TrimRight(stem, " ")
+}
+
+// length measures s in the unit of the rules
+func (r NameRules) length(s string) int {
+	if r.UTF16 {
+		n := 0
+		for _, c := range s {
+			n += utf16.RuneLen(c)
+		}
+		return n
+	}
+	return len(s)
+}
+
+// Sanitize returns a version of name, a single path component, that the
+// rules accept: invalid characters become "_", trailing dots and spaces
+// are dropped, device names get a "_" prefix and long names are cut at
+// the limit, keeping the extension where possible.
+func (r NameRules) Sanitize(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		switch {
+		case c == '/' || c == utf8.RuneError,
+			strings.ContainsRune(r.InvalidChars, c),
+			r.ReservedNames && c < 0x20:
+			b.WriteByte('_')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	name = b.String()
+
+	if r.ReservedNames {
+		name = strings.TrimRight(name, ". ")
+		if windowsDevices[strings.ToUpper(deviceStem(name))] {
+			name = "_" + name
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+
+	if r.MaxNameLength > 0 && r.length(name) > r.MaxNameLength {
+		ext := path.Ext(name)
+		if r.length(ext) >= r.MaxNameLength/2 {
+			ext = ""
+		}
+		stem := strings.TrimSuffix(name, ext)
+		for r.length(stem)+r.length(ext) > r.MaxNameLength {
+			_, size := utf8.DecodeLastRuneInString(stem)
+			stem = stem[:len(stem)-size]
+		}
+		name = stem + ext
+		if r.ReservedNames {
+			name = strings.TrimRight(stem, ". ") + ext
+		}
+	}
+	return name
+}
+
+// SanitizeName returns a version of name, a single path component, that
+// is valid on every supported OS. See NameRules.Sanitize.
+func SanitizeName(name string) string {
+	return PortableNameRules.Sanitize(name)
+}
+
+// checkName validates a path the operation op is about to create
+func (v *VFS) checkName(op, p string) error {
+	if v.nameRules == nil {
+		return nil
+	}
+	if err := v.nameRules.Validate(v.pathKey(p)); err != nil {
+		v.logger.Debug("%s rejected %s: %v", op, p, err)
+		return err
+	}
+	return nil
+}
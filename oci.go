@@ -0,0 +1,449 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// OCI whiteout markers, see the OCI image layer specification
+const (
+	ociWhiteoutPrefix = ".wh."
+	ociOpaqueWhiteout = ".wh..wh..opq"
+)
+
+// ExportOCILayer writes the tree rooted at root as an uncompressed OCI image
+// layer tarball. Entry names are relative to root, entries are sorted and
+// owned by root (uid and gid 0), and directories carry a trailing slash, as
+// image builders expect. Every path in deleted (absolute VFS paths below
+// root) is recorded as a whiteout, so the layer deletes it from the layers
+// below when the image is unpacked. Compress the output with gzip for an
+// application/vnd.oci.image.layer.v1.tar+gzip layer.
+func (v *VFS) ExportOCILayer(w io.Writer, root string, deleted ...string) error {
+	type layerEntry struct {
+		hdr  *tar.Header
+		path string // VFS path of a regular file, read when written
+	}
+	var entries []layerEntry
+
+	cleanRoot := filepath.ToSlash(root)
+	err := v.Walk(root, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := ociRelPath(cleanRoot, filepath.ToSlash(p))
+		if rel == "" {
+			return nil // The root itself is the image root
+		}
+
+		hdr := &tar.Header{
+			Name:    rel,
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+		}
+		switch {
+		case info.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case info.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = info.Size()
+		default:
+			return nil // Not representable in the VFS
+		}
+		entries = append(entries, layerEntry{hdr: hdr, path: p})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export layer from %s: %w", root, err)
+	}
+
+	for _, d := range deleted {
+		rel := ociRelPath(cleanRoot, filepath.ToSlash(v.normalizePath(d)))
+		if rel == "" || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("deleted path %s is not below %s", d, root)
+		}
+		dir, name := path.Split(rel)
+		entries = append(entries, layerEntry{hdr: &tar.Header{
+			Name:     dir + ociWhiteoutPrefix + name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+		}})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].hdr.Name < entries[j].hdr.Name
+	})
+
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			return err
+		}
+		if e.hdr.Typeflag != tar.TypeReg || e.hdr.Size == 0 {
+			continue
+		}
+
+		data, err := v.ReadFile(e.path)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != e.hdr.Size {
+			return fmt.Errorf("file %s changed during export", e.path)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ociRelPath returns p relative to root in layer form: without a leading
+// slash, "" for root itself and starting with "../" when p is not below root
+func ociRelPath(root, p string) string {
+	root, p = path.Clean("/"+root), path.Clean("/"+p)
+	switch {
+	case p == root:
+		return ""
+	case root == "/":
+		return p[1:]
+	case strings.HasPrefix(p, root+"/"):
+		return p[len(root)+1:]
+	}
+	return "../" + p[1:]
+}
+
+// ImportOCIImage flattens the layers of a container image into the VFS below
+// dest, applying each layer's whiteouts, so the image filesystem can be
+// inspected and scanned. src is an OCI image layout directory, an OCI
+// archive or a "docker save" tarball. Multi-platform images resolve to the
+// current platform. Pulling from a registry is not supported; export the
+// image with docker save or skopeo first. Symbolic links and device nodes
+// have no VFS equivalent and are skipped.
+func (v *VFS) ImportOCIImage(src, dest string) error {
+	fsys, closer, err := openImage(src)
+	if err != nil {
+		return fmt.Errorf("failed to open image %s: %w", src, err)
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	layers, err := imageLayers(fsys)
+	if err != nil {
+		return fmt.Errorf("failed to read image %s: %w", src, err)
+	}
+
+	for _, layer := range layers {
+		if err := v.applyOCILayer(fsys, layer, dest); err != nil {
+			return fmt.Errorf("failed to apply layer %s: %w", layer.path, err)
+		}
+	}
+
+	v.logger.Debug("Imported image %s (%d layers) to %s", src, len(layers), dest)
+	return nil
+}
+
+// ociDescriptor is the subset of an OCI content descriptor used for import
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociLayer is a layer blob within an image, in application order
+type ociLayer struct {
+	path   string
+	digest string
+}
+
+// openImage opens an image directory or tarball as an fs.FS
+func openImage(src string) (fs.FS, io.Closer, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return os.DirFS(src), nil, nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	fsys, _, err := openArchive(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return fsys, f, nil
+}
+
+// imageLayers lists the layers of the image in fsys, bottom layer first
+func imageLayers(fsys fs.FS) ([]ociLayer, error) {
+	if _, err := fs.Stat(fsys, "index.json"); err == nil {
+		var index struct {
+			Manifests []ociDescriptor `json:"manifests"`
+		}
+		if err := readImageJSON(fsys, "index.json", &index); err != nil {
+			return nil, err
+		}
+		return ociManifestLayers(fsys, index.Manifests, 0)
+	}
+
+	// docker save writes manifest.json with layer paths instead of digests
+	var manifests []struct {
+		Layers []string `json:"Layers"`
+	}
+	if err := readImageJSON(fsys, "manifest.json", &manifests); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.New("neither index.json nor manifest.json found")
+		}
+		return nil, err
+	}
+	if len(manifests) == 0 {
+		return nil, errors.New("manifest.json lists no images")
+	}
+
+	var layers []ociLayer
+	for _, p := range manifests[0].Layers {
+		layers = append(layers, ociLayer{path: path.Clean(p)})
+	}
+	return layers, nil
+}
+
+// ociManifestLayers picks the manifest for the current platform from
+// descriptors, following nested indexes, and returns its layers
+func ociManifestLayers(fsys fs.FS, descriptors []ociDescriptor, depth int) ([]ociLayer, error) {
+	if depth > 4 {
+		return nil, errors.New("image indexes nested too deeply")
+	}
+	if len(descriptors) == 0 {
+		return nil, errors.New("image index lists no manifests")
+	}
+
+	desc := descriptors[0]
+	for _, d := range descriptors {
+		if d.Platform != nil && d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH {
+			desc = d
+			break
+		}
+	}
+
+	var manifest struct {
+		MediaType string          `json:"mediaType"`
+		Manifests []ociDescriptor `json:"manifests"`
+		Layers    []ociDescriptor `json:"layers"`
+	}
+	blob, err := ociBlobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := readImageJSON(fsys, blob, &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifests) > 0 {
+		return ociManifestLayers(fsys, manifest.Manifests, depth+1)
+	}
+
+	var layers []ociLayer
+	for _, l := range manifest.Layers {
+		p, err := ociBlobPath(l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, ociLayer{path: p, digest: l.Digest})
+	}
+	return layers, nil
+}
+
+// ociBlobPath maps a digest to its location in an OCI image layout
+func ociBlobPath(digest string) (string, error) {
+	alg, encoded, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || encoded == "" || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return path.Join("blobs", alg, encoded), nil
+}
+
+func readImageJSON(fsys fs.FS, name string, v any) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return nil
+}
+
+// applyOCILayer unpacks one layer over dest. Whiteouts remove entries from
+// the layers below; an opaque whiteout hides everything in its directory
+// that this layer did not add itself.
+func (v *VFS) applyOCILayer(fsys fs.FS, layer ociLayer, dest string) error {
+	f, err := fsys.Open(layer.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var verify hash.Hash
+	var r io.Reader = f
+	if strings.HasPrefix(layer.digest, "sha256:") {
+		verify = sha256.New()
+		r = io.TeeReader(f, verify)
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	var tr *tar.Reader
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr = tar.NewReader(gz)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return errors.New("zstd compressed layers are not supported")
+	default:
+		tr = tar.NewReader(br)
+	}
+
+	added := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		dir, base := path.Split(name)
+		target := path.Join(dest, name)
+
+		switch {
+		case base == ociOpaqueWhiteout:
+			if err := v.clearLowerLayers(path.Join(dest, dir), added); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, ociWhiteoutPrefix):
+			if err := v.RemoveAll(path.Join(dest, dir, strings.TrimPrefix(base, ociWhiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if v.Exists(target) && !v.IsDir(target) {
+				if err := v.Remove(target); err != nil {
+					return err
+				}
+			}
+			err = v.MkdirAll(target, fs.FileMode(hdr.Mode).Perm())
+		case tar.TypeReg, tar.TypeLink:
+			var data []byte
+			if hdr.Typeflag == tar.TypeLink {
+				data, err = v.ReadFile(path.Join(dest, path.Clean("/"+hdr.Linkname)))
+			} else {
+				data, err = io.ReadAll(tr)
+			}
+			if err != nil {
+				return err
+			}
+			if v.IsDir(target) {
+				if err := v.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+			err = v.WriteFile(target, data, fs.FileMode(hdr.Mode).Perm())
+		default:
+			v.logger.Debug("Skipped unsupported layer entry %s (type %c)", name, hdr.Typeflag)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		added[target] = true
+	}
+
+	if verify != nil {
+		if _, err := io.Copy(io.Discard, br); err != nil {
+			return err
+		}
+		if sum := "sha256:" + hex.EncodeToString(verify.Sum(nil)); sum != layer.digest {
+			return fmt.Errorf("digest mismatch: got %s", sum)
+		}
+	}
+	return nil
+}
+
+// clearLowerLayers removes everything below dir except entries in added
+// and the directories leading to them
+func (v *VFS) clearLowerLayers(dir string, added map[string]bool) error {
+	files, err := v.ListFiles(dir)
+	if err != nil {
+		return nil // Nothing below to hide
+	}
+	dirs, err := v.ListDirs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		if p := path.Join(dir, name); !added[p] {
+			if err := v.Remove(p); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range dirs {
+		p := path.Join(dir, name)
+		if !added[p] && !addedBelow(p, added) {
+			if err := v.RemoveAll(p); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := v.clearLowerLayers(p, added); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addedBelow(dir string, added map[string]bool) bool {
+	for p := range added {
+		if within(p, dir) {
+			return true
+		}
+	}
+	return false
+}
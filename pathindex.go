@@ -0,0 +1,393 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ErrNoPathIndex is returned by RefreshIndex when no path index is enabled
+var ErrNoPathIndex = errors.New("path index is not enabled")
+
+// pathIndexQueue bounds the watch events waiting to be applied to the index
+const pathIndexQueue = 4096
+
+// pathIndex is a snapshot of every path in the VFS, used to answer lookups
+// of missing paths and FindFiles without touching the backend. It is shared
+// by all views of a VFS.
+type pathIndex struct {
+	maxAge  time.Duration
+	paths   map[internedPath]bool // Value reports whether the path is a directory
+	built   time.Time
+	loaded  bool
+	live    bool          // Every change reaches the index: all directories are watched, or all writes go through the VFS
+	stale   bool          // Events were lost; rebuild on next use
+	pending []indexUpdate // Updates made while a refresh is walking the tree
+	walking bool
+	mu      sync.RWMutex
+
+	refreshMu sync.Mutex // Serializes refreshes
+
+	events chan WatchEvent // Watch events for the index, nil without a watcher
+	done   chan struct{}
+}
+
+// indexUpdate is a change to the tree
+type indexUpdate struct {
+	path    string
+	isDir   bool
+	removed bool
+	from    string // Set when the subtree at from moved to path
+}
+
+// WithPathIndex keeps a snapshot of every path in the VFS, built on first
+// use. Exists, IsDir and Stat answer for missing paths from it without a
+// round trip to the backend, and FindFiles matches against it instead of
+// walking the tree.
+//
+// Writes through the VFS keep the snapshot current. On a disk VFS every
+// directory is also watched, so changes made behind the VFS's back are
+// applied as the watcher reports them. If watching is unavailable (or the
+// watcher reports lost events), FindFiles falls back to walking and the
+// snapshot is only refreshed by RefreshIndex or once it is older than
+// maxAge (never if maxAge is 0). Paths found in the index are still checked
+// against the backend, so a stale index can only hide files created
+// externally, never report removed ones.
+func WithPathIndex(maxAge time.Duration) Option {
+	return func(v *VFS) {
+		v.pathIndex = &pathIndex{maxAge: maxAge}
+	}
+}
+
+// startPathIndexWatch subscribes the path index to watch events
+func (v *VFS) startPathIndexWatch() {
+	idx := v.pathIndex
+	idx.events = make(chan WatchEvent, pathIndexQueue)
+	idx.done = make(chan struct{})
+
+	v.watchManager.addListener(func(event WatchEvent) {
+		select {
+		case idx.events <- event:
+		default:
+			idx.markStale()
+		}
+	})
+
+	go func() {
+		for {
+			select {
+			case event := <-idx.events:
+				v.applyWatchEvent(event)
+			case <-idx.done:
+				return
+			}
+		}
+	}()
+}
+
+// stopPathIndexWatch stops applying watch events
+func (v *VFS) stopPathIndexWatch() {
+	if idx := v.pathIndex; idx != nil && idx.done != nil {
+		select {
+		case <-idx.done:
+		default:
+			close(idx.done)
+		}
+	}
+}
+
+// RefreshIndex rebuilds the path index from the backend
+func (v *VFS) RefreshIndex() error {
+	return v.refreshIndex(context.Background(), nil)
+}
+
+// refreshIndex rebuilds the path index, calling visit for every entry. If
+// ctx is cancelled the previous index is kept.
+func (v *VFS) refreshIndex(ctx context.Context, visit func(string, fs.FileInfo)) error {
+	idx := v.pathIndex
+	if idx == nil {
+		return ErrNoPathIndex
+	}
+
+	idx.refreshMu.Lock()
+	defer idx.refreshMu.Unlock()
+
+	idx.mu.Lock()
+	idx.walking = true
+	idx.stale = false
+	idx.pending = nil
+	idx.mu.Unlock()
+
+	paths := make(map[internedPath]bool)
+	live := v.vfsType != VFSTypeDisk
+	if idx.events != nil {
+		live = true
+	}
+	err := afero.Walk(v.fs, "/", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path = filepath.ToSlash(path)
+		if visit != nil {
+			visit(path, info)
+		}
+
+		// Watch before the directory's entries are read, so entries
+		// created from now on are reported
+		if info.IsDir() && idx.events != nil && live {
+			if err := v.watchManager.watchInternal(path); err != nil {
+				v.logger.Error("Path index falls back to walking: %v", err)
+				live = false
+			}
+		}
+
+		paths[internPath(path)] = info.IsDir()
+		return nil
+	})
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.walking = false
+	pending := idx.pending
+	idx.pending = nil
+	if err != nil {
+		if ctx.Err() == nil {
+			v.logger.Error("Failed to build path index: %v", err)
+		}
+		return err
+	}
+
+	// Changes that happened during the walk may have been missed by it
+	for _, u := range pending {
+		applyIndexUpdate(paths, u)
+	}
+	idx.paths = paths
+	idx.built = time.Now()
+	idx.loaded = true
+	idx.live = live && !idx.stale
+
+	v.logger.Debug("Built path index with %d paths", len(paths))
+	return nil
+}
+
+// loadIndex makes sure the index is built and fresh, and reports whether it
+// can be used
+func (v *VFS) loadIndex() bool {
+	idx := v.pathIndex
+	if idx == nil {
+		return false
+	}
+
+	idx.mu.RLock()
+	fresh := idx.loaded && !idx.stale && (idx.maxAge <= 0 || time.Since(idx.built) < idx.maxAge)
+	idx.mu.RUnlock()
+	if !fresh && v.RefreshIndex() != nil {
+		return false
+	}
+	return true
+}
+
+// indexLookup consults the path index. known reports whether the index
+// could answer, in which case exists reports whether path may exist.
+func (v *VFS) indexLookup(path string) (isDir, exists, known bool) {
+	if v.pathIndex == nil || v.bundledManager.IsBundledPath(path) || !v.loadIndex() {
+		return false, false, false
+	}
+
+	idx := v.pathIndex
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if !idx.loaded {
+		return false, false, false
+	}
+	isDir, exists = idx.paths[internPath(v.pathKey(path))]
+	return isDir, exists, true
+}
+
+// indexFind answers FindFiles from the index. ok is false if the index is
+// not live, in which case the caller must walk.
+func (v *VFS) indexFind(root, pattern string) (matches []string, ok bool, err error) {
+	if v.pathIndex == nil || v.bundledManager.IsBundledPath(root) || !v.loadIndex() {
+		return nil, false, nil
+	}
+
+	idx := v.pathIndex
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if !idx.loaded || !idx.live || idx.stale {
+		return nil, false, nil
+	}
+
+	if err := v.authorize("Walk", root, false); err != nil {
+		return nil, true, err
+	}
+
+	rootKey := v.pathKey(root)
+	if _, exists := idx.paths[internPath(rootKey)]; !exists {
+		err := &fs.PathError{Op: "lstat", Path: v.normalizePath(root), Err: fs.ErrNotExist}
+		return nil, true, &WalkError{Root: v.normalizePath(root), Err: err}
+	}
+
+	for p, isDir := range idx.paths {
+		if isDir {
+			continue
+		}
+		if matched, _ := filepath.Match(pattern, p.name.Value()); !matched {
+			continue
+		}
+		if path := p.String(); within(path, rootKey) && !v.hidden.hidesBelow(rootKey, path) {
+			matches = append(matches, path)
+		}
+	}
+
+	// Same order as a walk: entries sorted by name within each directory
+	sort.Slice(matches, func(i, j int) bool {
+		return walkLess(matches[i], matches[j])
+	})
+	return matches, true, nil
+}
+
+// walkLess orders paths as a lexical walk visits them
+func walkLess(a, b string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i] == '/' {
+			return true
+		}
+		if b[i] == '/' {
+			return false
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
+
+// indexMutation records a successful write or removal in the path index
+func (v *VFS) indexMutation(op, key string) {
+	if v.pathIndex == nil || v.bundledManager.IsBundledPath(key) || op == "Chmod" {
+		return
+	}
+	v.pathIndex.apply(indexUpdate{path: key, isDir: op == "MkdirAll", removed: isRemoval(op)})
+}
+
+// applyWatchEvent records a change reported by the watcher
+func (v *VFS) applyWatchEvent(event WatchEvent) {
+	idx := v.pathIndex
+	if event.Error != nil {
+		idx.markStale()
+		return
+	}
+
+	if event.Op == WatchOpRemove || event.Op == WatchOpRename {
+		idx.apply(indexUpdate{path: event.Path, removed: true})
+		return
+	}
+
+	info, err := v.fs.Stat(event.Path)
+	if err != nil {
+		return // Already gone again; its removal event follows
+	}
+	if !info.IsDir() {
+		idx.apply(indexUpdate{path: event.Path})
+		return
+	}
+
+	// A new directory may have been filled before it could be watched
+	if err := v.watchManager.watchInternal(event.Path); err != nil {
+		v.logger.Error("Path index falls back to walking: %v", err)
+		idx.mu.Lock()
+		idx.live = false
+		idx.mu.Unlock()
+	}
+	afero.Walk(v.fs, event.Path, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		path = filepath.ToSlash(path)
+		if info.IsDir() && path != event.Path {
+			v.watchManager.watchInternal(path)
+		}
+		idx.apply(indexUpdate{path: path, isDir: info.IsDir()})
+		return nil
+	})
+}
+
+// apply records an update, also queueing it for a refresh in progress
+func (idx *pathIndex) apply(u indexUpdate) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.loaded {
+		applyIndexUpdate(idx.paths, u)
+	}
+	if idx.walking {
+		idx.pending = append(idx.pending, u)
+	}
+}
+
+// markStale forces a rebuild on next use, after events were lost
+func (idx *pathIndex) markStale() {
+	idx.mu.Lock()
+	idx.stale = true
+	idx.mu.Unlock()
+}
+
+// applyIndexUpdate adds a path and its parents, or removes a path and
+// everything below it. A move first carries the entries below the old path
+// over.
+func applyIndexUpdate(paths map[internedPath]bool, u indexUpdate) {
+	key := internPath(u.path)
+
+	if u.from != "" {
+		// Collect before inserting: entries added while ranging over a map
+		// may or may not be visited, and could be moved twice
+		moved := make(map[internedPath]bool)
+		for p, isDir := range paths {
+			if s := p.String(); within(s, u.from) {
+				delete(paths, p)
+				moved[internPath(renamedPath(s, u.from, u.path))] = isDir
+			}
+		}
+		for p, isDir := range moved {
+			paths[p] = isDir
+		}
+	}
+
+	if u.removed {
+		isDir, ok := paths[key]
+		delete(paths, key)
+		if ok && isDir {
+			for p := range paths {
+				if within(p.String(), u.path) {
+					delete(paths, p)
+				}
+			}
+		}
+		return
+	}
+
+	paths[key] = u.isDir
+	for dir := filepath.ToSlash(filepath.Dir(u.path)); ; dir = filepath.ToSlash(filepath.Dir(dir)) {
+		dirKey := internPath(dir)
+		if paths[dirKey] {
+			break
+		}
+		paths[dirKey] = true
+		if dir == "/" || !strings.HasPrefix(dir, "/") {
+			break
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// principalKey is the context key for the acting principal
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the identity id. Pass the
+// context to VFS.WithContext so audit records and access policies see it.
+func WithPrincipal(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, principalKey{}, id)
+}
+
+// PrincipalFrom returns the identity carried by ctx, if any
+func PrincipalFrom(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	id, ok := ctx.Value(principalKey{}).(string)
+	return id, ok
+}
+
+// WithContext returns a view of v whose operations run on behalf of ctx.
+// The view shares all files, bundles, watches and configuration with v;
+// only the context differs. It is cheap enough to create per request:
+//
+//	userFS := serverFS.WithContext(vfs.WithPrincipal(r.Context(), user))
+//	data, err := userFS.ReadFile("/reports/q3.csv")
+func (v *VFS) WithContext(ctx context.Context) *VFS {
+	view := *v
+	view.ctx = ctx
+	return &view
+}
+
+// Context returns the context set by WithContext, or context.Background
+func (v *VFS) Context() context.Context {
+	if v.ctx == nil {
+		return context.Background()
+	}
+	return v.ctx
+}
+
+// principal returns the identity of the caller, if known
+func (v *VFS) principal() string {
+	id, _ := PrincipalFrom(v.ctx)
+	return id
+}
+
+// AccessRequest describes an operation submitted to an access policy
+type AccessRequest struct {
+	Principal string // Empty when the caller carries no identity
+	Op        string // Method name, e.g. "ReadFile" or "RemoveAll"
+	Path      string
+	Write     bool // Whether the operation modifies the filesystem
+}
+
+// AccessPolicy decides whether a request is allowed. Returning a non-nil
+// error denies it; the error is wrapped in an AccessError.
+type AccessPolicy func(req AccessRequest) error
+
+// WithAccessPolicy checks every read (ReadFile, Open, Walk, ListFiles,
+// ListDirs) and every write (WriteFile, MkdirAll, Create, Remove, RemoveAll)
+// against policy before performing it
+func WithAccessPolicy(policy AccessPolicy) Option {
+	return func(v *VFS) {
+		v.accessPolicy = policy
+	}
+}
+
+// AccessError is returned when an access policy denies an operation. It
+// matches fs.ErrPermission with errors.Is.
+type AccessError struct {
+	AccessRequest
+	Err error
+}
+
+func (e *AccessError) Error() string {
+	who := e.Principal
+	if who == "" {
+		who = "anonymous"
+	}
+	return fmt.Sprintf("%s %s denied for %s: %v", e.Op, e.Path, who, e.Err)
+}
+
+func (e *AccessError) Unwrap() error { return e.Err }
+
+// Is reports AccessError as a permission error
+func (e *AccessError) Is(target error) bool {
+	return target == fs.ErrPermission
+}
+
+// authorize consults the access policy, if any
+func (v *VFS) authorize(op, path string, write bool) error {
+	if v.accessPolicy == nil {
+		return nil
+	}
+
+	req := AccessRequest{
+		Principal: v.principal(),
+		Op:        op,
+		Path:      v.normalizePath(path),
+		Write:     write,
+	}
+	if err := v.accessPolicy(req); err != nil {
+		var accessErr *AccessError
+		if errors.As(err, &accessErr) {
+			return err
+		}
+		return &AccessError{AccessRequest: req, Err: err}
+	}
+	return nil
+}
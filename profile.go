@@ -0,0 +1,144 @@
+package vfs
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// maxSlowOps bounds the number of slow operations kept in memory
+const maxSlowOps = 100
+
+// SlowOp records an operation that took longer than the configured threshold
+type SlowOp struct {
+	Op       string
+	Path     string
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+	Stack    string // Stack of the calling goroutine when the operation finished
+}
+
+// Profiler instruments hot VFS operations with pprof labels and a slow
+// operation log
+type Profiler struct {
+	labels    bool
+	threshold time.Duration
+	logger    Logger
+	slow      []SlowOp
+	mu        sync.Mutex
+}
+
+// WithProfileLabels runs every instrumented operation under pprof.Do with
+// the labels "vfs_op" and "vfs_path", so CPU profiles can be broken down by
+// operation. As with pprof.Do, the labels are added to those of the VFS
+// context, which are restored when the operation returns: callers running
+// under labels of their own should bind their context with WithContext to
+// keep them. Nested operations (SaveToDisk reading each file) are
+// attributed to the innermost one.
+func WithProfileLabels() Option {
+	return func(v *VFS) {
+		v.ensureProfiler().labels = true
+	}
+}
+
+// WithSlowOpLog records every instrumented operation that takes at least
+// threshold, including the goroutine stack, and logs it at Info level. The
+// most recent records are available from SlowOps.
+func WithSlowOpLog(threshold time.Duration) Option {
+	return func(v *VFS) {
+		v.ensureProfiler().threshold = threshold
+	}
+}
+
+func (v *VFS) ensureProfiler() *Profiler {
+	if v.profiler == nil {
+		v.profiler = &Profiler{}
+	}
+	return v.profiler
+}
+
+// SlowOps returns the recorded slow operations, oldest first
+func (v *VFS) SlowOps() []SlowOp {
+	if v.profiler == nil {
+		return nil
+	}
+
+	v.profiler.mu.Lock()
+	defer v.profiler.mu.Unlock()
+	return append([]SlowOp(nil), v.profiler.slow...)
+}
+
+// ResetSlowOps discards the recorded slow operations
+func (v *VFS) ResetSlowOps() {
+	if v.profiler == nil {
+		return
+	}
+
+	v.profiler.mu.Lock()
+	v.profiler.slow = nil
+	v.profiler.mu.Unlock()
+}
+
+// track runs fn as the instrumented operation op on path. fn is passed the
+// view to run on, bound to the labelled context when labels are on, so that
+// nested operations derive their labels from it.
+func (v *VFS) track(op, path string, fn func(v *VFS) error) error {
+	_, err := tracked(v, op, path, func(v *VFS) (struct{}, error) {
+		return struct{}{}, fn(v)
+	})
+	return err
+}
+
+// tracked is track for operations that return a value
+func tracked[T any](v *VFS, op, path string, fn func(v *VFS) (T, error)) (result T, err error) {
+	p := v.profiler
+	if p == nil {
+		return fn(v)
+	}
+
+	start := time.Now()
+	if p.labels {
+		pprof.Do(v.Context(), pprof.Labels("vfs_op", op, "vfs_path", path), func(ctx context.Context) {
+			result, err = fn(v.WithContext(ctx))
+		})
+	} else {
+		result, err = fn(v)
+	}
+	if elapsed := time.Since(start); p.threshold > 0 && elapsed >= p.threshold {
+		p.record(SlowOp{
+			Op:       op,
+			Path:     path,
+			Start:    start,
+			Duration: elapsed,
+			Err:      err,
+			Stack:    currentStack(),
+		})
+	}
+	return result, err
+}
+
+// record stores a slow operation, evicting the oldest when full
+func (p *Profiler) record(op SlowOp) {
+	p.mu.Lock()
+	if len(p.slow) == maxSlowOps {
+		copy(p.slow, p.slow[1:])
+		p.slow = p.slow[:maxSlowOps-1]
+	}
+	p.slow = append(p.slow, op)
+	logger := p.logger
+	p.mu.Unlock()
+
+	if logger != nil {
+		logger.Info("Slow operation %s %s took %v", op.Op, op.Path, op.Duration)
+	}
+}
+
+// currentStack returns the stack of the calling goroutine
+func currentStack() string {
+	buf := make([]byte, 8192)
+	n := runtime.Stack(buf, false)
+	return string(buf[:n])
+}
@@ -0,0 +1,147 @@
+package vfs
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// maxTrackedReads bounds the files whose reads are counted before they
+// qualify for promotion
+const maxTrackedReads = 4096
+
+// PromotionPolicy decides which bundled files a hybrid VFS copies into its
+// memory layer
+type PromotionPolicy struct {
+	// MinReads is the number of reads after which a file is promoted
+	MinReads int
+
+	// MaxSize is the largest file promoted; 0 means no limit
+	MaxSize int64
+
+	// MaxTotal bounds the total size of promoted files; 0 means no limit
+	MaxTotal int64
+}
+
+// PromotionStats reports the activity of the promotion policy
+type PromotionStats struct {
+	Promoted      int    // Files copied into the memory layer
+	PromotedBytes int64  // Total size of promoted files
+	Rejected      int    // Files that qualified but exceeded MaxSize or MaxTotal
+	Hits          uint64 // Reads served from the memory layer
+	Misses        uint64 // Reads served from the bundled filesystem
+}
+
+// promoter tracks reads of bundled files and holds promoted copies in a
+// memory backend of its own. Files are keyed by promotedPath.
+type promoter struct {
+	policy   PromotionPolicy
+	reads    map[string]int // Reads of files not promoted yet, at most maxTrackedReads
+	files    afero.Fs
+	rejected map[string]bool
+	stats    PromotionStats
+	mu       sync.Mutex
+}
+
+// WithPromotionPolicy makes a hybrid VFS copy bundled files into memory
+// once they have been read policy.MinReads times, subject to the size
+// limits. Promoted files are kept in a memory backend of their own, using
+// the VFS's allocator, and later reads of them skip the bundled filesystem.
+// Other VFS types ignore the policy.
+func WithPromotionPolicy(policy PromotionPolicy) Option {
+	return func(v *VFS) {
+		if policy.MinReads < 1 {
+			policy.MinReads = 1
+		}
+		v.promoter = newPromoter(policy)
+	}
+}
+
+func newPromoter(policy PromotionPolicy) *promoter {
+	return &promoter{
+		policy:   policy,
+		reads:    make(map[string]int),
+		files:    afero.NewMemMapFs(),
+		rejected: make(map[string]bool),
+	}
+}
+
+// PromotionStats returns the promotion statistics of a hybrid VFS
+func (v *VFS) PromotionStats() PromotionStats {
+	if v.promoter == nil {
+		return PromotionStats{}
+	}
+
+	v.promoter.mu.Lock()
+	defer v.promoter.mu.Unlock()
+	return v.promoter.stats
+}
+
+// promotedPath returns the key of the bundled file bundledPath, read as
+// filename: a directory per bundle prefix holding the cleaned path, so that
+// every spelling of a file (prefix://a/../b, prefix://b) shares one copy
+func promotedPath(filename, bundledPath string) string {
+	prefix := strings.TrimSuffix(strings.TrimSuffix(filename, bundledPath), "://")
+	return path.Join("/", prefix, path.Clean("/"+bundledPath))
+}
+
+// lookup reads a promoted file from the memory backend
+func (p *promoter) lookup(key string) ([]byte, bool) {
+	data, err := afero.ReadFile(p.files, key)
+	if err != nil {
+		return nil, false
+	}
+
+	p.mu.Lock()
+	p.stats.Hits++
+	p.mu.Unlock()
+	return data, true
+}
+
+// recordRead counts a read from the bundled filesystem and promotes the file
+// once it qualifies, writing a copy of data to the memory backend
+func (p *promoter) recordRead(key string, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stats.Misses++
+	if p.rejected[key] {
+		return
+	}
+	if _, err := p.files.Stat(key); err == nil {
+		return
+	}
+
+	if _, ok := p.reads[key]; !ok && len(p.reads) >= maxTrackedReads {
+		// Make room by forgetting the count of an arbitrary file. Files
+		// read often enough to qualify are counted again soon.
+		for other := range p.reads {
+			delete(p.reads, other)
+			break
+		}
+	}
+	p.reads[key]++
+	if p.reads[key] < p.policy.MinReads {
+		return
+	}
+	delete(p.reads, key)
+
+	size := int64(len(data))
+	if (p.policy.MaxSize > 0 && size > p.policy.MaxSize) ||
+		(p.policy.MaxTotal > 0 && p.stats.PromotedBytes+size > p.policy.MaxTotal) {
+		p.rejected[key] = true
+		p.stats.Rejected++
+		return
+	}
+
+	if err := p.files.MkdirAll(path.Dir(key), 0755); err != nil {
+		return
+	}
+	if err := afero.WriteFile(p.files, key, data, 0444); err != nil {
+		return
+	}
+	p.stats.Promoted++
+	p.stats.PromotedBytes += size
+}
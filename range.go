@@ -0,0 +1,124 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// ReadRange reads up to length bytes of the file at path starting at offset
+// off, without reading the rest of the file. Fewer bytes are returned if the
+// file ends first; reading at or past the end returns no bytes and no error.
+// Memory and disk files are read in place with ReadAt, bundled files with
+// ReadAt or Seek, and a sealed VFS slices its immutable copy.
+func (v *VFS) ReadRange(path string, off, length int64) ([]byte, error) {
+	return tracked(v, "ReadRange", path, func(v *VFS) ([]byte, error) {
+		return v.readFileRange(path, off, length)
+	})
+}
+
+func (v *VFS) readFileRange(path string, off, length int64) (_ []byte, err error) {
+	if off < 0 || length < 0 {
+		return nil, &fs.PathError{Op: "readrange", Path: path, Err: fs.ErrInvalid}
+	}
+
+	if err := v.authorize("ReadRange", path, false); err != nil {
+		return nil, err
+	}
+
+	if bundled, bundledPath, ok := v.bundledManager.GetBundledFS(path); ok {
+		return bundled.ReadRange(bundledPath, off, length)
+	}
+
+	if entry, _ := v.sealedLookup(path); entry != nil && !entry.info.IsDir() {
+		start := min(off, int64(len(entry.data)))
+		end := start + min(length, int64(len(entry.data))-start)
+		return append([]byte(nil), entry.data[start:end]...), nil
+	}
+
+	f, err := v.fs.Open(v.normalizePath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readRange(f, off, length)
+}
+
+// ReadRange reads part of an embedded file
+func (b *BundledFS) ReadRange(path string, off, length int64) ([]byte, error) {
+	f, err := b.fsys.Open(b.getFullPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readRange(f, off, length)
+}
+
+// readRange reads up to length bytes of f at off, using the cheapest access
+// method f supports
+func readRange(f fs.File, off, length int64) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "readrange", Path: info.Name(), Err: errors.New("is a directory")}
+	}
+
+	// Clamp to the file size so huge lengths don't allocate
+	if off >= info.Size() {
+		return []byte{}, nil
+	}
+	buf := make([]byte, min(length, info.Size()-off))
+
+	var n int
+	switch r := f.(type) {
+	case io.ReaderAt:
+		n, err = r.ReadAt(buf, off)
+	case io.Seeker:
+		if _, err = r.Seek(off, io.SeekStart); err == nil {
+			n, err = io.ReadFull(f, buf)
+		}
+	default:
+		if _, err = io.CopyN(io.Discard, f, off); err == nil {
+			n, err = io.ReadFull(f, buf)
+		}
+	}
+
+	// The file may have shrunk since Stat
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read range of %s: %w", info.Name(), err)
+	}
+	return buf[:n], nil
+}
+
+// errRangeChanged is returned by rangeReaderAt once the file was written
+var errRangeChanged = errors.New("file changed while being read")
+
+// rangeReaderAt adapts ReadRange to io.ReaderAt for one version of a file,
+// read through an io.SectionReader of its size. A read fails once the
+// generation moves on from gen, or comes up short because the file shrank.
+type rangeReaderAt struct {
+	vfs     *VFS
+	path    string
+	gen     uint64
+	changed bool
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	data, err := r.vfs.ReadRange(r.path, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < len(p) || r.vfs.Generation(r.path) != r.gen {
+		r.changed = true
+		return 0, errRangeChanged
+	}
+	return copy(p, data), nil
+}
@@ -0,0 +1,152 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/spf13/afero"
+)
+
+// journalWrite records the change made by a write admitted by beginWrite,
+// if it succeeded. It runs before endWrite, while the journal's order lock
+// is held, and is used as
+//
+//	defer v.endWrite()
+//	defer v.journalWrite(&err, Change{Op: "MkdirAll", Path: path})
+func (v *VFS) journalWrite(errp *error, c Change) {
+	if *errp != nil || v.journal == nil {
+		return
+	}
+	c.Path = v.pathKey(c.Path)
+	if c.OldPath != "" {
+		c.OldPath = v.pathKey(c.OldPath)
+	}
+	if err := v.recordChange(c); err != nil {
+		*errp = err
+	}
+}
+
+// recordChange adds c to the journal, with the mode of created paths and
+// the content of closed files if the journal records content. Written
+// content comes with c, so that it is never read back. The order lock
+// must be held.
+func (v *VFS) recordChange(c Change) error {
+	var readErr error
+	if !v.journal.opts.Content {
+		c.Data = nil
+	} else if err := v.readChange(&c); err != nil {
+		readErr = fmt.Errorf("failed to record content of %s in change journal: %w", c.Path, err)
+	}
+	return errors.Join(readErr, v.journal.record(c))
+}
+
+// readChange fills in the mode of c.Path, and its content for Close
+// changes
+func (v *VFS) readChange(c *Change) error {
+	switch c.Op {
+	case "WriteFile", "CreateNew", "Close", "MkdirAll", "Chmod":
+	default:
+		return nil
+	}
+	info, err := v.fs.Stat(c.Path)
+	if err != nil {
+		return err
+	}
+	c.Mode = info.Mode()
+	if c.Op != "Close" || info.IsDir() {
+		return nil
+	}
+	c.Data, err = afero.ReadFile(v.fs, c.Path)
+	c.Size = int64(len(c.Data))
+	return err
+}
+
+// journalOnClose is a file from Create whose content is journaled once
+// closed
+type journalOnClose struct {
+	afero.File
+	v   *VFS
+	key string
+}
+
+func (f *journalOnClose) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	f.v.journal.order.Lock()
+	err := f.v.recordChange(Change{Op: "Close", Path: f.key})
+	f.v.journal.order.Unlock()
+	f.v.changed.notify()
+	return err
+}
+
+// RebuildAt replays the change journal up to cursor into a new memory VFS,
+// showing the tree as it was at that point: for example what /out looked
+// like before step 7 of a pipeline. The journal must record content (see
+// JournalOptions.Content). With a Path, it is replayed from the file,
+// which keeps every change; otherwise MaxChanges must not have dropped any.
+//
+// Only changes made through the VFS are replayed: paths that existed
+// before the journal began, such as files already on disk, are missing.
+// Bundled resources are shared, as with Clone.
+func (v *VFS) RebuildAt(cursor Cursor) (*VFS, error) {
+	if v.journal == nil || !v.journal.opts.Content {
+		return nil, errors.New("rebuilding needs a change journal that records content")
+	}
+	if head := v.journal.cursor(); cursor > head {
+		return nil, fmt.Errorf("cursor %d is ahead of the journal at %d", cursor, head)
+	}
+
+	rebuilt := NewMemoryVFS(WithLogger(v.logger))
+	rebuilt.bundledManager = v.bundledManager
+	err := v.journal.each(cursor, func(c Change) error {
+		if err := rebuilt.replay(c); err != nil {
+			return fmt.Errorf("replaying change %d, %s %s: %w", c.Cursor, c.Op, c.Path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rebuilt, nil
+}
+
+// replay applies a journaled change directly to the backend. Changes
+// recorded without a mode get the defaults of the VFS.
+func (v *VFS) replay(c Change) error {
+	switch c.Op {
+	case "MkdirAll":
+		perm := c.Mode.Perm()
+		if c.Mode == 0 {
+			perm = 0755
+		}
+		return v.fs.MkdirAll(c.Path, perm)
+	case "Create", "WriteFile", "CreateNew", "Close":
+		if err := v.fs.MkdirAll(path.Dir(c.Path), 0755); err != nil {
+			return err
+		}
+		f, err := v.fs.Create(c.Path)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(c.Data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil || c.Mode == 0 {
+			return err
+		}
+		return v.fs.Chmod(c.Path, c.Mode.Perm())
+	case "Chmod":
+		return v.fs.Chmod(c.Path, c.Mode)
+	case "Remove", "RemoveAll":
+		return v.fs.RemoveAll(c.Path)
+	case "RenameDir":
+		if err := v.fs.MkdirAll(path.Dir(c.Path), 0755); err != nil {
+			return err
+		}
+		return v.fs.Rename(c.OldPath, c.Path)
+	}
+	return fmt.Errorf("unknown operation %s", c.Op)
+}
@@ -0,0 +1,222 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// RenameDir moves the directory oldPath, with everything below it, to
+// newPath, which must not exist yet. Backends that can rename in place (disk
+// and memory) do so in one step; the VFS's own state follows the move:
+// watches, the path index, metadata hashes and tags, and directory
+// listings. Watchers of either path receive one WatchOpRename event with
+// OldPath set. Moves between disk roots of a multi-root VFS are copied.
+func (v *VFS) RenameDir(oldPath, newPath string) error {
+	return v.track("RenameDir", oldPath, func(v *VFS) error {
+		return v.renameDir(oldPath, newPath)
+	})
+}
+
+func (v *VFS) renameDir(oldPath, newPath string) (err error) {
+	defer v.renameMutation("RenameDir", oldPath, newPath)(&err)
+
+	if err := v.authorize("RenameDir", oldPath, true); err != nil {
+		return err
+	}
+	if err := v.authorize("RenameDir", newPath, true); err != nil {
+		return err
+	}
+	if err := v.admitCreate("RenameDir", newPath, true); err != nil {
+		return err
+	}
+
+	if err := v.beginWrite("RenameDir", oldPath, true); err != nil {
+		return err
+	}
+	defer v.endWrite()
+	defer v.journalWrite(&err, Change{Op: "RenameDir", Path: newPath, OldPath: oldPath})
+
+	if v.bundledManager.IsBundledPath(oldPath) || v.bundledManager.IsBundledPath(newPath) {
+		return fmt.Errorf("cannot rename bundled URLs: %s to %s", oldPath, newPath)
+	}
+
+	oldKey, newKey := v.pathKey(oldPath), v.pathKey(newPath)
+	if frozen := v.frozenBy(newKey, true); frozen != "" {
+		return &fs.PathError{Op: "RenameDir", Path: newPath, Err: fmt.Errorf("%w: %s", ErrFrozen, frozen)}
+	}
+	if oldKey == "/" || within(newKey, oldKey) {
+		return &fs.PathError{Op: "RenameDir", Path: newPath, Err: fmt.Errorf("%w: cannot move %s into itself", fs.ErrInvalid, oldPath)}
+	}
+
+	info, err := v.fs.Stat(oldKey)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: "RenameDir", Path: oldPath, Err: errors.New("not a directory")}
+	}
+	if _, err := v.fs.Stat(newKey); err == nil {
+		return &fs.PathError{Op: "RenameDir", Path: newPath, Err: fs.ErrExist}
+	}
+	if err := v.checkWriteTree("RenameDir", oldKey, newKey); err != nil {
+		return err
+	}
+	if err := v.fs.MkdirAll(path.Dir(newKey), 0755); err != nil {
+		return err
+	}
+
+	err = v.fs.Rename(oldKey, newKey)
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) && errors.Is(linkErr.Err, errCrossMount) {
+		err = v.copyDir(oldKey, newKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	if v.watchManager != nil {
+		v.watchManager.rename(oldKey, newKey)
+	}
+	v.logger.Debug("Renamed directory %s to %s", oldPath, newPath)
+	return nil
+}
+
+// copyDir moves a directory by copying it and removing the original, for
+// backends that cannot rename between the two paths
+func (v *VFS) copyDir(oldKey, newKey string) error {
+	if _, err := copyTree(afero.NewBasePathFs(v.fs, oldKey), afero.NewBasePathFs(v.fs, newKey)); err != nil {
+		v.fs.RemoveAll(newKey)
+		return err
+	}
+	return v.fs.RemoveAll(oldKey)
+}
+
+// renamedPath returns p, which lies within oldKey, moved to newKey
+func renamedPath(p, oldKey, newKey string) string {
+	if oldKey == "/" {
+		return path.Join(newKey, p)
+	}
+	return newKey + strings.TrimPrefix(p, oldKey)
+}
+
+// rename moves the generations below oldKey to newKey. Moved paths get new
+// generations, since their content is new at that path.
+func (g *generationTable) rename(oldKey, newKey string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	moved := g.detach(oldKey)
+	if moved == nil {
+		moved = &genNode{}
+	}
+	var renumber func(node *genNode)
+	renumber = func(node *genNode) {
+		if node.gen != 0 {
+			g.next++
+			node.gen = g.next
+		}
+		for _, child := range node.children {
+			renumber(child)
+		}
+	}
+	renumber(moved)
+	g.next++
+	moved.gen = g.next
+
+	g.detach(newKey)
+	*g.lookup(newKey, true) = *moved
+}
+
+// rename moves the records below oldKey to newKey, keeping their hashes
+// and tags
+func (db *metadataDB) rename(oldKey, newKey string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var moved []*FileMetadata
+	for p, rec := range db.records {
+		if within(p, oldKey) {
+			delete(db.records, p)
+			rec.Path = renamedPath(p, oldKey, newKey)
+			moved = append(moved, rec)
+		}
+	}
+	for _, rec := range moved {
+		db.records[rec.Path] = rec
+		db.dirty = true
+	}
+}
+
+// rename moves the watches below oldKey to newKey and notifies the watchers
+// of either path with a single rename event
+func (wm *WatchManager) rename(oldKey, newKey string) {
+	if wm == nil {
+		return
+	}
+
+	wm.mu.Lock()
+	if wm.closed {
+		wm.mu.Unlock()
+		return
+	}
+
+	// Collect before inserting, so that moved entries are not visited again
+	moved := make(map[internedPath]WatchAction)
+	for p, action := range wm.watches {
+		s := p.String()
+		if !within(s, oldKey) {
+			continue
+		}
+		to := renamedPath(s, oldKey, newKey)
+		if oldDisk, err := wm.diskPath(s); err == nil && !wm.internal[oldDisk] {
+			wm.watcher.Remove(oldDisk)
+		}
+		if newDisk, err := wm.diskPath(to); err == nil {
+			if err := wm.watcher.Add(newDisk); err != nil {
+				wm.logger.Error("Failed to move watch from %s to %s: %v", s, to, err)
+			}
+		}
+		delete(wm.watches, p)
+		moved[internPath(to)] = action
+	}
+	for p, action := range moved {
+		wm.watches[p] = action
+	}
+
+	oldDir, oldErr := wm.diskPath(oldKey)
+	newDir, newErr := wm.diskPath(newKey)
+	if oldErr == nil && newErr == nil {
+		var movedDirs []string
+		for disk := range wm.internal {
+			rel, err := filepath.Rel(oldDir, disk)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			delete(wm.internal, disk)
+			wm.watcher.Remove(disk)
+			movedDirs = append(movedDirs, filepath.Join(newDir, rel))
+		}
+		for _, dir := range movedDirs {
+			if err := wm.watcher.Add(dir); err == nil {
+				wm.internal[dir] = true
+			}
+		}
+	}
+	wm.mu.Unlock()
+
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	event := WatchEvent{Path: newKey, OldPath: oldKey, Op: WatchOpRename, IsDir: true}
+	for watchPath, action := range wm.watches {
+		if wm.pathMatches(newKey, watchPath.String()) || wm.pathMatches(oldKey, watchPath.String()) {
+			wm.dispatch(action, event)
+		}
+	}
+}
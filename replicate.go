@@ -0,0 +1,440 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReplicaConflict is returned by Replicate for target paths that were
+// changed by someone else since they were last replicated
+var ErrReplicaConflict = errors.New("target changed since it was last replicated")
+
+// ReplicateOptions configures Replicate
+type ReplicateOptions struct {
+	Root       string        // Subtree to replicate, "/" by default
+	Dest       string        // Where Root goes on the target, Root by default
+	Continuous bool          // Keep pushing changes until ctx is done
+	Interval   time.Duration // Also push every Interval when continuous, to catch changes made behind the VFS's back
+	Overwrite  bool          // Push over target changes instead of reporting conflicts
+	OnError    func(error)   // Receives the errors of continuous pushes, which are logged otherwise
+	StatePath  string        // File recording what was pushed, so that a restarted Replicate pushes only changes and still detects conflicts
+}
+
+// changeSignal wakes up subscribers after mutations. It is shared by all
+// views of a VFS.
+type changeSignal struct {
+	subs map[chan struct{}]bool
+	mu   sync.Mutex
+}
+
+// subscribe returns a channel that receives a value after mutations, and
+// the function that unsubscribes it. Mutations made while the subscriber
+// is busy are coalesced into one value.
+func (s *changeSignal) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	if s.subs == nil {
+		s.subs = make(map[chan struct{}]bool)
+	}
+	s.subs[ch] = true
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}
+}
+
+func (s *changeSignal) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicaState is what a path looked like when it was last pushed
+type replicaState struct {
+	Source string `json:"source"` // Change token of the source entry
+	Target string `json:"target"` // Change token of the target entry after the push
+}
+
+// replicaFile is the format of ReplicateOptions.StatePath
+type replicaFile struct {
+	Root   string                  `json:"root"`
+	Dest   string                  `json:"dest"`
+	Pushed map[string]replicaState `json:"pushed"`
+}
+
+// replicator pushes one subtree of a VFS to a target
+type replicator struct {
+	v      *VFS
+	target FileSystem
+	opts   ReplicateOptions
+	pushed map[string]replicaState // By path relative to Root
+}
+
+// Replicate pushes the tree at opts.Root to target, like SaveToDisk does
+// for disk: files and directories that changed since the last push are
+// written, and ones removed from the VFS are removed from the target.
+//
+// Entries are compared by their change tokens (see ETag), so only changes
+// are pushed. Target paths that someone else modified or removed since they
+// were pushed are left alone and reported as ErrReplicaConflict, unless
+// opts.Overwrite is set. Entries already on the target before the first
+// push are overwritten.
+//
+// What was pushed is only known to the running Replicate unless
+// opts.StatePath is set; a later Replicate without it pushes everything
+// again and cannot tell target changes from its own.
+//
+// Without opts.Continuous, Replicate pushes once and returns the errors met.
+// Otherwise it pushes again after every mutation through the VFS, and every
+// opts.Interval if set, until ctx is done, then returns ctx.Err(). With a
+// change journal (see WithChangeJournal), only the paths in the journal
+// are pushed after a mutation; without one, the whole tree is compared.
+func (v *VFS) Replicate(ctx context.Context, target FileSystem, opts ReplicateOptions) error {
+	if target == nil {
+		return fmt.Errorf("replicate: nil target")
+	}
+	if v.bundledManager.IsBundledPath(opts.Root) {
+		return fmt.Errorf("replicate: cannot replicate bundled URLs")
+	}
+	if opts.Root == "" {
+		opts.Root = "/"
+	}
+	opts.Root = v.pathKey(opts.Root)
+	if opts.Dest == "" {
+		opts.Dest = opts.Root
+	}
+	opts.Dest = v.pathKey(opts.Dest)
+
+	r := &replicator{v: v, target: target, opts: opts, pushed: make(map[string]replicaState)}
+	if err := r.load(); err != nil {
+		return fmt.Errorf("replicate: %w", err)
+	}
+	if !opts.Continuous {
+		return r.push(ctx, ".")
+	}
+
+	changed, unsubscribe := v.changed.subscribe()
+	defer unsubscribe()
+
+	var tick <-chan time.Time
+	if opts.Interval > 0 {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// Changes made during a push are pushed again by the next one
+	var cursor Cursor
+	if v.journal != nil {
+		cursor = v.journal.cursor()
+	}
+	err := r.push(ctx, ".")
+	for {
+		if err != nil && ctx.Err() == nil {
+			if opts.OnError != nil {
+				opts.OnError(err)
+			} else {
+				v.logger.Error("Replicating %s: %v", opts.Root, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick:
+			err = r.push(ctx, ".")
+			continue
+		case <-changed:
+		}
+		if v.journal == nil {
+			err = r.push(ctx, ".")
+			continue
+		}
+
+		changes, next, journalErr := v.journal.since(cursor)
+		if journalErr != nil { // Truncated, so compare everything
+			cursor = v.journal.cursor()
+			err = r.push(ctx, ".")
+			continue
+		}
+		cursor = next
+		err = r.pushChanges(ctx, changes)
+	}
+}
+
+// pushChanges pushes the paths below Root that changes touched
+func (r *replicator) pushChanges(ctx context.Context, changes []Change) error {
+	var touched []string
+	for _, c := range changes {
+		for _, key := range []string{c.Path, c.OldPath} {
+			if key != "" && within(key, r.opts.Root) && !r.v.hidden.hidesBelow(r.opts.Root, key) {
+				touched = append(touched, relPath(r.opts.Root, key))
+			}
+		}
+	}
+	sort.Strings(touched)
+
+	// A path is pushed with its subtree, from its highest ancestor that
+	// was never pushed, so that new parent directories are pushed too
+	var errs []error
+	var done []string
+	for _, rel := range touched {
+		for dir := rel; dir != "."; {
+			dir = path.Dir(dir)
+			if _, known := r.pushed[dir]; !known {
+				rel = dir
+			}
+		}
+		if slices.ContainsFunc(done, func(d string) bool { return relWithin(rel, d) }) {
+			continue
+		}
+		done = append(done, rel)
+		if err := r.push(ctx, rel); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// push makes one pass over the source tree at rel, relative to Root,
+// pushing what changed, then saves the state
+func (r *replicator) push(ctx context.Context, rel string) error {
+	err := r.pushTree(ctx, rel)
+	if saveErr := r.save(); saveErr != nil {
+		err = errors.Join(err, fmt.Errorf("replicate: %w", saveErr))
+	}
+	return err
+}
+
+// pushTree pushes the source tree at rel, and removes from the target
+// what was pushed below rel but is gone from the source
+func (r *replicator) pushTree(ctx context.Context, rel string) error {
+	var errs []error
+	seen := make(map[string]bool)
+
+	root := path.Join(r.opts.Root, rel)
+	if _, err := r.v.Stat(root); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if err == nil {
+		if err := r.walkTree(ctx, root, rel, seen, &errs); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+	}
+
+	// Children sort after their parents, so go backwards. Directories
+	// holding a conflicting entry are kept.
+	var removed, kept []string
+	for p := range r.pushed {
+		if relWithin(p, rel) && !seen[p] {
+			removed = append(removed, p)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	for _, p := range removed {
+		if slices.ContainsFunc(kept, func(k string) bool { return relWithin(k, p) }) {
+			continue
+		}
+		if err := r.remove(p); err != nil {
+			errs = append(errs, err)
+			kept = append(kept, p)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// walkTree pushes every entry of the source tree at root, which is rel
+// relative to Root, and marks it as seen
+func (r *replicator) walkTree(ctx context.Context, root, rel string, seen map[string]bool, errs *[]error) error {
+	base, visited := "", false
+	return r.v.walk(root, func(entry WalkEntry, err error) error {
+		if !visited {
+			base, visited = entry.FSPath, true
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p := path.Join(rel, relPath(base, entry.FSPath))
+		seen[p] = true
+		if err := r.pushEntry(p, entry); err != nil {
+			*errs = append(*errs, err)
+		}
+		return nil
+	})
+}
+
+// load reads the state saved at StatePath by an earlier Replicate of the
+// same Root and Dest, if any
+func (r *replicator) load() error {
+	if r.opts.StatePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(r.opts.StatePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var file replicaFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid replication state %s: %w", r.opts.StatePath, err)
+	}
+	if file.Root == r.opts.Root && file.Dest == r.opts.Dest && file.Pushed != nil {
+		r.pushed = file.Pushed
+	}
+	return nil
+}
+
+// save writes the state to StatePath, replacing the file atomically
+func (r *replicator) save() error {
+	if r.opts.StatePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(replicaFile{Root: r.opts.Root, Dest: r.opts.Dest, Pushed: r.pushed})
+	if err != nil {
+		return err
+	}
+	tmp := r.opts.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.opts.StatePath)
+}
+
+// relWithin is within for paths relative to Root
+func relWithin(p, dir string) bool {
+	return dir == "." || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// pushEntry pushes the source entry at rel if it changed since the last push
+func (r *replicator) pushEntry(rel string, entry WalkEntry) error {
+	token := r.sourceToken(entry)
+	state, known := r.pushed[rel]
+	if known && state.Source == token {
+		return nil
+	}
+
+	dest := r.destPath(rel)
+	if err := r.checkTarget(dest, state, known); err != nil {
+		return err
+	}
+
+	info := entry.Info
+	if info.IsDir() {
+		if err := r.target.MkdirAll(dest, info.Mode().Perm()); err != nil {
+			return err
+		}
+	} else {
+		data, err := r.v.ReadFile(entry.Path)
+		if err != nil {
+			return err
+		}
+		if err := r.target.WriteFile(dest, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	targetInfo, err := r.target.Stat(dest)
+	if err != nil {
+		return err
+	}
+	r.pushed[rel] = replicaState{Source: token, Target: r.targetToken(dest, targetInfo)}
+	return nil
+}
+
+// remove removes the target counterpart of a source entry that is gone
+func (r *replicator) remove(rel string) error {
+	dest := r.destPath(rel)
+	if err := r.checkTarget(dest, r.pushed[rel], true); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			delete(r.pushed, rel) // Gone on both sides
+			return nil
+		}
+		return err
+	}
+	if err := r.target.RemoveAll(dest); err != nil {
+		return err
+	}
+	delete(r.pushed, rel)
+	return nil
+}
+
+// checkTarget returns ErrReplicaConflict if the target entry at dest no
+// longer is what was last pushed there. A known entry that is missing is
+// reported as a conflict that also matches fs.ErrNotExist.
+func (r *replicator) checkTarget(dest string, state replicaState, known bool) error {
+	if !known || r.opts.Overwrite {
+		return nil
+	}
+	info, err := r.target.Stat(dest)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &fs.PathError{Op: "Replicate", Path: dest, Err: errors.Join(ErrReplicaConflict, fs.ErrNotExist)}
+		}
+		return err
+	}
+	if r.targetToken(dest, info) != state.Target {
+		return &fs.PathError{Op: "Replicate", Path: dest, Err: ErrReplicaConflict}
+	}
+	return nil
+}
+
+// destPath maps a path relative to Root to the target
+func (r *replicator) destPath(rel string) string {
+	return path.Join(r.opts.Dest, rel)
+}
+
+// sourceToken returns the change token of a source entry. Directories only
+// change with their mode: their contents are pushed entry by entry.
+func (r *replicator) sourceToken(entry WalkEntry) string {
+	if entry.Info.IsDir() {
+		return fmt.Sprintf("dir-%o", entry.Info.Mode().Perm())
+	}
+	tag, err := r.v.ETag(entry.Path)
+	if err != nil {
+		return statToken(entry.Info)
+	}
+	return fmt.Sprintf("%s-%o", tag, entry.Info.Mode().Perm())
+}
+
+// targetToken returns the change token of a target entry: its ETag if the
+// target is a VFS, and its size, time and mode otherwise. Pushing into a
+// directory changes its time, so directories only count their mode.
+func (r *replicator) targetToken(dest string, info fs.FileInfo) string {
+	if info.IsDir() {
+		return fmt.Sprintf("dir-%o", info.Mode().Perm())
+	}
+	if tv, ok := r.target.(*VFS); ok {
+		if tag, err := tv.ETag(dest); err == nil {
+			return fmt.Sprintf("%s-%o", tag, info.Mode().Perm())
+		}
+	}
+	return statToken(info)
+}
+
+// statToken is the change token of a file known only by its FileInfo
+func statToken(info fs.FileInfo) string {
+	return fmt.Sprintf("%x-%x-%o", info.Size(), info.ModTime().UnixNano(), info.Mode().Perm())
+}
@@ -0,0 +1,86 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+// scanProgressInterval is the minimum time between progress reports
+const scanProgressInterval = 100 * time.Millisecond
+
+// ScanProgress reports the progress of a background scan
+type ScanProgress struct {
+	Phase string // "index" or "metadata"
+	Path  string // Entry being scanned
+	Files int    // Files scanned so far in this phase
+	Dirs  int    // Directories scanned so far in this phase
+	Bytes int64  // Size of the files scanned so far in this phase
+	Done  bool   // Set on the final report
+	Err   error  // Why the scan stopped, on the final report
+}
+
+// ScanAsync builds the path index (see WithPathIndex) and rescans the
+// metadata database (see WithMetadataDB) in the background, so a large
+// disk root can be indexed while the application is already running.
+// Progress is reported on the returned channel at most every 100ms, and
+// the channel is closed after a final report with Done set. The caller
+// must drain the channel. Cancelling ctx stops the scan; the final report
+// then carries ctx's error.
+func (v *VFS) ScanAsync(ctx context.Context) (<-chan ScanProgress, error) {
+	if v.pathIndex == nil && v.metadata == nil {
+		return nil, errors.New("neither a path index nor a metadata database is enabled")
+	}
+
+	progress := make(chan ScanProgress, 1)
+	go func() {
+		defer close(progress)
+
+		var current ScanProgress
+		var last time.Time
+		send := func(p ScanProgress) {
+			select {
+			case progress <- p:
+			case <-ctx.Done():
+			}
+		}
+		visit := func(path string, info fs.FileInfo) {
+			current.Path = path
+			if info.IsDir() {
+				current.Dirs++
+			} else {
+				current.Files++
+				current.Bytes += info.Size()
+			}
+			if time.Since(last) >= scanProgressInterval {
+				last = time.Now()
+				send(current)
+			}
+		}
+
+		var err error
+		if v.pathIndex != nil {
+			current = ScanProgress{Phase: "index"}
+			err = v.refreshIndex(ctx, visit)
+		}
+		if err == nil && v.metadata != nil {
+			current = ScanProgress{Phase: "metadata"}
+			err = v.rescanMetadata(ctx, visit)
+		}
+
+		current.Done = true
+		current.Err = err
+		if ctx.Err() != nil {
+			// The caller may have stopped reading
+			select {
+			case progress <- current:
+			default:
+			}
+			return
+		}
+		send(current)
+	}()
+
+	return progress, nil
+}
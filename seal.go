@@ -0,0 +1,157 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/afero"
+)
+
+// ErrSealed is returned for writes to a sealed VFS
+var ErrSealed = errors.New("vfs is sealed")
+
+// sealState is shared by a VFS and all views created from it
+type sealState struct {
+	gate   sync.RWMutex // Held for reading by writers and exclusively by Seal
+	sealed atomic.Bool
+	index  atomic.Pointer[sealedIndex]
+	frozen []string // Sorted roots of frozen subtrees, guarded by gate
+}
+
+// sealedIndex is an immutable snapshot of a sealed memory VFS. It is never
+// modified after publication, so reads need no locking.
+type sealedIndex struct {
+	entries map[string]*sealedEntry // By path key, looked up on every read
+}
+
+type sealedEntry struct {
+	info  fs.FileInfo
+	data  []byte
+	files []string // Sorted child file names, for directories
+	dirs  []string // Sorted child directory names, for directories
+}
+
+// Seal makes the VFS permanently immutable. Every later write through the
+// VFS or any of its views fails with ErrSealed, and writes already in
+// progress finish before Seal returns. Files opened with Create before
+// sealing remain writable.
+//
+// Memory and hybrid filesystems are additionally frozen into an immutable
+// index, so ReadFile, Stat, Exists, IsDir, ListFiles and ListDirs are served
+// without taking any lock. Disk filesystems keep reading from disk.
+func (v *VFS) Seal() error {
+	v.seal.gate.Lock()
+	defer v.seal.gate.Unlock()
+
+	if v.seal.sealed.Load() {
+		return nil
+	}
+
+	if v.vfsType == VFSTypeMemory || v.vfsType == VFSTypeHybrid {
+		index, err := v.buildSealedIndex()
+		if err != nil {
+			return err
+		}
+		v.seal.index.Store(index)
+	}
+
+	v.seal.sealed.Store(true)
+	v.logger.Debug("Sealed VFS")
+	return nil
+}
+
+// IsSealed reports whether Seal has been called
+func (v *VFS) IsSealed() bool {
+	return v.seal.sealed.Load()
+}
+
+// beginWrite admits a write operation, failing if the VFS is sealed or path
+// is frozen. subtree reports whether the operation also affects everything
+// below path. Every successful call must be paired with endWrite.
+func (v *VFS) beginWrite(op, path string, subtree bool) error {
+	if v.journal != nil {
+		v.journal.order.Lock()
+	}
+	v.seal.gate.RLock()
+	if v.seal.sealed.Load() {
+		v.endWrite()
+		return &fs.PathError{Op: op, Path: path, Err: ErrSealed}
+	}
+	if len(v.seal.frozen) > 0 && !v.bundledManager.IsBundledPath(path) {
+		if frozen := v.frozenBy(v.pathKey(path), subtree); frozen != "" {
+			v.endWrite()
+			return &fs.PathError{Op: op, Path: path, Err: fmt.Errorf("%w: %s", ErrFrozen, frozen)}
+		}
+	}
+	return nil
+}
+
+// endWrite releases a write admitted by beginWrite
+func (v *VFS) endWrite() {
+	v.seal.gate.RUnlock()
+	if v.journal != nil {
+		v.journal.order.Unlock()
+	}
+}
+
+// buildSealedIndex snapshots every non-bundled entry
+func (v *VFS) buildSealedIndex() (*sealedIndex, error) {
+	index := &sealedIndex{entries: make(map[string]*sealedEntry)}
+
+	err := afero.Walk(v.fs, "/", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		path = filepath.ToSlash(path)
+		entry := &sealedEntry{info: FileInfo{
+			name:    info.Name(),
+			size:    info.Size(),
+			mode:    info.Mode(),
+			modTime: info.ModTime(),
+			isDir:   info.IsDir(),
+		}}
+		if !info.IsDir() {
+			if entry.data, err = v.afero.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		index.entries[path] = entry
+
+		if path != "/" {
+			if parent, ok := index.entries[filepath.ToSlash(filepath.Dir(path))]; ok {
+				if info.IsDir() {
+					parent.dirs = append(parent.dirs, info.Name())
+				} else {
+					parent.files = append(parent.files, info.Name())
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, entry := range index.entries {
+		sort.Strings(entry.files)
+		sort.Strings(entry.dirs)
+	}
+	return index, nil
+}
+
+// sealedLookup returns the immutable index entry for path. indexed reports
+// whether the VFS is sealed with an index, in which case a nil entry means
+// the path does not exist.
+func (v *VFS) sealedLookup(path string) (entry *sealedEntry, indexed bool) {
+	index := v.seal.index.Load()
+	if index == nil {
+		return nil, false
+	}
+	return index.entries[v.pathKey(path)], true
+}
@@ -0,0 +1,153 @@
+package vfs
+
+import (
+	"bytes"
+	"sync"
+)
+
+// defaultSharedCacheLimit bounds the memory held by OpenShared copies
+const defaultSharedCacheLimit = 64 << 20
+
+// sharedCache holds one copy of each hot file opened with OpenShared. It is
+// shared by all views of a VFS.
+type sharedCache struct {
+	entries map[internedPath]*sharedEntry
+	size    int64
+	limit   int64
+	clock   uint64 // Incremented on every open, to find the least recently used entry
+	mu      sync.Mutex
+}
+
+type sharedEntry struct {
+	version string        // ETag of the file when it was read
+	ready   chan struct{} // Closed once data or err is set
+	data    []byte
+	err     error
+	size    int64 // Bytes accounted to the cache, set under the cache lock
+	lastUse uint64
+}
+
+func newSharedCache() *sharedCache {
+	return &sharedCache{entries: make(map[internedPath]*sharedEntry), limit: defaultSharedCacheLimit}
+}
+
+// WithSharedCacheLimit sets the total size of the file copies kept for
+// OpenShared (64 MiB by default). The least recently opened files are
+// dropped first; files larger than the limit are never cached.
+func WithSharedCacheLimit(bytes int64) Option {
+	return func(v *VFS) {
+		v.shared.limit = bytes
+	}
+}
+
+// OpenShared returns a reader over a single cached copy of the file at path.
+// Concurrent and repeated calls share that copy, so a hot file read by every
+// worker occupies memory once, and only the first caller reads it from the
+// underlying storage. The copy is refreshed when the file changes and
+// dropped when it is written or removed through the VFS.
+//
+// The readers are independent: each has its own position and is safe to use
+// alongside the others. A sealed VFS returns readers over its immutable
+// snapshot without any caching.
+func (v *VFS) OpenShared(path string) (*bytes.Reader, error) {
+	if err := v.authorize("OpenShared", path, false); err != nil {
+		return nil, err
+	}
+
+	if entry, _ := v.sealedLookup(path); entry != nil && !entry.info.IsDir() {
+		return bytes.NewReader(entry.data), nil
+	}
+
+	// Bundled files never change, so any cached copy is current
+	version := ""
+	if !v.bundledManager.IsBundledPath(path) {
+		// Taken before reading: if the file changes in between, the copy is
+		// newer than its version and simply gets re-read on the next open
+		etag, err := v.ETag(path)
+		if err != nil {
+			return nil, err
+		}
+		version = etag
+	}
+
+	key := internPath(v.pathKey(path))
+	c := v.shared
+
+	c.mu.Lock()
+	c.clock++
+	entry, ok := c.entries[key]
+	if ok && entry.version == version {
+		entry.lastUse = c.clock
+		c.mu.Unlock()
+
+		<-entry.ready
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return bytes.NewReader(entry.data), nil
+	}
+
+	if ok {
+		c.size -= entry.size
+	}
+	entry = &sharedEntry{version: version, ready: make(chan struct{}), lastUse: c.clock}
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	entry.data, entry.err = v.ReadFile(path)
+	close(entry.ready)
+
+	c.mu.Lock()
+	if c.entries[key] == entry {
+		if entry.err != nil || int64(len(entry.data)) > c.limit {
+			delete(c.entries, key)
+		} else {
+			entry.size = int64(len(entry.data))
+			c.size += entry.size
+			c.evict()
+		}
+	}
+	c.mu.Unlock()
+
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return bytes.NewReader(entry.data), nil
+}
+
+// evict drops the least recently used copies until the cache fits its
+// limit. The caller must hold c.mu.
+func (c *sharedCache) evict() {
+	for c.size > c.limit {
+		var oldestKey internedPath
+		var oldest *sharedEntry
+		for key, entry := range c.entries {
+			select {
+			case <-entry.ready:
+			default:
+				continue // Still being read
+			}
+			if oldest == nil || entry.lastUse < oldest.lastUse {
+				oldestKey, oldest = key, entry
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(c.entries, oldestKey)
+		c.size -= oldest.size
+	}
+}
+
+// forget drops the copy of path, and of everything below it if removed
+func (c *sharedCache) forget(path string, removed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if p := key.String(); p == path || (removed && within(p, path)) {
+			delete(c.entries, key)
+			c.size -= entry.size
+		}
+	}
+}
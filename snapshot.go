@@ -0,0 +1,154 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SnapshotInfo describes a labeled snapshot
+type SnapshotInfo struct {
+	Label  string
+	Time   time.Time
+	Cursor Cursor // Change journal position when taken, 0 without a journal
+}
+
+// snapshot is a labeled, sealed copy of a VFS
+type snapshot struct {
+	info SnapshotInfo
+	vfs  *VFS
+}
+
+// snapshotSet holds the labeled snapshots of a VFS. It is shared by all
+// views.
+type snapshotSet struct {
+	byLabel map[string]*snapshot
+	mu      sync.Mutex
+}
+
+// SnapshotNamed takes a snapshot of the whole VFS under label: a sealed
+// memory copy that later writes do not affect. It shows a single point in
+// time, the one at SnapshotInfo.Cursor: RebuildAt of that cursor shows the
+// same tree, except for paths that existed before the journal began and
+// files still open from Create. Labels are unique; DeleteSnapshot frees one
+// for reuse. If an entry cannot be read, for example because the access
+// policy denies it, no snapshot is taken and the error is returned.
+//
+// Each snapshot is a full deep copy, as made by Clone, so taking one costs
+// time and memory in proportion to the whole tree, and the memory stays
+// in use until the snapshot is deleted. Every write through the VFS and its
+// views waits for the whole copy, so on a large tree writers stall for as
+// long as the snapshot takes; reads go on.
+//
+// Snapshots give long-lived tools a lightweight branching model: take one
+// before an experiment, compare with DiffSnapshots, export it through the
+// VFS returned by Snapshot, or Clone it to continue from there.
+func (v *VFS) SnapshotNamed(label string) error {
+	if label == "" {
+		return errors.New("snapshot label is empty")
+	}
+
+	set := v.snapshots
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if _, ok := set.byLabel[label]; ok {
+		return fmt.Errorf("snapshot %q: %w", label, fs.ErrExist)
+	}
+
+	// The order lock also holds back Close changes, which are journaled
+	// outside the gate
+	if v.journal != nil {
+		v.journal.order.Lock()
+	}
+	v.seal.gate.Lock()
+	copied, err := v.cloneWith(newCopyOptions(nil))
+	var cursor Cursor
+	if v.journal != nil {
+		cursor = v.journal.cursor()
+	}
+	v.seal.gate.Unlock()
+	if v.journal != nil {
+		v.journal.order.Unlock()
+	}
+
+	if err != nil {
+		return fmt.Errorf("snapshot %q: %w", label, err)
+	}
+	if err := copied.Seal(); err != nil {
+		return fmt.Errorf("snapshot %q: %w", label, err)
+	}
+	if set.byLabel == nil {
+		set.byLabel = make(map[string]*snapshot)
+	}
+	set.byLabel[label] = &snapshot{info: SnapshotInfo{Label: label, Time: time.Now(), Cursor: cursor}, vfs: copied}
+	v.logger.Debug("Took snapshot %q", label)
+	return nil
+}
+
+// Snapshot returns the sealed VFS of the snapshot labeled label, to read or
+// export, for example with ExportTxtar or SaveToDisk
+func (v *VFS) Snapshot(label string) (*VFS, error) {
+	set := v.snapshots
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	s, ok := set.byLabel[label]
+	if !ok {
+		return nil, fmt.Errorf("snapshot %q: %w", label, fs.ErrNotExist)
+	}
+	return s.vfs, nil
+}
+
+// Snapshots lists the labeled snapshots, oldest first
+func (v *VFS) Snapshots() []SnapshotInfo {
+	set := v.snapshots
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	infos := make([]SnapshotInfo, 0, len(set.byLabel))
+	for _, s := range set.byLabel {
+		infos = append(infos, s.info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].Time.Equal(infos[j].Time) {
+			return infos[i].Time.Before(infos[j].Time)
+		}
+		return infos[i].Label < infos[j].Label
+	})
+	return infos
+}
+
+// DeleteSnapshot drops the snapshot labeled label
+func (v *VFS) DeleteSnapshot(label string) error {
+	set := v.snapshots
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if _, ok := set.byLabel[label]; !ok {
+		return fmt.Errorf("snapshot %q: %w", label, fs.ErrNotExist)
+	}
+	delete(set.byLabel, label)
+	return nil
+}
+
+// DiffSnapshots compares the trees at root in the snapshots labeled a and
+// b, as Diff does. An empty label stands for the current state of the VFS.
+func (v *VFS) DiffSnapshots(a, b, root string) ([]Difference, error) {
+	fsA, err := v.snapshotOrSelf(a)
+	if err != nil {
+		return nil, err
+	}
+	fsB, err := v.snapshotOrSelf(b)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(fsA, fsB, root)
+}
+
+func (v *VFS) snapshotOrSelf(label string) (FileSystem, error) {
+	if label == "" {
+		return v, nil
+	}
+	return v.Snapshot(label)
+}
@@ -0,0 +1,463 @@
+package vfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SquashFS support
+//
+// A SquashFS 4.0 image holds file data in compressed blocks, followed by
+// metadata tables (inodes, directories, fragments) stored as a series of
+// metadata blocks of up to 8 KiB, each with a two byte length header.
+// Inodes are addressed by references: the start of their metadata block
+// relative to the inode table in the upper bits and an offset into the
+// uncompressed block in the lower 16 bits. File tails smaller than a block
+// may be packed together into shared fragment blocks.
+//
+// Only gzip compression is supported, as the other compressors SquashFS
+// uses (lzma, lzo, xz, lz4 and zstd) have no standard library decoder.
+
+const (
+	squashMetadataSize = 8192
+	squashNoFragment   = 0xffffffff
+)
+
+// squashCompressors names the compressor ids of the superblock
+var squashCompressors = map[uint16]string{1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
+
+func matchSquashFS(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("hsqs"))
+}
+
+// openSquashFS indexes a SquashFS image. File blocks are decompressed as
+// they are read.
+func openSquashFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	sb := make([]byte, 96)
+	if _, err := r.ReadAt(sb, 0); err != nil {
+		return nil, errors.New("truncated superblock")
+	}
+	le := binary.LittleEndian
+
+	if major := le.Uint16(sb[28:30]); major != 4 {
+		return nil, fmt.Errorf("unsupported SquashFS version %d", major)
+	}
+	if c := le.Uint16(sb[20:22]); c != 1 {
+		name := squashCompressors[c]
+		if name == "" {
+			name = fmt.Sprint(c)
+		}
+		return nil, fmt.Errorf("unsupported SquashFS compressor %s", name)
+	}
+
+	img := &squashImage{
+		r:          r,
+		size:       size,
+		blockSize:  le.Uint32(sb[12:16]),
+		fragments:  le.Uint32(sb[16:20]),
+		inodeTable: int64(le.Uint64(sb[64:72])),
+		dirTable:   int64(le.Uint64(sb[72:80])),
+		fragTable:  int64(le.Uint64(sb[80:88])),
+		afs:        newArchiveFS(),
+		metadata:   make(map[int64]squashMetaBlock),
+		visited:    make(map[uint64]bool),
+	}
+	if img.blockSize < 4096 || img.blockSize > 1<<20 || img.blockSize&(img.blockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d", img.blockSize)
+	}
+
+	root, err := img.inode(le.Uint64(sb[32:40]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root inode: %w", err)
+	}
+	if !root.dir {
+		return nil, errors.New("root inode is not a directory")
+	}
+	img.afs.add("", fs.ModeDir|root.mode, root.modTime, 0, nil)
+	if err := img.walk(root, "", 0); err != nil {
+		return nil, err
+	}
+	return img.afs.finish(), nil
+}
+
+// squashImage is the state of a SquashFS image being indexed
+type squashImage struct {
+	r          io.ReaderAt
+	size       int64
+	blockSize  uint32
+	fragments  uint32
+	inodeTable int64
+	dirTable   int64
+	fragTable  int64
+	afs        *archiveFS
+	mu         sync.Mutex
+	metadata   map[int64]squashMetaBlock // Decompressed metadata blocks by position
+	visited    map[uint64]bool           // Directory inodes, to stop cycles
+}
+
+// squashMetaBlock is a decompressed metadata block and the position of
+// the block after it
+type squashMetaBlock struct {
+	data []byte
+	next int64
+}
+
+// squashInode is the part of an inode the index needs
+type squashInode struct {
+	dir, regular bool
+	mode         fs.FileMode
+	modTime      time.Time
+
+	// Directories
+	listing, listingOffset uint32 // Listing block, relative to the directory table
+	listingSize            uint32
+
+	// Regular files
+	size       int64
+	blocks     int64 // Start of the first data block
+	blockSizes []uint32
+	fragment   uint32
+	fragOffset uint32
+}
+
+// metaBlock reads the metadata block at pos
+func (img *squashImage) metaBlock(pos int64) (squashMetaBlock, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if b, ok := img.metadata[pos]; ok {
+		return b, nil
+	}
+
+	var header [2]byte
+	if _, err := img.r.ReadAt(header[:], pos); err != nil {
+		return squashMetaBlock{}, fmt.Errorf("failed to read metadata block at %d: %w", pos, err)
+	}
+	n := binary.LittleEndian.Uint16(header[:])
+	raw := make([]byte, n&0x7fff)
+	if _, err := img.r.ReadAt(raw, pos+2); err != nil {
+		return squashMetaBlock{}, fmt.Errorf("failed to read metadata block at %d: %w", pos, err)
+	}
+
+	data := raw
+	if n&0x8000 == 0 {
+		var err error
+		if data, err = squashInflate(raw, squashMetadataSize); err != nil {
+			return squashMetaBlock{}, err
+		}
+	}
+
+	b := squashMetaBlock{data: data, next: pos + 2 + int64(len(raw))}
+	img.metadata[pos] = b
+	return b, nil
+}
+
+// readMeta reads n bytes of metadata starting off bytes into the block at
+// pos, continuing into the following blocks as needed. It returns the
+// position just past the bytes read.
+func (img *squashImage) readMeta(pos int64, off uint32, n int) ([]byte, int64, uint32, error) {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		b, err := img.metaBlock(pos)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if int(off) > len(b.data) {
+			return nil, 0, 0, errors.New("metadata offset out of range")
+		}
+		take := min(n-len(out), len(b.data)-int(off))
+		out = append(out, b.data[off:int(off)+take]...)
+		if off += uint32(take); int(off) == len(b.data) {
+			if b.next >= img.size && len(out) < n {
+				return nil, 0, 0, io.ErrUnexpectedEOF
+			}
+			pos, off = b.next, 0
+		}
+	}
+	return out, pos, off, nil
+}
+
+// metaReader is a sequential reader over metadata
+type metaReader struct {
+	img *squashImage
+	pos int64
+	off uint32
+	err error
+}
+
+// next returns the next n bytes; errors are sticky and reported by the
+// reader's err field
+func (m *metaReader) next(n int) []byte {
+	if m.err != nil {
+		return make([]byte, n)
+	}
+	data, pos, off, err := m.img.readMeta(m.pos, m.off, n)
+	if err != nil {
+		m.err = err
+		return make([]byte, n)
+	}
+	m.pos, m.off = pos, off
+	return data
+}
+
+// inode reads the inode at ref
+func (img *squashImage) inode(ref uint64) (*squashInode, error) {
+	le := binary.LittleEndian
+	m := &metaReader{img: img, pos: img.inodeTable + int64(ref>>16), off: uint32(ref & 0xffff)}
+
+	h := m.next(16)
+	ino := &squashInode{
+		mode:    fs.FileMode(le.Uint16(h[2:4]) & 0777),
+		modTime: time.Unix(int64(le.Uint32(h[8:12])), 0).UTC(),
+	}
+
+	switch typ := le.Uint16(h[0:2]); typ {
+	case 1: // Basic directory
+		b := m.next(16)
+		ino.dir = true
+		ino.listing = le.Uint32(b[0:4])
+		ino.listingSize = uint32(le.Uint16(b[8:10]))
+		ino.listingOffset = uint32(le.Uint16(b[10:12]))
+	case 8: // Extended directory
+		b := m.next(24)
+		ino.dir = true
+		ino.listingSize = le.Uint32(b[4:8])
+		ino.listing = le.Uint32(b[8:12])
+		ino.listingOffset = uint32(le.Uint16(b[18:20]))
+	case 2: // Basic file
+		b := m.next(16)
+		ino.regular = true
+		ino.blocks = int64(le.Uint32(b[0:4]))
+		ino.fragment = le.Uint32(b[4:8])
+		ino.fragOffset = le.Uint32(b[8:12])
+		ino.size = int64(le.Uint32(b[12:16]))
+	case 9: // Extended file
+		b := m.next(40)
+		ino.regular = true
+		ino.blocks = int64(le.Uint64(b[0:8]))
+		ino.size = int64(le.Uint64(b[8:16]))
+		ino.fragment = le.Uint32(b[28:32])
+		ino.fragOffset = le.Uint32(b[32:36])
+	default:
+		return ino, m.err // Links, devices, fifos and sockets
+	}
+
+	if ino.regular {
+		if ino.size < 0 || ino.size > img.size*int64(img.blockSize) {
+			return nil, errors.New("invalid file size")
+		}
+		n := ino.size / int64(img.blockSize)
+		if ino.fragment == squashNoFragment && ino.size%int64(img.blockSize) != 0 {
+			n++
+		}
+		raw := m.next(int(n) * 4)
+		ino.blockSizes = make([]uint32, n)
+		for i := range ino.blockSizes {
+			ino.blockSizes[i] = le.Uint32(raw[4*i:])
+		}
+	}
+	return ino, m.err
+}
+
+// walk adds the entries of directory dir, found at name, to the index
+func (img *squashImage) walk(dir *squashInode, name string, depth int) error {
+	if depth > 256 {
+		return errors.New("directories nested too deeply")
+	}
+	key := uint64(dir.listing)<<16 | uint64(dir.listingOffset)
+	if img.visited[key] {
+		return nil
+	}
+	img.visited[key] = true
+
+	le := binary.LittleEndian
+	m := &metaReader{img: img, pos: img.dirTable + int64(dir.listing), off: dir.listingOffset}
+
+	// The listing size counts the implicit "." and ".." entries
+	remaining := int(dir.listingSize) - 3
+	for remaining > 0 && m.err == nil {
+		h := m.next(12)
+		count, start := int(le.Uint32(h[0:4]))+1, le.Uint32(h[4:8])
+		remaining -= 12
+
+		for i := 0; i < count && remaining > 0 && m.err == nil; i++ {
+			e := m.next(8)
+			offset := le.Uint16(e[0:2])
+			entryName := string(m.next(int(le.Uint16(e[6:8])) + 1))
+			remaining -= 8 + len(entryName)
+
+			if entryName == "." || entryName == ".." || strings.Contains(entryName, "/") {
+				continue
+			}
+			p := path.Join(name, entryName)
+
+			ino, err := img.inode(uint64(start)<<16 | uint64(offset))
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+
+			switch {
+			case ino.dir:
+				img.afs.add(p, fs.ModeDir|ino.mode, ino.modTime, 0, nil)
+				if err := img.walk(ino, p, depth+1); err != nil {
+					return err
+				}
+			case ino.regular:
+				file := &squashFile{img: img, ino: ino}
+				img.afs.add(p, ino.mode, ino.modTime, ino.size, func() (io.ReaderAt, error) {
+					return file, nil
+				})
+			}
+		}
+	}
+	return m.err
+}
+
+// fragment returns the position and stored size of fragment block i
+func (img *squashImage) fragment(i uint32) (int64, uint32, error) {
+	if i >= img.fragments {
+		return 0, 0, fmt.Errorf("invalid fragment %d", i)
+	}
+
+	// The fragment table is an array of pointers to metadata blocks of 16
+	// byte entries
+	const perBlock = squashMetadataSize / 16
+	var ptr [8]byte
+	if _, err := img.r.ReadAt(ptr[:], img.fragTable+int64(i/perBlock)*8); err != nil {
+		return 0, 0, err
+	}
+	entry, _, _, err := img.readMeta(int64(binary.LittleEndian.Uint64(ptr[:])), (i%perBlock)*16, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(entry[0:8])), binary.LittleEndian.Uint32(entry[8:12]), nil
+}
+
+// block reads and decompresses the data block of stored size at pos
+func (img *squashImage) block(pos int64, stored uint32) ([]byte, error) {
+	n := stored & 0xffffff
+	if n > img.blockSize+img.blockSize/2 {
+		return nil, errors.New("invalid data block size")
+	}
+	raw := make([]byte, n)
+	if _, err := img.r.ReadAt(raw, pos); err != nil {
+		return nil, err
+	}
+	if stored&(1<<24) != 0 {
+		return raw, nil // Stored uncompressed
+	}
+	return squashInflate(raw, int(img.blockSize))
+}
+
+// squashInflate decompresses a zlib stream of at most limit bytes
+func squashInflate(raw []byte, limit int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, errors.New("decompressed block too large")
+	}
+	return data, nil
+}
+
+// squashFile reads the content of a regular file, keeping the last
+// decompressed block
+type squashFile struct {
+	img *squashImage
+	ino *squashInode
+
+	mu        sync.Mutex
+	cached    int64 // Index of the block in cachedBuf
+	cachedBuf []byte
+}
+
+// ReadAt implements io.ReaderAt
+func (f *squashFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	bs := int64(f.img.blockSize)
+	for len(p) > 0 && off < f.ino.size {
+		data, err := f.blockData(off / bs)
+		if err != nil {
+			return n, err
+		}
+		within := off % bs
+		if within >= int64(len(data)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		m := copy(p, data[within:])
+		n, p, off = n+m, p[m:], off+int64(m)
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// blockData returns the uncompressed content of block i of the file,
+// which is the file's fragment when i is past its full blocks
+func (f *squashFile) blockData(i int64) ([]byte, error) {
+	if f.cachedBuf != nil && f.cached == i {
+		return f.cachedBuf, nil
+	}
+
+	bs := int64(f.img.blockSize)
+	length := min(bs, f.ino.size-i*bs)
+	var data []byte
+	if i < int64(len(f.ino.blockSizes)) {
+		stored := f.ino.blockSizes[i]
+		if stored&0xffffff == 0 {
+			data = make([]byte, length) // Sparse block
+		} else {
+			pos := f.ino.blocks
+			for _, s := range f.ino.blockSizes[:i] {
+				pos += int64(s & 0xffffff)
+			}
+			var err error
+			if data, err = f.img.block(pos, stored); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if f.ino.fragment == squashNoFragment {
+			return nil, io.ErrUnexpectedEOF
+		}
+		pos, stored, err := f.img.fragment(f.ino.fragment)
+		if err != nil {
+			return nil, err
+		}
+		frag, err := f.img.block(pos, stored)
+		if err != nil {
+			return nil, err
+		}
+		start := int64(f.ino.fragOffset)
+		if start+length > int64(len(frag)) {
+			return nil, errors.New("fragment out of range")
+		}
+		data = frag[start : start+length]
+	}
+
+	if int64(len(data)) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	f.cached, f.cachedBuf = i, data[:length]
+	return f.cachedBuf, nil
+}
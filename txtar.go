@@ -0,0 +1,170 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Txtar support
+//
+// The txtar format is a trivial text archive used by Go script tests and
+// tooling such as gopls to exchange small trees:
+//
+//	optional comment
+//	-- hello.txt --
+//	hello
+//	-- dir/empty/ --
+//
+// Every file's content ends in a newline once archived, and entries whose
+// name ends in "/" denote empty directories.
+
+// ExportTxtar writes the tree rooted at root to w in txtar format. Names in
+// the archive are relative to root. Empty directories are recorded as
+// entries ending in "/".
+func (v *VFS) ExportTxtar(w io.Writer, root string) error {
+	if w == nil {
+		return fmt.Errorf("cannot export to nil writer")
+	}
+
+	vfsRoot := v.normalizePath(root)
+	var buf bytes.Buffer
+
+	err := v.Walk(vfsRoot, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(p), filepath.ToSlash(vfsRoot)), "/")
+		if rel == "" {
+			return nil // Skip the root itself
+		}
+
+		if info.IsDir() {
+			entries, err := v.ListFiles(p)
+			if err != nil {
+				return err
+			}
+			dirs, err := v.ListDirs(p)
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 && len(dirs) == 0 {
+				fmt.Fprintf(&buf, "-- %s/ --\n", rel)
+			}
+			return nil
+		}
+
+		data, err := v.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&buf, "-- %s --\n", rel)
+		buf.Write(fixTxtarNewline(data))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export %s as txtar: %w", root, err)
+	}
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// ImportTxtar reads a txtar archive from r and writes its files below dest.
+// The archive comment is ignored.
+func (v *VFS) ImportTxtar(r io.Reader, dest string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read txtar archive: %w", err)
+	}
+
+	for _, f := range parseTxtar(data) {
+		name := path.Join(dest, f.name)
+		if strings.HasSuffix(f.name, "/") {
+			if err := v.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := v.WriteFile(name, f.data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// txtarFile is a single file in a txtar archive
+type txtarFile struct {
+	name string
+	data []byte
+}
+
+// parseTxtar splits a txtar archive into its files, discarding the leading
+// comment. Parsing never fails: text before the first marker is the comment.
+// Names are cleaned and made relative so they cannot escape the import
+// destination; directory entries keep their trailing "/".
+func parseTxtar(data []byte) []txtarFile {
+	var files []txtarFile
+	_, name, data := findTxtarMarker(data)
+	for name != "" {
+		f := txtarFile{name: strings.TrimPrefix(path.Clean("/"+name), "/")}
+		if strings.HasSuffix(name, "/") && f.name != "" {
+			f.name += "/"
+		}
+		var next string
+		f.data, next, data = findTxtarMarker(data)
+		if f.name != "" {
+			files = append(files, f)
+		}
+		name = next
+	}
+	return files
+}
+
+// findTxtarMarker returns the data before the next "-- name --" marker line,
+// the marker's name and the data after the marker line
+func findTxtarMarker(data []byte) (before []byte, name string, after []byte) {
+	var i int
+	for {
+		if name, after = txtarMarkerName(data[i:]); name != "" {
+			return data[:i], name, after
+		}
+		j := bytes.IndexByte(data[i:], '\n')
+		if j < 0 {
+			return fixTxtarNewline(data), "", nil
+		}
+		i += j + 1
+	}
+}
+
+// txtarMarkerName reports the file name if data begins with a marker line
+func txtarMarkerName(data []byte) (name string, after []byte) {
+	if !bytes.HasPrefix(data, []byte("-- ")) {
+		return "", nil
+	}
+	line := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line, after = data[:i], data[i+1:]
+	}
+	line = bytes.TrimRight(line, "\r")
+	if !bytes.HasSuffix(line, []byte(" --")) || len(line) < len("-- x --") {
+		return "", nil
+	}
+	return strings.TrimSpace(string(line[3 : len(line)-3])), after
+}
+
+// fixTxtarNewline ensures non-empty data ends in a newline
+func fixTxtarNewline(data []byte) []byte {
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return data
+	}
+	return append(data[:len(data):len(data)], '\n')
+}
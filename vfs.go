@@ -68,10 +68,11 @@ type WatchAction func(event WatchEvent)
 
 // WatchEvent represents a file system event
 type WatchEvent struct {
-	Path  string
-	Op    WatchOp
-	IsDir bool
-	Error error
+	Path    string
+	OldPath string // Previous path of a WatchOpRename from RenameDir
+	Op      WatchOp
+	IsDir   bool
+	Error   error
 }
 
 // WatchOp represents the type of file system operation
@@ -109,8 +110,25 @@ const (
 	VFSTypeMemory VFSType = iota
 	VFSTypeDisk
 	VFSTypeHybrid
+	VFSTypeArchive // Read-only, backed by an archive file (see NewArchiveVFS)
 )
 
+// String returns the name of the VFS type
+func (t VFSType) String() string {
+	switch t {
+	case VFSTypeMemory:
+		return "memory"
+	case VFSTypeDisk:
+		return "disk"
+	case VFSTypeHybrid:
+		return "hybrid"
+	case VFSTypeArchive:
+		return "archive"
+	default:
+		return "unknown"
+	}
+}
+
 // Logger interface for optional logging
 type Logger interface {
 	Debug(msg string, args ...interface{})
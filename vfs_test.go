@@ -1,15 +1,37 @@
 package vfs
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+	"unicode/utf16"
+
+	"github.com/spf13/afero"
 )
 
 //go:embed testdata/*
@@ -645,3 +667,3507 @@ func BenchmarkVFS_Dump(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkRemoveLargeTree measures Remove in a tree of 200k files, where
+// the VFS's own tables must not be scanned in full
+func BenchmarkRemoveLargeTree(b *testing.B) {
+	vfs := NewMemoryVFS()
+	for i := 0; i < 200000; i++ {
+		vfs.WriteFile(fmt.Sprintf("/dir%d/file%d.txt", i%1000, i), nil, 0644)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := vfs.WriteFile("/tmp/scratch.txt", nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+		if err := vfs.Remove("/tmp/scratch.txt"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestTxtarRoundTrip tests exporting and re-importing a tree as txtar
+func TestTxtarRoundTrip(t *testing.T) {
+	vfs := NewMemoryVFS()
+	vfs.WriteFile("/src/main.go", []byte("package main\n"), 0644)
+	vfs.WriteFile("/src/lib/util.go", []byte("package lib\n"), 0644)
+	vfs.MkdirAll("/src/empty", 0755)
+
+	var buf bytes.Buffer
+	if err := vfs.ExportTxtar(&buf, "/src"); err != nil {
+		t.Fatalf("ExportTxtar failed: %v", err)
+	}
+
+	expected := "-- empty/ --\n-- lib/util.go --\npackage lib\n-- main.go --\npackage main\n"
+	if buf.String() != expected {
+		t.Errorf("Archive mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), expected)
+	}
+
+	imported := NewMemoryVFS()
+	if err := imported.ImportTxtar(&buf, "/dest"); err != nil {
+		t.Fatalf("ImportTxtar failed: %v", err)
+	}
+
+	content, err := imported.ReadFileString("/dest/lib/util.go")
+	if err != nil || content != "package lib\n" {
+		t.Errorf("Imported content mismatch: got %q, %v", content, err)
+	}
+	if !imported.IsDir("/dest/empty") {
+		t.Error("Empty directory should be imported")
+	}
+
+	// Names that try to escape the destination stay inside it
+	err = imported.ImportTxtar(strings.NewReader("-- ../../escape.txt --\nx\n"), "/dest")
+	if err != nil {
+		t.Fatalf("ImportTxtar failed: %v", err)
+	}
+	if !imported.Exists("/dest/escape.txt") || imported.Exists("/escape.txt") {
+		t.Error("Archive names should be confined to the destination")
+	}
+}
+
+// TestSlowOpLog tests recording of operations exceeding the threshold
+func TestSlowOpLog(t *testing.T) {
+	vfs := NewMemoryVFS(WithSlowOpLog(time.Nanosecond), WithProfileLabels())
+
+	vfs.WriteFile("/slow.txt", []byte("content"), 0644)
+	vfs.ReadFile("/missing.txt")
+
+	ops := vfs.SlowOps()
+	if len(ops) < 2 {
+		t.Fatalf("Expected at least 2 slow operations, got %d", len(ops))
+	}
+
+	var sawWrite, sawFailedRead bool
+	for _, op := range ops {
+		if op.Op == "WriteFile" && op.Path == "/slow.txt" && op.Err == nil {
+			sawWrite = true
+			if !strings.Contains(op.Stack, "TestSlowOpLog") {
+				t.Errorf("Stack should include the caller, got:\n%s", op.Stack)
+			}
+		}
+		if op.Op == "ReadFile" && op.Path == "/missing.txt" && op.Err != nil {
+			sawFailedRead = true
+		}
+	}
+	if !sawWrite || !sawFailedRead {
+		t.Errorf("Missing expected slow operations: %+v", ops)
+	}
+
+	vfs.ResetSlowOps()
+	if len(vfs.SlowOps()) != 0 {
+		t.Error("ResetSlowOps should clear the log")
+	}
+
+	// Operations under the threshold are not recorded
+	fast := NewMemoryVFS(WithSlowOpLog(time.Hour))
+	fast.WriteFile("/fast.txt", []byte("content"), 0644)
+	if len(fast.SlowOps()) != 0 {
+		t.Error("Fast operations should not be recorded")
+	}
+}
+
+// TestProfileLabels tests that operations are labelled on top of the labels
+// of an outer pprof.Do, which survive the call
+func TestProfileLabels(t *testing.T) {
+	vfs := NewMemoryVFS(WithProfileLabels())
+	vfs.WriteFile("/dir/a.txt", []byte("a"), 0644)
+
+	// labels returns the pprof labels of the test goroutine, as listed in
+	// the goroutine profile
+	labels := func() string {
+		var buf bytes.Buffer
+		pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		for _, block := range strings.Split(buf.String(), "\n\n") {
+			if strings.Contains(block, ".TestProfileLabels.") {
+				for _, line := range strings.Split(block, "\n") {
+					if label, ok := strings.CutPrefix(line, "# labels: "); ok {
+						return label
+					}
+				}
+			}
+		}
+		return ""
+	}
+
+	ctx := context.Background()
+	pprof.Do(ctx, pprof.Labels("request", "42"), func(ctx context.Context) {
+		view := vfs.WithContext(ctx)
+		var during string
+		view.WalkRel("/dir", func(string, fs.DirEntry) error {
+			during = labels()
+			return nil
+		})
+		if !strings.Contains(during, `"request":"42"`) || !strings.Contains(during, `"vfs_op":"WalkRel"`) {
+			t.Errorf("Labels during an operation = %s, want the caller's and the operation's", during)
+		}
+
+		view.ReadFile("/dir/a.txt")
+		if after := labels(); after != `{"request":"42"}` {
+			t.Errorf("Labels after an operation = %s, want the caller's", after)
+		}
+	})
+}
+
+// TestAuditLog tests the chained audit trail of mutating operations
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	vfs := NewMemoryVFS(WithAuditLog(&buf, AuditOptions{Principal: "builder"}))
+
+	vfs.WriteFile("/a.txt", []byte("hello"), 0644)
+	vfs.Move("/a.txt", "/b.txt")
+	vfs.Remove("/missing.txt")
+	vfs.ReadFile("/b.txt") // Reads are not audited
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expectedOps := []string{"WriteFile /a.txt", "WriteFile /b.txt", "Remove /a.txt", "Remove /missing.txt"}
+	if len(lines) != len(expectedOps) {
+		t.Fatalf("Expected %d audit records, got %d:\n%s", len(expectedOps), len(lines), buf.String())
+	}
+
+	for i, line := range lines {
+		for _, field := range strings.Fields(expectedOps[i]) {
+			if !strings.Contains(line, `"`+field+`"`) {
+				t.Errorf("Record %d should contain %q: %s", i, field, line)
+			}
+		}
+		if !strings.Contains(line, `"principal":"builder"`) {
+			t.Errorf("Record %d should contain the principal: %s", i, line)
+		}
+	}
+	if !strings.Contains(lines[0], `"bytes":5`) || !strings.Contains(lines[0], `"result":"ok"`) {
+		t.Errorf("Unexpected write record: %s", lines[0])
+	}
+	if strings.Contains(lines[3], `"result":"ok"`) {
+		t.Errorf("Failed remove should record the error: %s", lines[3])
+	}
+
+	n, err := VerifyAuditLog(strings.NewReader(buf.String()))
+	if err != nil || n != 4 {
+		t.Errorf("VerifyAuditLog = %d, %v; want 4 valid records", n, err)
+	}
+
+	tampered := strings.Replace(buf.String(), `"/b.txt"`, `"/c.txt"`, 1)
+	if _, err := VerifyAuditLog(strings.NewReader(tampered)); err == nil {
+		t.Error("VerifyAuditLog should detect modified records")
+	}
+
+	dropped := strings.Join(append(lines[:1:1], lines[2:]...), "\n")
+	if _, err := VerifyAuditLog(strings.NewReader(dropped)); err == nil {
+		t.Error("VerifyAuditLog should detect dropped records")
+	}
+}
+
+// TestAuditLogReopen tests that a log reopened by a new VFS continues its
+// chain
+func TestAuditLogReopen(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		rf, err := NewRotatingFile(logPath, 1<<20, 1)
+		if err != nil {
+			t.Fatalf("NewRotatingFile failed: %v", err)
+		}
+		vfs := NewMemoryVFS(WithAuditLog(rf, AuditOptions{}))
+		vfs.WriteFile(fmt.Sprintf("/run%d.txt", i), []byte("x"), 0644)
+		rf.Close()
+	}
+
+	data, _ := os.ReadFile(logPath)
+	if n, err := VerifyAuditLog(bytes.NewReader(data)); err != nil || n != 2 {
+		t.Errorf("VerifyAuditLog = %d, %v; want 2 chained records", n, err)
+	}
+
+	// Writers that cannot be read back are seeded with Prev
+	var buf bytes.Buffer
+	last := lastRecordHash(logPath)
+	NewMemoryVFS(WithAuditLog(&buf, AuditOptions{Prev: last})).WriteFile("/run2.txt", []byte("x"), 0644)
+	if !strings.Contains(buf.String(), `"prev":"`+last+`"`) {
+		t.Errorf("Record should chain to Prev: %s", buf.String())
+	}
+}
+
+// TestRotatingFile tests size-based rotation of the audit log file
+func TestRotatingFile(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := NewRotatingFile(logPath, 300, 2)
+	if err != nil {
+		t.Fatalf("NewRotatingFile failed: %v", err)
+	}
+	defer rf.Close()
+
+	vfs := NewMemoryVFS(WithAuditLog(rf, AuditOptions{}))
+	for i := 0; i < 10; i++ {
+		vfs.WriteFile(fmt.Sprintf("/file%d.txt", i), []byte("x"), 0644)
+	}
+
+	for _, name := range []string{logPath, logPath + ".1", logPath + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %v", name, err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s exceeds the maximum size: %d bytes", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); err == nil {
+		t.Error("Only two backups should be kept")
+	}
+
+	// The chain continues across rotated files
+	var all bytes.Buffer
+	for _, name := range []string{logPath + ".2", logPath + ".1", logPath} {
+		data, _ := os.ReadFile(name)
+		all.Write(data)
+	}
+	if _, err := VerifyAuditLog(&all); err != nil {
+		t.Errorf("Chain should verify across rotated files: %v", err)
+	}
+}
+
+// TestPrincipalAndAccessPolicy tests context-carried identities
+func TestPrincipalAndAccessPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	policy := func(req AccessRequest) error {
+		if req.Write && req.Principal != "admin" {
+			return fmt.Errorf("read-only user")
+		}
+		return nil
+	}
+
+	vfs := NewMemoryVFS(WithAuditLog(&buf, AuditOptions{Principal: "system"}), WithAccessPolicy(policy))
+	admin := vfs.WithContext(WithPrincipal(context.Background(), "admin"))
+	guest := vfs.WithContext(WithPrincipal(context.Background(), "guest"))
+
+	if err := admin.WriteFile("/report.txt", []byte("data"), 0644); err != nil {
+		t.Fatalf("Admin write failed: %v", err)
+	}
+
+	err := guest.WriteFile("/report.txt", []byte("changed"), 0644)
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("Guest write should be denied with a permission error, got %v", err)
+	}
+	var accessErr *AccessError
+	if !errors.As(err, &accessErr) || accessErr.Principal != "guest" || accessErr.Op != "WriteFile" {
+		t.Errorf("Unexpected access error: %#v", err)
+	}
+
+	// Views share the same files
+	if content, err := guest.ReadFileString("/report.txt"); err != nil || content != "data" {
+		t.Errorf("Guest read = %q, %v", content, err)
+	}
+
+	if id, ok := PrincipalFrom(admin.Context()); !ok || id != "admin" {
+		t.Errorf("PrincipalFrom = %q, %v", id, ok)
+	}
+	if _, ok := PrincipalFrom(vfs.Context()); ok {
+		t.Error("Base VFS should carry no principal")
+	}
+
+	log := buf.String()
+	if !strings.Contains(log, `"principal":"admin"`) || !strings.Contains(log, `"principal":"guest"`) {
+		t.Errorf("Audit log should record both principals:\n%s", log)
+	}
+	if !strings.Contains(log, "read-only user") {
+		t.Errorf("Audit log should record the denial:\n%s", log)
+	}
+}
+
+// TestSeal tests that a sealed VFS rejects writes and serves reads
+func TestSeal(t *testing.T) {
+	vfs := NewMemoryVFS()
+	vfs.WriteFile("/config.json", []byte(`{"debug": false}`), 0644)
+	vfs.WriteFile("/lib/a.go", []byte("package lib"), 0644)
+	vfs.MkdirAll("/lib/empty", 0755)
+
+	view := vfs.WithContext(context.Background())
+	if err := vfs.Seal(); err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if !vfs.IsSealed() || !view.IsSealed() {
+		t.Error("VFS and its views should report sealed")
+	}
+
+	writes := map[string]error{
+		"WriteFile": vfs.WriteFile("/new.txt", []byte("x"), 0644),
+		"MkdirAll":  vfs.MkdirAll("/newdir", 0755),
+		"Remove":    vfs.Remove("/config.json"),
+		"RemoveAll": view.RemoveAll("/lib"),
+	}
+	_, writes["Create"] = vfs.Create("/created.txt")
+	for op, err := range writes {
+		if !errors.Is(err, ErrSealed) {
+			t.Errorf("%s should fail with ErrSealed, got %v", op, err)
+		}
+	}
+
+	content, err := vfs.ReadFileString("/config.json")
+	if err != nil || content != `{"debug": false}` {
+		t.Errorf("ReadFile after seal = %q, %v", content, err)
+	}
+	if !vfs.Exists("/lib/a.go") || vfs.Exists("/new.txt") {
+		t.Error("Exists should reflect the sealed contents")
+	}
+	if !vfs.IsDir("/lib/empty") || vfs.IsDir("/config.json") {
+		t.Error("IsDir should reflect the sealed contents")
+	}
+	if info, err := vfs.Stat("lib/a.go"); err != nil || info.Size() != int64(len("package lib")) {
+		t.Errorf("Stat after seal = %v, %v", info, err)
+	}
+	if _, err := vfs.Stat("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of missing path should fail with ErrNotExist, got %v", err)
+	}
+
+	files, _ := vfs.ListFiles("/lib")
+	dirs, _ := vfs.ListDirs("/lib")
+	if strings.Join(files, ",") != "a.go" || strings.Join(dirs, ",") != "empty" {
+		t.Errorf("Listing after seal: files %v, dirs %v", files, dirs)
+	}
+
+	// Returned data must not alias the sealed copy
+	data, _ := vfs.ReadFile("/config.json")
+	data[0] = 'X'
+	if content, _ := vfs.ReadFileString("/config.json"); content[0] != '{' {
+		t.Error("Modifying returned data should not change sealed contents")
+	}
+}
+
+// TestFreeze tests that frozen subtrees reject writes while the rest stays writable
+func TestFreeze(t *testing.T) {
+	vfs := NewMemoryVFS()
+	vfs.WriteFile("/vendor/lib/lib.go", []byte("package lib"), 0644)
+	vfs.WriteFile("/src/main.go", []byte("package main"), 0644)
+
+	if err := vfs.Freeze("vendor"); err != nil {
+		t.Fatalf("Freeze failed: %v", err)
+	}
+	if !vfs.IsFrozen("/vendor/lib/lib.go") || vfs.IsFrozen("/src/main.go") || vfs.IsFrozen("/vendored") {
+		t.Error("IsFrozen should only report paths inside /vendor")
+	}
+
+	if err := vfs.WriteFile("/src/util.go", []byte("package main"), 0644); err != nil {
+		t.Errorf("Write outside frozen subtree failed: %v", err)
+	}
+
+	other := NewMemoryVFS()
+	other.WriteFile("/vendor/new/new.go", []byte("package new"), 0644)
+	var txtar strings.Builder
+	other.ExportTxtar(&txtar, "/")
+
+	writes := map[string]error{
+		"WriteFile":   vfs.WriteFile("/vendor/lib/lib.go", []byte("changed"), 0644),
+		"MkdirAll":    vfs.MkdirAll("/vendor/extra", 0755),
+		"Remove":      vfs.Remove("/vendor/lib/lib.go"),
+		"RemoveAll":   vfs.RemoveAll("/"),
+		"Move":        vfs.Move("/src/main.go", "/vendor/main.go"),
+		"Merge":       vfs.Merge(other, "/"),
+		"ImportTxtar": vfs.ImportTxtar(strings.NewReader(txtar.String()), "/"),
+	}
+	for op, err := range writes {
+		if !errors.Is(err, ErrFrozen) {
+			t.Errorf("%s should fail with ErrFrozen, got %v", op, err)
+		}
+	}
+	if content, _ := vfs.ReadFileString("/vendor/lib/lib.go"); content != "package lib" {
+		t.Errorf("Frozen file was modified: %q", content)
+	}
+	if !vfs.Exists("/src/main.go") {
+		t.Error("Failed move should not remove the source")
+	}
+
+	if err := vfs.Unfreeze("/vendor"); err != nil {
+		t.Fatalf("Unfreeze failed: %v", err)
+	}
+	if err := vfs.Unfreeze("/vendor"); err == nil {
+		t.Error("Unfreeze of a path that is not frozen should fail")
+	}
+	if err := vfs.WriteFile("/vendor/lib/lib.go", []byte("changed"), 0644); err != nil {
+		t.Errorf("Write after Unfreeze failed: %v", err)
+	}
+}
+
+// TestETag tests that generations and ETags change on every write
+func TestETag(t *testing.T) {
+	vfs := NewHybridVFS()
+	vfs.RegisterBundled("test", testdataFS, "testdata")
+	vfs.WriteFile("/app.js", []byte("v1"), 0644)
+
+	gen := vfs.Generation("/app.js")
+	etag, err := vfs.ETag("app.js")
+	if err != nil || gen == 0 || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("ETag = %q, %v (generation %d)", etag, err, gen)
+	}
+	if again, _ := vfs.ETag("/app.js"); again != etag {
+		t.Errorf("ETag should be stable without writes: %q != %q", again, etag)
+	}
+
+	vfs.WriteFile("/app.js", []byte("v2"), 0644)
+	if vfs.Generation("/app.js") <= gen {
+		t.Error("Generation should increase on write")
+	}
+	if changed, _ := vfs.ETag("/app.js"); changed == etag {
+		t.Error("ETag should change on write")
+	}
+
+	vfs.Remove("/app.js")
+	if vfs.Generation("/app.js") != 0 {
+		t.Error("Generation should be forgotten on removal")
+	}
+	if _, err := vfs.ETag("/app.js"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ETag of a removed file should fail with ErrNotExist, got %v", err)
+	}
+
+	bundled, err := vfs.ETag("test://test.txt")
+	if err != nil || bundled == "" {
+		t.Errorf("ETag of bundled file = %q, %v", bundled, err)
+	}
+}
+
+// TestGenerationSubtree tests that removing or moving a directory only
+// affects the generations below it
+func TestGenerationSubtree(t *testing.T) {
+	vfs := NewMemoryVFS()
+	vfs.WriteFile("/a/x.txt", []byte("x"), 0644)
+	vfs.WriteFile("/a/sub/y.txt", []byte("y"), 0644)
+	vfs.WriteFile("/ab/z.txt", []byte("z"), 0644)
+	before := vfs.Generation("/a/sub/y.txt")
+
+	if err := vfs.RenameDir("/a", "/b"); err != nil {
+		t.Fatalf("RenameDir failed: %v", err)
+	}
+	if vfs.Generation("/a/sub/y.txt") != 0 || vfs.Generation("/b/sub/y.txt") <= before {
+		t.Errorf("Generations should move with the directory: old %d, new %d",
+			vfs.Generation("/a/sub/y.txt"), vfs.Generation("/b/sub/y.txt"))
+	}
+
+	vfs.RemoveAll("/b")
+	if vfs.Generation("/b/x.txt") != 0 || vfs.Generation("/b/sub/y.txt") != 0 {
+		t.Error("RemoveAll should forget the generations below the directory")
+	}
+	if vfs.Generation("/ab/z.txt") == 0 {
+		t.Error("RemoveAll should keep the generations of sibling paths sharing a prefix")
+	}
+}
+
+// TestHTTPHandler tests serving files with conditional and range requests
+func TestHTTPHandler(t *testing.T) {
+	vfs := NewHybridVFS()
+	vfs.RegisterBundled("test", testdataFS, "testdata")
+	vfs.WriteFile("/site/index.html", []byte("<h1>home</h1>"), 0644)
+	vfs.WriteFile("/site/app.js", []byte("console.log(1)"), 0644)
+
+	server := httptest.NewServer(NewHTTPHandler(vfs, "/site"))
+	defer server.Close()
+
+	get := func(path string, header ...string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/app.js")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("GET /app.js = %d, ETag %q", resp.StatusCode, etag)
+	}
+	if resp := get("/app.js", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Conditional GET = %d, want 304", resp.StatusCode)
+	}
+	if resp := get("/app.js", "Range", "bytes=0-6"); resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("Range GET = %d, want 206", resp.StatusCode)
+	}
+
+	vfs.WriteFile("/site/app.js", []byte("console.log(2)"), 0644)
+	if resp := get("/app.js", "If-None-Match", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("Conditional GET after write = %d, want 200", resp.StatusCode)
+	}
+
+	if resp := get("/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET / = %d, want index.html", resp.StatusCode)
+	}
+	if resp := get("/missing.js"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /missing.js = %d, want 404", resp.StatusCode)
+	}
+	if resp := get("/../../etc/passwd"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Path traversal = %d, want 404", resp.StatusCode)
+	}
+
+	bundledServer := httptest.NewServer(NewHTTPHandler(vfs, "test://"))
+	defer bundledServer.Close()
+	bundledResp, err := http.Get(bundledServer.URL + "/test.txt")
+	if err != nil {
+		t.Fatalf("GET bundled file failed: %v", err)
+	}
+	bundledResp.Body.Close()
+	if bundledResp.StatusCode != http.StatusOK || bundledResp.Header.Get("ETag") == "" {
+		t.Errorf("GET bundled file = %d, ETag %q", bundledResp.StatusCode, bundledResp.Header.Get("ETag"))
+	}
+}
+
+// TestHTTPHandlerConsistentBody tests that a response is never a mix of two
+// versions of a file written concurrently
+func TestHTTPHandlerConsistentBody(t *testing.T) {
+	vfs := NewMemoryVFS()
+	versions := [][]byte{bytes.Repeat([]byte("a"), 1<<16), bytes.Repeat([]byte("b"), 1<<16)}
+	vfs.WriteFile("/site/data.bin", versions[0], 0644)
+	handler := NewHTTPHandler(vfs, "/site")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			vfs.WriteFile("/site/data.bin", versions[i%2], 0644)
+		}
+	}()
+
+	// serve reports the body of a response, or false if the handler
+	// dropped the connection
+	serve := func() (body []byte, whole bool) {
+		defer func() {
+			if r := recover(); r != nil && r != http.ErrAbortHandler {
+				panic(r)
+			}
+		}()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/data.bin", nil))
+		return rec.Body.Bytes(), true
+	}
+
+	for i := 0; i < 50; i++ {
+		// An empty body is the file truncated by a write in progress,
+		// which every reader can see
+		if body, whole := serve(); whole && len(body) > 0 && !bytes.Equal(body, versions[0]) && !bytes.Equal(body, versions[1]) {
+			t.Fatalf("Response mixes versions of the file (%d bytes)", len(body))
+		}
+	}
+	<-done
+}
+
+// TestReadRange tests partial reads on every backend
+func TestReadRange(t *testing.T) {
+	diskVFS := NewDiskVFS(t.TempDir())
+	sealedVFS := NewMemoryVFS()
+	hybridVFS := NewHybridVFS()
+	hybridVFS.RegisterBundled("test", testdataFS, "testdata")
+
+	backends := map[string]struct {
+		vfs  *VFS
+		path string
+	}{
+		"memory":  {NewMemoryVFS(), "/data.txt"},
+		"disk":    {diskVFS, "/data.txt"},
+		"sealed":  {sealedVFS, "/data.txt"},
+		"bundled": {hybridVFS, "test://test.txt"},
+	}
+	const content = "This is a test file."
+
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			if !strings.HasPrefix(b.path, "test://") {
+				if err := b.vfs.WriteFile(b.path, []byte(content), 0644); err != nil {
+					t.Fatalf("WriteFile failed: %v", err)
+				}
+			}
+			if b.vfs == sealedVFS {
+				sealedVFS.Seal()
+			}
+
+			cases := []struct {
+				off, length int64
+				want        string
+			}{
+				{0, 4, "This"},
+				{10, 4, "test"},
+				{15, 1 << 40, "file."},
+				{int64(len(content)), 10, ""},
+				{100, 10, ""},
+				{5, 0, ""},
+			}
+			for _, tc := range cases {
+				got, err := b.vfs.ReadRange(b.path, tc.off, tc.length)
+				if err != nil || string(got) != tc.want {
+					t.Errorf("ReadRange(%d, %d) = %q, %v, want %q", tc.off, tc.length, got, err, tc.want)
+				}
+			}
+
+			if _, err := b.vfs.ReadRange(b.path, -1, 4); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("Negative offset should fail with ErrInvalid, got %v", err)
+			}
+		})
+	}
+
+	if _, err := NewMemoryVFS().ReadRange("/missing", 0, 1); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadRange of a missing file should fail with ErrNotExist, got %v", err)
+	}
+}
+
+// TestOpenShared tests that shared readers use one cached copy and see writes
+func TestOpenShared(t *testing.T) {
+	vfs := NewMemoryVFS(WithSharedCacheLimit(32))
+	vfs.WriteFile("/tmpl/page.html", []byte("<p>{{.}}</p>"), 0644)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := vfs.OpenShared("/tmpl/page.html")
+			if err != nil {
+				t.Errorf("OpenShared failed: %v", err)
+				return
+			}
+			if data, _ := io.ReadAll(r); string(data) != "<p>{{.}}</p>" {
+				t.Errorf("Shared reader returned %q", data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(vfs.shared.entries); n != 1 || vfs.shared.size != int64(len("<p>{{.}}</p>")) {
+		t.Errorf("Expected a single cached copy, got %d entries of %d bytes", n, vfs.shared.size)
+	}
+
+	vfs.WriteFile("/tmpl/page.html", []byte("<div>{{.}}</div>"), 0644)
+	r, _ := vfs.OpenShared("/tmpl/page.html")
+	if data, _ := io.ReadAll(r); string(data) != "<div>{{.}}</div>" {
+		t.Errorf("Shared reader after write returned %q", data)
+	}
+
+	// Exceeding the limit evicts the least recently opened copy
+	vfs.WriteFile("/tmpl/other.html", []byte("<span>{{.}}</span>"), 0644)
+	vfs.OpenShared("/tmpl/other.html")
+	if _, ok := vfs.shared.entries[internPath("/tmpl/page.html")]; ok || vfs.shared.size > 32 {
+		t.Errorf("Cache should have evicted page.html, size %d", vfs.shared.size)
+	}
+
+	vfs.RemoveAll("/tmpl")
+	if len(vfs.shared.entries) != 0 || vfs.shared.size != 0 {
+		t.Error("Removal should drop cached copies")
+	}
+	if _, err := vfs.OpenShared("/tmpl/page.html"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("OpenShared of a removed file should fail with ErrNotExist, got %v", err)
+	}
+}
+
+// TestPromotionPolicy tests that hot bundled files are promoted in hybrid mode
+func TestPromotionPolicy(t *testing.T) {
+	vfs := NewHybridVFS(WithPromotionPolicy(PromotionPolicy{MinReads: 3, MaxSize: 1024}))
+	vfs.RegisterBundled("test", testdataFS, "testdata")
+
+	for i := 0; i < 5; i++ {
+		content, err := vfs.ReadFileString("test://test.txt")
+		if err != nil || content != "This is a test file." {
+			t.Fatalf("Read %d = %q, %v", i, content, err)
+		}
+	}
+
+	stats := vfs.PromotionStats()
+	want := PromotionStats{Promoted: 1, PromotedBytes: int64(len("This is a test file.")), Hits: 2, Misses: 3}
+	if stats != want {
+		t.Errorf("PromotionStats = %+v, want %+v", stats, want)
+	}
+
+	// Promoted data must not alias what callers receive
+	data, _ := vfs.ReadFile("test://test.txt")
+	data[0] = 'X'
+	if content, _ := vfs.ReadFileString("test://test.txt"); content[0] != 'T' {
+		t.Error("Modifying returned data should not change the promoted copy")
+	}
+
+	small := NewHybridVFS(WithPromotionPolicy(PromotionPolicy{MinReads: 1, MaxSize: 4}))
+	small.RegisterBundled("test", testdataFS, "testdata")
+	small.ReadFile("test://test.txt")
+	small.ReadFile("test://test.txt")
+	if stats := small.PromotionStats(); stats.Promoted != 0 || stats.Rejected != 1 || stats.Misses != 2 {
+		t.Errorf("Oversized file should be rejected once, got %+v", stats)
+	}
+
+	// The read that promotes a file hands out its own copy too
+	once := NewHybridVFS(WithPromotionPolicy(PromotionPolicy{MinReads: 1}))
+	once.RegisterBundled("test", testdataFS, "testdata")
+	data, _ = once.ReadFile("test://test.txt")
+	data[0] = 'X'
+	if content, _ := once.ReadFileString("test://test.txt"); content[0] != 'T' {
+		t.Error("Modifying data from the promoting read should not change the promoted copy")
+	}
+
+	// Spellings of the same path share one promoted copy
+	if stats := once.PromotionStats(); stats.Promoted != 1 {
+		t.Fatalf("PromotionStats = %+v, want one promoted file", stats)
+	}
+	if content, err := once.ReadFileString("test://sub/../test.txt"); err != nil || content != "This is a test file." {
+		t.Errorf("Read through another spelling = %q, %v", content, err)
+	}
+	if stats := once.PromotionStats(); stats.Promoted != 1 || stats.Hits != 2 {
+		t.Errorf("Another spelling should hit the promoted copy, got %+v", stats)
+	}
+
+	// Read counts of files not promoted yet are bounded
+	p := newPromoter(PromotionPolicy{MinReads: 2})
+	for i := 0; i < 2*maxTrackedReads; i++ {
+		p.recordRead(fmt.Sprintf("/file%d", i), nil)
+	}
+	if len(p.reads) > maxTrackedReads {
+		t.Errorf("Tracked %d files, want at most %d", len(p.reads), maxTrackedReads)
+	}
+}
+
+// TestAllocator tests the pool and arena memory backends
+func TestAllocator(t *testing.T) {
+	for _, alloc := range []Allocator{AllocatorPool, AllocatorArena} {
+		vfs := NewMemoryVFS(WithAllocator(alloc))
+		for i := 0; i < 1000; i++ {
+			vfs.WriteFile(fmt.Sprintf("/obj/%03d.o", i), []byte(fmt.Sprintf("object %d", i)), 0644)
+		}
+		big := bytes.Repeat([]byte("x"), 2*maxAllocSize)
+		vfs.WriteFile("/big.bin", big, 0600)
+
+		// Files share slabs, and larger ones keep their own buffer
+		store := vfs.fs.(*swapFs).current().(*memFs).store
+		slabs := 0
+		for _, class := range store.slabs {
+			slabs += len(class)
+		}
+		if alloc == AllocatorPool && slabs != 1 {
+			t.Errorf("%d: 1000 small files should fit one slab, got %d", alloc, slabs)
+		}
+		if data, err := vfs.ReadFile("/big.bin"); err != nil || !bytes.Equal(data, big) {
+			t.Errorf("%d: large file read back wrong: %v", alloc, err)
+		}
+
+		// Stored files are copied out to be written, and do not disturb
+		// their neighbours
+		f, _ := vfs.fs.OpenFile("/obj/001.o", os.O_WRONLY|os.O_APPEND, 0)
+		f.Write([]byte(" and more"))
+		f.Close()
+		for name, want := range map[string]string{"/obj/000.o": "object 0", "/obj/001.o": "object 1 and more", "/obj/002.o": "object 2"} {
+			if got, _ := vfs.ReadFileString(name); got != want {
+				t.Errorf("%d: %s = %q, want %q", alloc, name, got, want)
+			}
+		}
+
+		if err := vfs.RenameDir("/obj", "/objects"); err != nil {
+			t.Fatalf("%d: RenameDir failed: %v", alloc, err)
+		}
+		if got, _ := vfs.ReadFileString("/objects/999.o"); got != "object 999" {
+			t.Errorf("%d: renamed file = %q", alloc, got)
+		}
+		if info, _ := vfs.Stat("/objects/999.o"); info == nil || info.Size() != int64(len("object 999")) || info.Mode().Perm() != 0644 {
+			t.Errorf("%d: renamed file info = %v", alloc, info)
+		}
+
+		// Pooled slots are reused once their files are gone
+		vfs.RemoveAll("/objects")
+		vfs.WriteFile("/again.o", []byte("reused"), 0644)
+		if alloc == AllocatorPool && len(store.free[0]) != 999 {
+			t.Errorf("Expected 999 free slots after reuse, got %d", len(store.free[0]))
+		}
+
+		// Clones and compaction keep the allocator
+		clone := vfs.Clone().(*VFS)
+		if _, ok := clone.fs.(*swapFs).current().(*memFs); !ok || clone.allocator != alloc {
+			t.Errorf("%d: clone should use the same allocator", alloc)
+		}
+		if _, err := vfs.Compact(); err != nil {
+			t.Fatalf("%d: Compact failed: %v", alloc, err)
+		}
+		if got, _ := vfs.ReadFileString("/again.o"); got != "reused" {
+			t.Errorf("%d: compacted file = %q", alloc, got)
+		}
+	}
+}
+
+// TestCompact tests that compaction preserves contents and metadata
+func TestCompact(t *testing.T) {
+	vfs := NewMemoryVFS()
+	vfs.WriteFile("/big.bin", make([]byte, 1<<20), 0644)
+	vfs.WriteFile("/big.bin", []byte("small now"), 0600)
+	vfs.MkdirAll("/empty", 0700)
+	for i := 0; i < 100; i++ {
+		vfs.WriteFile(fmt.Sprintf("/tmp/%d.o", i), []byte("obj"), 0644)
+	}
+	vfs.RemoveAll("/tmp")
+
+	before, _ := vfs.Stat("/big.bin")
+	etag, _ := vfs.ETag("/big.bin")
+	view := vfs.WithContext(context.Background())
+
+	stats, err := vfs.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if stats.Files != 1 || stats.Bytes != int64(len("small now")) || stats.Churn != 104 {
+		t.Errorf("CompactStats = %+v", stats)
+	}
+	if vfs.LastCompaction() != stats {
+		t.Error("LastCompaction should return the latest stats")
+	}
+
+	after, err := view.Stat("/big.bin")
+	if err != nil || after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("Metadata changed by compaction: %v -> %v (%v)", before, after, err)
+	}
+	if again, _ := view.ETag("/big.bin"); again != etag {
+		t.Errorf("ETag changed by compaction: %s -> %s", etag, again)
+	}
+	if info, err := view.Stat("/empty"); err != nil || !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("Empty directory not preserved: %v, %v", info, err)
+	}
+	if content, _ := view.ReadFileString("/big.bin"); content != "small now" {
+		t.Errorf("Content changed by compaction: %q", content)
+	}
+	if vfs.Exists("/tmp/1.o") {
+		t.Error("Removed files reappeared after compaction")
+	}
+
+	f, _ := vfs.Create("/open.txt")
+	if _, err := vfs.Compact(); err == nil {
+		t.Error("Compact should fail while files are open for writing")
+	}
+	f.Close()
+	if _, err := vfs.Compact(); err != nil {
+		t.Errorf("Compact after closing failed: %v", err)
+	}
+}
+
+// TestAutoCompact tests background compaction after churn
+func TestAutoCompact(t *testing.T) {
+	vfs := NewMemoryVFS(WithAutoCompact(CompactPolicy{MinChurn: 10}))
+	for i := 0; i < 10; i++ {
+		vfs.WriteFile("/churn.txt", []byte(strings.Repeat("x", i)), 0644)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for vfs.LastCompaction().Churn == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Background compaction did not run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if content, _ := vfs.ReadFileString("/churn.txt"); content != strings.Repeat("x", 9) {
+		t.Errorf("Content after background compaction: %q", content)
+	}
+}
+
+// BenchmarkAllocatorObjects reports the heap objects and bytes a tree of
+// small files keeps live with each allocator
+func BenchmarkAllocatorObjects(b *testing.B) {
+	const files = 20000
+	allocators := []struct {
+		name  string
+		alloc Allocator
+	}{{"heap", AllocatorHeap}, {"pool", AllocatorPool}, {"arena", AllocatorArena}}
+	for _, a := range allocators {
+		alloc := a.alloc
+		b.Run(a.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				vfs := NewMemoryVFS(WithAllocator(alloc))
+				for j := 0; j < files; j++ {
+					vfs.WriteFile(fmt.Sprintf("/obj/%d.o", j), []byte("object file"), 0644)
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapObjects-before.HeapObjects)/files, "objects/file")
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/files, "bytes/file")
+				runtime.KeepAlive(vfs)
+			}
+		})
+	}
+}
+
+// TestMemStats tests that interning shares repeated path prefixes
+func TestMemStats(t *testing.T) {
+	vfs := NewMemoryVFS()
+	prefix := "/node_modules/@scope/package/dist/esm/internal/"
+	for i := 0; i < 100; i++ {
+		vfs.WriteFile(fmt.Sprintf("%sfile%03d.js", prefix, i), []byte("export {}"), 0644)
+	}
+
+	stats := vfs.MemStats()
+	if stats.Paths != 100 {
+		t.Errorf("Paths = %d, want 100", stats.Paths)
+	}
+	if stats.InternedBytes >= stats.PathBytes/4 || stats.Saved() <= 0 {
+		t.Errorf("Interning should store the shared prefix once: %+v", stats)
+	}
+
+	// The sealed index is keyed by plain strings, for cheap lookups
+	vfs.Seal()
+	if sealed := vfs.MemStats(); sealed.Paths != stats.Paths {
+		t.Errorf("Sealed index should not be counted: %+v", sealed)
+	}
+
+	if p := internPath("relative/name.txt"); p.String() != "relative/name.txt" || internPath("name").String() != "name" {
+		t.Errorf("internPath should round-trip, got %q", p)
+	}
+}
+
+// TestPathIndex tests fast negative lookups and explicit refresh
+func TestPathIndex(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src"), 0755)
+	os.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("package main"), 0644)
+
+	vfs := NewDiskVFS(dir, WithPathIndex(0))
+	if !vfs.Exists("/src/main.go") || !vfs.IsDir("/src") {
+		t.Fatal("Existing paths should be found")
+	}
+	if vfs.Exists("/src/missing.go") {
+		t.Error("Missing path should not exist")
+	}
+
+	// Writes through the VFS update the index
+	vfs.WriteFile("/pkg/util/util.go", []byte("package util"), 0644)
+	if !vfs.Exists("/pkg/util/util.go") || !vfs.IsDir("/pkg/util") {
+		t.Error("Index should include files written through the VFS and their parents")
+	}
+	vfs.RemoveAll("/pkg")
+	if vfs.Exists("/pkg/util/util.go") || vfs.Exists("/pkg") {
+		t.Error("Index should drop removed trees")
+	}
+
+	// External changes are invisible until refreshed
+	os.WriteFile(filepath.Join(dir, "external.txt"), []byte("x"), 0644)
+	if vfs.Exists("/external.txt") {
+		t.Error("Externally created file should be hidden by the index")
+	}
+	if _, err := vfs.Stat("/external.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat should answer from the index, got %v", err)
+	}
+	if err := vfs.RefreshIndex(); err != nil {
+		t.Fatalf("RefreshIndex failed: %v", err)
+	}
+	if !vfs.Exists("/external.txt") {
+		t.Error("Externally created file should be found after refresh")
+	}
+
+	// A stale index never reports removed files
+	os.Remove(filepath.Join(dir, "external.txt"))
+	if vfs.Exists("/external.txt") {
+		t.Error("Removed file should not exist even if indexed")
+	}
+
+	if err := NewMemoryVFS().RefreshIndex(); !errors.Is(err, ErrNoPathIndex) {
+		t.Errorf("RefreshIndex without an index should fail with ErrNoPathIndex, got %v", err)
+	}
+}
+
+// TestDirCache tests that cached listings follow writes and disk events
+func TestDirCache(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src"), 0755)
+	os.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("package main"), 0644)
+
+	vfs := NewDiskVFS(dir, WithDirCache(0))
+	defer vfs.Close()
+
+	list := func() string {
+		files, err := vfs.ListFiles("/src")
+		if err != nil {
+			t.Fatalf("ListFiles failed: %v", err)
+		}
+		return strings.Join(files, ",")
+	}
+
+	if got := list(); got != "main.go" {
+		t.Fatalf("ListFiles = %q", got)
+	}
+	if _, _, ok := vfs.dirCache.get(internPath("/src")); !ok {
+		t.Fatal("Listing should be cached")
+	}
+
+	vfs.WriteFile("/src/util.go", []byte("package main"), 0644)
+	if got := list(); got != "main.go,util.go" {
+		t.Errorf("ListFiles after write = %q", got)
+	}
+
+	vfs.WriteFile("/src/internal/deep/x.go", []byte("package deep"), 0644)
+	if dirs, _ := vfs.ListDirs("/src"); strings.Join(dirs, ",") != "internal" {
+		t.Errorf("ListDirs after nested write = %v", dirs)
+	}
+
+	// Changes on disk arrive through the watcher
+	os.WriteFile(filepath.Join(dir, "src", "external.go"), []byte("package main"), 0644)
+	deadline := time.Now().Add(5 * time.Second)
+	for list() != "external.go,main.go,util.go" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Listing not invalidated by watch event: %q", list())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// User watches don't disturb the cache's own watches
+	vfs.Watch("/src", func(WatchEvent) {})
+	vfs.StopWatch("/src")
+	os.Remove(filepath.Join(dir, "src", "external.go"))
+	deadline = time.Now().Add(5 * time.Second)
+	for list() != "main.go,util.go" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Listing not invalidated after StopWatch: %q", list())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestApplyIndexUpdateMove tests that a move carries every entry below the
+// old path over exactly once
+func TestApplyIndexUpdateMove(t *testing.T) {
+	paths := map[internedPath]bool{internPath("/"): true, internPath("/src"): true}
+	for i := 0; i < 500; i++ {
+		paths[internPath(fmt.Sprintf("/src/f%d", i))] = false
+	}
+
+	applyIndexUpdate(paths, indexUpdate{path: "/dst", from: "/src", isDir: true})
+	if len(paths) != 502 {
+		t.Errorf("Expected 502 entries after the move, got %d", len(paths))
+	}
+	for i := 0; i < 500; i++ {
+		if isDir, ok := paths[internPath(fmt.Sprintf("/dst/f%d", i))]; !ok || isDir {
+			t.Fatalf("/dst/f%d should be a moved file", i)
+		}
+	}
+	if _, ok := paths[internPath("/src/f0")]; ok {
+		t.Error("Old entries should be gone")
+	}
+}
+
+// TestPathIndexFindFiles tests that FindFiles answers from a watched index
+func TestPathIndexFindFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "a/b.go", "a/b/c.go", "a.txt", "z/y.go", "a-b/d.go"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte("package x"), 0644)
+	}
+
+	indexed := NewDiskVFS(dir, WithPathIndex(0))
+	defer indexed.Close()
+	plain := NewDiskVFS(dir)
+	defer plain.Close()
+
+	for _, root := range []string{"/", "/a", "a/b", "/z/y.go"} {
+		want, wantErr := plain.FindFiles(root, "*.go")
+		got, err := indexed.FindFiles(root, "*.go")
+		if fmt.Sprint(got) != fmt.Sprint(want) || (err == nil) != (wantErr == nil) {
+			t.Errorf("FindFiles(%q) = %v, %v; walking gives %v, %v", root, got, err, want, wantErr)
+		}
+	}
+	if _, err := indexed.FindFiles("/missing", "*.go"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("FindFiles of a missing root should fail with ErrNotExist, got %v", err)
+	}
+	if !indexed.pathIndex.live {
+		t.Fatal("Index of a watched disk VFS should be live")
+	}
+
+	// External changes arrive through the watcher
+	os.MkdirAll(filepath.Join(dir, "new", "deep"), 0755)
+	os.WriteFile(filepath.Join(dir, "new", "deep", "n.go"), []byte("package n"), 0644)
+	os.Remove(filepath.Join(dir, "a.go"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := indexed.FindFiles("/", "*.go")
+		want, _ := plain.FindFiles("/", "*.go")
+		if fmt.Sprint(got) == fmt.Sprint(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Index did not follow disk changes: %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestMetadataDB tests the persisted metadata sidecar
+func TestMetadataDB(t *testing.T) {
+	root := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "meta.json")
+	os.MkdirAll(filepath.Join(root, "src"), 0755)
+	os.WriteFile(filepath.Join(root, "src", "main.go"), []byte("package main"), 0644)
+
+	vfs := NewDiskVFS(root, WithMetadataDB(dbPath))
+	if err := vfs.RescanMetadata(); err != nil {
+		t.Fatalf("RescanMetadata failed: %v", err)
+	}
+	meta, err := vfs.Metadata("/src/main.go")
+	if err != nil || meta.Size != 12 || len(meta.Hash) != 64 {
+		t.Fatalf("Metadata = %+v, %v", meta, err)
+	}
+	if err := vfs.SetTags("/src/main.go", "entry", "go"); err != nil {
+		t.Fatalf("SetTags failed: %v", err)
+	}
+	vfs.WriteFile("/src/util.go", []byte("package main"), 0644)
+	vfs.Close()
+
+	// A new VFS starts from the sidecar and only rehashes changed files
+	reopened := NewDiskVFS(root, WithMetadataDB(dbPath))
+	defer reopened.Close()
+	if got := reopened.FindByTag("go"); strings.Join(got, ",") != "/src/main.go" {
+		t.Errorf("FindByTag after reopening = %v", got)
+	}
+	reopened.metadata.records["/src/main.go"].Hash = "cached"
+	if meta, _ := reopened.Metadata("/src/main.go"); meta.Hash != "cached" {
+		t.Error("Unchanged file should not be rehashed")
+	}
+
+	reopened.WriteFile("/src/main.go", []byte("package main // changed"), 0644)
+	meta, _ = reopened.Metadata("/src/main.go")
+	if meta.Hash == "cached" || meta.Size != 23 || strings.Join(meta.Tags, ",") != "entry,go" {
+		t.Errorf("Metadata after write = %+v", meta)
+	}
+
+	os.Remove(filepath.Join(root, "src", "util.go"))
+	if err := reopened.RescanMetadata(); err != nil {
+		t.Fatalf("RescanMetadata failed: %v", err)
+	}
+	if _, ok := reopened.metadata.records["/src/util.go"]; ok {
+		t.Error("Rescan should drop records of removed files")
+	}
+
+	// Diff compares recorded hashes of both sides
+	other := NewDiskVFS(t.TempDir(), WithMetadataDB(filepath.Join(t.TempDir(), "other.json")))
+	defer other.Close()
+	other.WriteFile("/src/main.go", []byte("package main // changed"), 0644)
+	if diffs, err := Diff(reopened, other, "/"); err != nil || len(diffs) != 0 {
+		t.Errorf("Diff = %v, %v", diffs, err)
+	}
+
+	// Without a database on the other side, Diff does not hash this one
+	plain := NewMemoryVFS()
+	plain.WriteFile("/src/main.go", []byte("package main // changed"), 0644)
+	reopened.metadata.records["/src/main.go"].Hash = ""
+	Diff(reopened, plain, "/")
+	if reopened.metadata.records["/src/main.go"].Hash != "" {
+		t.Error("Diff should not hash files the other side cannot compare")
+	}
+
+	// Close reports metadata that could not be saved
+	broken := NewDiskVFS(root, WithMetadataDB(filepath.Join(t.TempDir(), "missing", "meta.json")))
+	broken.WriteFile("/src/new.go", []byte("package main"), 0644)
+	broken.RescanMetadata()
+	if err := broken.Close(); err == nil {
+		t.Error("Close should return the error of saving metadata")
+	}
+}
+
+// TestScanAsync tests background scanning with progress and cancellation
+func TestScanAsync(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 50; i++ {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("file%02d.txt", i)), []byte("data"), 0644)
+	}
+
+	vfs := NewDiskVFS(root, WithPathIndex(0), WithMetadataDB(filepath.Join(t.TempDir(), "meta.json")))
+	defer vfs.Close()
+
+	progress, err := vfs.ScanAsync(context.Background())
+	if err != nil {
+		t.Fatalf("ScanAsync failed: %v", err)
+	}
+	var final ScanProgress
+	for p := range progress {
+		final = p
+	}
+	if !final.Done || final.Err != nil || final.Phase != "metadata" || final.Files != 50 || final.Bytes != 200 {
+		t.Errorf("Final progress = %+v", final)
+	}
+	if len(vfs.metadata.records) != 50 || !vfs.pathIndex.loaded {
+		t.Error("Scan should fill the metadata database and path index")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	progress, _ = vfs.ScanAsync(ctx)
+	for p := range progress {
+		final = p
+	}
+	if !final.Done || !errors.Is(final.Err, context.Canceled) {
+		t.Errorf("Cancelled scan final progress = %+v", final)
+	}
+
+	if _, err := NewMemoryVFS().ScanAsync(context.Background()); err == nil {
+		t.Error("ScanAsync without index or metadata should fail")
+	}
+}
+
+// writeTestArchives writes the same tree as a tar, a gzipped tar and a zip
+// archive and returns their paths
+func writeTestArchives(t *testing.T, files map[string]string) []string {
+	t.Helper()
+	dir := t.TempDir()
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(files[name]))
+	}
+	tw.WriteHeader(&tar.Header{Name: "link.txt", Linkname: "README.md", Typeflag: tar.TypeLink})
+	tw.Close()
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for i, name := range names {
+		method := zip.Deflate
+		if i%2 == 0 {
+			method = zip.Store
+		}
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		w.Write([]byte(files[name]))
+	}
+	zw.Close()
+
+	paths := []string{filepath.Join(dir, "tree.tar"), filepath.Join(dir, "tree.tar.gz"), filepath.Join(dir, "tree.zip")}
+	for i, data := range [][]byte{tarBuf.Bytes(), gzBuf.Bytes(), zipBuf.Bytes()} {
+		if err := os.WriteFile(paths[i], data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+// TestArchiveVFS tests opening tar and zip archives as a read-only VFS
+func TestArchiveVFS(t *testing.T) {
+	files := map[string]string{
+		"README.md":       "# project",
+		"src/main.go":     "package main",
+		"src/lib/lib.go":  "package lib",
+		"./dot/../up.txt": strings.Repeat("0123456789", 1000),
+	}
+
+	for _, path := range writeTestArchives(t, files) {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			vfs, err := NewArchiveVFS(path)
+			if err != nil {
+				t.Fatalf("NewArchiveVFS failed: %v", err)
+			}
+			defer vfs.Close()
+
+			if content, err := vfs.ReadFileString("/src/lib/lib.go"); err != nil || content != "package lib" {
+				t.Errorf("ReadFile = %q, %v", content, err)
+			}
+			if part, err := vfs.ReadRange("/up.txt", 9995, 10); err != nil || string(part) != "56789" {
+				t.Errorf("ReadRange = %q, %v", part, err)
+			}
+			if !vfs.IsDir("/src") || !vfs.Exists("README.md") || vfs.Exists("/missing") {
+				t.Error("Exists and IsDir should reflect the archive")
+			}
+			if dirs, _ := vfs.ListDirs("/src"); strings.Join(dirs, ",") != "lib" {
+				t.Errorf("ListDirs = %v", dirs)
+			}
+			if found, _ := vfs.FindFiles("/", "*.go"); strings.Join(found, ",") != "/src/lib/lib.go,/src/main.go" {
+				t.Errorf("FindFiles = %v", found)
+			}
+			if strings.HasSuffix(path, ".tar") {
+				if content, _ := vfs.ReadFileString("/link.txt"); content != "# project" {
+					t.Errorf("Hard link content = %q", content)
+				}
+			}
+
+			if err := vfs.WriteFile("/new.txt", []byte("x"), 0644); !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("WriteFile should fail with ErrPermission, got %v", err)
+			}
+			if err := vfs.RemoveAll("/src"); !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("RemoveAll should fail with ErrPermission, got %v", err)
+			}
+
+			clone := vfs.Clone()
+			if content, _ := clone.ReadFileString("/src/main.go"); content != "package main" {
+				t.Errorf("Clone of archive VFS = %q", content)
+			}
+		})
+	}
+
+	notArchive := filepath.Join(t.TempDir(), "plain.txt")
+	os.WriteFile(notArchive, []byte("just text"), 0644)
+	if _, err := NewArchiveVFS(notArchive); err == nil {
+		t.Error("Opening a non-archive should fail")
+	}
+}
+
+func TestExportOCILayer(t *testing.T) {
+	vfs := New()
+	vfs.WriteFile("/rootfs/etc/app.conf", []byte("port=80"), 0640)
+	vfs.WriteFile("/rootfs/bin/app", []byte("#!/bin/sh"), 0755)
+	vfs.MkdirAll("/rootfs/var/empty", 0755)
+
+	var buf bytes.Buffer
+	if err := vfs.ExportOCILayer(&buf, "/rootfs", "/rootfs/etc/old.conf", "/rootfs/tmp"); err != nil {
+		t.Fatalf("ExportOCILayer failed: %v", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Reading layer failed: %v", err)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Errorf("%s owned by %d:%d, want 0:0", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+		switch hdr.Name {
+		case "etc/app.conf":
+			data, _ := io.ReadAll(tr)
+			if string(data) != "port=80" || hdr.Mode != 0640 {
+				t.Errorf("etc/app.conf = %q mode %o", data, hdr.Mode)
+			}
+		case "bin/app":
+			if hdr.Mode != 0755 {
+				t.Errorf("bin/app mode = %o", hdr.Mode)
+			}
+		}
+		names = append(names, hdr.Name)
+	}
+
+	want := ".wh.tmp,bin/,bin/app,etc/,etc/.wh.old.conf,etc/app.conf,var/,var/empty/"
+	if strings.Join(names, ",") != want {
+		t.Errorf("Layer entries = %v, want %s", names, want)
+	}
+
+	if err := vfs.ExportOCILayer(io.Discard, "/rootfs", "/elsewhere/file"); err == nil {
+		t.Error("Whiteouts outside root should be rejected")
+	}
+}
+
+func TestImportOCIImage(t *testing.T) {
+	type entry struct{ name, body, link string }
+	layerTar := func(gz bool, entries ...entry) []byte {
+		var buf bytes.Buffer
+		var w io.Writer = &buf
+		var zw *gzip.Writer
+		if gz {
+			zw = gzip.NewWriter(&buf)
+			w = zw
+		}
+		tw := tar.NewWriter(w)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+			switch {
+			case strings.HasSuffix(e.name, "/"):
+				hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+			case e.link != "":
+				hdr.Typeflag, hdr.Linkname = tar.TypeLink, e.link
+			}
+			tw.WriteHeader(hdr)
+			tw.Write([]byte(e.body))
+		}
+		tw.Close()
+		if zw != nil {
+			zw.Close()
+		}
+		return buf.Bytes()
+	}
+
+	lower := layerTar(false,
+		entry{name: "etc/"},
+		entry{name: "etc/a.conf", body: "a"},
+		entry{name: "etc/b.conf", body: "b"},
+		entry{name: "usr/lib/old.so", body: "old"},
+		entry{name: "usr/share/doc", body: "doc"},
+	)
+	upper := layerTar(true,
+		entry{name: "etc/.wh.b.conf"},
+		entry{name: "usr/bin/tool", body: "tool"},
+		entry{name: "usr/.wh..wh..opq"},
+		entry{name: "usr/bin/tool2", link: "usr/bin/tool"},
+	)
+
+	writeImage := func(t *testing.T, files map[string][]byte) string {
+		image := filepath.Join(t.TempDir(), "image.tar")
+		f, _ := os.Create(image)
+		tw := tar.NewWriter(f)
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))})
+			tw.Write(files[name])
+		}
+		tw.Close()
+		f.Close()
+		return image
+	}
+	digest := func(data []byte) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	}
+	blob := func(data []byte) string {
+		return "blobs/sha256/" + strings.TrimPrefix(digest(data), "sha256:")
+	}
+
+	manifest := []byte(fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[
+		{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":%q},
+		{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q}]}`, digest(lower), digest(upper)))
+	index := []byte(fmt.Sprintf(`{"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q}]}`, digest(manifest)))
+
+	images := map[string]string{
+		"oci": writeImage(t, map[string][]byte{
+			"oci-layout":   []byte(`{"imageLayoutVersion":"1.0.0"}`),
+			"index.json":   index,
+			blob(manifest): manifest,
+			blob(lower):    lower,
+			blob(upper):    upper,
+		}),
+		"docker": writeImage(t, map[string][]byte{
+			"manifest.json":   []byte(`[{"Config":"config.json","Layers":["l1/layer.tar","l2/layer.tar"]}]`),
+			"l1/layer.tar":    lower,
+			"l2/layer.tar":    upper,
+			"config.json":     []byte(`{}`),
+			"repositories":    []byte(`{}`),
+			"l1/VERSION":      []byte("1.0"),
+			"l2/VERSION":      []byte("1.0"),
+			"l2/json":         []byte(`{}`),
+			"l1/json":         []byte(`{}`),
+			"extra/README.md": []byte("ignored"),
+		}),
+	}
+
+	for name, image := range images {
+		t.Run(name, func(t *testing.T) {
+			vfs := New()
+			if err := vfs.ImportOCIImage(image, "/rootfs"); err != nil {
+				t.Fatalf("ImportOCIImage failed: %v", err)
+			}
+
+			files, _ := vfs.FindFiles("/rootfs", "*")
+			want := "/rootfs/etc/a.conf,/rootfs/usr/bin/tool,/rootfs/usr/bin/tool2"
+			if strings.Join(files, ",") != want {
+				t.Errorf("Files = %v, want %s", files, want)
+			}
+			if content, _ := vfs.ReadFileString("/rootfs/usr/bin/tool2"); content != "tool" {
+				t.Errorf("Hard link content = %q", content)
+			}
+		})
+	}
+
+	corrupt := bytes.Replace(upper, upper[20:24], []byte("XXXX"), 1)
+	bad := writeImage(t, map[string][]byte{
+		"index.json":   index,
+		blob(manifest): manifest,
+		blob(lower):    lower,
+		blob(upper):    corrupt,
+	})
+	if err := New().ImportOCIImage(bad, "/"); err == nil {
+		t.Error("A layer that does not match its digest should be rejected")
+	}
+	if err := New().ImportOCIImage("docker.io/library/alpine:latest", "/"); err == nil {
+		t.Error("Registry references should be rejected")
+	}
+}
+
+// buildTestISO returns an ISO9660 image with Rock Ridge names on some
+// entries: /readme.txt, /BOOT/KERNEL.BIN and a symbolic link to skip
+func buildTestISO() []byte {
+	img := make([]byte, 22*isoSectorSize)
+	record := func(name []byte, extent, size uint32, flags byte, system []byte) []byte {
+		n := 33 + len(name)
+		if len(name)%2 == 0 {
+			n++
+		}
+		rec := make([]byte, n+len(system))
+		rec[0] = byte(len(rec))
+		binary.LittleEndian.PutUint32(rec[2:], extent)
+		binary.BigEndian.PutUint32(rec[6:], extent)
+		binary.LittleEndian.PutUint32(rec[10:], size)
+		binary.BigEndian.PutUint32(rec[14:], size)
+		copy(rec[18:], []byte{124, 1, 2, 3, 4, 5, 0})
+		rec[25] = flags
+		rec[32] = byte(len(name))
+		copy(rec[33:], name)
+		copy(rec[n:], system)
+		return rec
+	}
+	posix := func(mode uint32) []byte {
+		px := []byte{'P', 'X', 12, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(px[4:], mode)
+		return px
+	}
+	nm := func(name string) []byte {
+		return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+	}
+	dir := func(sector int, records ...[]byte) {
+		off := sector * isoSectorSize
+		for _, rec := range records {
+			off += copy(img[off:], rec)
+		}
+	}
+
+	readme, kernel := []byte("Boot notes"), []byte("kernel image")
+	copy(img[20*isoSectorSize:], readme)
+	copy(img[21*isoSectorSize:], kernel)
+
+	dir(18,
+		record([]byte{0}, 18, isoSectorSize, 2, []byte{'S', 'P', 7, 1, 0xbe, 0xef, 0}),
+		record([]byte{1}, 18, isoSectorSize, 2, nil),
+		record([]byte("BOOT"), 19, isoSectorSize, 2, nil),
+		record([]byte("README.TXT;1"), 20, uint32(len(readme)), 0, append(nm("readme.txt"), posix(0100600)...)),
+		record([]byte("LINK.;1"), 0, 0, 0, append(nm("link"), posix(0120777)...)),
+	)
+	dir(19,
+		record([]byte{0}, 19, isoSectorSize, 2, nil),
+		record([]byte{1}, 18, isoSectorSize, 2, nil),
+		record([]byte("KERNEL.BIN;1"), 21, uint32(len(kernel)), 0, nil),
+	)
+
+	pvd := img[16*isoSectorSize:]
+	pvd[0] = 1
+	copy(pvd[1:], "CD001\x01")
+	copy(pvd[156:], record([]byte{0}, 18, isoSectorSize, 2, nil))
+	term := img[17*isoSectorSize:]
+	term[0] = 255
+	copy(term[1:], "CD001\x01")
+	return img
+}
+
+// buildTestFAT returns a FAT12 volume holding a fragmented file with a
+// long name and /EFI/BOOTX64.EFI
+func buildTestFAT() []byte {
+	const sector = 512
+	img := make([]byte, 64*sector)
+	boot := img[:sector]
+	copy(boot, []byte{0xeb, 0x3c, 0x90})
+	binary.LittleEndian.PutUint16(boot[11:], sector)
+	boot[13] = 1                                // Sectors per cluster
+	binary.LittleEndian.PutUint16(boot[14:], 1) // Reserved sectors
+	boot[16] = 1                                // FATs
+	binary.LittleEndian.PutUint16(boot[17:], 16)
+	binary.LittleEndian.PutUint16(boot[19:], 64)
+	boot[21] = 0xf8
+	binary.LittleEndian.PutUint16(boot[22:], 1)
+	boot[510], boot[511] = 0x55, 0xaa
+
+	table := img[sector : 2*sector]
+	set := func(c, v uint16) {
+		off := c + c/2
+		if c%2 == 0 {
+			table[off] = byte(v)
+			table[off+1] = table[off+1]&0xf0 | byte(v>>8)&0x0f
+		} else {
+			table[off] = table[off]&0x0f | byte(v<<4)
+			table[off+1] = byte(v >> 4)
+		}
+	}
+	set(0, 0xff8)
+	set(1, 0xfff)
+	set(2, 4) // The long file continues in cluster 4
+	set(3, 0xfff)
+	set(4, 0xfff)
+	set(5, 0xfff)
+
+	cluster := func(c int) []byte { return img[(3+c-2)*sector : (4+c-2)*sector] }
+	entry := func(short string, attr byte, c uint16, size uint32) []byte {
+		e := make([]byte, 32)
+		copy(e, short)
+		e[11] = attr
+		binary.LittleEndian.PutUint16(e[24:], 0x5822) // 2024-01-02
+		binary.LittleEndian.PutUint16(e[26:], c)
+		binary.LittleEndian.PutUint32(e[28:], size)
+		return e
+	}
+	longName := func(name, short string) []byte {
+		units := utf16.Encode([]rune(name))
+		units = append(units, 0)
+		parts := (len(units) + 12) / 13
+		for len(units) < parts*13 {
+			units = append(units, 0xffff)
+		}
+		var out []byte
+		for seq := parts; seq >= 1; seq-- {
+			e := make([]byte, 32)
+			e[0] = byte(seq)
+			if seq == parts {
+				e[0] |= 0x40
+			}
+			e[11], e[13] = 0x0f, fatChecksum([]byte(short))
+			chunk := units[(seq-1)*13 : seq*13]
+			offsets := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+			for i, u := range chunk {
+				binary.LittleEndian.PutUint16(e[offsets[i]:], u)
+			}
+			out = append(out, e...)
+		}
+		return out
+	}
+
+	root := img[2*sector : 3*sector]
+	var entries []byte
+	entries = append(entries, entry("FIRMWARE   ", 0x08, 0, 0)...)
+	entries = append(entries, longName("long file name.txt", "LONGFI~1TXT")...)
+	entries = append(entries, entry("LONGFI~1TXT", 0x20, 2, sector+100)...)
+	entries = append(entries, entry("EFI        ", 0x10, 3, 0)...)
+	copy(root, entries)
+
+	copy(cluster(2), bytes.Repeat([]byte("a"), sector))
+	copy(cluster(4), bytes.Repeat([]byte("b"), 100))
+
+	efi := append(entry(".          ", 0x10, 3, 0), entry("..         ", 0x10, 0, 0)...)
+	efi = append(efi, entry("BOOTX64 EFI", 0x21, 5, 10)...)
+	copy(cluster(3), efi)
+	copy(cluster(5), "EFI loader")
+	return img
+}
+
+func TestDiskImages(t *testing.T) {
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "boot.iso")
+	os.WriteFile(iso, buildTestISO(), 0644)
+	fat := filepath.Join(dir, "esp.img")
+	os.WriteFile(fat, buildTestFAT(), 0644)
+
+	// A whole disk with an MBR partition table and the volume at sector 1
+	mbr := make([]byte, 512)
+	mbr[446+4] = 0x01
+	binary.LittleEndian.PutUint32(mbr[446+8:], 1)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	disk := filepath.Join(dir, "disk.img")
+	os.WriteFile(disk, append(mbr, buildTestFAT()...), 0644)
+
+	t.Run("iso9660", func(t *testing.T) {
+		vfs, err := NewArchiveVFS(iso)
+		if err != nil {
+			t.Fatalf("NewArchiveVFS failed: %v", err)
+		}
+		defer vfs.Close()
+
+		files, _ := vfs.FindFiles("/", "*")
+		if strings.Join(files, ",") != "/BOOT/KERNEL.BIN,/readme.txt" {
+			t.Errorf("Files = %v", files)
+		}
+		if content, _ := vfs.ReadFileString("/BOOT/KERNEL.BIN"); content != "kernel image" {
+			t.Errorf("KERNEL.BIN = %q", content)
+		}
+		if info, err := vfs.Stat("/readme.txt"); err != nil || info.Mode().Perm() != 0600 || info.ModTime().Year() != 2024 {
+			t.Errorf("Stat = %v, %v", info, err)
+		}
+	})
+
+	t.Run("fat", func(t *testing.T) {
+		vfs, err := NewArchiveVFS(fat)
+		if err != nil {
+			t.Fatalf("NewArchiveVFS failed: %v", err)
+		}
+		defer vfs.Close()
+
+		files, _ := vfs.FindFiles("/", "*")
+		if strings.Join(files, ",") != "/EFI/BOOTX64.EFI,/long file name.txt" {
+			t.Errorf("Files = %v", files)
+		}
+		want := strings.Repeat("a", 512) + strings.Repeat("b", 100)
+		if content, _ := vfs.ReadFileString("/long file name.txt"); content != want {
+			t.Errorf("Fragmented file has %d bytes, want %d", len(content), len(want))
+		}
+		if part, _ := vfs.ReadRange("/long file name.txt", 510, 4); string(part) != "aabb" {
+			t.Errorf("ReadRange across clusters = %q", part)
+		}
+		if info, err := vfs.Stat("/EFI/BOOTX64.EFI"); err != nil || info.Mode().Perm() != 0444 {
+			t.Errorf("Read-only file Stat = %v, %v", info, err)
+		}
+	})
+
+	t.Run("mount", func(t *testing.T) {
+		vfs := New()
+		if err := vfs.MountImage("esp", disk); err != nil {
+			t.Fatalf("MountImage failed: %v", err)
+		}
+		if err := vfs.MountImage("cd://", iso); err != nil {
+			t.Fatalf("MountImage failed: %v", err)
+		}
+		defer vfs.Close()
+
+		if content, _ := vfs.ReadFileString("esp://EFI/BOOTX64.EFI"); content != "EFI loader" {
+			t.Errorf("Mounted FAT file = %q", content)
+		}
+		if dirs, _ := vfs.ListDirs("cd://"); strings.Join(dirs, ",") != "BOOT" {
+			t.Errorf("Mounted ISO root dirs = %v", dirs)
+		}
+		if err := vfs.WriteFile("esp://new.txt", nil, 0644); err == nil {
+			t.Error("Mounted images should be read-only")
+		}
+		if err := vfs.MountImage("bad", filepath.Join(dir, "missing.img")); err == nil {
+			t.Error("Mounting a missing image should fail")
+		}
+	})
+}
+
+// buildTestSquashFS returns a gzip compressed SquashFS image holding
+// /hello.txt, packed in a fragment, /data/big.bin, one compressed block
+// plus a fragment tail, and a symbolic link to skip
+func buildTestSquashFS(big []byte) []byte {
+	const blockSize = 4096
+	le := binary.LittleEndian
+	img := make([]byte, 96)
+
+	// Data area: the compressed first block of big.bin, then the fragment
+	var zbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	zw.Write(big[:blockSize])
+	zw.Close()
+	blockPos := len(img)
+	img = append(img, zbuf.Bytes()...)
+
+	hello := []byte("hello squashfs")
+	fragPos := len(img)
+	fragment := append(append([]byte{}, hello...), big[blockSize:]...)
+	img = append(img, fragment...)
+
+	meta := func(data []byte) []byte {
+		return append(le.AppendUint16(nil, uint16(len(data))|0x8000), data...)
+	}
+	inodeHeader := func(typ, mode uint16, number uint32) []byte {
+		h := le.AppendUint16(nil, typ)
+		h = le.AppendUint16(h, mode)
+		h = le.AppendUint32(h, 0) // uid and gid indexes
+		h = le.AppendUint32(h, 1700000000)
+		return le.AppendUint32(h, number)
+	}
+	dirInode := func(number uint32, listing, size, offset int) []byte {
+		b := inodeHeader(1, 0755, number)
+		b = le.AppendUint32(b, uint32(listing))
+		b = le.AppendUint32(b, 2)
+		b = le.AppendUint16(b, uint16(size))
+		b = le.AppendUint16(b, uint16(offset))
+		return le.AppendUint32(b, 1)
+	}
+	fileInode := func(number uint32, start int, fragOffset, size int, blocks ...uint32) []byte {
+		b := inodeHeader(2, 0644, number)
+		b = le.AppendUint32(b, uint32(start))
+		b = le.AppendUint32(b, 0) // Fragment 0
+		b = le.AppendUint32(b, uint32(fragOffset))
+		b = le.AppendUint32(b, uint32(size))
+		for _, s := range blocks {
+			b = le.AppendUint32(b, s)
+		}
+		return b
+	}
+	type dirEntry struct {
+		name  string
+		inode int
+		typ   uint16
+	}
+	listing := func(entries ...dirEntry) []byte {
+		b := le.AppendUint32(nil, uint32(len(entries)-1))
+		b = le.AppendUint32(b, 0) // All inodes are in the first metadata block
+		b = le.AppendUint32(b, 1)
+		for _, e := range entries {
+			b = le.AppendUint16(b, uint16(e.inode))
+			b = le.AppendUint16(b, 0)
+			b = le.AppendUint16(b, e.typ)
+			b = le.AppendUint16(b, uint16(len(e.name)-1))
+			b = append(b, e.name...)
+		}
+		return b
+	}
+
+	// Directory listings: the root's first, then /data's
+	dataList := listing(dirEntry{"big.bin", 64, 2}, dirEntry{"link", 100, 3})
+	rootList := listing(dirEntry{"data", 32, 1}, dirEntry{"hello.txt", 133, 2})
+	dirs := append(append([]byte{}, rootList...), dataList...)
+
+	// Inodes at fixed offsets: root 0, data 32, big.bin 64, link 100,
+	// hello.txt 133
+	var inodes []byte
+	inodes = append(inodes, dirInode(1, 0, len(rootList)+3, 0)...)
+	inodes = append(inodes, dirInode(2, 0, len(dataList)+3, len(rootList))...)
+	inodes = append(inodes, fileInode(3, blockPos, len(hello), len(big), uint32(zbuf.Len()))...)
+	link := inodeHeader(3, 0777, 4)
+	link = le.AppendUint32(link, 1)
+	link = le.AppendUint32(link, 9)
+	inodes = append(append(inodes, link...), "hello.txt"...)
+	inodes = append(inodes, fileInode(5, 0, 0, len(hello))...)
+
+	inodeTable := len(img)
+	img = append(img, meta(inodes)...)
+	dirTable := len(img)
+	img = append(img, meta(dirs)...)
+
+	fragMeta := len(img)
+	entry := le.AppendUint64(nil, uint64(fragPos))
+	entry = le.AppendUint32(entry, uint32(len(fragment))|1<<24)
+	img = append(img, meta(le.AppendUint32(entry, 0))...)
+	fragTable := len(img)
+	img = le.AppendUint64(img, uint64(fragMeta))
+
+	sb := img[:96]
+	copy(sb, "hsqs")
+	le.PutUint32(sb[4:], 5)
+	le.PutUint32(sb[12:], blockSize)
+	le.PutUint32(sb[16:], 1) // Fragments
+	le.PutUint16(sb[20:], 1) // gzip
+	le.PutUint16(sb[22:], 12)
+	le.PutUint16(sb[28:], 4)
+	le.PutUint64(sb[32:], 0) // Root inode reference
+	le.PutUint64(sb[40:], uint64(len(img)))
+	le.PutUint64(sb[64:], uint64(inodeTable))
+	le.PutUint64(sb[72:], uint64(dirTable))
+	le.PutUint64(sb[80:], uint64(fragTable))
+	return img
+}
+
+func TestSquashFS(t *testing.T) {
+	big := make([]byte, 5000)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	image := filepath.Join(t.TempDir(), "rootfs.squashfs")
+	os.WriteFile(image, buildTestSquashFS(big), 0644)
+
+	vfs, err := NewArchiveVFS(image)
+	if err != nil {
+		t.Fatalf("NewArchiveVFS failed: %v", err)
+	}
+	defer vfs.Close()
+
+	files, _ := vfs.FindFiles("/", "*")
+	if strings.Join(files, ",") != "/data/big.bin,/hello.txt" {
+		t.Errorf("Files = %v", files)
+	}
+	if content, _ := vfs.ReadFileString("/hello.txt"); content != "hello squashfs" {
+		t.Errorf("hello.txt = %q", content)
+	}
+	if data, err := vfs.ReadFile("/data/big.bin"); err != nil || !bytes.Equal(data, big) {
+		t.Errorf("big.bin read %d bytes, %v", len(data), err)
+	}
+	if part, _ := vfs.ReadRange("/data/big.bin", 4090, 10); !bytes.Equal(part, big[4090:4100]) {
+		t.Errorf("ReadRange across block and fragment = %v", part)
+	}
+	if info, err := vfs.Stat("/data"); err != nil || !info.IsDir() || info.ModTime().Unix() != 1700000000 {
+		t.Errorf("Stat = %v, %v", info, err)
+	}
+
+	// Images using compressors without a standard library decoder are
+	// rejected with a clear error
+	xz := buildTestSquashFS(big)
+	binary.LittleEndian.PutUint16(xz[20:], 4)
+	os.WriteFile(image, xz, 0644)
+	if _, err := NewArchiveVFS(image); err == nil || !strings.Contains(err.Error(), "xz") {
+		t.Errorf("xz image error = %v", err)
+	}
+}
+
+func TestMultiRootVFS(t *testing.T) {
+	work, cache := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(cache, "hit.bin"), []byte("cached"), 0644)
+
+	vfs := NewMultiRootVFS(map[string]string{"/c": work, "/d": cache})
+	defer vfs.Close()
+
+	if err := vfs.WriteFile("/c/src/main.go", []byte("package main"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(work, "src", "main.go")); err != nil || string(data) != "package main" {
+		t.Errorf("File on disk = %q, %v", data, err)
+	}
+	if content, _ := vfs.ReadFileString("/d/hit.bin"); content != "cached" {
+		t.Errorf("ReadFile from second root = %q", content)
+	}
+
+	if dirs, _ := vfs.ListDirs("/"); strings.Join(dirs, ",") != "c,d" {
+		t.Errorf("ListDirs(/) = %v", dirs)
+	}
+	if info, err := vfs.Stat("/d"); err != nil || !info.IsDir() || info.Name() != "d" {
+		t.Errorf("Stat of mount point = %v, %v", info, err)
+	}
+	if found, _ := vfs.FindFiles("/", "*"); strings.Join(found, ",") != "/c/src/main.go,/d/hit.bin" {
+		t.Errorf("FindFiles across roots = %v", found)
+	}
+
+	if err := vfs.Move("/d/hit.bin", "/c/hit.bin"); err != nil {
+		t.Errorf("Move across roots failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(work, "hit.bin")); err != nil {
+		t.Errorf("Moved file missing on disk: %v", err)
+	}
+
+	if err := vfs.RemoveAll("/d"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Removing a mount point should fail with ErrPermission, got %v", err)
+	}
+	if err := vfs.WriteFile("/outside.txt", nil, 0644); err == nil {
+		t.Error("Writes outside the mounts should fail")
+	}
+
+	// Each root is watched through its own disk path
+	events := make(chan WatchEvent, 16)
+	if err := vfs.Watch("/d", func(e WatchEvent) { events <- e }); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	os.WriteFile(filepath.Join(cache, "new.bin"), []byte("x"), 0644)
+	select {
+	case e := <-events:
+		if e.Path != "/d/new.bin" {
+			t.Errorf("Event path = %s, want /d/new.bin", e.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event from the second root")
+	}
+
+	// Mounts can also extend a disk VFS with a primary root
+	primary := t.TempDir()
+	os.MkdirAll(filepath.Join(primary, "src"), 0755)
+	mixed := NewDiskVFS(primary, WithDiskMount("/mnt/cache", cache))
+	defer mixed.Close()
+	if dirs, _ := mixed.ListDirs("/"); strings.Join(dirs, ",") != "mnt,src" {
+		t.Errorf("ListDirs with nested mount = %v", dirs)
+	}
+	if content, _ := mixed.ReadFileString("/mnt/cache/new.bin"); content != "x" {
+		t.Errorf("ReadFile through nested mount = %q", content)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	for _, d := range []Durability{DurabilityNone, DurabilityFlush, DurabilityFsync} {
+		t.Run(d.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			vfs := NewDiskVFS(dir, WithDurability(d))
+			defer vfs.Close()
+
+			if err := vfs.WriteFile("/a/b/file.txt", []byte("data"), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			f, err := vfs.Create("/created.txt")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if _, synced := f.(*syncOnClose); synced != (d >= DurabilityFlush) {
+				t.Errorf("Create handle syncs on close = %v", synced)
+			}
+			f.Write([]byte("created"))
+			if err := f.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+			if err := vfs.Remove("/created.txt"); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+
+			// Only changes that weren't synced on the spot are pending
+			pending := len(vfs.dirty.paths)
+			if want := map[Durability]int{DurabilityNone: 2, DurabilityFlush: 2, DurabilityFsync: 0}[d]; pending != want {
+				t.Errorf("%d paths pending, want %d", pending, want)
+			}
+			if err := vfs.SyncAll(); err != nil {
+				t.Errorf("SyncAll failed: %v", err)
+			}
+			if len(vfs.dirty.paths) != 0 {
+				t.Errorf("Paths still pending after SyncAll: %v", vfs.dirty.paths)
+			}
+
+			if err := vfs.Sync("/a/b/file.txt"); err != nil {
+				t.Errorf("Sync failed: %v", err)
+			}
+			if err := vfs.Sync("/a"); err != nil {
+				t.Errorf("Sync of directory failed: %v", err)
+			}
+			if err := vfs.Sync("/missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Sync of missing path = %v", err)
+			}
+		})
+	}
+
+	mem := New(WithDurability(DurabilityFsync))
+	mem.WriteFile("/x", []byte("x"), 0644)
+	if err := mem.Sync("/x"); err != nil {
+		t.Errorf("Sync on memory VFS = %v", err)
+	}
+	if err := mem.SyncAll(); err != nil {
+		t.Errorf("SyncAll on memory VFS = %v", err)
+	}
+}
+
+func TestCreateNew(t *testing.T) {
+	backends := map[string]*VFS{
+		"memory": New(),
+		"disk":   NewDiskVFS(t.TempDir()),
+	}
+	for name, vfs := range backends {
+		t.Run(name, func(t *testing.T) {
+			defer vfs.Close()
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var won []int
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					err := vfs.CreateNew("/run/app.pid", []byte(fmt.Sprint(i)), 0644)
+					switch {
+					case err == nil:
+						mu.Lock()
+						won = append(won, i)
+						mu.Unlock()
+					case !errors.Is(err, fs.ErrExist):
+						t.Errorf("CreateNew failed with %v, want ErrExist", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if len(won) != 1 {
+				t.Fatalf("%d callers created the file, want exactly 1", len(won))
+			}
+			if content, _ := vfs.ReadFileString("/run/app.pid"); content != fmt.Sprint(won[0]) {
+				t.Errorf("Content = %q, want the winner's %d", content, won[0])
+			}
+
+			vfs.Remove("/run/app.pid")
+			if err := vfs.CreateNew("/run/app.pid", []byte("again"), 0644); err != nil {
+				t.Errorf("CreateNew after Remove failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestRenameDir(t *testing.T) {
+	backends := map[string]func(t *testing.T) *VFS{
+		"memory": func(t *testing.T) *VFS { return New() },
+		"disk":   func(t *testing.T) *VFS { return NewDiskVFS(t.TempDir()) },
+	}
+	for name, newVFS := range backends {
+		t.Run(name, func(t *testing.T) {
+			vfs := newVFS(t)
+			defer vfs.Close()
+			vfs.WriteFile("/src/main.go", []byte("package main"), 0644)
+			vfs.WriteFile("/src/pkg/util.go", []byte("package pkg"), 0644)
+
+			if err := vfs.RenameDir("/src", "/lib/app"); err != nil {
+				t.Fatalf("RenameDir failed: %v", err)
+			}
+			if content, _ := vfs.ReadFileString("/lib/app/pkg/util.go"); content != "package pkg" {
+				t.Errorf("Moved file = %q", content)
+			}
+			if vfs.Exists("/src") {
+				t.Error("Old directory should be gone")
+			}
+
+			vfs.MkdirAll("/other", 0755)
+			if err := vfs.RenameDir("/lib", "/other"); !errors.Is(err, fs.ErrExist) {
+				t.Errorf("RenameDir onto existing path = %v, want ErrExist", err)
+			}
+			if err := vfs.RenameDir("/lib", "/lib/app/nested"); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("RenameDir into itself = %v, want ErrInvalid", err)
+			}
+			if err := vfs.RenameDir("/lib/app/main.go", "/main"); err == nil {
+				t.Error("RenameDir of a file should fail")
+			}
+		})
+	}
+
+	t.Run("state", func(t *testing.T) {
+		vfs := NewDiskVFS(t.TempDir(), WithMetadataDB(filepath.Join(t.TempDir(), "meta.json")), WithPathIndex(time.Hour))
+		defer vfs.Close()
+		vfs.WriteFile("/src/main.go", []byte("package main"), 0644)
+		vfs.SetTags("/src/main.go", "entry")
+		before, _ := vfs.Metadata("/src/main.go")
+
+		events := make(chan WatchEvent, 16)
+		if err := vfs.Watch("/src", func(e WatchEvent) {
+			if e.OldPath != "" {
+				events <- e
+			}
+		}); err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+
+		if err := vfs.RenameDir("/src", "/app"); err != nil {
+			t.Fatalf("RenameDir failed: %v", err)
+		}
+		select {
+		case e := <-events:
+			if e.Op != WatchOpRename || e.Path != "/app" || e.OldPath != "/src" || !e.IsDir {
+				t.Errorf("Rename event = %+v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("No rename event")
+		}
+		if !vfs.IsWatching("/app") || vfs.IsWatching("/src") {
+			t.Error("Watch should follow the directory")
+		}
+
+		if got := vfs.FindByTag("entry"); strings.Join(got, ",") != "/app/main.go" {
+			t.Errorf("FindByTag after rename = %v", got)
+		}
+		if after, _ := vfs.Metadata("/app/main.go"); after.Hash != before.Hash {
+			t.Errorf("Hash after rename = %q, want %q", after.Hash, before.Hash)
+		}
+		if found, _ := vfs.FindFiles("/", "*.go"); strings.Join(found, ",") != "/app/main.go" {
+			t.Errorf("FindFiles after rename = %v", found)
+		}
+	})
+
+	t.Run("across roots", func(t *testing.T) {
+		work, cache := t.TempDir(), t.TempDir()
+		vfs := NewMultiRootVFS(map[string]string{"/c": work, "/d": cache})
+		defer vfs.Close()
+		vfs.WriteFile("/c/build/out.bin", []byte("binary"), 0644)
+
+		if err := vfs.RenameDir("/c/build", "/d/build"); err != nil {
+			t.Fatalf("RenameDir across roots failed: %v", err)
+		}
+		if data, err := os.ReadFile(filepath.Join(cache, "build", "out.bin")); err != nil || string(data) != "binary" {
+			t.Errorf("Copied file = %q, %v", data, err)
+		}
+		if _, err := os.Stat(filepath.Join(work, "build")); !os.IsNotExist(err) {
+			t.Errorf("Source should be removed, Stat = %v", err)
+		}
+	})
+}
+
+// TestRenameDirInternalWatches tests that internal watches below a renamed
+// directory move with it, including names starting with ".."
+func TestRenameDirInternalWatches(t *testing.T) {
+	root := t.TempDir()
+	vfs := NewDiskVFS(root)
+	defer vfs.Close()
+	wm := vfs.watchManager
+	if wm == nil {
+		t.Skip("watching is not supported")
+	}
+
+	vfs.MkdirAll("/a/..cache", 0755)
+	vfs.MkdirAll("/ab", 0755)
+	for _, dir := range []string{"/a/..cache", "/ab"} {
+		if err := wm.watchInternal(dir); err != nil {
+			t.Fatalf("watchInternal(%s) failed: %v", dir, err)
+		}
+	}
+
+	if err := vfs.RenameDir("/a", "/b"); err != nil {
+		t.Fatalf("RenameDir failed: %v", err)
+	}
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	for _, dir := range []string{"b/..cache", "ab"} {
+		if !wm.internal[filepath.Join(root, dir)] {
+			t.Errorf("Expected an internal watch on %s, got %v", dir, wm.internal)
+		}
+	}
+	if wm.internal[filepath.Join(root, "a", "..cache")] {
+		t.Error("The watch on the old path should be gone")
+	}
+}
+
+func TestWalkSkip(t *testing.T) {
+	vfs := New()
+	for _, p := range []string{"/a/1.txt", "/a/2.txt", "/a/3.txt", "/b/skip/x.txt", "/b/y.txt", "/c/z.txt"} {
+		vfs.WriteFile(p, []byte(p), 0644)
+	}
+
+	walk := func(skip func(path string, info fs.FileInfo) error) (string, error) {
+		var visited []string
+		err := vfs.Walk("/", func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			visited = append(visited, path)
+			return skip(path, info)
+		})
+		return strings.Join(visited, ","), err
+	}
+
+	got, err := walk(func(path string, info fs.FileInfo) error {
+		if path == "/b/skip" || path == "/a/2.txt" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if want := "/,/a,/a/1.txt,/a/2.txt,/b,/b/skip,/b/y.txt,/c,/c/z.txt"; err != nil || got != want {
+		t.Errorf("Walk with SkipDir visited %s, %v; want %s", got, err, want)
+	}
+
+	got, err = walk(func(path string, info fs.FileInfo) error {
+		if path == "/b/skip" {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if want := "/,/a,/a/1.txt,/a/2.txt,/a/3.txt,/b,/b/skip"; err != nil || got != want {
+		t.Errorf("Walk with SkipAll visited %s, %v; want %s", got, err, want)
+	}
+
+	if err := vfs.Walk("/a/1.txt", func(string, fs.FileInfo, error) error { return fs.SkipDir }); err != nil {
+		t.Errorf("SkipDir from a file root should end the walk cleanly, got %v", err)
+	}
+
+	var walkErr *WalkError
+	err = vfs.Walk("/missing", func(path string, info fs.FileInfo, err error) error { return err })
+	if !errors.As(err, &walkErr) || walkErr.Root != "/missing" || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Walk of a missing root = %v, want a *WalkError wrapping ErrNotExist", err)
+	}
+	if _, err := vfs.FindFiles("/missing", "*"); !errors.As(err, &walkErr) {
+		t.Errorf("FindFiles of a missing root = %v, want a *WalkError", err)
+	}
+}
+
+func TestWalkEntriesBundled(t *testing.T) {
+	vfs := New(WithType(VFSTypeHybrid))
+	if err := vfs.RegisterBundled("test", testdataFS, "testdata"); err != nil {
+		t.Fatalf("RegisterBundled failed: %v", err)
+	}
+
+	var urls, inner []string
+	err := vfs.WalkEntries("test://fuzz", func(entry WalkEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		urls = append(urls, entry.Path)
+		inner = append(inner, entry.FSPath)
+		if entry.Info.IsDir() && entry.FSPath == "fuzz/FuzzFindFiles" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkEntries failed: %v", err)
+	}
+	if got := strings.Join(urls, ","); got != "test://fuzz,test://fuzz/FuzzFindFiles" {
+		t.Errorf("Paths = %s", got)
+	}
+	if got := strings.Join(inner, ","); got != "fuzz,fuzz/FuzzFindFiles" {
+		t.Errorf("FSPaths = %s", got)
+	}
+
+	var visited int
+	err = vfs.Walk("test://fuzz", func(path string, info fs.FileInfo, err error) error {
+		visited++
+		return fs.SkipAll
+	})
+	if err != nil || visited != 1 {
+		t.Errorf("Bundled Walk with SkipAll visited %d entries, %v", visited, err)
+	}
+
+	var walkErr *WalkError
+	err = vfs.Walk("test://missing", func(path string, info fs.FileInfo, err error) error { return err })
+	if !errors.As(err, &walkErr) || walkErr.Root != "test://missing" {
+		t.Errorf("Bundled Walk of a missing root = %v, want a *WalkError", err)
+	}
+}
+
+func TestBundledPathRoundTrip(t *testing.T) {
+	vfs := New(WithType(VFSTypeHybrid))
+	if err := vfs.RegisterBundled("test", testdataFS, "./testdata/"); err != nil {
+		t.Fatalf("RegisterBundled failed: %v", err)
+	}
+
+	var walked []string
+	vfs.Walk("test://", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, path)
+		if _, err := vfs.Stat(path); err != nil {
+			t.Errorf("Stat of walked path %s failed: %v", path, err)
+		}
+		return nil
+	})
+	if len(walked) == 0 || walked[0] != "test://" {
+		t.Errorf("Walk should start at the bundle root test://, got %v", walked)
+	}
+
+	urls, err := vfs.FindFiles("test://", "*.txt")
+	if err != nil || strings.Join(urls, ",") != "test://test.txt" {
+		t.Fatalf("FindFiles = %v, %v", urls, err)
+	}
+	if _, err := vfs.ReadFile(urls[0]); err != nil {
+		t.Errorf("ReadFile of a found URL failed: %v", err)
+	}
+
+	rel, err := vfs.FindFilesAs("test://fuzz", "*", PathBundleRelative)
+	if err != nil || len(rel) == 0 || !strings.HasPrefix(rel[0], "fuzz/FuzzFindFiles/") {
+		t.Errorf("FindFilesAs bundle-relative = %v, %v", rel, err)
+	}
+	if _, err := fs.ReadFile(testdataFS, "testdata/"+rel[0]); err != nil {
+		t.Errorf("Bundle-relative path %s is not below the subdirectory: %v", rel[0], err)
+	}
+
+	if vfs.Exists("test://../vfs_test.go") || !vfs.Exists("test:///../test.txt") {
+		t.Error("Bundled paths should be cleaned within the subdirectory")
+	}
+}
+
+func TestWalkRel(t *testing.T) {
+	vfs := New(WithType(VFSTypeHybrid))
+	vfs.WriteFile("/site/index.html", []byte("<html>"), 0644)
+	vfs.WriteFile("/site/css/main.css", []byte("body{}"), 0644)
+	vfs.WriteFile("/site/drafts/wip.html", []byte("wip"), 0644)
+
+	var got []string
+	err := vfs.WalkRel("/site", func(rel string, d fs.DirEntry) error {
+		if d.IsDir() && rel == "drafts" {
+			return fs.SkipDir
+		}
+		got = append(got, rel)
+		return nil
+	})
+	if want := ".,css,css/main.css,index.html"; err != nil || strings.Join(got, ",") != want {
+		t.Errorf("WalkRel = %v, %v; want %s", got, err, want)
+	}
+
+	vfs.RegisterBundled("test", testdataFS, "testdata")
+	got = nil
+	vfs.WalkRel("test://", func(rel string, d fs.DirEntry) error {
+		got = append(got, rel)
+		return nil
+	})
+	if !slices.Contains(got, "test.txt") || got[0] != "." {
+		t.Errorf("WalkRel over a bundle = %v", got)
+	}
+
+	err = vfs.WalkRel("/missing", func(string, fs.DirEntry) error { return nil })
+	var walkErr *WalkError
+	if !errors.As(err, &walkErr) {
+		t.Errorf("WalkRel of a missing root = %v, want a *WalkError", err)
+	}
+}
+
+// failingWriter fails after accepting n writes
+type failingWriter struct {
+	n      int
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.writes >= w.n {
+		return 0, errors.New("disk full")
+	}
+	w.writes++
+	return len(p), nil
+}
+
+func TestDumpSectionsAndErrors(t *testing.T) {
+	vfs := NewMemoryVFS()
+	vfs.WriteFile("/a.txt", []byte("a"), 0644)
+	vfs.WriteFile("/src/main.go", []byte("package main"), 0644)
+	vfs.WriteFile("/src/util/util.go", []byte("package util"), 0644)
+	vfs.RegisterBundled("assets", testEmbed, "testdata")
+
+	for _, n := range []int{0, 2, 5} {
+		w := &failingWriter{n: n}
+		if err := vfs.Dump(w); err == nil || err.Error() != "disk full" {
+			t.Errorf("Dump after %d writes = %v, want the writer's error", n, err)
+		}
+		if w.writes != n {
+			t.Errorf("Dump kept writing after the writer failed: %d writes", w.writes)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := vfs.DumpSections(&buf, DumpBundles); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	if out := buf.String(); strings.Contains(out, "VFS Root") || !strings.Contains(out, "Bundle [assets://]:") {
+		t.Errorf("Dump of bundles only =\n%s", out)
+	}
+
+	buf.Reset()
+	if err := vfs.DumpTree(&buf, "/src"); err != nil {
+		t.Fatalf("DumpTree failed: %v", err)
+	}
+	want := "--- /src ---\n├── main.go\n└── util\n    └── util.go\n"
+	if buf.String() != want {
+		t.Errorf("DumpTree(/src) =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := vfs.DumpTree(&buf, "assets://fuzz"); err != nil || !strings.Contains(buf.String(), "└── FuzzFindFiles") {
+		t.Errorf("DumpTree of a bundle = %v\n%s", err, buf.String())
+	}
+	if err := vfs.DumpTree(nil, "/"); err == nil {
+		t.Error("DumpTree to a nil writer should fail")
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	work, cache := t.TempDir(), t.TempDir()
+	vfs := NewMultiRootVFS(map[string]string{"/c": work, "/d": cache},
+		WithDirCache(time.Minute), WithPathIndex(0), WithDurability(DurabilityFsync))
+	defer vfs.Close()
+	vfs.RegisterBundled("assets", testEmbed, "testdata")
+	vfs.Freeze("/c/release")
+
+	info := vfs.Describe()
+	want := VFSInfo{
+		Type:             VFSTypeDisk,
+		Mounts:           map[string]string{"/c": work, "/d": cache},
+		Bundles:          []string{"assets"},
+		SharedCacheLimit: defaultSharedCacheLimit,
+		DirCache:         true,
+		DirCacheTTL:      time.Minute,
+		PathIndex:        true,
+		Durability:       DurabilityFsync,
+		Watching:         true,
+		Frozen:           []string{"/c/release"},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("Describe() = %+v\nwant %+v", info, want)
+	}
+
+	mem := NewMemoryVFS().Describe()
+	if mem.Type != VFSTypeMemory || mem.Type.String() != "memory" || mem.Watching || mem.Root != "" || mem.Mounts != nil {
+		t.Errorf("Describe() of a memory VFS = %+v", mem)
+	}
+}
+
+func TestBulkCopyDirsAndModes(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "build", "out"), 0755)
+	os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	os.WriteFile(filepath.Join(src, "bin", "run.sh"), []byte("#!/bin/sh"), 0755)
+	os.Chmod(filepath.Join(src, "bin", "run.sh"), 0750)
+	os.Chmod(filepath.Join(src, "bin"), 0700)
+
+	vfs := NewMemoryVFS()
+	if err := vfs.LoadFromDisk(src, "/app"); err != nil {
+		t.Fatalf("LoadFromDisk failed: %v", err)
+	}
+
+	check := func(name string, fsys FileSystem) {
+		t.Helper()
+		if !fsys.IsDir("/app/build/out") {
+			t.Errorf("%s: empty directory was not copied", name)
+		}
+		if info, err := fsys.Stat("/app/bin/run.sh"); err != nil || info.Mode().Perm() != 0750 {
+			t.Errorf("%s: file mode = %v, %v; want 0750", name, info.Mode(), err)
+		}
+		if info, err := fsys.Stat("/app/bin"); err != nil || info.Mode().Perm() != 0700 {
+			t.Errorf("%s: directory mode = %v, %v; want 0700", name, info.Mode(), err)
+		}
+	}
+	check("LoadFromDisk", vfs)
+	check("Clone", vfs.Clone())
+
+	merged := NewMemoryVFS(WithChangeJournal(JournalOptions{Content: true}))
+	merged.MkdirAll("/app", 0711)
+	if err := merged.Merge(vfs.Clone(), "/"); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	check("Merge", merged)
+
+	// Modes are journaled, so a rebuild restores them too
+	rebuilt, err := merged.RebuildAt(merged.journal.cursor())
+	if err != nil {
+		t.Fatalf("RebuildAt failed: %v", err)
+	}
+	check("RebuildAt", rebuilt)
+
+	merged.Seal()
+	if err := merged.Merge(vfs.Clone(), "/"); !errors.Is(err, ErrSealed) {
+		t.Errorf("Merge into a sealed VFS = %v, want ErrSealed", err)
+	}
+
+	plain := NewMemoryVFS()
+	if err := plain.LoadFromDiskWith(src, "/app", CopyEmptyDirs(false), CopyModes(false)); err != nil {
+		t.Fatalf("LoadFromDisk failed: %v", err)
+	}
+	if plain.Exists("/app/build") {
+		t.Error("Empty directories should be skipped when turned off")
+	}
+	if info, _ := plain.Stat("/app/bin"); info.Mode().Perm() != 0755 {
+		t.Errorf("Directory mode without CopyModes = %v, want 0755", info.Mode())
+	}
+	if clone := vfs.CloneWith(CopyEmptyDirs(false)); clone.Exists("/app/build/out") {
+		t.Error("Clone should skip empty directories when turned off")
+	}
+}
+
+func TestHiddenFiles(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"main.go", ".DS_Store", "img/Thumbs.db", "img/logo.png", ".git/HEAD", ".env"} {
+		os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(src, name), []byte(name), 0644)
+	}
+
+	files := func(fsys *VFS) string {
+		found, err := fsys.FindFiles("/", "*")
+		if err != nil {
+			t.Fatalf("FindFiles failed: %v", err)
+		}
+		return strings.Join(found, ",")
+	}
+
+	vfs := NewMemoryVFS()
+	vfs.LoadFromDisk(src, "/")
+	if got, want := files(vfs), "/.env,/.git/HEAD,/img/logo.png,/main.go"; got != want {
+		t.Errorf("Default policy loaded %s, want %s", got, want)
+	}
+
+	strict := NewDiskVFS(src, WithDotfiles(false), WithPathIndex(0))
+	defer strict.Close()
+	if got, want := files(strict), "/img/logo.png,/main.go"; got != want {
+		t.Errorf("Without dotfiles found %s, want %s", got, want)
+	}
+	var buf bytes.Buffer
+	if err := strict.ExportTxtar(&buf, "/"); err != nil || strings.Contains(buf.String(), ".git") || strings.Contains(buf.String(), "Thumbs") {
+		t.Errorf("ExportTxtar included hidden files: %v\n%s", err, buf.String())
+	}
+	if !strict.Exists("/.env") {
+		t.Error("Hidden files should still be readable directly")
+	}
+
+	everything := NewDiskVFS(src, WithJunkFiles())
+	defer everything.Close()
+	if got := files(everything); !strings.Contains(got, "/.DS_Store") || !strings.Contains(got, "/img/Thumbs.db") {
+		t.Errorf("WithJunkFiles() without patterns found %s", got)
+	}
+	if clone := strict.Clone(); !clone.Exists("/.git/HEAD") {
+		t.Error("Clone should copy hidden files")
+	}
+	merged := NewMemoryVFS()
+	if err := merged.Merge(strict, "/"); err != nil || !merged.Exists("/.git/HEAD") {
+		t.Errorf("Merge should copy hidden files like Clone: %v", err)
+	}
+
+	dest := t.TempDir()
+	if err := everything.SaveToDisk("/", dest); err != nil {
+		t.Fatalf("SaveToDisk failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, ".DS_Store")); err != nil {
+		t.Errorf("SaveToDisk without junk patterns should save .DS_Store: %v", err)
+	}
+}
+
+func TestNameRules(t *testing.T) {
+	vfs := NewMemoryVFS(WithNameRules(WindowsNameRules))
+	for _, p := range []string{"/gen/a:b.txt", "/CON", "/out/nul.tar.gz", "/trailing.", "/" + strings.Repeat("é", 256)} {
+		err := vfs.WriteFile(p, []byte("x"), 0644)
+		var nameErr *NameError
+		if !errors.As(err, &nameErr) || !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("WriteFile(%q) = %v, want a *NameError", p, err)
+		}
+	}
+	if err := vfs.MkdirAll("/a/LPT1/b", 0755); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("MkdirAll through a device name = %v, want ErrInvalid", err)
+	}
+	if err := vfs.WriteFile("/"+strings.Repeat("é", 255), []byte("x"), 0644); err != nil {
+		t.Errorf("255 UTF-16 units should be accepted on Windows: %v", err)
+	}
+	if err := vfs.WriteFile("/console.log", []byte("x"), 0644); err != nil {
+		t.Errorf("WriteFile of a valid name failed: %v", err)
+	}
+
+	if err := NewMemoryVFS().WriteFile("/a:b", []byte("x"), 0644); err != nil {
+		t.Errorf("Memory VFS should accept any name by default: %v", err)
+	}
+	if err := NewDiskVFS(t.TempDir()).WriteFile("/"+strings.Repeat("x", 256), nil, 0644); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Disk VFS should reject names the OS cannot store, got %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"report: Q1?.pdf": "report_ Q1_.pdf",
+		"CON.txt":         "_CON.txt",
+		"dots...":         "dots",
+		"a/b":             "a_b",
+		"..":              "_",
+		"":                "_",
+		"tab\there":       "tab_here",
+		"normal-name.go":  "normal-name.go",
+	} {
+		if got := SanitizeName(name); got != want {
+			t.Errorf("SanitizeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+	long := SanitizeName(strings.Repeat("a", 300) + ".json")
+	if len(long) != 255 || !strings.HasSuffix(long, ".json") {
+		t.Errorf("SanitizeName of a long name = %d bytes, %q", len(long), long[len(long)-8:])
+	}
+	if err := PortableNameRules.Validate("/" + SanitizeName(`a<b>"c|d*`)); err != nil {
+		t.Errorf("Sanitized name does not validate: %v", err)
+	}
+}
+
+func TestUniquePath(t *testing.T) {
+	backends := map[string]func(t *testing.T) *VFS{
+		"memory": func(t *testing.T) *VFS { return NewMemoryVFS() },
+		"disk":   func(t *testing.T) *VFS { return NewDiskVFS(t.TempDir()) },
+	}
+	for name, newVFS := range backends {
+		t.Run(name, func(t *testing.T) {
+			vfs := newVFS(t)
+			defer vfs.Close()
+			vfs.WriteFile("/downloads/report.pdf", []byte("first"), 0644)
+			vfs.MkdirAll("/downloads/report-1.pdf", 0755)
+
+			p, err := vfs.UniquePath("/downloads", "report", "pdf")
+			if err != nil || p != "/downloads/report-2.pdf" {
+				t.Fatalf("UniquePath = %q, %v; want /downloads/report-2.pdf", p, err)
+			}
+			if content, _ := vfs.ReadFileString("/downloads/report.pdf"); content != "first" {
+				t.Error("UniquePath must not touch existing files")
+			}
+
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			seen := make(map[string]bool)
+			for range 20 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					p, err := vfs.UniquePath("/gen", "out", ".go")
+					if err != nil {
+						t.Errorf("UniquePath failed: %v", err)
+						return
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if seen[p] {
+						t.Errorf("Path %s handed out twice", p)
+					}
+					seen[p] = true
+				}()
+			}
+			wg.Wait()
+			if !seen["/gen/out.go"] || !seen["/gen/out-19.go"] {
+				t.Errorf("Concurrent names = %v", slices.Sorted(maps.Keys(seen)))
+			}
+		})
+	}
+}
+
+func TestWritePolicy(t *testing.T) {
+	vfs := NewMemoryVFS(WithWritePolicy(
+		OnlyUnder("/workspace"),
+		DenyExtensions("/workspace/uploads", "exe", ".BAT"),
+		DenyNames("/workspace", ".htaccess"),
+	))
+
+	denied := map[string]func() error{
+		"outside":      func() error { return vfs.WriteFile("/etc/passwd", nil, 0644) },
+		"exe":          func() error { return vfs.WriteFile("/workspace/uploads/setup.exe", nil, 0644) },
+		"upper case":   func() error { return vfs.WriteFile("/workspace/uploads/run.Bat", nil, 0644) },
+		"create":       func() error { _, err := vfs.Create("/workspace/uploads/a/b.exe"); return err },
+		"name":         func() error { return vfs.CreateNew("/workspace/site/.htaccess", nil, 0644) },
+		"mkdir":        func() error { return vfs.MkdirAll("/tmp/cache", 0755) },
+		"unique":       func() error { _, err := vfs.UniquePath("/workspace/uploads", "x", ".exe"); return err },
+		"rename inner": func() error { return vfs.RenameDir("/workspace/staging", "/workspace/uploads/staging") },
+		"rename out":   func() error { return vfs.RenameDir("/workspace/staging", "/staging") },
+	}
+	vfs.WriteFile("/workspace/staging/tool.exe", []byte("MZ"), 0644)
+
+	for name, write := range denied {
+		if err := write(); !errors.Is(err, ErrWriteDenied) || !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: err = %v, want ErrWriteDenied", name, err)
+		}
+	}
+	if vfs.Exists("/workspace/uploads/setup.exe") || vfs.Exists("/staging") {
+		t.Error("Denied writes should leave nothing behind")
+	}
+
+	if err := vfs.WriteFile("/workspace/uploads/photo.jpg", []byte("jpeg"), 0644); err != nil {
+		t.Errorf("Allowed write failed: %v", err)
+	}
+	if err := vfs.MkdirAll("/workspace/uploads/tool.exe.d", 0755); err != nil {
+		t.Errorf("Extension rules should not apply to directories: %v", err)
+	}
+	if err := vfs.RenameDir("/workspace/staging", "/workspace/build"); err != nil {
+		t.Errorf("Allowed rename failed: %v", err)
+	}
+
+	dirs := []string{"workspace/"}
+	OnlyUnder(dirs...)
+	if dirs[0] != "workspace/" {
+		t.Errorf("OnlyUnder changed its arguments to %q", dirs)
+	}
+}
+
+func TestContentScanner(t *testing.T) {
+	scanner := func(ctx context.Context, path string, content io.Reader) (ScanVerdict, error) {
+		data, err := io.ReadAll(content)
+		switch {
+		case err != nil:
+			return ScanClean, err
+		case bytes.Contains(data, []byte("EICAR")):
+			return ScanReject, nil
+		case bytes.Contains(data, []byte("SUSPECT")):
+			return ScanQuarantine, nil
+		case bytes.Contains(data, []byte("OFFLINE")):
+			return ScanClean, errors.New("scanner unavailable")
+		}
+		return ScanClean, nil
+	}
+
+	t.Run("sync", func(t *testing.T) {
+		vfs := NewMemoryVFS(WithContentScanner(scanner, ScanOptions{MinSize: 4, Extensions: []string{"bin", ".exe"}}))
+
+		if err := vfs.WriteFile("/up/a.bin", []byte("xxEICARxx"), 0644); !errors.Is(err, ErrContentRejected) || vfs.Exists("/up/a.bin") {
+			t.Errorf("Rejected write = %v, exists %v", err, vfs.Exists("/up/a.bin"))
+		}
+		if err := vfs.CreateNew("/up/b.exe", []byte("SUSPECT"), 0644); !errors.Is(err, ErrQuarantined) || vfs.Exists("/up/b.exe") {
+			t.Errorf("Quarantined write = %v", err)
+		}
+		if content, _ := afero.ReadFile(vfs.Quarantine(), "/up/b.exe"); string(content) != "SUSPECT" {
+			t.Errorf("Quarantined content = %q", content)
+		}
+		if found, _ := vfs.FindFiles("/", "b.exe"); len(found) != 0 {
+			t.Errorf("Quarantined content should not be reachable through the VFS, found %v", found)
+		}
+		if err := vfs.WriteFile("/up/c.bin", []byte("OFFLINE"), 0644); err == nil || vfs.Exists("/up/c.bin") {
+			t.Error("A failing scanner should fail the write")
+		}
+		if err := vfs.WriteFile("/up/notes.txt", []byte("EICAR"), 0644); err != nil {
+			t.Errorf("Other extensions should not be scanned: %v", err)
+		}
+		if err := vfs.WriteFile("/up/d.bin", []byte("EIC"), 0644); err != nil {
+			t.Errorf("Files below MinSize should not be scanned: %v", err)
+		}
+
+		f, _ := vfs.Create("/up/stream.bin")
+		f.Write([]byte("chunk EICAR chunk"))
+		if err := f.Close(); !errors.Is(err, ErrContentRejected) || vfs.Exists("/up/stream.bin") {
+			t.Errorf("Close of a rejected Create = %v", err)
+		}
+	})
+
+	t.Run("async", func(t *testing.T) {
+		release := make(chan struct{})
+		slow := func(ctx context.Context, path string, content io.Reader) (ScanVerdict, error) {
+			<-release
+			if err := ctx.Err(); err != nil {
+				return ScanClean, err
+			}
+			return scanner(ctx, path, content)
+		}
+		review := afero.NewMemMapFs()
+		vfs := NewMemoryVFS(WithContentScanner(slow, ScanOptions{Async: true, Quarantine: review}))
+
+		// The scan outlives the request that wrote the file
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := vfs.WithContext(ctx).WriteFile("/up/a.bin", []byte("EICAR"), 0644); err != nil {
+			t.Fatalf("Asynchronous scans should not fail the write: %v", err)
+		}
+		cancel()
+		vfs.WriteFile("/up/b.bin", []byte("SUSPECT"), 0644)
+		vfs.WriteFile("/up/offline.bin", []byte("OFFLINE"), 0644)
+		vfs.WriteFile("/up/c.bin", []byte("EICAR"), 0644)
+		vfs.WriteFile("/up/c.bin", []byte("clean now"), 0644) // Rewritten before the scan ends
+		close(release)
+		vfs.scanner.pending.Wait()
+
+		if ok, _ := afero.Exists(review, "/up/a.bin"); vfs.Exists("/up/a.bin") || ok {
+			t.Error("Rejected file should be removed")
+		}
+		if ok, _ := afero.Exists(review, "/up/b.bin"); vfs.Exists("/up/b.bin") || !ok {
+			t.Error("Quarantined file should be moved to the quarantine")
+		}
+		if ok, _ := afero.Exists(review, "/up/offline.bin"); vfs.Exists("/up/offline.bin") || !ok {
+			t.Error("A file that could not be scanned should be quarantined")
+		}
+		if content, _ := vfs.ReadFileString("/up/c.bin"); content != "clean now" {
+			t.Errorf("Rewritten file = %q, want it kept", content)
+		}
+	})
+}
+
+func TestCreateLimited(t *testing.T) {
+	backends := map[string]func(t *testing.T) *VFS{
+		"memory": func(t *testing.T) *VFS { return NewMemoryVFS() },
+		"disk":   func(t *testing.T) *VFS { return NewDiskVFS(t.TempDir()) },
+	}
+	for name, newVFS := range backends {
+		t.Run(name, func(t *testing.T) {
+			vfs := newVFS(t)
+			defer vfs.Close()
+
+			w, err := vfs.CreateLimited("/uploads/ok.bin", 64)
+			if err != nil {
+				t.Fatalf("CreateLimited failed: %v", err)
+			}
+			if _, err := io.Copy(w, io.LimitReader(strings.NewReader(strings.Repeat("a", 100)), 64)); err != nil {
+				t.Errorf("Writing exactly the limit failed: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+			if info, err := vfs.Stat("/uploads/ok.bin"); err != nil || info.Size() != 64 {
+				t.Errorf("Stored file = %v, %v", info, err)
+			}
+
+			w, _ = vfs.CreateLimited("/uploads/bomb.bin", 64)
+			body := iotest.OneByteReader(strings.NewReader(strings.Repeat("b", 1000)))
+			n, err := io.Copy(w, body)
+			if !errors.Is(err, ErrTooLarge) || n != 64 {
+				t.Errorf("io.Copy past the limit = %d, %v; want 64, ErrTooLarge", n, err)
+			}
+			if err := w.Close(); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("Close after the limit = %v, want ErrTooLarge", err)
+			}
+			if vfs.Exists("/uploads/bomb.bin") {
+				t.Error("Partial file should be removed")
+			}
+		})
+	}
+}
+
+// TestCreateLimitedJournal tests that an aborted CreateLimited writer does
+// not journal its partial content
+func TestCreateLimitedJournal(t *testing.T) {
+	vfs := NewMemoryVFS(WithChangeJournal(JournalOptions{Content: true}))
+	w, _ := vfs.CreateLimited("/uploads/bomb.bin", 4)
+	w.Write([]byte("too large"))
+	w.Close()
+
+	changes, _, _ := vfs.Changes(0)
+	for _, c := range changes {
+		if c.Op == "Close" {
+			t.Errorf("Aborted upload journaled %+v", c)
+		}
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("on demand", func(t *testing.T) {
+		src := NewMemoryVFS()
+		dst := NewDiskVFS(t.TempDir())
+		defer dst.Close()
+
+		src.WriteFile("/site/index.html", []byte("home"), 0644)
+		src.WriteFile("/site/css/main.css", []byte("body{}"), 0600)
+		src.MkdirAll("/site/empty", 0755)
+		src.WriteFile("/other.txt", []byte("not replicated"), 0644)
+
+		opts := ReplicateOptions{Root: "/site", Dest: "/www"}
+		if err := src.Replicate(ctx, dst, opts); err != nil {
+			t.Fatalf("Replicate failed: %v", err)
+		}
+		if content, _ := dst.ReadFileString("/www/css/main.css"); content != "body{}" {
+			t.Errorf("Replicated content = %q", content)
+		}
+		if info, err := dst.Stat("/www/css/main.css"); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Replicated mode = %v, %v", info, err)
+		}
+		if !dst.IsDir("/www/empty") || dst.Exists("/www/other.txt") || dst.Exists("/other.txt") {
+			t.Error("Only the tree at Root should be replicated")
+		}
+	})
+
+	t.Run("conflicts", func(t *testing.T) {
+		src := NewMemoryVFS()
+		dst := NewMemoryVFS()
+		src.WriteFile("/a.txt", []byte("a1"), 0644)
+		src.WriteFile("/b.txt", []byte("b1"), 0644)
+		src.WriteFile("/gone/c.txt", []byte("c1"), 0644)
+		src.WriteFile("/gone/d.txt", []byte("d1"), 0644)
+
+		r := &replicator{v: src, target: dst, opts: ReplicateOptions{Root: "/", Dest: "/"}, pushed: make(map[string]replicaState)}
+		if err := r.push(ctx, "."); err != nil {
+			t.Fatalf("First push failed: %v", err)
+		}
+
+		dst.WriteFile("/a.txt", []byte("edited on target"), 0644)
+		dst.WriteFile("/gone/c.txt", []byte("edited on target"), 0644)
+		src.WriteFile("/a.txt", []byte("a2"), 0644)
+		src.WriteFile("/b.txt", []byte("b2"), 0644)
+		src.RemoveAll("/gone")
+
+		err := r.push(ctx, ".")
+		if !errors.Is(err, ErrReplicaConflict) {
+			t.Fatalf("Push over target changes = %v, want ErrReplicaConflict", err)
+		}
+		if content, _ := dst.ReadFileString("/a.txt"); content != "edited on target" {
+			t.Errorf("Conflicting file = %q, want the target's change kept", content)
+		}
+		if content, _ := dst.ReadFileString("/b.txt"); content != "b2" {
+			t.Errorf("Unconflicted file = %q, want b2", content)
+		}
+		if !dst.Exists("/gone/c.txt") || dst.Exists("/gone/d.txt") {
+			t.Error("Removal should keep the conflicting file and remove the rest")
+		}
+
+		r.opts.Overwrite = true
+		if err := r.push(ctx, "."); err != nil {
+			t.Fatalf("Push with Overwrite failed: %v", err)
+		}
+		if content, _ := dst.ReadFileString("/a.txt"); content != "a2" || dst.Exists("/gone") {
+			t.Errorf("Overwrite should push over the target, got %q", content)
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		src := NewMemoryVFS()
+		dst := NewMemoryVFS()
+		src.WriteFile("/a.txt", []byte("a1"), 0644)
+		opts := ReplicateOptions{StatePath: filepath.Join(t.TempDir(), "replica.json")}
+		if err := src.Replicate(ctx, dst, opts); err != nil {
+			t.Fatalf("First Replicate failed: %v", err)
+		}
+
+		dst.WriteFile("/a.txt", []byte("edited on target"), 0644)
+		src.WriteFile("/a.txt", []byte("a2"), 0644)
+		if err := src.Replicate(ctx, dst, opts); !errors.Is(err, ErrReplicaConflict) {
+			t.Errorf("Replicate after a restart = %v, want ErrReplicaConflict", err)
+		}
+	})
+
+	for _, journal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("continuous journal=%v", journal), func(t *testing.T) {
+			testContinuousReplicate(t, journal)
+		})
+	}
+}
+
+// testContinuousReplicate tests continuous replication, following the
+// change journal or comparing the whole tree
+func testContinuousReplicate(t *testing.T, journal bool) {
+	var opts []Option
+	if journal {
+		opts = append(opts, WithChangeJournal(JournalOptions{}))
+	}
+	src := NewMemoryVFS(opts...)
+	dst := NewMemoryVFS()
+	src.WriteFile("/a.txt", []byte("first"), 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- src.Replicate(ctx, dst, ReplicateOptions{Continuous: true})
+	}()
+
+	waitFor := func(cond func() bool) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if cond() {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !waitFor(func() bool { return dst.Exists("/a.txt") }) {
+		t.Fatal("Initial push did not happen")
+	}
+	src.WriteFile("/b.txt", []byte("second"), 0644)
+	src.Remove("/a.txt")
+	if !waitFor(func() bool { return dst.Exists("/b.txt") && !dst.Exists("/a.txt") }) {
+		t.Error("Mutations were not pushed")
+	}
+
+	src.WriteFile("/new/dir/c.txt", []byte("third"), 0644)
+	src.RenameDir("/new", "/moved")
+	if !waitFor(func() bool { return dst.Exists("/moved/dir/c.txt") && !dst.Exists("/new") }) {
+		t.Error("New and renamed directories were not pushed")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Continuous Replicate returned %v, want context.Canceled", err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	if _, err := NewBroadcastHandler(NewMemoryVFS()); !errors.Is(err, ErrNotSealed) {
+		t.Fatalf("Publishing an unsealed VFS = %v, want ErrNotSealed", err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), BroadcastChunkSize/16+100) // Two chunks
+	newTree := func(files map[string]string) *VFS {
+		v := NewMemoryVFS()
+		v.WriteFile("/lib/big.a", big, 0644)
+		for name, content := range files {
+			v.WriteFile(name, []byte(content), 0644)
+		}
+		if err := v.Seal(); err != nil {
+			t.Fatalf("Seal failed: %v", err)
+		}
+		return v
+	}
+
+	h, err := NewBroadcastHandler(newTree(map[string]string{"/lib/fmt.go": "package fmt", "/lib/os.go": "package os"}))
+	if err != nil {
+		t.Fatalf("NewBroadcastHandler failed: %v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx := context.Background()
+	worker := NewMemoryVFS()
+	r := NewBroadcastReceiver(worker, srv.URL, nil)
+
+	stats, err := r.Sync(ctx)
+	if err != nil {
+		t.Fatalf("First sync failed: %v", err)
+	}
+	if stats.Files != 3 || stats.ChunksFetched != 4 {
+		t.Errorf("First sync = %+v, want 3 files from 4 chunks", stats)
+	}
+	if data, _ := worker.ReadFile("/lib/big.a"); !bytes.Equal(data, big) {
+		t.Error("Multi-chunk file was not reassembled")
+	}
+
+	if stats, err := r.Sync(ctx); err != nil || stats.Files != 0 || stats.ChunksFetched != 0 {
+		t.Errorf("Sync at the same version = %+v, %v; want nothing fetched", stats, err)
+	}
+
+	// New version: one file changed, one removed, one added with content
+	// the worker already holds
+	h.Publish(newTree(map[string]string{"/lib/fmt.go": "package fmt // v2", "/lib/copy.go": "package os"}))
+	stats, err = r.Sync(ctx)
+	if err != nil {
+		t.Fatalf("Delta sync failed: %v", err)
+	}
+	if stats.ChunksFetched != 1 || stats.ChunksReused != 1 || stats.Removed != 1 {
+		t.Errorf("Delta sync = %+v, want 1 chunk fetched, 1 reused, 1 removed", stats)
+	}
+	if content, _ := worker.ReadFileString("/lib/copy.go"); content != "package os" || worker.Exists("/lib/os.go") {
+		t.Error("Delta sync did not apply the new version")
+	}
+
+	resp, err := http.Get(srv.URL + "/chunks/" + strings.Repeat("0", 64))
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Unknown chunk = %v, %v; want 404", resp, err)
+	}
+	resp.Body.Close()
+
+	// A sync whose chunks cannot all be fetched leaves the worker as it was
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/chunks/") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, req)
+	}))
+	defer failing.Close()
+	h.Publish(newTree(map[string]string{"/lib/fmt.go": "package fmt // v3"}))
+	if _, err := NewBroadcastReceiver(worker, failing.URL, nil).Sync(ctx); err == nil {
+		t.Error("Sync without chunks should fail")
+	}
+	if content, _ := worker.ReadFileString("/lib/fmt.go"); content != "package fmt // v2" || !worker.Exists("/lib/copy.go") {
+		t.Errorf("Failed sync changed the worker: fmt.go = %q", content)
+	}
+
+	rec := httptest.NewRecorder()
+	new(BroadcastHandler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/manifest", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Zero handler = %d, want 503", rec.Code)
+	}
+}
+
+func TestWatchStream(t *testing.T) {
+	v := NewDiskVFS(t.TempDir())
+	defer v.Close()
+	v.MkdirAll("/docs", 0755)
+	if err := v.Watch("/", func(WatchEvent) {}); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	h, err := NewWatchStreamHandler(v, 3)
+	if err != nil {
+		t.Fatalf("NewWatchStreamHandler failed: %v", err)
+	}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	if !v.IsWatching("/") {
+		t.Error("The handler should leave the user's watch in place")
+	}
+
+	// Events are injected directly, so the test does not depend on fsnotify
+	h.record(WatchEvent{Path: "/a.txt", Op: WatchOpCreate})
+	h.record(WatchEvent{Path: "/new", OldPath: "/old", Op: WatchOpRename, IsDir: true})
+
+	// collect runs a watcher of url from cursor until it has delivered n
+	// events
+	collect := func(url, cursor string, n int) ([]WatchEvent, string) {
+		w := NewRemoteWatcher(url, nil)
+		w.retry = 10 * time.Millisecond
+		w.Resume(cursor)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var events []WatchEvent
+		w.Run(ctx, func(event WatchEvent) {
+			events = append(events, event)
+			if len(events) == n {
+				cancel()
+			}
+		})
+		return events, w.Cursor()
+	}
+
+	events, cursor := collect(srv.URL, h.cursor(0), 2)
+	want := []WatchEvent{
+		{Path: "/a.txt", Op: WatchOpCreate},
+		{Path: "/new", OldPath: "/old", Op: WatchOpRename, IsDir: true},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Received %+v, want %+v", events, want)
+	}
+
+	h.record(WatchEvent{Path: "/b.txt", Op: WatchOpWrite})
+	if events, _ := collect(srv.URL, cursor, 1); len(events) != 1 || events[0].Path != "/b.txt" {
+		t.Errorf("Resumed watcher received %+v, want only the missed event", events)
+	}
+
+	// Clients choose their paths
+	h.record(WatchEvent{Path: "/docs/readme.md", Op: WatchOpWrite})
+	if events, _ := collect(srv.URL+"?path=/docs", h.cursor(3), 1); len(events) != 1 || events[0].Path != "/docs/readme.md" {
+		t.Errorf("Watcher of /docs received %+v, want only its event", events)
+	}
+	if resp, err := http.Get(srv.URL + "?path=/missing"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Watching a missing path = %v, %v; want 400", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// Cursors from another handler, or older than the backlog, lose events
+	for _, stale := range []string{"earlier:1", h.cursor(0)} {
+		if events, _ := collect(srv.URL, stale, 1); len(events) != 1 || !errors.Is(events[0].Error, ErrEventsLost) {
+			t.Errorf("Watcher resuming from %s received %+v, want ErrEventsLost", stale, events)
+		}
+	}
+
+	if event := (streamEvent{Path: "/a.txt", Op: "TRUNCATE"}).watchEvent(); event.Error == nil {
+		t.Error("An unknown op should be reported as an error")
+	}
+}
+
+func TestChangeJournal(t *testing.T) {
+	if _, _, err := NewMemoryVFS().Changes(0); err == nil {
+		t.Error("Changes without a journal should fail")
+	}
+
+	journalPath := filepath.Join(t.TempDir(), "changes.jsonl")
+	vfs := NewMemoryVFS(WithChangeJournal(JournalOptions{Path: journalPath}))
+	vfs.MkdirAll("/src", 0755)
+	vfs.WriteFile("/src/a.go", []byte("package a"), 0644)
+	vfs.Remove("/missing") // Fails, so not recorded
+	vfs.WriteFile("/src/a.go", []byte("package a // v2"), 0644)
+	vfs.RenameDir("/src", "/lib")
+	vfs.Remove("/lib/a.go")
+
+	changes, cursor, err := vfs.Changes(0)
+	if err != nil {
+		t.Fatalf("Changes failed: %v", err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, fmt.Sprintf("%d %s %s %s", c.Cursor, c.Op, c.OldPath, c.Path))
+	}
+	want := []string{
+		"1 MkdirAll  /src",
+		"2 WriteFile  /src/a.go",
+		"3 WriteFile  /src/a.go",
+		"4 RenameDir /src /lib",
+		"5 Remove  /lib/a.go",
+	}
+	if !slices.Equal(got, want) || cursor != 5 {
+		t.Fatalf("Changes(0) = %q, %d; want %q, 5", got, cursor, want)
+	}
+
+	if changes, cursor, _ := vfs.Changes(3); len(changes) != 2 || cursor != 5 {
+		t.Errorf("Changes(3) = %d changes, cursor %d; want 2, 5", len(changes), cursor)
+	}
+	if changes, cursor, _ := vfs.Changes(5); len(changes) != 0 || cursor != 5 {
+		t.Errorf("Changes at the head = %d changes, cursor %d", len(changes), cursor)
+	}
+	if _, _, err := vfs.Changes(9); err == nil {
+		t.Error("A cursor ahead of the journal should fail")
+	}
+
+	t.Run("wait", func(t *testing.T) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			vfs.WriteFile("/lib/b.go", nil, 0644)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		changes, cursor, err := vfs.WaitChanges(ctx, 5)
+		if err != nil || len(changes) != 1 || changes[0].Path != "/lib/b.go" || cursor != 6 {
+			t.Errorf("WaitChanges = %+v, %d, %v", changes, cursor, err)
+		}
+	})
+
+	t.Run("durable", func(t *testing.T) {
+		vfs.Close()
+		reopened := NewMemoryVFS(WithChangeJournal(JournalOptions{Path: journalPath, MaxChanges: 2}))
+		defer reopened.Close()
+
+		if _, cursor, err := reopened.Changes(3); !errors.Is(err, ErrJournalTruncated) || cursor != 6 {
+			t.Errorf("Changes before the kept changes = %d, %v; want 6, ErrJournalTruncated", cursor, err)
+		}
+		reopened.MkdirAll("/out", 0755)
+		if changes, cursor, err := reopened.Changes(5); err != nil || len(changes) != 2 || cursor != 7 {
+			t.Errorf("Reopened journal = %d changes, cursor %d, %v; want numbering to continue", len(changes), cursor, err)
+		}
+	})
+
+	t.Run("write errors", func(t *testing.T) {
+		broken := NewMemoryVFS(WithChangeJournal(JournalOptions{Path: filepath.Join(t.TempDir(), "journal.jsonl")}))
+		broken.journal.file.Close()
+		if err := broken.WriteFile("/a.txt", nil, 0644); err == nil {
+			t.Error("A write whose change cannot be journaled should fail")
+		}
+		if err := broken.Close(); err == nil {
+			t.Error("Close should report the journal failing to close")
+		}
+	})
+}
+
+// TestChangeJournalOrder tests that concurrent writes are journaled in the
+// order the backend applied them, with the content each one wrote
+func TestChangeJournalOrder(t *testing.T) {
+	vfs := NewMemoryVFS(WithChangeJournal(JournalOptions{Content: true}))
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 20 {
+				vfs.WriteFile("/shared.txt", fmt.Appendf(nil, "writer %d, write %d", i, j), 0644)
+			}
+		}()
+	}
+	wg.Wait()
+
+	changes, _, _ := vfs.Changes(0)
+	last := changes[len(changes)-1]
+	if content, _ := vfs.ReadFileString("/shared.txt"); string(last.Data) != content {
+		t.Errorf("Last journaled content = %q, file holds %q", last.Data, content)
+	}
+}
+
+// TestChangeJournalCopiesData tests that neither the writer's buffer nor the
+// slices handed out by Changes alias the journaled content
+func TestChangeJournalCopiesData(t *testing.T) {
+	vfs := NewMemoryVFS(WithChangeJournal(JournalOptions{Content: true}))
+	buf := []byte("v1")
+	vfs.WriteFile("/a.txt", buf, 0644)
+	copy(buf, "XX")
+
+	changes, _, _ := vfs.Changes(0)
+	if string(changes[0].Data) != "v1" {
+		t.Fatalf("Reusing the written buffer changed the journal: %q", changes[0].Data)
+	}
+	copy(changes[0].Data, "YY")
+	if again, _, _ := vfs.Changes(0); string(again[0].Data) != "v1" {
+		t.Errorf("Modifying returned Data changed the journal: %q", again[0].Data)
+	}
+}
+
+func TestRebuildAt(t *testing.T) {
+	if _, err := NewMemoryVFS(WithChangeJournal(JournalOptions{})).RebuildAt(0); err == nil {
+		t.Error("RebuildAt without journaled content should fail")
+	}
+
+	vfs := NewMemoryVFS(WithChangeJournal(JournalOptions{Content: true}))
+	vfs.WriteFile("/out/main.o", []byte("v1"), 0644)
+	vfs.MkdirAll("/out/empty", 0700)
+	_, beforeStep2, _ := vfs.Changes(0)
+
+	vfs.WriteFile("/out/main.o", []byte("v2"), 0600)
+	f, _ := vfs.Create("/out/link.map")
+	f.Write([]byte("map"))
+	f.Close()
+	vfs.RenameDir("/out", "/dist")
+	vfs.Remove("/dist/empty")
+
+	old, err := vfs.RebuildAt(beforeStep2)
+	if err != nil {
+		t.Fatalf("RebuildAt failed: %v", err)
+	}
+	if content, _ := old.ReadFileString("/out/main.o"); content != "v1" {
+		t.Errorf("Rebuilt main.o = %q, want v1", content)
+	}
+	if info, err := old.Stat("/out/empty"); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Rebuilt directory = %v, %v", info, err)
+	}
+	if old.Exists("/out/link.map") || old.Exists("/dist") {
+		t.Error("Rebuilt tree should not contain later changes")
+	}
+
+	_, head, _ := vfs.Changes(0)
+	now, err := vfs.RebuildAt(head)
+	if err != nil {
+		t.Fatalf("RebuildAt the head failed: %v", err)
+	}
+	if diffs, err := Diff(vfs, now, "/"); err != nil || len(diffs) != 0 {
+		t.Errorf("Rebuilt current state differs: %v, %v", diffs, err)
+	}
+
+	if _, err := vfs.RebuildAt(head + 1); err == nil {
+		t.Error("RebuildAt past the head should fail")
+	}
+
+	// A journal file keeps the content, and every change, for RebuildAt
+	journalPath := filepath.Join(t.TempDir(), "journal.jsonl")
+	durable := NewMemoryVFS(WithChangeJournal(JournalOptions{Path: journalPath, Content: true, MaxChanges: 1}))
+	durable.WriteFile("/a.txt", []byte("first"), 0644)
+	durable.WriteFile("/a.txt", []byte("second"), 0644)
+	if data := durable.journal.changes[0].Data; data != nil {
+		t.Errorf("Content %q should be left in the journal file", data)
+	}
+	if changes, _, err := durable.Changes(1); err != nil || len(changes) != 1 || string(changes[0].Data) != "second" {
+		t.Errorf("Changes should reload content from the file: %+v, %v", changes, err)
+	}
+	old, err = durable.RebuildAt(1)
+	if err != nil {
+		t.Fatalf("RebuildAt of a truncated journal with a file failed: %v", err)
+	}
+	if content, _ := old.ReadFileString("/a.txt"); content != "first" {
+		t.Errorf("Rebuilt a.txt = %q, want first", content)
+	}
+	durable.Close()
+
+	reopened := NewMemoryVFS(WithChangeJournal(JournalOptions{Path: journalPath, Content: true}))
+	if changes, _, err := reopened.Changes(0); err != nil || len(changes) != 2 || string(changes[0].Data) != "first" {
+		t.Errorf("Reopened journal = %+v, %v; want content reloaded", changes, err)
+	}
+	reopened.Close()
+
+	replayed := NewMemoryVFS()
+	if err := replayed.replay(Change{Op: "MkdirAll", Path: "/d"}); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if info, err := replayed.Stat("/d"); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Directory replayed without a mode = %v, %v; want 0755", info, err)
+	}
+}
+
+func TestSnapshotNamed(t *testing.T) {
+	vfs := NewMemoryVFS(WithChangeJournal(JournalOptions{}))
+	vfs.WriteFile("/src/main.go", []byte("package main"), 0644)
+	vfs.WriteFile("/src/util.go", []byte("package main // util"), 0644)
+
+	if err := vfs.SnapshotNamed("pre-optimize"); err != nil {
+		t.Fatalf("SnapshotNamed failed: %v", err)
+	}
+	if err := vfs.SnapshotNamed("pre-optimize"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Reusing a label = %v, want fs.ErrExist", err)
+	}
+
+	vfs.WriteFile("/src/main.go", []byte("package main // optimized"), 0644)
+	vfs.Remove("/src/util.go")
+	vfs.WriteFile("/src/inline.go", []byte("package main // inlined"), 0644)
+	vfs.SnapshotNamed("post-optimize")
+
+	infos := vfs.Snapshots()
+	if len(infos) != 2 || infos[0].Label != "pre-optimize" || infos[1].Label != "post-optimize" || infos[0].Cursor >= infos[1].Cursor {
+		t.Fatalf("Snapshots() = %+v", infos)
+	}
+
+	pre, err := vfs.Snapshot("pre-optimize")
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if content, _ := pre.ReadFileString("/src/main.go"); content != "package main" {
+		t.Errorf("Snapshot content = %q, want it unaffected by later writes", content)
+	}
+	if err := pre.WriteFile("/x", nil, 0644); !errors.Is(err, ErrSealed) {
+		t.Errorf("Writing to a snapshot = %v, want ErrSealed", err)
+	}
+
+	diffs, err := vfs.DiffSnapshots("pre-optimize", "post-optimize", "/src")
+	if err != nil {
+		t.Fatalf("DiffSnapshots failed: %v", err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.Kind.String()+" "+d.Path)
+	}
+	want := []string{"ADDED /inline.go", "MODIFIED /main.go", "REMOVED /util.go"}
+	if !slices.Equal(got, want) {
+		t.Errorf("DiffSnapshots = %q, want %q", got, want)
+	}
+	if diffs, _ := vfs.DiffSnapshots("post-optimize", "", "/"); len(diffs) != 0 {
+		t.Errorf("Latest snapshot differs from the current state: %v", diffs)
+	}
+
+	var archive bytes.Buffer
+	if err := pre.ExportTxtar(&archive, "/src"); err != nil || !strings.Contains(archive.String(), "-- util.go --") {
+		t.Errorf("Exporting a snapshot = %v, %q", err, archive.String())
+	}
+
+	if err := vfs.DeleteSnapshot("pre-optimize"); err != nil {
+		t.Errorf("DeleteSnapshot failed: %v", err)
+	}
+	if _, err := vfs.Snapshot("pre-optimize"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Deleted snapshot = %v, want fs.ErrNotExist", err)
+	}
+}
+
+// TestSnapshotNamedUnreadable tests that a snapshot fails rather than
+// silently leave out entries it cannot read
+func TestSnapshotNamedUnreadable(t *testing.T) {
+	vfs := NewMemoryVFS(WithAccessPolicy(func(req AccessRequest) error {
+		if !req.Write && req.Path == "/secret.txt" {
+			return errors.New("denied")
+		}
+		return nil
+	}))
+	vfs.WriteFile("/public.txt", []byte("public"), 0644)
+	vfs.WriteFile("/secret.txt", []byte("secret"), 0600)
+
+	var accessErr *AccessError
+	if err := vfs.SnapshotNamed("partial"); !errors.As(err, &accessErr) {
+		t.Errorf("SnapshotNamed with an unreadable file = %v, want an AccessError", err)
+	}
+	if _, err := vfs.Snapshot("partial"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("A failed snapshot should not be kept, got %v", err)
+	}
+}
+
+// TestSnapshotCursor tests that a snapshot taken during writes matches
+// the rebuild at its cursor
+func TestSnapshotCursor(t *testing.T) {
+	vfs := NewMemoryVFS(WithChangeJournal(JournalOptions{Content: true}))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				name := fmt.Sprintf("/w%d/%d.txt", i, j%8)
+				vfs.WriteFile(name, fmt.Appendf(nil, "%d", j), 0644)
+				if j%3 == 0 {
+					vfs.Remove(name)
+				}
+			}
+		}()
+	}
+
+	for i := range 5 {
+		label := fmt.Sprintf("s%d", i)
+		if err := vfs.SnapshotNamed(label); err != nil {
+			t.Fatalf("SnapshotNamed failed: %v", err)
+		}
+		snap, _ := vfs.Snapshot(label)
+		info := vfs.Snapshots()[i]
+		rebuilt, err := vfs.RebuildAt(info.Cursor)
+		if err != nil {
+			t.Fatalf("RebuildAt failed: %v", err)
+		}
+		if diffs, err := Diff(snap, rebuilt, "/"); err != nil || len(diffs) != 0 {
+			t.Errorf("Snapshot %s differs from RebuildAt(%d): %v, %v", label, info.Cursor, diffs, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,46 @@
+package vfstest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/yasufadhili/vfs"
+)
+
+// FromMap builds a memory VFS from a map of paths to file contents. Paths
+// ending in "/" create empty directories. It panics if a file cannot be
+// written, which only happens for malformed paths.
+func FromMap(files map[string]string) *vfs.VFS {
+	v := vfs.NewMemoryVFS()
+	for name, content := range files {
+		name = "/" + strings.TrimPrefix(name, "/")
+		if strings.HasSuffix(name, "/") {
+			mustDo(v.MkdirAll(name, 0755), name)
+			continue
+		}
+		mustDo(v.WriteFile(name, []byte(content), 0644), name)
+	}
+	return v
+}
+
+// FromTxtar builds a memory VFS from a txtar archive, the format used by Go
+// script tests:
+//
+//	comment
+//	-- hello.txt --
+//	hello
+//	-- dir/empty/ --
+//
+// Entries whose name ends in "/" create empty directories.
+func FromTxtar(data []byte) *vfs.VFS {
+	v := vfs.NewMemoryVFS()
+	mustDo(v.ImportTxtar(bytes.NewReader(data), "/"), "txtar archive")
+	return v
+}
+
+func mustDo(err error, name string) {
+	if err != nil {
+		panic(fmt.Sprintf("vfstest: creating fixture %s: %v", name, err))
+	}
+}
@@ -0,0 +1,58 @@
+package vfstest
+
+import "testing"
+
+// pathSeeds are path shapes that have historically broken path handling:
+// traversal, doubled separators, bundled prefix look-alikes, Windows forms
+// and unusual characters
+var pathSeeds = []string{
+	"",
+	"/",
+	".",
+	"..",
+	"a.txt",
+	"/a.txt",
+	"/dir/file.go",
+	"dir//file",
+	"/dir/./file",
+	"/dir/../file",
+	"../../etc/passwd",
+	"/../../escape",
+	"dir/",
+	"//double",
+	"stdlib://core.jml",
+	"stdlib://../outside",
+	"stdlib:/core.jml",
+	"stdlib//core.jml",
+	"std://lib://nested",
+	"://empty-prefix",
+	"C:\\Windows\\file.txt",
+	"\\\\server\\share\\file",
+	"dir\\file",
+	"CON",
+	"nul.txt",
+	"name:with:colons",
+	"trailing. ",
+	"space name/file name.txt",
+	"unicode/ファイル.txt",
+	"nfd/e\u0301.txt",
+	"*?[]",
+	"[",
+	"/dir/*.go",
+	"-- marker --",
+	"new\nline",
+	"nul\x00byte",
+}
+
+// PathSeeds returns a copy of the seed corpus used by FuzzPaths
+func PathSeeds() []string {
+	return append([]string(nil), pathSeeds...)
+}
+
+// FuzzPaths adds the path seed corpus to f. Every seed is a single string
+// argument, so it suits fuzz targets of the form func(t *testing.T, p string).
+func FuzzPaths(f *testing.F) {
+	for _, p := range pathSeeds {
+		f.Add(p)
+	}
+}
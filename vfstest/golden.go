@@ -0,0 +1,59 @@
+package vfstest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/yasufadhili/vfs"
+)
+
+// Golden compares the tree produced in got against the golden files stored
+// in goldenDir on disk. When update is true the golden directory is replaced
+// with the current contents of got instead, which is normally wired to a
+// test flag:
+//
+//	var update = flag.Bool("update", false, "rewrite golden files")
+//
+//	func TestCodegen(t *testing.T) {
+//		out := generate()
+//		vfstest.Golden(t, out, "testdata/golden", *update, vfstest.Root("/out"))
+//	}
+//
+// Version control keeps neither permissions nor empty directories, so
+// Golden compares file contents only; the remaining options behave as in
+// AssertTreesEqual.
+func Golden(t testing.TB, got vfs.FileSystem, goldenDir string, update bool, opts ...Option) bool {
+	t.Helper()
+
+	c := newConfig(opts)
+
+	if update {
+		if err := os.RemoveAll(goldenDir); err != nil {
+			t.Fatalf("removing golden directory %s: %v", goldenDir, err)
+		}
+		if err := os.MkdirAll(goldenDir, 0755); err != nil {
+			t.Fatalf("creating golden directory %s: %v", goldenDir, err)
+		}
+		if got.Exists(c.root) {
+			if err := got.SaveToDisk(c.root, goldenDir); err != nil {
+				t.Fatalf("writing golden files to %s: %v", goldenDir, err)
+			}
+		}
+		t.Logf("updated golden files in %s", goldenDir)
+		return true
+	}
+
+	if _, err := os.Stat(goldenDir); err != nil {
+		t.Errorf("golden directory %s is not readable (run with update to create it): %v", goldenDir, err)
+		return false
+	}
+
+	want := vfs.NewMemoryVFS()
+	if err := want.LoadFromDisk(goldenDir, c.root); err != nil {
+		t.Errorf("loading golden files from %s: %v", goldenDir, err)
+		return false
+	}
+
+	opts = append([]Option{IgnoreModes(), IgnoreDirs()}, opts...)
+	return AssertTreesEqual(t, want, got, opts...)
+}
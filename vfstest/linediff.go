@@ -0,0 +1,87 @@
+package vfstest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// maxDiffLines bounds the quadratic line diff; larger inputs are summarised
+const maxDiffLines = 1000
+
+// lineDiff renders a line-oriented diff of want and got where removed lines
+// are prefixed with "-" and added lines with "+". Unchanged lines are elided
+// except for a single line of context around each change.
+func lineDiff(want, got []byte) string {
+	if bytes.IndexByte(want, 0) >= 0 || bytes.IndexByte(got, 0) >= 0 {
+		return fmt.Sprintf("binary content differs (want %d bytes, got %d bytes)\n", len(want), len(got))
+	}
+
+	a := splitLines(string(want))
+	b := splitLines(string(got))
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return fmt.Sprintf("content differs (want %d lines, got %d lines)\n", len(a), len(b))
+	}
+
+	// Longest common subsequence table, lcs[i][j] covers a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, line{'+', b[j]})
+			j++
+		default:
+			lines = append(lines, line{'-', a[i]})
+			i++
+		}
+	}
+
+	var out strings.Builder
+	elided := false
+	for k, l := range lines {
+		if l.op == ' ' {
+			nearChange := (k > 0 && lines[k-1].op != ' ') || (k+1 < len(lines) && lines[k+1].op != ' ')
+			if !nearChange {
+				if !elided {
+					out.WriteString("...\n")
+					elided = true
+				}
+				continue
+			}
+		}
+		elided = false
+		fmt.Fprintf(&out, "%c %s\n", l.op, l.text)
+	}
+	return out.String()
+}
+
+// splitLines splits s into lines without their terminators
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
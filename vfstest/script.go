@@ -0,0 +1,485 @@
+package vfstest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/yasufadhili/vfs"
+)
+
+// Script tests
+//
+// A script is a txtar archive whose comment section holds commands and whose
+// files seed a fresh VFS. The syntax follows the go-internal testscript
+// package, so scripts using its file commands port over unchanged, but every
+// command runs against the VFS instead of a temporary directory:
+//
+//	cp in/a.txt out/a.txt
+//	exists out/a.txt
+//	! exists out/b.txt
+//	cmp out/a.txt want.txt
+//	grep -count=1 '^hello' out/a.txt
+//
+//	-- in/a.txt --
+//	hello
+//	-- want.txt --
+//	hello
+//
+// Built-in commands are cat, cmp, cp, exists, grep, mkdir, mv, rm, skip and
+// stop. A leading "!" negates a command, lines starting with "#" are
+// comments, and single quotes group arguments ('' is a literal quote).
+
+// ScriptCmd implements a custom script command. neg reports whether the
+// command was prefixed with "!".
+type ScriptCmd func(s *Script, neg bool, args []string)
+
+// ScriptParams configures RunScripts
+type ScriptParams struct {
+	// Dir holds the scripts; every file ending in .txtar or .txt is run
+	Dir string
+
+	// NewFS creates the VFS for each script; defaults to vfs.NewMemoryVFS
+	NewFS func() *vfs.VFS
+
+	// Setup runs after the archive files are loaded, before the script
+	Setup func(s *Script) error
+
+	// Cmds adds or overrides commands
+	Cmds map[string]ScriptCmd
+}
+
+// ScriptT is the part of testing.TB a script reports through
+type ScriptT interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+	Logf(format string, args ...interface{})
+}
+
+// Script is the state of a single running script
+type Script struct {
+	t    ScriptT
+	fs   *vfs.VFS
+	cmds map[string]ScriptCmd
+	line int
+	stop bool
+}
+
+// scriptSkip unwinds a script that requested a skip
+type scriptSkip struct{}
+
+// FS returns the filesystem the script operates on
+func (s *Script) FS() *vfs.VFS {
+	return s.fs
+}
+
+// Fatalf fails the script, reporting the current line
+func (s *Script) Fatalf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Fatalf("%s%s", s.where(), fmt.Sprintf(format, args...))
+}
+
+// Logf logs a message against the current line
+func (s *Script) Logf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Logf("%s%s", s.where(), fmt.Sprintf(format, args...))
+}
+
+// where prefixes messages with the current line, unless the runner
+// reports it itself
+func (s *Script) where() string {
+	if s.line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("line %d: ", s.line)
+}
+
+// ReadFile returns the content of a file in the script's VFS
+func (s *Script) ReadFile(name string) string {
+	data, err := s.fs.ReadFile(s.path(name))
+	if err != nil {
+		s.Fatalf("%v", err)
+	}
+	return string(data)
+}
+
+// path resolves a script argument to an absolute VFS path
+func (s *Script) path(name string) string {
+	if strings.Contains(name, "://") {
+		return name // Bundled URL
+	}
+	return path.Join("/", name)
+}
+
+// RunScripts runs every script in p.Dir as a subtest of t
+func RunScripts(t *testing.T, p ScriptParams) {
+	t.Helper()
+
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		t.Fatalf("reading script directory: %v", err)
+	}
+
+	found := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || (!strings.HasSuffix(name, ".txtar") && !strings.HasSuffix(name, ".txt")) {
+			continue
+		}
+		found = true
+
+		data, err := os.ReadFile(filepath.Join(p.Dir, name))
+		if err != nil {
+			t.Fatalf("reading script %s: %v", name, err)
+		}
+
+		t.Run(strings.TrimSuffix(strings.TrimSuffix(name, ".txt"), ".txtar"), func(t *testing.T) {
+			RunScript(t, data, p)
+		})
+	}
+
+	if !found {
+		t.Fatalf("no scripts found in %s", p.Dir)
+	}
+}
+
+// RunScript runs a single script held in data. p.Dir is ignored.
+func RunScript(t testing.TB, data []byte, p ScriptParams) {
+	t.Helper()
+
+	newFS := p.NewFS
+	if newFS == nil {
+		newFS = func() *vfs.VFS { return vfs.NewMemoryVFS() }
+	}
+
+	s := &Script{t: t, fs: newFS(), cmds: make(map[string]ScriptCmd)}
+	for name, cmd := range scriptCmds {
+		s.cmds[name] = cmd
+	}
+	for name, cmd := range p.Cmds {
+		s.cmds[name] = cmd
+	}
+
+	script, files := splitScript(data)
+	if err := s.fs.ImportTxtar(bytes.NewReader(files), "/"); err != nil {
+		t.Fatalf("loading script files: %v", err)
+	}
+
+	if p.Setup != nil {
+		if err := p.Setup(s); err != nil {
+			t.Fatalf("script setup: %v", err)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(scriptSkip); ok {
+				t.SkipNow()
+			}
+			panic(r)
+		}
+	}()
+
+	for i, line := range strings.Split(string(script), "\n") {
+		s.line = i + 1
+		s.exec(line)
+		if s.stop {
+			return
+		}
+	}
+}
+
+// RunScriptCmd runs the built-in command args[0] against fs, for adapters
+// that run script commands under another script runner, such as the
+// vfstestscript module for go-internal's testscript. Failures are reported
+// through t, prefixed with line unless it is 0 because t reports the line
+// itself. skip and stop are left to the runner.
+func RunScriptCmd(t ScriptT, fs *vfs.VFS, line int, neg bool, args []string) {
+	t.Helper()
+
+	s := &Script{t: t, fs: fs, line: line}
+	if len(args) == 0 {
+		s.Fatalf("missing command")
+	}
+	switch args[0] {
+	case "skip", "stop":
+		s.Fatalf("use the %s command of the script runner", args[0])
+	}
+	cmd, ok := scriptCmds[args[0]]
+	if !ok {
+		s.Fatalf("unknown command %q", args[0])
+	}
+	cmd(s, neg, args[1:])
+}
+
+// exec runs a single script line
+func (s *Script) exec(line string) {
+	s.t.Helper()
+
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	args, err := splitScriptArgs(line)
+	if err != nil {
+		s.Fatalf("%v", err)
+	}
+
+	neg := false
+	if args[0] == "!" {
+		neg = true
+		args = args[1:]
+	} else if strings.HasPrefix(args[0], "!") {
+		neg = true
+		args[0] = args[0][1:]
+	}
+	if len(args) == 0 {
+		s.Fatalf("missing command after !")
+	}
+
+	cmd, ok := s.cmds[args[0]]
+	if !ok {
+		s.Fatalf("unknown command %q", args[0])
+	}
+	cmd(s, neg, args[1:])
+}
+
+// splitScript separates the script in the archive comment from the files
+func splitScript(data []byte) (script, files []byte) {
+	for i := 0; i < len(data); {
+		line, next := data[i:], len(data)
+		if j := bytes.IndexByte(line, '\n'); j >= 0 {
+			line, next = line[:j], i+j+1
+		}
+		line = bytes.TrimRight(line, "\r")
+		if bytes.HasPrefix(line, []byte("-- ")) && bytes.HasSuffix(line, []byte(" --")) && len(line) >= len("-- x --") {
+			return data[:i], data[i:]
+		}
+		i = next
+	}
+	return data, nil
+}
+
+// splitScriptArgs splits a line into words, honouring single quotes
+func splitScriptArgs(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord, quoted := false, false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\'':
+			if i+1 < len(line) && line[i+1] == '\'' {
+				word.WriteByte('\'')
+				i++
+				continue
+			}
+			quoted = false
+		case quoted:
+			word.WriteByte(c)
+		case c == '\'':
+			quoted, inWord = true, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted argument")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// scriptCmds holds the built-in commands
+var scriptCmds = map[string]ScriptCmd{
+	"cat":    cmdCat,
+	"cmp":    cmdCmp,
+	"cp":     cmdCp,
+	"exists": cmdExists,
+	"grep":   cmdGrep,
+	"mkdir":  cmdMkdir,
+	"mv":     cmdMv,
+	"rm":     cmdRm,
+	"skip":   cmdSkip,
+	"stop":   cmdStop,
+}
+
+// cat logs the contents of files
+func cmdCat(s *Script, neg bool, args []string) {
+	if neg {
+		s.Fatalf("unsupported: ! cat")
+	}
+	for _, name := range args {
+		s.Logf("%s:\n%s", name, s.ReadFile(name))
+	}
+}
+
+// cmp compares two files for equality
+func cmdCmp(s *Script, neg bool, args []string) {
+	if len(args) != 2 {
+		s.Fatalf("usage: cmp file1 file2")
+	}
+
+	a, b := s.ReadFile(args[0]), s.ReadFile(args[1])
+	if neg {
+		if a == b {
+			s.Fatalf("%s and %s do not differ", args[0], args[1])
+		}
+		return
+	}
+	if a != b {
+		s.Fatalf("%s and %s differ:\n%s", args[0], args[1], lineDiff([]byte(a), []byte(b)))
+	}
+}
+
+// cp copies one or more files; with several sources the target is a directory
+func cmdCp(s *Script, neg bool, args []string) {
+	if neg {
+		s.Fatalf("unsupported: ! cp")
+	}
+	if len(args) < 2 {
+		s.Fatalf("usage: cp src... dst")
+	}
+
+	dst := s.path(args[len(args)-1])
+	srcs := args[:len(args)-1]
+	toDir := len(srcs) > 1 || s.fs.IsDir(dst)
+
+	for _, src := range srcs {
+		target := dst
+		if toDir {
+			target = path.Join(dst, path.Base(src))
+		}
+		if err := s.fs.Copy(s.path(src), target); err != nil {
+			s.Fatalf("cp: %v", err)
+		}
+	}
+}
+
+// exists checks that files exist, or with -dir that directories exist
+func cmdExists(s *Script, neg bool, args []string) {
+	dirs := false
+	if len(args) > 0 && args[0] == "-dir" {
+		dirs = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		s.Fatalf("usage: exists [-dir] path...")
+	}
+
+	for _, name := range args {
+		p := s.path(name)
+		exists := s.fs.Exists(p) && (!dirs || s.fs.IsDir(p))
+		if exists && neg {
+			s.Fatalf("%s unexpectedly exists", name)
+		}
+		if !exists && !neg {
+			s.Fatalf("%s does not exist", name)
+		}
+	}
+}
+
+// grep checks that a file contains a line matching a regular expression
+func cmdGrep(s *Script, neg bool, args []string) {
+	count := -1
+	if len(args) > 0 && strings.HasPrefix(args[0], "-count=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(args[0], "-count="))
+		if err != nil || n < 1 {
+			s.Fatalf("bad -count: %s", args[0])
+		}
+		if neg {
+			s.Fatalf("cannot use -count with negated grep")
+		}
+		count = n
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		s.Fatalf("usage: grep [-count=N] pattern file")
+	}
+
+	re, err := regexp.Compile(`(?m)` + args[0])
+	if err != nil {
+		s.Fatalf("grep: %v", err)
+	}
+
+	matches := len(re.FindAllString(s.ReadFile(args[1]), -1))
+	switch {
+	case neg && matches > 0:
+		s.Fatalf("unexpected match for %#q in %s", args[0], args[1])
+	case !neg && matches == 0:
+		s.Fatalf("no match for %#q in %s", args[0], args[1])
+	case count >= 0 && matches != count:
+		s.Fatalf("have %d matches for %#q in %s, want %d", matches, args[0], args[1], count)
+	}
+}
+
+// mkdir creates directories
+func cmdMkdir(s *Script, neg bool, args []string) {
+	if neg {
+		s.Fatalf("unsupported: ! mkdir")
+	}
+	for _, name := range args {
+		if err := s.fs.MkdirAll(s.path(name), 0755); err != nil {
+			s.Fatalf("mkdir: %v", err)
+		}
+	}
+}
+
+// mv renames a file
+func cmdMv(s *Script, neg bool, args []string) {
+	if neg {
+		s.Fatalf("unsupported: ! mv")
+	}
+	if len(args) != 2 {
+		s.Fatalf("usage: mv old new")
+	}
+	if err := s.fs.Move(s.path(args[0]), s.path(args[1])); err != nil {
+		s.Fatalf("mv: %v", err)
+	}
+}
+
+// rm removes files and directories recursively
+func cmdRm(s *Script, neg bool, args []string) {
+	if neg {
+		s.Fatalf("unsupported: ! rm")
+	}
+	for _, name := range args {
+		if err := s.fs.RemoveAll(s.path(name)); err != nil {
+			s.Fatalf("rm: %v", err)
+		}
+	}
+}
+
+// skip skips the test
+func cmdSkip(s *Script, neg bool, args []string) {
+	if len(args) > 0 {
+		s.Logf("skip: %s", strings.Join(args, " "))
+	}
+	panic(scriptSkip{})
+}
+
+// stop ends the script successfully
+func cmdStop(s *Script, neg bool, args []string) {
+	if len(args) > 0 {
+		s.Logf("stop: %s", strings.Join(args, " "))
+	}
+	s.stop = true
+}
@@ -0,0 +1,167 @@
+// Package vfstest provides helpers for testing code that produces or
+// consumes a vfs.FileSystem.
+package vfstest
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/yasufadhili/vfs"
+)
+
+// Option configures tree comparisons
+type Option func(*config)
+
+type config struct {
+	root        string
+	ignoreModes bool
+	ignoreDirs  bool
+	ignore      []string
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{root: "/"}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Root compares only the subtree rooted at root in both filesystems
+func Root(root string) Option {
+	return func(c *config) {
+		c.root = root
+	}
+}
+
+// IgnoreModes disables permission comparisons
+func IgnoreModes() Option {
+	return func(c *config) {
+		c.ignoreModes = true
+	}
+}
+
+// IgnoreDirs compares regular files only, so empty directories that exist
+// on one side are not reported
+func IgnoreDirs() Option {
+	return func(c *config) {
+		c.ignoreDirs = true
+	}
+}
+
+// Ignore skips paths whose base name or root-relative path matches any of
+// the given path.Match patterns
+func Ignore(patterns ...string) Option {
+	return func(c *config) {
+		c.ignore = append(c.ignore, patterns...)
+	}
+}
+
+// ignored reports whether a difference should be filtered out
+func (c *config) ignored(d vfs.Difference) bool {
+	if c.ignoreDirs && d.IsDir && d.Kind != vfs.DiffTypeChanged {
+		return true
+	}
+	if c.ignoreModes && d.Kind == vfs.DiffModeChanged {
+		return true
+	}
+	for _, pattern := range c.ignore {
+		if ok, _ := path.Match(pattern, path.Base(d.Path)); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, d.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AssertTreesEqual reports a test error describing every missing file,
+// unexpected file, content difference and mode difference between want and
+// got. It returns true when the trees are equal.
+func AssertTreesEqual(t testing.TB, want, got vfs.FileSystem, opts ...Option) bool {
+	t.Helper()
+
+	c := newConfig(opts)
+	diffs, err := vfs.Diff(want, got, c.root)
+	if err != nil {
+		t.Errorf("comparing trees at %s: %v", c.root, err)
+		return false
+	}
+
+	var report strings.Builder
+	count := 0
+	for _, d := range diffs {
+		if c.ignored(d) {
+			continue
+		}
+		count++
+		writeDifference(&report, want, got, c.root, d)
+	}
+
+	if count == 0 {
+		return true
+	}
+
+	t.Errorf("trees differ at %s (%d differences):\n%s", c.root, count, report.String())
+	return false
+}
+
+// writeDifference renders a single difference in a human readable form
+func writeDifference(b *strings.Builder, want, got vfs.FileSystem, root string, d vfs.Difference) {
+	kind := "file"
+	if d.IsDir {
+		kind = "directory"
+	}
+
+	switch d.Kind {
+	case vfs.DiffRemoved:
+		fmt.Fprintf(b, "  missing %s: %s\n", kind, d.Path)
+	case vfs.DiffAdded:
+		fmt.Fprintf(b, "  unexpected %s: %s\n", kind, d.Path)
+	case vfs.DiffTypeChanged:
+		fmt.Fprintf(b, "  type mismatch: %s (want %s, got %s)\n", d.Path, typeName(d.ModeA), typeName(d.ModeB))
+	case vfs.DiffModeChanged:
+		fmt.Fprintf(b, "  mode mismatch: %s (want %v, got %v)\n", d.Path, d.ModeA.Perm(), d.ModeB.Perm())
+	case vfs.DiffModified:
+		fmt.Fprintf(b, "  content mismatch: %s\n", d.Path)
+		full := joinRoot(root, d.Path)
+		wantData, _ := want.ReadFile(full)
+		gotData, _ := got.ReadFile(full)
+		b.WriteString(indent(lineDiff(wantData, gotData), "    "))
+	}
+}
+
+// joinRoot joins a root-relative difference path back onto the compared root,
+// keeping bundled prefixes such as "stdlib://" intact
+func joinRoot(root, rel string) string {
+	if strings.HasSuffix(root, "://") {
+		return root + strings.TrimPrefix(rel, "/")
+	}
+	return path.Join(root, rel)
+}
+
+func typeName(mode interface{ IsDir() bool }) string {
+	if mode.IsDir() {
+		return "directory"
+	}
+	return "file"
+}
+
+func indent(s, prefix string) string {
+	if s == "" {
+		return ""
+	}
+	lines := strings.SplitAfter(s, "\n")
+	var b strings.Builder
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		b.WriteString(prefix)
+		b.WriteString(line)
+	}
+	return b.String()
+}
@@ -0,0 +1,232 @@
+package vfstest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yasufadhili/vfs"
+)
+
+// recorder captures assertion failures instead of failing the real test
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertTreesEqual(t *testing.T) {
+	want := vfs.NewMemoryVFS()
+	want.WriteFile("/a.txt", []byte("one\ntwo\nthree\n"), 0644)
+	want.WriteFile("/dir/b.txt", []byte("b"), 0644)
+	want.WriteFile("/only-want.txt", []byte("x"), 0644)
+	want.WriteFile("/script.sh", []byte("#!/bin/sh\n"), 0755)
+
+	got := vfs.NewMemoryVFS()
+	got.WriteFile("/a.txt", []byte("one\n2\nthree\n"), 0644)
+	got.WriteFile("/dir/b.txt", []byte("b"), 0644)
+	got.WriteFile("/only-got.txt", []byte("y"), 0644)
+	got.WriteFile("/script.sh", []byte("#!/bin/sh\n"), 0644)
+
+	r := &recorder{}
+	if AssertTreesEqual(r, want, got) {
+		t.Fatal("AssertTreesEqual should report differences")
+	}
+
+	report := strings.Join(r.errors, "\n")
+	t.Logf("Report:\n%s", report)
+
+	expected := []string{
+		"missing file: /only-want.txt",
+		"unexpected file: /only-got.txt",
+		"content mismatch: /a.txt",
+		"- two",
+		"+ 2",
+		"mode mismatch: /script.sh (want -rwxr-xr-x, got -rw-r--r--)",
+	}
+	for _, e := range expected {
+		if !strings.Contains(report, e) {
+			t.Errorf("Expected report to contain %q", e)
+		}
+	}
+	if strings.Contains(report, "/dir/b.txt") {
+		t.Error("Identical files should not be reported")
+	}
+
+	r = &recorder{}
+	if AssertTreesEqual(r, want, got, IgnoreModes(), Ignore("only-*", "/a.txt")) == false {
+		t.Errorf("Filtered comparison should pass, got: %v", r.errors)
+	}
+}
+
+func TestAssertTreesEqualSubtree(t *testing.T) {
+	want := vfs.NewMemoryVFS()
+	want.WriteFile("/out/main.go", []byte("package main"), 0644)
+
+	got := vfs.NewMemoryVFS()
+	got.WriteFile("/out/main.go", []byte("package main"), 0644)
+	got.WriteFile("/tmp/scratch", []byte("ignored"), 0644)
+
+	AssertTreesEqual(t, want, got, Root("/out"))
+}
+
+func TestFromMap(t *testing.T) {
+	v := FromMap(map[string]string{
+		"a.txt":      "hello",
+		"/dir/b.txt": "world",
+		"/empty/":    "",
+	})
+
+	if content, _ := v.ReadFileString("/a.txt"); content != "hello" {
+		t.Errorf("Content mismatch for /a.txt: got %q", content)
+	}
+	if content, _ := v.ReadFileString("/dir/b.txt"); content != "world" {
+		t.Errorf("Content mismatch for /dir/b.txt: got %q", content)
+	}
+	if !v.IsDir("/empty") {
+		t.Error("/empty should be a directory")
+	}
+}
+
+func TestFromTxtar(t *testing.T) {
+	archive := []byte(`This comment is ignored.
+-- hello.txt --
+hello
+world
+-- dir/nested.txt --
+nested
+-- dir/empty/ --
+`)
+
+	got := FromTxtar(archive)
+	want := FromMap(map[string]string{
+		"/hello.txt":      "hello\nworld\n",
+		"/dir/nested.txt": "nested\n",
+		"/dir/empty/":     "",
+	})
+
+	AssertTreesEqual(t, want, got)
+}
+
+func TestGolden(t *testing.T) {
+	goldenDir := filepath.Join(t.TempDir(), "golden")
+
+	got := FromMap(map[string]string{
+		"/out/main.go":     "package main\n",
+		"/out/pkg/util.go": "package pkg\n",
+		"/scratch.txt":     "not part of the output",
+	})
+
+	// Writing golden files
+	Golden(t, got, goldenDir, true, Root("/out"))
+
+	data, err := os.ReadFile(filepath.Join(goldenDir, "pkg", "util.go"))
+	if err != nil || string(data) != "package pkg\n" {
+		t.Fatalf("Golden file not written: %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(goldenDir, "scratch.txt")); err == nil {
+		t.Error("Files outside the root should not be written")
+	}
+
+	// Comparing against them
+	Golden(t, got, goldenDir, false, Root("/out"))
+
+	got.WriteFile("/out/main.go", []byte("package changed\n"), 0644)
+	r := &recorder{}
+	if Golden(r, got, goldenDir, false, Root("/out")) {
+		t.Error("Golden should report modified output")
+	}
+	if len(r.errors) == 0 || !strings.Contains(r.errors[0], "content mismatch: /main.go") {
+		t.Errorf("Unexpected report: %v", r.errors)
+	}
+
+	r = &recorder{}
+	if Golden(r, got, filepath.Join(t.TempDir(), "missing"), false) {
+		t.Error("Golden should fail when the golden directory is missing")
+	}
+}
+
+func TestRunScripts(t *testing.T) {
+	RunScripts(t, ScriptParams{
+		Dir: "testdata/script",
+		Cmds: map[string]ScriptCmd{
+			"upper": func(s *Script, neg bool, args []string) {
+				if len(args) != 2 {
+					s.Fatalf("usage: upper src dst")
+				}
+				data := strings.ToUpper(s.ReadFile(args[0]))
+				if err := s.FS().WriteFile("/"+args[1], []byte(data), 0644); err != nil {
+					s.Fatalf("%v", err)
+				}
+			},
+		},
+	})
+}
+
+// fatalRecorder captures the first fatal script failure
+type fatalRecorder struct {
+	msg string
+}
+
+// fatal unwinds a script failed through fatalRecorder
+type fatal struct{}
+
+func (r *fatalRecorder) Helper() {}
+
+func (r *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	r.msg = fmt.Sprintf(format, args...)
+	panic(fatal{})
+}
+
+func (r *fatalRecorder) Logf(format string, args ...interface{}) {}
+
+func TestRunScriptCmd(t *testing.T) {
+	fs := vfs.NewMemoryVFS()
+	fs.WriteFile("/a.txt", []byte("hello\n"), 0644)
+	RunScriptCmd(t, fs, 0, false, []string{"grep", "^hello", "a.txt"})
+
+	// fail runs a failing command and returns its message
+	fail := func(line int, args ...string) (msg string) {
+		r := &fatalRecorder{}
+		defer func() {
+			if _, ok := recover().(fatal); !ok {
+				t.Errorf("%q should fail", args)
+			}
+			msg = r.msg
+		}()
+		RunScriptCmd(r, fs, line, false, args)
+		return ""
+	}
+	if msg := fail(7, "exists", "b.txt"); !strings.HasPrefix(msg, "line 7: ") {
+		t.Errorf("Failure at line 7 = %q, want the line", msg)
+	}
+	if msg := fail(0, "exists", "b.txt"); strings.HasPrefix(msg, "line") {
+		t.Errorf("Failure without a line = %q, want it left to the runner", msg)
+	}
+	if msg := fail(0, "stop"); !strings.Contains(msg, "stop") {
+		t.Errorf("stop should be left to the runner, got %q", msg)
+	}
+}
+
+func TestSplitScriptArgs(t *testing.T) {
+	args, err := splitScriptArgs(`grep 'it''s here' 'a b'  c`)
+	if err != nil {
+		t.Fatalf("splitScriptArgs failed: %v", err)
+	}
+
+	expected := []string{"grep", "it's here", "a b", "c"}
+	if strings.Join(args, "|") != strings.Join(expected, "|") {
+		t.Errorf("Args mismatch: got %q, want %q", args, expected)
+	}
+
+	if _, err := splitScriptArgs(`grep 'unterminated`); err == nil {
+		t.Error("Expected error for unterminated quote")
+	}
+}
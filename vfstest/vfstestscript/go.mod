@@ -0,0 +1,18 @@
+module github.com/yasufadhili/vfs/vfstest/vfstestscript
+
+go 1.24
+
+require (
+	github.com/rogpeppe/go-internal v1.14.1
+	github.com/yasufadhili/vfs v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.9.0 // indirect
+	github.com/spf13/afero v1.14.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	golang.org/x/tools v0.26.0 // indirect
+)
+
+replace github.com/yasufadhili/vfs => ../..
@@ -0,0 +1,97 @@
+// Package vfstestscript adapts the vfstest script commands to the
+// go-internal testscript package. It is a module of its own, so that only
+// users of the adapter depend on go-internal.
+//
+// Params extends testscript.Params so that each script gets a VFS seeded
+// with the archive files, and a vfs command that runs the vfstest file
+// commands against it instead of the work directory:
+//
+//	exec mytool -o out
+//	vfs cp in/a.txt out/a.txt
+//	vfs exists out/a.txt
+//	! vfs exists out/b.txt
+//	vfs cmp out/a.txt want.txt
+//	vfs grep -count=1 '^hello' out/a.txt
+//
+// testscript does not let custom commands replace its built-in cp, exists,
+// cmp and grep, which act on the work directory, hence the vfs prefix.
+// Custom commands reach the VFS with FS. Failures are reported by testscript,
+// with the script file and line.
+package vfstestscript
+
+import (
+	"maps"
+
+	"github.com/rogpeppe/go-internal/testscript"
+	"github.com/yasufadhili/vfs"
+	"github.com/yasufadhili/vfs/vfstest"
+)
+
+// vfsKey keys the VFS in testscript.Env.Values
+type vfsKey struct{}
+
+// Params returns p with its Setup extended to create a VFS for each script
+// with newFS, vfs.NewMemoryVFS if nil, load the archive files into it, and
+// add the vfs command to p.Cmds. p's own Setup runs afterwards and can reach
+// the VFS through env.Values.
+func Params(p testscript.Params, newFS func() *vfs.VFS) testscript.Params {
+	if newFS == nil {
+		newFS = func() *vfs.VFS { return vfs.NewMemoryVFS() }
+	}
+
+	setup := p.Setup
+	p.Setup = func(env *testscript.Env) error {
+		fs := newFS()
+		env.Defer(func() { fs.Close() })
+		if err := fs.LoadFromDisk(env.WorkDir, "/"); err != nil {
+			return err
+		}
+		env.Values[vfsKey{}] = fs
+		if setup != nil {
+			return setup(env)
+		}
+		return nil
+	}
+
+	cmds := maps.Clone(p.Cmds)
+	if cmds == nil {
+		cmds = make(map[string]func(*testscript.TestScript, bool, []string))
+	}
+	cmds["vfs"] = cmdVFS
+	p.Cmds = cmds
+	return p
+}
+
+// FS returns the VFS of a script run with Params
+func FS(ts *testscript.TestScript) *vfs.VFS {
+	fs, _ := ts.Value(vfsKey{}).(*vfs.VFS)
+	return fs
+}
+
+// scriptT reports through a testscript.TestScript, which prefixes messages
+// with the script file and line
+type scriptT struct {
+	ts *testscript.TestScript
+}
+
+func (t scriptT) Helper() {}
+
+func (t scriptT) Fatalf(format string, args ...interface{}) {
+	t.ts.Fatalf(format, args...)
+}
+
+func (t scriptT) Logf(format string, args ...interface{}) {
+	t.ts.Logf(format, args...)
+}
+
+// cmdVFS runs one of the vfstest file commands against the VFS
+func cmdVFS(ts *testscript.TestScript, neg bool, args []string) {
+	if len(args) == 0 {
+		ts.Fatalf("usage: vfs command args...")
+	}
+	fs := FS(ts)
+	if fs == nil {
+		ts.Fatalf("vfs: no VFS, use vfstestscript.Params to build the params")
+	}
+	vfstest.RunScriptCmd(scriptT{ts}, fs, 0, neg, args)
+}
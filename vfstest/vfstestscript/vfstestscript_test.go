@@ -0,0 +1,22 @@
+package vfstestscript
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rogpeppe/go-internal/testscript"
+)
+
+func TestParams(t *testing.T) {
+	testscript.Run(t, Params(testscript.Params{
+		Dir: "testdata/script",
+		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
+			"upper": func(ts *testscript.TestScript, neg bool, args []string) {
+				fs := FS(ts)
+				data, err := fs.ReadFile("/" + args[0])
+				ts.Check(err)
+				ts.Check(fs.WriteFile("/"+args[0], []byte(strings.ToUpper(string(data))), 0644))
+			},
+		},
+	}, nil))
+}
@@ -0,0 +1,138 @@
+package vfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// WalkError is passed to a walk callback when the walk cannot proceed at
+// all because its root is missing or unreadable. Walk returns it if the
+// callback does.
+type WalkError struct {
+	Root string
+	Err  error
+}
+
+func (e *WalkError) Error() string {
+	return fmt.Sprintf("walk %s: %v", e.Root, e.Err)
+}
+
+func (e *WalkError) Unwrap() error { return e.Err }
+
+// WalkEntryError is passed to a walk callback when one entry below the root
+// cannot be read. Returning nil or fs.SkipDir from the callback skips the
+// entry and the walk carries on.
+type WalkEntryError struct {
+	Path string
+	Err  error
+}
+
+func (e *WalkEntryError) Error() string {
+	return fmt.Sprintf("walk entry %s: %v", e.Path, e.Err)
+}
+
+func (e *WalkEntryError) Unwrap() error { return e.Err }
+
+// WalkEntry is an entry visited by WalkEntries
+type WalkEntry struct {
+	// Path as other VFS methods accept it: a prefix:// URL for bundled
+	// entries, or the VFS path
+	Path string
+
+	// FSPath is the path within the bundle, without prefix or subdirectory,
+	// for bundled entries, and the VFS path otherwise
+	FSPath string
+
+	Info fs.FileInfo // nil if the entry could not be read
+}
+
+// WalkEntryFunc is called by WalkEntries for each entry. It follows the
+// conventions of filepath.WalkFunc: err is a *WalkError or *WalkEntryError,
+// and returning fs.SkipDir or fs.SkipAll prunes the walk.
+type WalkEntryFunc func(entry WalkEntry, err error) error
+
+// WalkEntries traverses the filesystem like Walk, giving the callback both
+// the VFS form of each path and its form within the backing filesystem
+func (v *VFS) WalkEntries(root string, fn WalkEntryFunc) error {
+	return v.track("WalkEntries", root, func(v *VFS) error {
+		return v.walk(root, fn)
+	})
+}
+
+// WalkRel traverses the filesystem like Walk, passing fn each path
+// relative to root, with "/" separators and "." for root itself. fn may
+// return fs.SkipDir or fs.SkipAll; any error met while walking ends the walk
+// and is returned as a *WalkError or *WalkEntryError.
+func (v *VFS) WalkRel(root string, fn func(relPath string, d fs.DirEntry) error) error {
+	return v.track("WalkRel", root, func(v *VFS) error {
+		base, visited := "", false
+		return v.walk(root, func(entry WalkEntry, err error) error {
+			if !visited {
+				base, visited = entry.FSPath, true // Both walks visit the root first
+			}
+			if err != nil {
+				return err
+			}
+			return fn(relPath(base, entry.FSPath), fs.FileInfoToDirEntry(entry.Info))
+		})
+	})
+}
+
+// relPath returns p relative to base, which contains it
+func relPath(base, p string) string {
+	base, p = filepath.ToSlash(base), filepath.ToSlash(p)
+	switch {
+	case p == base:
+		return "."
+	case base == "":
+		return p
+	}
+	return strings.TrimPrefix(p, strings.TrimSuffix(base, "/")+"/")
+}
+
+// walk traverses root, leaving out what the hidden file policy hides
+func (v *VFS) walk(root string, fn WalkEntryFunc) error {
+	return v.walkAll(root, v.hidden.skipHidden(fn))
+}
+
+// walkAll traverses root, including hidden files
+func (v *VFS) walkAll(root string, fn WalkEntryFunc) error {
+	if err := v.authorize("Walk", root, false); err != nil {
+		return err
+	}
+
+	if bundled, bundledPath, ok := v.bundledManager.GetBundledFS(root); ok {
+		return bundled.WalkEntries(bundledPath, fn)
+	}
+
+	vfsRoot := v.normalizePath(root)
+	err := afero.Walk(v.fs, vfsRoot, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			err = walkError(path == vfsRoot, path, err)
+		}
+		return fn(WalkEntry{Path: path, FSPath: path, Info: info}, err)
+	})
+	return walkResult(err)
+}
+
+// walkError types an error met at path: at the root the walk cannot go
+// on, below it only the entry is lost
+func walkError(atRoot bool, path string, err error) error {
+	if atRoot {
+		return &WalkError{Root: path, Err: err}
+	}
+	return &WalkEntryError{Path: path, Err: err}
+}
+
+// walkResult maps fs.SkipDir and fs.SkipAll that a callback returned to
+// success. afero.Walk passes them through from the root and from files.
+func walkResult(err error) error {
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
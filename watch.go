@@ -1,8 +1,11 @@
 package vfs
 
 import (
+	"errors"
 	"fmt"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 
@@ -11,12 +14,15 @@ import (
 
 // WatchManager handles file system watching operations
 type WatchManager struct {
-	watcher  *fsnotify.Watcher
-	watches  map[string]WatchAction
-	rootPath string
-	logger   Logger
-	mu       sync.RWMutex
-	closed   bool
+	watcher   *fsnotify.Watcher
+	watches   map[internedPath]WatchAction
+	internal  map[string]bool  // Disk paths watched for the VFS's own caches
+	listeners []*watchListener // Internal listeners, called for every event
+	rootPath  string
+	mounts    []diskMount // Further disk roots of a multi-root VFS
+	logger    Logger
+	mu        sync.RWMutex
+	closed    bool
 }
 
 // NewWatchManager creates a new watch manager
@@ -29,7 +35,8 @@ func NewWatchManager(rootPath string, logger Logger) *WatchManager {
 
 	wm := &WatchManager{
 		watcher:  watcher,
-		watches:  make(map[string]WatchAction),
+		watches:  make(map[internedPath]WatchAction),
+		internal: make(map[string]bool),
 		rootPath: rootPath,
 		logger:   logger,
 	}
@@ -60,10 +67,13 @@ func (wm *WatchManager) processEvents() {
 			wm.mu.RLock()
 			for path, action := range wm.watches {
 				action(WatchEvent{
-					Path:  path,
+					Path:  path.String(),
 					Error: err,
 				})
 			}
+			for _, listener := range wm.listeners {
+				listener.fn(WatchEvent{Error: err})
+			}
 			wm.mu.RUnlock()
 		}
 	}
@@ -74,19 +84,20 @@ func (wm *WatchManager) handleEvent(event fsnotify.Event) {
 	wm.mu.RLock()
 	defer wm.mu.RUnlock()
 
-	// Convert absolute path back to relative path for VFS
-	relPath, err := filepath.Rel(wm.rootPath, event.Name)
+	// Convert the absolute disk path back to a VFS path
+	vfsPath, err := wm.vfsPath(event.Name)
 	if err != nil {
 		wm.logger.Error("Failed to get relative path for %s: %v", event.Name, err)
 		return
 	}
 
-	// Convert to VFS path format
-	vfsPath := "/" + filepath.ToSlash(relPath)
+	for _, listener := range wm.listeners {
+		listener.fn(WatchEvent{Path: vfsPath, Op: convertFsnotifyOp(event.Op)})
+	}
 
 	// Find matching watch patterns
 	for watchPath, action := range wm.watches {
-		if wm.pathMatches(vfsPath, watchPath) {
+		if wm.pathMatches(vfsPath, watchPath.String()) {
 			watchEvent := WatchEvent{
 				Path:  vfsPath,
 				Op:    convertFsnotifyOp(event.Op),
@@ -94,20 +105,23 @@ func (wm *WatchManager) handleEvent(event fsnotify.Event) {
 			}
 
 			wm.logger.Debug("File event: %s %s", watchEvent.Op, watchEvent.Path)
-
-			// Execute the watch action in a separate goroutine to avoid blocking
-			go func(action WatchAction, event WatchEvent) {
-				defer func() {
-					if r := recover(); r != nil {
-						wm.logger.Error("Watch action panicked: %v", r)
-					}
-				}()
-				action(event)
-			}(action, watchEvent)
+			wm.dispatch(action, watchEvent)
 		}
 	}
 }
 
+// dispatch runs a watch action in a separate goroutine to avoid blocking
+func (wm *WatchManager) dispatch(action WatchAction, event WatchEvent) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				wm.logger.Error("Watch action panicked: %v", r)
+			}
+		}()
+		action(event)
+	}()
+}
+
 // pathMatches checks if a file path matches a watch pattern
 func (wm *WatchManager) pathMatches(filePath, watchPath string) bool {
 	// Exact match
@@ -164,11 +178,9 @@ func (wm *WatchManager) Watch(path string, action WatchAction) error {
 	defer wm.mu.Unlock()
 
 	// Convert VFS path to absolute disk path
-	var diskPath string
-	if path == "/" {
-		diskPath = wm.rootPath
-	} else {
-		diskPath = filepath.Join(wm.rootPath, strings.TrimPrefix(path, "/"))
+	diskPath, err := wm.diskPath(path)
+	if err != nil {
+		return err
 	}
 
 	// Add to fsnotify watcher
@@ -177,7 +189,7 @@ func (wm *WatchManager) Watch(path string, action WatchAction) error {
 	}
 
 	// Store the action
-	wm.watches[path] = action
+	wm.watches[internPath(path)] = action
 	wm.logger.Debug("Started watching path: %s", path)
 
 	return nil
@@ -193,20 +205,17 @@ func (wm *WatchManager) StopWatch(path string) error {
 	defer wm.mu.Unlock()
 
 	// Convert VFS path to absolute disk path
-	var diskPath string
-	if path == "/" {
-		diskPath = wm.rootPath
-	} else {
-		diskPath = filepath.Join(wm.rootPath, strings.TrimPrefix(path, "/"))
-	}
+	diskPath, err := wm.diskPath(path)
 
-	// Remove from fsnotify watcher
-	if err := wm.watcher.Remove(diskPath); err != nil {
-		wm.logger.Error("Failed to stop watching path %s: %v", path, err)
+	// Remove from fsnotify watcher, unless the VFS still needs it
+	if err == nil && !wm.internal[diskPath] {
+		if err := wm.watcher.Remove(diskPath); err != nil {
+			wm.logger.Error("Failed to stop watching path %s: %v", path, err)
+		}
 	}
 
 	// Remove the action
-	delete(wm.watches, path)
+	delete(wm.watches, internPath(path))
 	wm.logger.Debug("Stopped watching path: %s", path)
 
 	return nil
@@ -222,18 +231,114 @@ func (wm *WatchManager) StopAllWatches() error {
 	defer wm.mu.Unlock()
 
 	for path := range wm.watches {
-		diskPath := filepath.Join(wm.rootPath, strings.TrimPrefix(path, "/"))
+		diskPath, err := wm.diskPath(path.String())
+		if err != nil || wm.internal[diskPath] {
+			continue
+		}
 		if err := wm.watcher.Remove(diskPath); err != nil {
 			wm.logger.Error("Failed to stop watching path %s: %v", path, err)
 		}
 	}
 
-	wm.watches = make(map[string]WatchAction)
+	wm.watches = make(map[internedPath]WatchAction)
 	wm.logger.Debug("Stopped all watches")
 
 	return nil
 }
 
+// watchListener is a listener registered with addListener
+type watchListener struct {
+	fn func(WatchEvent)
+}
+
+// addListener registers fn to be called synchronously for every event the
+// watcher receives, whether or not a user watch matches it, and returns the
+// function that removes it. Listeners must not call back into the watch
+// manager.
+func (wm *WatchManager) addListener(fn func(WatchEvent)) func() {
+	l := &watchListener{fn: fn}
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	wm.listeners = append(wm.listeners, l)
+
+	return func() {
+		wm.mu.Lock()
+		defer wm.mu.Unlock()
+		wm.listeners = slices.DeleteFunc(wm.listeners, func(other *watchListener) bool { return other == l })
+	}
+}
+
+// watchInternal watches a directory on behalf of the VFS itself. Such
+// watches deliver events to listeners only and survive StopWatch.
+func (wm *WatchManager) watchInternal(path string) error {
+	if wm == nil {
+		return fmt.Errorf("watch manager is not available")
+	}
+
+	// Index updates call this from their own goroutine, racing with Close
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.closed {
+		return fmt.Errorf("watch manager is not available")
+	}
+
+	diskPath, err := wm.diskPath(path)
+	if err != nil {
+		return err
+	}
+	if wm.internal[diskPath] {
+		return nil
+	}
+	if err := wm.watcher.Add(diskPath); err != nil {
+		return fmt.Errorf("failed to watch path %s: %w", path, err)
+	}
+	wm.internal[diskPath] = true
+	return nil
+}
+
+// diskPath converts a VFS path to the disk path it is stored at
+func (wm *WatchManager) diskPath(path string) (string, error) {
+	clean := filepath.ToSlash(filepath.Clean("/" + path))
+	for _, mount := range wm.mounts {
+		if within(clean, mount.point) {
+			return filepath.Join(mount.disk, filepath.FromSlash(strings.TrimPrefix(clean, mount.point))), nil
+		}
+	}
+
+	if wm.rootPath == "" {
+		return "", fmt.Errorf("path %s is not on disk", path)
+	}
+	if path == "/" {
+		return wm.rootPath, nil
+	}
+	return filepath.Join(wm.rootPath, strings.TrimPrefix(path, "/")), nil
+}
+
+// vfsPath converts a disk path reported by the watcher to a VFS path. The
+// root with the longest disk path containing it wins, so mounts nested in
+// the primary root resolve to their mount point.
+func (wm *WatchManager) vfsPath(diskPath string) (string, error) {
+	best, bestLen := "", -1
+	try := func(point, root string) {
+		rel, err := filepath.Rel(root, diskPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || len(root) <= bestLen {
+			return
+		}
+		best, bestLen = path.Join(point, filepath.ToSlash(rel)), len(root)
+	}
+
+	if wm.rootPath != "" {
+		try("/", wm.rootPath)
+	}
+	for _, mount := range wm.mounts {
+		try(mount.point, mount.disk)
+	}
+	if bestLen < 0 {
+		return "", fmt.Errorf("%s is outside the VFS roots", diskPath)
+	}
+	return best, nil
+}
+
 // IsWatching checks if a path is being watched
 func (wm *WatchManager) IsWatching(path string) bool {
 	if wm == nil || wm.closed {
@@ -243,7 +348,7 @@ func (wm *WatchManager) IsWatching(path string) bool {
 	wm.mu.RLock()
 	defer wm.mu.RUnlock()
 
-	_, exists := wm.watches[path]
+	_, exists := wm.watches[internPath(path)]
 	return exists
 }
 
@@ -301,8 +406,30 @@ func (v *VFS) IsWatching(path string) bool {
 
 // Close closes the VFS and stops all watches
 func (v *VFS) Close() error {
+	if v.scanner != nil {
+		v.scanner.pending.Wait()
+	}
+	v.stopPathIndexWatch()
+	closeErr := v.SaveMetadata()
+	if closeErr != nil {
+		v.logger.Error("%v", closeErr)
+	}
+	if v.journal != nil {
+		if err := v.journal.close(); err != nil {
+			v.logger.Error("Failed to close change journal: %v", err)
+			closeErr = errors.Join(closeErr, fmt.Errorf("failed to close change journal: %w", err))
+		}
+	}
+	if v.archive != nil {
+		if err := v.archive.Close(); err != nil {
+			v.logger.Error("Failed to close archive: %v", err)
+		}
+	}
+	if err := v.mounts.close(); err != nil {
+		v.logger.Error("Failed to close mounted image: %v", err)
+	}
 	if v.watchManager != nil {
-		return v.watchManager.Close()
+		return errors.Join(closeErr, v.watchManager.Close())
 	}
-	return nil
+	return closeErr
 }
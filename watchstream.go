@@ -0,0 +1,366 @@
+package vfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEventsLost is delivered by a RemoteWatcher, as the Error of a
+// WatchEvent, when events were missed while it was disconnected, such as
+// after the server restarted. Consumers should rescan what they watch.
+var ErrEventsLost = errors.New("watch events were lost")
+
+// streamEvent is a watch event as sent to remote clients
+type streamEvent struct {
+	seq     uint64
+	Path    string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"`
+	Op      string `json:"op"`
+	IsDir   bool   `json:"dir,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WatchStreamHandler forwards the watch events of a disk VFS to remote
+// clients as a stream of server-sent events. Clients choose what to watch
+// with path query parameters, "/" if there are none; as with Watch, a
+// directory path covers the entries in it.
+//
+// Each event carries a cursor; clients reconnecting with the cursor of the
+// last event they saw, in the Last-Event-ID header or the cursor query
+// parameter, receive the events they missed. Clients whose cursor is too
+// old, or from before the handler was created, receive a reset event
+// instead.
+type WatchStreamHandler struct {
+	v        *VFS
+	epoch    string // Distinguishes cursors of this handler from earlier ones
+	backlog  int
+	events   []streamEvent // The last backlog events, oldest first
+	next     uint64
+	changed  changeSignal
+	mu       sync.Mutex
+	stopOnce sync.Once
+	stop     func() // Removes the handler's watch listener
+}
+
+// NewWatchStreamHandler returns a handler streaming the watch events of v.
+// It listens alongside the watches of v rather than replacing them, and
+// paths clients ask for stay watched until v is closed. The last backlog
+// events are kept for reconnecting clients, 1024 if backlog is 0.
+func NewWatchStreamHandler(v *VFS, backlog int) (*WatchStreamHandler, error) {
+	if v.watchManager == nil {
+		return nil, fmt.Errorf("watching is only available for disk-based VFS")
+	}
+	if backlog <= 0 {
+		backlog = 1024
+	}
+	h := &WatchStreamHandler{
+		v:       v,
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		backlog: backlog,
+	}
+	h.stop = v.watchManager.addListener(h.record)
+	return h, nil
+}
+
+// Close stops forwarding events. Connected clients stay connected but
+// receive no further events.
+func (h *WatchStreamHandler) Close() error {
+	h.stopOnce.Do(h.stop)
+	return nil
+}
+
+// matches reports whether an event concerns one of paths. Errors concern
+// every client.
+func (h *WatchStreamHandler) matches(e streamEvent, paths []string) bool {
+	if e.Path == "" {
+		return true
+	}
+	for _, p := range paths {
+		if h.v.watchManager.pathMatches(e.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// record appends an event to the backlog and wakes up the streams
+func (h *WatchStreamHandler) record(event WatchEvent) {
+	e := streamEvent{Path: event.Path, OldPath: event.OldPath, Op: event.Op.String(), IsDir: event.IsDir}
+	if event.Error != nil {
+		e.Error = event.Error.Error()
+	}
+
+	h.mu.Lock()
+	h.next++
+	e.seq = h.next
+	h.events = append(h.events, e)
+	if len(h.events) > h.backlog {
+		h.events = h.events[len(h.events)-h.backlog:]
+	}
+	h.mu.Unlock()
+
+	h.changed.notify()
+}
+
+// resume returns the sequence number after which a client with cursor
+// continues, and whether it missed events it can no longer get
+func (h *WatchStreamHandler) resume(cursor string) (seq uint64, lost bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if cursor == "" {
+		return h.next, false // New client, starting now
+	}
+	epoch, s, _ := strings.Cut(cursor, ":")
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || epoch != h.epoch || seq > h.next {
+		return h.next, true
+	}
+	if len(h.events) > 0 && seq+1 < h.events[0].seq {
+		return h.next, true
+	}
+	return seq, false
+}
+
+// since returns the events after seq
+func (h *WatchStreamHandler) since(seq uint64) []streamEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, e := range h.events {
+		if e.seq > seq {
+			return append([]streamEvent(nil), h.events[i:]...)
+		}
+	}
+	return nil
+}
+
+func (h *WatchStreamHandler) cursor(seq uint64) string {
+	return h.epoch + ":" + strconv.FormatUint(seq, 10)
+}
+
+// ServeHTTP implements http.Handler
+func (h *WatchStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = query.Get("cursor")
+	}
+
+	paths := query["path"]
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for i, p := range paths {
+		paths[i] = h.v.pathKey(p)
+		if err := h.v.watchManager.watchInternal(paths[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before reading the backlog, so no event slips in between
+	changed, unsubscribe := h.changed.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	seq, lost := h.resume(cursor)
+	if lost {
+		fmt.Fprintf(w, "id: %s\nevent: reset\ndata: {}\n\n", h.cursor(seq))
+	} else {
+		fmt.Fprint(w, ": connected\n\n")
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		for _, e := range h.since(seq) {
+			if !h.matches(e, paths) {
+				seq = e.seq
+				continue
+			}
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", h.cursor(e.seq), data); err != nil {
+				return
+			}
+			seq = e.seq
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-heartbeat.C:
+			// Keeps proxies from closing an idle stream
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// RemoteWatcher receives the events of a WatchStreamHandler and delivers
+// them like a local watch, reconnecting and resuming from the last event
+// seen whenever the connection drops. The paths to watch are given as path
+// query parameters of its url.
+type RemoteWatcher struct {
+	url    string
+	client *http.Client
+	retry  time.Duration // Delay between reconnects
+	cursor string
+	mu     sync.Mutex
+}
+
+// NewRemoteWatcher returns a watcher for the WatchStreamHandler at url. A
+// nil client uses http.DefaultClient; it should have no overall timeout,
+// since streams stay open.
+func NewRemoteWatcher(url string, client *http.Client) *RemoteWatcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteWatcher{url: url, client: client, retry: time.Second}
+}
+
+// Cursor returns the cursor of the last event delivered, to be passed to
+// Resume by a later watcher
+func (w *RemoteWatcher) Cursor() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cursor
+}
+
+// Resume makes the next connection continue after the event with cursor,
+// so that a restarted consumer sees the events it missed
+func (w *RemoteWatcher) Resume(cursor string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cursor = cursor
+}
+
+// Run delivers events to action, in order and one at a time, until ctx is
+// done, then returns ctx.Err(). When events were missed, action receives a
+// WatchEvent whose Error is ErrEventsLost.
+func (w *RemoteWatcher) Run(ctx context.Context, action WatchAction) error {
+	for {
+		err := w.stream(ctx, action)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			action(WatchEvent{Error: fmt.Errorf("remote watch: %w", err)})
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.retry):
+		}
+	}
+}
+
+// stream reads events from one connection until it ends
+func (w *RemoteWatcher) stream(ctx context.Context, action WatchAction) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if cursor := w.Cursor(); cursor != "" {
+		req.Header.Set("Last-Event-ID", cursor)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	var id, kind, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "id":
+				id = value
+			case "event":
+				kind = value
+			case "data":
+				data = value
+			}
+			continue
+		}
+
+		// A blank line ends the event
+		switch {
+		case kind == "reset":
+			action(WatchEvent{Error: ErrEventsLost})
+		case data != "":
+			var e streamEvent
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return fmt.Errorf("malformed event: %w", err)
+			}
+			action(e.watchEvent())
+		}
+		if id != "" {
+			w.Resume(id)
+		}
+		id, kind, data = "", "", ""
+	}
+	return scanner.Err()
+}
+
+// watchEvent converts a received event back to a WatchEvent. Events with
+// an unknown op, say from a newer server, carry the error instead.
+func (e streamEvent) watchEvent() WatchEvent {
+	event := WatchEvent{Path: e.Path, OldPath: e.OldPath, IsDir: e.IsDir}
+	if e.Error != "" {
+		event.Error = errors.New(e.Error)
+		return event
+	}
+	op, err := parseWatchOp(e.Op)
+	if err != nil {
+		event.Error = err
+	}
+	event.Op = op
+	return event
+}
+
+// parseWatchOp is the inverse of WatchOp.String
+func parseWatchOp(s string) (WatchOp, error) {
+	for op := WatchOpCreate; op <= WatchOpChmod; op++ {
+		if op.String() == s {
+			return op, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown watch op %q", s)
+}
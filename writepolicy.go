@@ -0,0 +1,130 @@
+package vfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ErrWriteDenied is returned for writes a write policy forbids. It matches
+// fs.ErrPermission with errors.Is.
+var ErrWriteDenied = fmt.Errorf("write denied by policy: %w", fs.ErrPermission)
+
+// WriteRule inspects a path about to be created and returns why it may not
+// be, or "" to let it through. isDir is set for directories.
+type WriteRule func(path string, isDir bool) string
+
+// WithWritePolicy forbids creating the files and directories that any of
+// rules rejects. It is enforced by every operation that creates paths:
+// WriteFile, Create, CreateNew, MkdirAll and RenameDir, and through them
+// Copy, Move, Merge, LoadFromDisk and the importers.
+//
+//	vfs.WithWritePolicy(
+//		vfs.OnlyUnder("/workspace"),
+//		vfs.DenyExtensions("/workspace/uploads", ".exe", ".bat"),
+//	)
+func WithWritePolicy(rules ...WriteRule) Option {
+	return func(v *VFS) {
+		v.writeRules = append(v.writeRules, rules...)
+	}
+}
+
+// OnlyUnder allows creating paths only inside the given directories, and
+// the directories leading to them
+func OnlyUnder(dirs ...string) WriteRule {
+	dirs = slices.Clone(dirs)
+	for i, dir := range dirs {
+		dirs[i] = path.Clean("/" + filepath.ToSlash(dir))
+	}
+	return func(p string, isDir bool) string {
+		for _, dir := range dirs {
+			if within(p, dir) || (isDir && within(dir, p)) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("outside %s", strings.Join(dirs, ", "))
+	}
+}
+
+// DenyExtensions forbids files with any of the extensions exts, such as
+// ".exe", inside dir. Extensions are compared case-insensitively.
+func DenyExtensions(dir string, exts ...string) WriteRule {
+	dir = path.Clean("/" + filepath.ToSlash(dir))
+	deny := make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		deny[strings.ToLower(ext)] = true
+	}
+	return func(p string, isDir bool) string {
+		if isDir || !within(p, dir) {
+			return ""
+		}
+		if ext := strings.ToLower(path.Ext(p)); deny[ext] {
+			return fmt.Sprintf("%s files are not allowed in %s", ext, dir)
+		}
+		return ""
+	}
+}
+
+// DenyNames forbids files and directories inside dir whose names match any
+// of the filepath.Match patterns
+func DenyNames(dir string, patterns ...string) WriteRule {
+	dir = path.Clean("/" + filepath.ToSlash(dir))
+	patterns = slices.Clone(patterns)
+	return func(p string, isDir bool) string {
+		if !within(p, dir) || p == dir {
+			return ""
+		}
+		name := path.Base(p)
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return fmt.Sprintf("%s is not allowed in %s", name, dir)
+			}
+		}
+		return ""
+	}
+}
+
+// checkWrite applies the write policy to a path about to be created
+func (v *VFS) checkWrite(op, p string, isDir bool) error {
+	key := v.pathKey(p)
+	for _, rule := range v.writeRules {
+		if reason := rule(key, isDir); reason != "" {
+			return &fs.PathError{Op: op, Path: p, Err: fmt.Errorf("%w: %s", ErrWriteDenied, reason)}
+		}
+	}
+	return nil
+}
+
+// checkWriteTree applies the write policy to every entry below oldKey as
+// it would be after moving to newKey
+func (v *VFS) checkWriteTree(op, oldKey, newKey string) error {
+	if len(v.writeRules) == 0 {
+		return nil
+	}
+	return afero.Walk(v.fs, oldKey, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return v.checkWrite(op, renamedPath(filepath.ToSlash(p), oldKey, newKey), info.IsDir())
+	})
+}
+
+// admitCreate checks a path that op is about to create against the name
+// rules and the write policy
+func (v *VFS) admitCreate(op, p string, isDir bool) error {
+	if v.bundledManager.IsBundledPath(p) {
+		return nil // Rejected by the operation itself
+	}
+	if err := v.checkName(op, p); err != nil {
+		return err
+	}
+	return v.checkWrite(op, p, isDir)
+}